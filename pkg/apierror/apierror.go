@@ -0,0 +1,63 @@
+// Package apierror classifies the errors of the ARM and storage clients, so
+// that callers can tell a missing resource, a rejected precondition or an
+// API the stamp lacks from a failure without unpacking the error types of
+// each SDK.
+package apierror
+
+import (
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// IsNotFound reports whether err is an ARM error for a resource that does
+// not exist.
+func IsNotFound(err error) bool {
+	return IsStatus(err, http.StatusNotFound)
+}
+
+// IsStatus reports whether err is an ARM error with the HTTP status code.
+func IsStatus(err error, code int) bool {
+	if derr, ok := err.(autorest.DetailedError); ok {
+		return derr.StatusCode == code
+	}
+	return false
+}
+
+// IsStorageStatus reports whether err is a storage service error with the
+// HTTP status code.
+func IsStorageStatus(err error, code int) bool {
+	if serr, ok := err.(storage.AzureStorageServiceError); ok {
+		return serr.StatusCode == code
+	}
+	if serr, ok := err.(storage.UnexpectedStatusCodeError); ok {
+		return serr.Got() == code
+	}
+	return false
+}
+
+// unsupportedCodes are the error codes ARM answers with when the API
+// version of the stamp lacks a resource type or action.
+var unsupportedCodes = map[string]bool{
+	"InvalidResourceType":        true,
+	"InvalidApiVersionParameter": true,
+	"NoRegisteredProviderFound":  true,
+}
+
+// IsUnsupported reports whether err tells that the API version of the stamp
+// lacks the resource type or action called, as older Azure Stack stamps do.
+// Errors without an ARM error code, whatever their body, count when their
+// status is 404 or 405, which is how some resource providers answer for a
+// route they do not know.
+func IsUnsupported(err error) bool {
+	derr, ok := err.(autorest.DetailedError)
+	if !ok {
+		return false
+	}
+	if rerr, ok := derr.Original.(*azure.RequestError); ok && rerr.ServiceError != nil && rerr.ServiceError.Code != "" {
+		return unsupportedCodes[rerr.ServiceError.Code]
+	}
+	return derr.StatusCode == http.StatusNotFound || derr.StatusCode == http.StatusMethodNotAllowed
+}
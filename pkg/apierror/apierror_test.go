@@ -0,0 +1,82 @@
+package apierror
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+func TestIsStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		err      error
+		notFound bool
+		conflict bool
+	}{
+		{"nil", nil, false, false},
+		{"plain", errors.New("404"), false, false},
+		{"not found", autorest.DetailedError{StatusCode: http.StatusNotFound}, true, false},
+		{"conflict", autorest.DetailedError{StatusCode: http.StatusConflict}, false, true},
+		{"no response", autorest.DetailedError{Original: errors.New("dial tcp: timeout")}, false, false},
+		{"storage not found", storage.AzureStorageServiceError{StatusCode: http.StatusNotFound}, false, false},
+	} {
+		if got := IsNotFound(tt.err); got != tt.notFound {
+			t.Errorf("%s: IsNotFound() = %v, want %v", tt.name, got, tt.notFound)
+		}
+		if got := IsStatus(tt.err, http.StatusConflict); got != tt.conflict {
+			t.Errorf("%s: IsStatus(409) = %v, want %v", tt.name, got, tt.conflict)
+		}
+	}
+}
+
+func TestIsStorageStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"service error", storage.AzureStorageServiceError{StatusCode: http.StatusConflict, Code: "LeaseAlreadyPresent"}, true},
+		{"other status", storage.AzureStorageServiceError{StatusCode: http.StatusNotFound}, false},
+		{"ARM error", autorest.DetailedError{StatusCode: http.StatusConflict}, false},
+	} {
+		if got := IsStorageStatus(tt.err, http.StatusConflict); got != tt.want {
+			t.Errorf("%s: IsStorageStatus(409) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsUnsupported(t *testing.T) {
+	withCode := func(status int, code string) error {
+		return autorest.DetailedError{
+			StatusCode: status,
+			Original:   &azure.RequestError{ServiceError: &azure.ServiceError{Code: code}},
+		}
+	}
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain", errors.New("InvalidResourceType"), false},
+		{"resource type", withCode(http.StatusBadRequest, "InvalidResourceType"), true},
+		{"API version", withCode(http.StatusBadRequest, "InvalidApiVersionParameter"), true},
+		{"provider", withCode(http.StatusBadRequest, "NoRegisteredProviderFound"), true},
+		{"missing resource", withCode(http.StatusNotFound, "ResourceNotFound"), false},
+		{"missing group", withCode(http.StatusNotFound, "ResourceGroupNotFound"), false},
+		{"unknown route", autorest.DetailedError{StatusCode: http.StatusNotFound}, true},
+		{"unknown route with a message", withCode(http.StatusNotFound, ""), true},
+		{"bad request with a message", withCode(http.StatusBadRequest, ""), false},
+		{"method not allowed", autorest.DetailedError{StatusCode: http.StatusMethodNotAllowed}, true},
+		{"server error", autorest.DetailedError{StatusCode: http.StatusInternalServerError}, false},
+	} {
+		if got := IsUnsupported(tt.err); got != tt.want {
+			t.Errorf("%s: IsUnsupported() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
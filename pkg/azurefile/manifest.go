@@ -0,0 +1,104 @@
+package azurefile
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Keys of the Secret read by the azureFile volume plugin.
+const (
+	secretAccountNameKey = "azurestorageaccountname"
+	secretAccountKeyKey  = "azurestorageaccountkey"
+)
+
+// MountOptions are the POSIX ownership and permissions CIFS mounts give the
+// files of a share, which has none of its own.
+type MountOptions struct {
+	// DirMode and FileMode are the permissions of directories and files.
+	// Zero leaves them to the mount defaults.
+	DirMode  os.FileMode
+	FileMode os.FileMode
+	// UID and GID own all files. Nil leaves them to the mount defaults.
+	UID *int
+	GID *int
+	// Extra options are passed through as they are, e.g. "vers=3.0".
+	Extra []string
+}
+
+// Strings returns the options in mount -o form, e.g. "dir_mode=0755".
+func (m MountOptions) Strings() ([]string, error) {
+	var opts []string
+	for _, mode := range []struct {
+		name  string
+		value os.FileMode
+	}{{"dir_mode", m.DirMode}, {"file_mode", m.FileMode}} {
+		if mode.value&^os.ModePerm != 0 {
+			return nil, fmt.Errorf("azurefile: %s %v has bits besides permissions", mode.name, mode.value)
+		}
+		if mode.value != 0 {
+			opts = append(opts, fmt.Sprintf("%s=%04o", mode.name, uint32(mode.value)))
+		}
+	}
+	for _, id := range []struct {
+		name  string
+		value *int
+	}{{"uid", m.UID}, {"gid", m.GID}} {
+		if id.value == nil {
+			continue
+		}
+		if *id.value < 0 {
+			return nil, fmt.Errorf("azurefile: negative %s %d", id.name, *id.value)
+		}
+		opts = append(opts, id.name+"="+strconv.Itoa(*id.value))
+	}
+	for _, opt := range m.Extra {
+		// Options are stored comma separated in the share metadata.
+		if opt == "" || strings.ContainsAny(opt, ", ") {
+			return nil, fmt.Errorf("azurefile: invalid mount option %q", opt)
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+// SecretManifest returns a Kubernetes Secret holding the account name and
+// key of the volume, in the form the azureFile volume plugin reads. The
+// manifest is JSON, which kubectl accepts like YAML.
+func (v *Volume) SecretManifest(name, namespace string) ([]byte, error) {
+	if name == "" {
+		return nil, fmt.Errorf("azurefile: secret name is required")
+	}
+	if v.AccountKey == "" {
+		return nil, fmt.Errorf("azurefile: volume %s has no account key", v.ShareName)
+	}
+	type metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace,omitempty"`
+		Labels    map[string]string `json:"labels,omitempty"`
+	}
+	secret := struct {
+		APIVersion string            `json:"apiVersion"`
+		Kind       string            `json:"kind"`
+		Metadata   metadata          `json:"metadata"`
+		Type       string            `json:"type"`
+		Data       map[string]string `json:"data"`
+	}{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: metadata{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{tagCreatedBy: createdByValue},
+		},
+		Type: "Opaque",
+		Data: map[string]string{
+			secretAccountNameKey: base64.StdEncoding.EncodeToString([]byte(v.AccountName)),
+			secretAccountKeyKey:  base64.StdEncoding.EncodeToString([]byte(v.AccountKey)),
+		},
+	}
+	return json.MarshalIndent(secret, "", "  ")
+}
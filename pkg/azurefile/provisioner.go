@@ -0,0 +1,439 @@
+// Package azurefile provisions Azure Files shares for Kubernetes AzureFile
+// volumes. A Provisioner picks a storage account it created earlier in the
+// cluster resource group (or creates one), creates the share with its quota
+// and initial directories, and records the mount options and reclaim policy
+// in the share metadata so the volume can be looked up and deprovisioned
+// later. The account credentials are handed out as a Secret manifest for the
+// azureFile volume plugin.
+package azurefile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	armstorage "github.com/Azure/azure-sdk-for-go/arm/storage"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+)
+
+const (
+	// Share quota limits in GiB.
+	minQuotaGiB = 1
+	maxQuotaGiB = 5120
+
+	defaultQuotaGiB = 5
+
+	// accountNamePrefix starts the names of accounts created by the
+	// provisioner; the rest is random hex up to the 24 character limit.
+	accountNamePrefix    = "kubefile"
+	maxAccountNameLength = 24
+	maxNameAttempts      = 5
+
+	tagCreatedBy   = "created-by"
+	createdByValue = "kubernetes-azurefile"
+
+	metadataCreatedBy     = "createdby"
+	metadataMountOptions  = "mountoptions"
+	metadataReclaimPolicy = "reclaimpolicy"
+)
+
+// ReclaimPolicy tells what happens to a share when its volume is released.
+type ReclaimPolicy string
+
+const (
+	// ReclaimDelete deletes the share and everything in it.
+	ReclaimDelete ReclaimPolicy = "Delete"
+	// ReclaimRetain leaves the share in place for manual cleanup.
+	ReclaimRetain ReclaimPolicy = "Retain"
+)
+
+// AccountsClient is the subset of armstorage.AccountsClient the provisioner
+// uses.
+type AccountsClient interface {
+	ListByResourceGroup(resourceGroupName string) (armstorage.AccountListResult, error)
+	ListKeys(resourceGroupName, accountName string) (armstorage.AccountListKeysResult, error)
+	CheckNameAvailability(accountName armstorage.AccountCheckNameAvailabilityParameters) (armstorage.CheckNameAvailabilityResult, error)
+	Create(resourceGroupName, accountName string, parameters armstorage.AccountCreateParameters, cancel <-chan struct{}) (<-chan armstorage.Account, <-chan error)
+}
+
+var _ AccountsClient = armstorage.AccountsClient{}
+
+// Options describe the share to provision.
+type Options struct {
+	// ShareName is the name of the share, 3-63 lower case letters, digits
+	// and single hyphens.
+	ShareName string
+	// QuotaGiB is the share quota. Zero means 5 GiB.
+	QuotaGiB int
+	// AccountName selects an existing account in the resource group instead
+	// of one picked or created by the provisioner.
+	AccountName string
+	// SkuName is the SKU of picked or created accounts. Empty means
+	// Standard_LRS; premium accounts cannot hold shares.
+	SkuName armstorage.SkuName
+	// Location of picked or created accounts. Empty means the provisioner
+	// Location.
+	Location string
+	// Directories are created in the share, with their parents, e.g.
+	// "logs/app".
+	Directories []string
+	// MountOptions are recorded with the share and returned in the Volume.
+	MountOptions MountOptions
+	// ReclaimPolicy is applied by Deprovision. Empty means ReclaimDelete.
+	ReclaimPolicy ReclaimPolicy
+}
+
+// Volume is a provisioned share.
+type Volume struct {
+	AccountName   string
+	AccountKey    string
+	ShareName     string
+	QuotaGiB      int
+	MountOptions  []string
+	ReclaimPolicy ReclaimPolicy
+}
+
+// Provisioner creates and deletes shares in the storage accounts of a
+// resource group.
+type Provisioner struct {
+	Accounts      AccountsClient
+	ResourceGroup string
+	// Location is the default location of accounts.
+	Location string
+	// StorageEndpointSuffix is the storage endpoint suffix of the cloud.
+	// Empty means storage.DefaultBaseURL.
+	StorageEndpointSuffix string
+	// NewFileService, if set, builds the file service client of an account
+	// instead of storage.NewClient.
+	NewFileService func(accountName, accountKey string) (*storage.FileServiceClient, error)
+}
+
+// NewProvisioner returns a provisioner for the accounts of resourceGroup.
+func NewProvisioner(accounts AccountsClient, resourceGroup, location, storageEndpointSuffix string) *Provisioner {
+	return &Provisioner{
+		Accounts:              accounts,
+		ResourceGroup:         resourceGroup,
+		Location:              location,
+		StorageEndpointSuffix: storageEndpointSuffix,
+	}
+}
+
+// Provision creates the share described by opts. Provisioning an existing
+// share that was created by the provisioner succeeds, updating its quota and
+// metadata, so a provisioning attempt interrupted halfway can be retried.
+func (p *Provisioner) Provision(opts Options) (*Volume, error) {
+	if err := validateShareName(opts.ShareName); err != nil {
+		return nil, err
+	}
+	quota := opts.QuotaGiB
+	if quota == 0 {
+		quota = defaultQuotaGiB
+	}
+	if quota < minQuotaGiB || quota > maxQuotaGiB {
+		return nil, fmt.Errorf("azurefile: quota %d GiB is out of the %d-%d GiB range", quota, minQuotaGiB, maxQuotaGiB)
+	}
+	policy := opts.ReclaimPolicy
+	if policy == "" {
+		policy = ReclaimDelete
+	}
+	if policy != ReclaimDelete && policy != ReclaimRetain {
+		return nil, fmt.Errorf("azurefile: unknown reclaim policy %q", policy)
+	}
+	mountOptions, err := opts.MountOptions.Strings()
+	if err != nil {
+		return nil, err
+	}
+
+	accountName := opts.AccountName
+	if accountName == "" {
+		if accountName, err = p.ensureAccount(opts); err != nil {
+			return nil, err
+		}
+	}
+	key, err := p.accountKey(accountName)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := p.fileService(accountName, key)
+	if err != nil {
+		return nil, err
+	}
+
+	share := fs.GetShareReference(opts.ShareName)
+	share.Properties.Quota = quota
+	share.Metadata = map[string]string{
+		metadataCreatedBy:     createdByValue,
+		metadataMountOptions:  strings.Join(mountOptions, ","),
+		metadataReclaimPolicy: string(policy),
+	}
+	if err := share.Create(nil); err != nil {
+		if !apierror.IsStorageStatus(err, http.StatusConflict) {
+			return nil, fmt.Errorf("azurefile: creating share %s in account %s: %v", opts.ShareName, accountName, err)
+		}
+		if err := adoptShare(share); err != nil {
+			return nil, err
+		}
+	}
+	glog.V(2).Infof("azurefile: provisioned share %s (%d GiB) in account %s", opts.ShareName, quota, accountName)
+
+	for _, dir := range opts.Directories {
+		if err := createDirectory(share, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Volume{
+		AccountName:   accountName,
+		AccountKey:    key,
+		ShareName:     opts.ShareName,
+		QuotaGiB:      quota,
+		MountOptions:  mountOptions,
+		ReclaimPolicy: policy,
+	}, nil
+}
+
+// adoptShare brings an existing share created by the provisioner in line
+// with the requested quota and metadata. Shares created by someone else are
+// left alone.
+func adoptShare(share *storage.Share) error {
+	wanted := share.Metadata
+	quota := share.Properties.Quota
+	if err := share.FetchAttributes(nil); err != nil {
+		return fmt.Errorf("azurefile: reading existing share %s: %v", share.Name, err)
+	}
+	if share.Metadata[metadataCreatedBy] != createdByValue {
+		return fmt.Errorf("azurefile: share %s already exists and was not created by the provisioner", share.Name)
+	}
+	if share.Properties.Quota != quota {
+		share.Properties.Quota = quota
+		if err := share.SetProperties(nil); err != nil {
+			return fmt.Errorf("azurefile: setting quota of share %s: %v", share.Name, err)
+		}
+	}
+	share.Metadata = wanted
+	if err := share.SetMetadata(nil); err != nil {
+		return fmt.Errorf("azurefile: setting metadata of share %s: %v", share.Name, err)
+	}
+	return nil
+}
+
+// createDirectory creates dir and its parents in share.
+func createDirectory(share *storage.Share, dir string) error {
+	d := share.GetRootDirectoryReference()
+	for _, name := range strings.Split(path.Clean("/"+dir), "/") {
+		if name == "" {
+			continue
+		}
+		d = d.GetDirectoryReference(name)
+		if _, err := d.CreateIfNotExists(nil); err != nil {
+			return fmt.Errorf("azurefile: creating directory %s in share %s: %v", dir, share.Name, err)
+		}
+	}
+	return nil
+}
+
+// Lookup returns the volume of a share created by the provisioner, with the
+// mount options and reclaim policy recorded when it was provisioned.
+func (p *Provisioner) Lookup(accountName, shareName string) (*Volume, error) {
+	key, err := p.accountKey(accountName)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := p.fileService(accountName, key)
+	if err != nil {
+		return nil, err
+	}
+	share := fs.GetShareReference(shareName)
+	if err := share.FetchAttributes(nil); err != nil {
+		return nil, fmt.Errorf("azurefile: reading share %s in account %s: %v", shareName, accountName, err)
+	}
+	if share.Metadata[metadataCreatedBy] != createdByValue {
+		return nil, fmt.Errorf("azurefile: share %s in account %s was not created by the provisioner", shareName, accountName)
+	}
+	v := &Volume{
+		AccountName:   accountName,
+		AccountKey:    key,
+		ShareName:     shareName,
+		QuotaGiB:      share.Properties.Quota,
+		ReclaimPolicy: ReclaimPolicy(share.Metadata[metadataReclaimPolicy]),
+	}
+	if opts := share.Metadata[metadataMountOptions]; opts != "" {
+		v.MountOptions = strings.Split(opts, ",")
+	}
+	return v, nil
+}
+
+// Deprovision releases the share of v according to its reclaim policy.
+// Retained shares are left untouched; deleted shares that are already gone
+// are not an error, and shares the provisioner did not create are refused.
+// The storage account is kept for other volumes.
+func (p *Provisioner) Deprovision(v *Volume) error {
+	if v.ReclaimPolicy == ReclaimRetain {
+		glog.V(2).Infof("azurefile: retaining share %s in account %s", v.ShareName, v.AccountName)
+		return nil
+	}
+	key := v.AccountKey
+	if key == "" {
+		var err error
+		if key, err = p.accountKey(v.AccountName); err != nil {
+			return err
+		}
+	}
+	fs, err := p.fileService(v.AccountName, key)
+	if err != nil {
+		return err
+	}
+	share := fs.GetShareReference(v.ShareName)
+	if err := share.FetchAttributes(nil); err != nil {
+		if apierror.IsStorageStatus(err, http.StatusNotFound) {
+			return nil
+		}
+		return fmt.Errorf("azurefile: reading share %s in account %s: %v", v.ShareName, v.AccountName, err)
+	}
+	if share.Metadata[metadataCreatedBy] != createdByValue {
+		return fmt.Errorf("azurefile: share %s in account %s was not created by the provisioner, not deleting it", v.ShareName, v.AccountName)
+	}
+	deleted, err := share.DeleteIfExists(nil)
+	if err != nil {
+		return fmt.Errorf("azurefile: deleting share %s in account %s: %v", v.ShareName, v.AccountName, err)
+	}
+	if deleted {
+		glog.V(2).Infof("azurefile: deleted share %s in account %s", v.ShareName, v.AccountName)
+	}
+	return nil
+}
+
+// ensureAccount returns an account created by the provisioner that matches
+// the SKU and location of opts, creating one if there is none.
+func (p *Provisioner) ensureAccount(opts Options) (string, error) {
+	sku := opts.SkuName
+	if sku == "" {
+		sku = armstorage.StandardLRS
+	}
+	if sku == armstorage.PremiumLRS {
+		return "", fmt.Errorf("azurefile: %s accounts cannot hold file shares", sku)
+	}
+	location := opts.Location
+	if location == "" {
+		location = p.Location
+	}
+
+	result, err := p.Accounts.ListByResourceGroup(p.ResourceGroup)
+	if err != nil {
+		return "", fmt.Errorf("azurefile: listing storage accounts in %s: %v", p.ResourceGroup, err)
+	}
+	if result.Value != nil {
+		for _, acct := range *result.Value {
+			if acct.Name != nil && accountMatches(acct, sku, location) {
+				return *acct.Name, nil
+			}
+		}
+	}
+	return p.createAccount(sku, location)
+}
+
+func accountMatches(acct armstorage.Account, sku armstorage.SkuName, location string) bool {
+	if acct.Tags == nil {
+		return false
+	}
+	if tag := (*acct.Tags)[tagCreatedBy]; tag == nil || *tag != createdByValue {
+		return false
+	}
+	if acct.Sku == nil || acct.Sku.Name != sku || acct.Kind != armstorage.Storage {
+		return false
+	}
+	return acct.Location != nil && normalizeLocation(*acct.Location) == normalizeLocation(location)
+}
+
+func normalizeLocation(location string) string {
+	return strings.ToLower(strings.Replace(location, " ", "", -1))
+}
+
+func (p *Provisioner) createAccount(sku armstorage.SkuName, location string) (string, error) {
+	name, err := p.newAccountName()
+	if err != nil {
+		return "", err
+	}
+	createdBy := createdByValue
+	params := armstorage.AccountCreateParameters{
+		Sku:      &armstorage.Sku{Name: sku},
+		Kind:     armstorage.Storage,
+		Location: &location,
+		Tags:     &map[string]*string{tagCreatedBy: &createdBy},
+	}
+	glog.V(2).Infof("azurefile: creating %s storage account %s in %s", sku, name, p.ResourceGroup)
+	_, errc := p.Accounts.Create(p.ResourceGroup, name, params, nil)
+	if err := <-errc; err != nil {
+		return "", fmt.Errorf("azurefile: creating storage account %s: %v", name, err)
+	}
+	return name, nil
+}
+
+// newAccountName returns a random account name that is still available.
+func (p *Provisioner) newAccountName() (string, error) {
+	accountType := "Microsoft.Storage/storageAccounts"
+	for i := 0; i < maxNameAttempts; i++ {
+		raw := make([]byte, (maxAccountNameLength-len(accountNamePrefix))/2)
+		if _, err := rand.Read(raw); err != nil {
+			return "", err
+		}
+		name := accountNamePrefix + hex.EncodeToString(raw)
+		result, err := p.Accounts.CheckNameAvailability(armstorage.AccountCheckNameAvailabilityParameters{Name: &name, Type: &accountType})
+		if err != nil {
+			return "", fmt.Errorf("azurefile: checking availability of account name %s: %v", name, err)
+		}
+		if result.NameAvailable != nil && *result.NameAvailable {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("azurefile: no available storage account name after %d attempts", maxNameAttempts)
+}
+
+func (p *Provisioner) accountKey(accountName string) (string, error) {
+	result, err := p.Accounts.ListKeys(p.ResourceGroup, accountName)
+	if err != nil {
+		return "", fmt.Errorf("azurefile: listing keys of storage account %s: %v", accountName, err)
+	}
+	if result.Keys != nil {
+		for _, k := range *result.Keys {
+			if k.Value != nil && *k.Value != "" {
+				return *k.Value, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("azurefile: storage account %s has no keys", accountName)
+}
+
+func (p *Provisioner) fileService(accountName, accountKey string) (*storage.FileServiceClient, error) {
+	if p.NewFileService != nil {
+		return p.NewFileService(accountName, accountKey)
+	}
+	suffix := p.StorageEndpointSuffix
+	if suffix == "" {
+		suffix = storage.DefaultBaseURL
+	}
+	client, err := storage.NewClient(accountName, accountKey, suffix, storage.DefaultAPIVersion, true)
+	if err != nil {
+		return nil, fmt.Errorf("azurefile: creating storage client for account %s: %v", accountName, err)
+	}
+	fs := client.GetFileService()
+	return &fs, nil
+}
+
+func validateShareName(name string) error {
+	valid := len(name) >= 3 && len(name) <= 63 && name[0] != '-' && name[len(name)-1] != '-' && !strings.Contains(name, "--")
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			valid = false
+		}
+	}
+	if !valid {
+		return fmt.Errorf("azurefile: invalid share name %q", name)
+	}
+	return nil
+}
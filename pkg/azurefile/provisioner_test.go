@@ -0,0 +1,90 @@
+package azurefile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+const testAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+// fakeShares serves the shares of a file service, each with its metadata,
+// and records the shares deleted.
+type fakeShares struct {
+	metadata map[string]map[string]string
+	deleted  []string
+}
+
+func (f *fakeShares) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	metadata, ok := f.metadata[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		for k, v := range metadata {
+			w.Header().Set("x-ms-meta-"+k, v)
+		}
+		w.Header().Set("x-ms-share-quota", "5")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		delete(f.metadata, name)
+		f.deleted = append(f.deleted, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// redirect sends every request to the test server.
+type redirect struct{ server *url.URL }
+
+func (rt redirect) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme, req.URL.Host = rt.server.Scheme, rt.server.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestDeprovisionRefusesForeignShares(t *testing.T) {
+	shares := &fakeShares{metadata: map[string]map[string]string{
+		"pvc-1":  {metadataCreatedBy: createdByValue},
+		"manual": {"owner": "someone"},
+	}}
+	server := httptest.NewServer(shares)
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	p := NewProvisioner(nil, "cluster", "local", "")
+	p.NewFileService = func(accountName, accountKey string) (*storage.FileServiceClient, error) {
+		client, err := storage.NewClient(accountName, accountKey, storage.DefaultBaseURL, storage.DefaultAPIVersion, false)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = &http.Client{Transport: redirect{serverURL}}
+		fs := client.GetFileService()
+		return &fs, nil
+	}
+
+	for _, tt := range []struct {
+		share string
+		ok    bool
+	}{
+		{"pvc-1", true},
+		{"manual", false},
+		{"gone", true},
+	} {
+		err := p.Deprovision(&Volume{AccountName: "account", AccountKey: testAccountKey, ShareName: tt.share, ReclaimPolicy: ReclaimDelete})
+		if (err == nil) != tt.ok {
+			t.Errorf("Deprovision(%s) = %v, want success %v", tt.share, err, tt.ok)
+		}
+	}
+	if want := []string{"pvc-1"}; !reflect.DeepEqual(shares.deleted, want) {
+		t.Errorf("deleted shares %v, want %v", shares.deleted, want)
+	}
+}
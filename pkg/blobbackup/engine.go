@@ -0,0 +1,414 @@
+// Package blobbackup implements incremental backups of page blobs such as
+// unmanaged VHDs. Each backup snapshots the source, ships only the pages that
+// changed since the previous source snapshot to a blob in another container
+// (usually in another account) and snapshots that blob, so every backup point
+// is a snapshot of the destination blob that can be restored on its own.
+package blobbackup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+	"github.com/honcao/cloudprovider/pkg/internal/pageranges"
+)
+
+const (
+	// maxChunkSize is the largest body accepted by Put Page.
+	maxChunkSize = 4 * 1024 * 1024
+
+	defaultConcurrency = 4
+
+	// snapshotTimeFormat matches the 7 fractional digits used by the blob
+	// service for snapshot timestamps.
+	snapshotTimeFormat = "2006-01-02T15:04:05.0000000Z"
+
+	metadataSourceSnapshot = "backupsourcesnapshot"
+	metadataSource         = "backupsource"
+)
+
+// Retention bounds the chain of backup points kept for each blob. The newest
+// point is always kept.
+type Retention struct {
+	// MaxPoints is the number of points to keep. Zero means unlimited.
+	MaxPoints int
+	// MaxAge removes points older than this. Zero means unlimited.
+	MaxAge time.Duration
+}
+
+// Point is one restorable backup of a blob.
+type Point struct {
+	// Snapshot is the destination snapshot holding this point.
+	Snapshot time.Time
+	// SourceSnapshot is the source snapshot the point was taken from.
+	SourceSnapshot time.Time
+	// Size is the blob size in bytes.
+	Size int64
+}
+
+// Engine backs up page blobs into Destination.
+type Engine struct {
+	// Destination is the container holding backup blobs and their snapshots.
+	Destination *storage.Container
+	// Retention is applied after every successful backup.
+	Retention Retention
+	// ChunkSize is the size of each ranged read/write. It is rounded down to
+	// a page multiple and capped at 4 MiB.
+	ChunkSize int64
+	// Concurrency is the number of chunks transferred in parallel.
+	Concurrency int
+}
+
+// NewEngine returns an Engine writing into destination with the given retention.
+func NewEngine(destination *storage.Container, retention Retention) *Engine {
+	return &Engine{
+		Destination: destination,
+		Retention:   retention,
+		ChunkSize:   maxChunkSize,
+		Concurrency: defaultConcurrency,
+	}
+}
+
+// Backup takes a new backup point of src. The first backup copies every valid
+// page; later ones copy only pages changed since the previous source snapshot.
+func (e *Engine) Backup(ctx context.Context, src *storage.Blob) (Point, error) {
+	if err := src.GetProperties(nil); err != nil {
+		return Point{}, fmt.Errorf("blobbackup: getting properties of %s: %v", src.Name, err)
+	}
+	if src.Properties.BlobType != storage.BlobTypePage {
+		return Point{}, fmt.Errorf("blobbackup: %s is a %s, only page blobs are supported", src.Name, src.Properties.BlobType)
+	}
+	size := src.Properties.ContentLength
+
+	sourceSnapshot, err := src.CreateSnapshot(nil)
+	if err != nil {
+		return Point{}, fmt.Errorf("blobbackup: snapshotting %s: %v", src.Name, err)
+	}
+	glog.V(2).Infof("blobbackup: created source snapshot %s of %s", sourceSnapshot.Format(snapshotTimeFormat), src.Name)
+
+	point, previous, err := e.ship(ctx, src, *sourceSnapshot, size)
+	if err != nil {
+		deleteSnapshot(src, *sourceSnapshot)
+		return Point{}, err
+	}
+
+	// Only the latest source snapshot is needed to compute the next diff.
+	if previous != nil {
+		deleteSnapshot(src, *previous)
+	}
+	if err := e.Prune(src.Name); err != nil {
+		glog.Warningf("blobbackup: pruning backups of %s: %v", src.Name, err)
+	}
+	return point, nil
+}
+
+// ship transfers the pages of the source snapshot into the destination blob
+// and snapshots it. It returns the new point and the previous source snapshot,
+// if the transfer was incremental.
+func (e *Engine) ship(ctx context.Context, src *storage.Blob, sourceSnapshot time.Time, size int64) (Point, *time.Time, error) {
+	dst := e.Destination.GetBlobReference(src.Name)
+	previous, err := e.previousSourceSnapshot(dst)
+	if err != nil {
+		return Point{}, nil, err
+	}
+	if client := src.Container.Client(); previous != nil && !client.Supports(storage.FeaturePageRangeDiff) {
+		glog.Warningf("blobbackup: service version %s cannot diff page ranges, taking a full backup of %s", client.APIVersion(), src.Name)
+		deleteSnapshot(src, *previous)
+		previous = nil
+	}
+	if previous != nil {
+		if ok, err := snapshotExists(src, *previous); err != nil {
+			return Point{}, nil, err
+		} else if !ok {
+			glog.Warningf("blobbackup: source snapshot %s of %s is gone, taking a full backup", previous.Format(snapshotTimeFormat), src.Name)
+			previous = nil
+		}
+	}
+
+	var changed, cleared []storage.PageRange
+	if previous == nil {
+		dst.Properties.ContentLength = size
+		dst.Properties.BlobType = storage.BlobTypePage
+		if err := dst.PutPageBlob(nil); err != nil {
+			return Point{}, nil, fmt.Errorf("blobbackup: creating %s: %v", dst.Name, err)
+		}
+		changed, err = pageRanges(src, &storage.GetPageRangesOptions{Snapshot: &sourceSnapshot})
+		if err != nil {
+			return Point{}, nil, err
+		}
+	} else {
+		if dst.Properties.ContentLength != size {
+			dst.Properties.ContentLength = size
+			if err := dst.SetProperties(nil); err != nil {
+				return Point{}, nil, fmt.Errorf("blobbackup: resizing %s to %d bytes: %v", dst.Name, size, err)
+			}
+		}
+		changed, err = pageRanges(src, &storage.GetPageRangesOptions{Snapshot: &sourceSnapshot, PreviousSnapshot: previous})
+		if err != nil {
+			return Point{}, nil, err
+		}
+		// The diff only lists written pages, so pages cleared since the
+		// previous snapshot are found by comparing the valid ranges.
+		before, err := pageRanges(src, &storage.GetPageRangesOptions{Snapshot: previous})
+		if err != nil {
+			return Point{}, nil, err
+		}
+		after, err := pageRanges(src, &storage.GetPageRangesOptions{Snapshot: &sourceSnapshot})
+		if err != nil {
+			return Point{}, nil, err
+		}
+		cleared = pageranges.Clamp(pageranges.Subtract(before, after), size)
+	}
+
+	for _, r := range cleared {
+		if err := dst.ClearRange(storage.BlobRange{Start: uint64(r.Start), End: uint64(r.End)}, nil); err != nil {
+			return Point{}, nil, fmt.Errorf("blobbackup: clearing %d-%d of %s: %v", r.Start, r.End, dst.Name, err)
+		}
+	}
+	if err := e.copyRanges(ctx, src.Container, src.Name, sourceSnapshot, dst, changed); err != nil {
+		return Point{}, nil, err
+	}
+	glog.V(2).Infof("blobbackup: shipped %d changed and %d cleared ranges of %s", len(changed), len(cleared), src.Name)
+
+	dst.Metadata = storage.BlobMetadata{
+		metadataSourceSnapshot: sourceSnapshot.Format(snapshotTimeFormat),
+		metadataSource:         src.GetURL(),
+	}
+	if err := dst.SetMetadata(nil); err != nil {
+		return Point{}, nil, fmt.Errorf("blobbackup: recording source snapshot on %s: %v", dst.Name, err)
+	}
+	snapshot, err := dst.CreateSnapshot(nil)
+	if err != nil {
+		return Point{}, nil, fmt.Errorf("blobbackup: snapshotting %s: %v", dst.Name, err)
+	}
+
+	return Point{Snapshot: *snapshot, SourceSnapshot: sourceSnapshot, Size: size}, previous, nil
+}
+
+// Points lists the backup points of the named blob, oldest first.
+func (e *Engine) Points(name string) ([]Point, error) {
+	var points []Point
+	params := storage.ListBlobsParameters{
+		Prefix:  name,
+		Include: &storage.IncludeBlobDataset{Snapshots: true, Metadata: true},
+	}
+	for {
+		resp, err := e.Destination.ListBlobs(params)
+		if err != nil {
+			return nil, fmt.Errorf("blobbackup: listing backups of %s: %v", name, err)
+		}
+		for _, b := range resp.Blobs {
+			if b.Name != name || b.Snapshot.IsZero() {
+				continue
+			}
+			p := Point{Snapshot: b.Snapshot, Size: b.Properties.ContentLength}
+			if t, err := time.Parse(snapshotTimeFormat, b.Metadata[metadataSourceSnapshot]); err == nil {
+				p.SourceSnapshot = t
+			}
+			points = append(points, p)
+		}
+		if resp.NextMarker == "" {
+			break
+		}
+		params.Marker = resp.NextMarker
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Snapshot.Before(points[j].Snapshot) })
+	return points, nil
+}
+
+// Prune deletes backup points of the named blob that fall outside the
+// retention policy.
+func (e *Engine) Prune(name string) error {
+	points, err := e.Points(name)
+	if err != nil {
+		return err
+	}
+	dst := e.Destination.GetBlobReference(name)
+	now := time.Now()
+	for i, p := range points {
+		remaining := len(points) - i
+		if remaining == 1 {
+			break
+		}
+		tooMany := e.Retention.MaxPoints > 0 && remaining > e.Retention.MaxPoints
+		tooOld := e.Retention.MaxAge > 0 && now.Sub(p.Snapshot) > e.Retention.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		snapshot := p.Snapshot
+		if err := dst.Delete(&storage.DeleteBlobOptions{Snapshot: &snapshot}); err != nil {
+			return fmt.Errorf("blobbackup: deleting backup %s of %s: %v", snapshot.Format(snapshotTimeFormat), name, err)
+		}
+		glog.V(2).Infof("blobbackup: pruned backup %s of %s", snapshot.Format(snapshotTimeFormat), name)
+	}
+	return nil
+}
+
+// Restore rebuilds target as it was at the backup point of the named blob
+// taken at snapshot. target is overwritten.
+func (e *Engine) Restore(ctx context.Context, name string, snapshot time.Time, target *storage.Blob) error {
+	backup := e.Destination.GetBlobReference(name)
+	if err := backup.GetProperties(&storage.GetBlobPropertiesOptions{Snapshot: &snapshot}); err != nil {
+		return fmt.Errorf("blobbackup: getting backup %s of %s: %v", snapshot.Format(snapshotTimeFormat), name, err)
+	}
+
+	target.Properties.ContentLength = backup.Properties.ContentLength
+	target.Properties.BlobType = storage.BlobTypePage
+	if err := target.PutPageBlob(nil); err != nil {
+		return fmt.Errorf("blobbackup: creating %s: %v", target.Name, err)
+	}
+
+	ranges, err := pageRanges(backup, &storage.GetPageRangesOptions{Snapshot: &snapshot})
+	if err != nil {
+		return err
+	}
+	if err := e.copyRanges(ctx, e.Destination, name, snapshot, target, ranges); err != nil {
+		return err
+	}
+	glog.V(2).Infof("blobbackup: restored %s at %s into %s", name, snapshot.Format(snapshotTimeFormat), target.Name)
+	return nil
+}
+
+// copyRanges copies ranges from a snapshot of container/name into dst.
+func (e *Engine) copyRanges(ctx context.Context, container *storage.Container, name string, snapshot time.Time, dst *storage.Blob, ranges []storage.PageRange) error {
+	chunkSize := e.ChunkSize
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		chunkSize = maxChunkSize
+	}
+	chunkSize -= chunkSize % pageranges.PageSize
+	if chunkSize == 0 {
+		chunkSize = pageranges.PageSize
+	}
+	concurrency := e.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	chunks := pageranges.Split(ranges, chunkSize)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	setErr := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	sem := make(chan struct{}, concurrency)
+loop:
+	for _, r := range chunks {
+		if failed() {
+			break
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			setErr(ctx.Err())
+			break loop
+		}
+
+		wg.Add(1)
+		go func(r storage.PageRange) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			// Ranged reads update the blob's properties, so each chunk
+			// uses its own references.
+			from := container.GetBlobReference(name)
+			to := dst.Container.GetBlobReference(dst.Name)
+			if err := copyRange(from, snapshot, to, r); err != nil {
+				setErr(err)
+			}
+		}(r)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func copyRange(from *storage.Blob, snapshot time.Time, to *storage.Blob, r storage.PageRange) error {
+	blobRange := storage.BlobRange{Start: uint64(r.Start), End: uint64(r.End)}
+	body, err := from.GetRange(&storage.GetBlobRangeOptions{
+		Range:          &blobRange,
+		GetBlobOptions: &storage.GetBlobOptions{Snapshot: &snapshot},
+	})
+	if err != nil {
+		return fmt.Errorf("blobbackup: reading %d-%d of %s: %v", r.Start, r.End, from.Name, err)
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return fmt.Errorf("blobbackup: reading %d-%d of %s: %v", r.Start, r.End, from.Name, err)
+	}
+	if int64(len(data)) != r.End-r.Start+1 {
+		return fmt.Errorf("blobbackup: short read of %d-%d of %s: got %d bytes", r.Start, r.End, from.Name, len(data))
+	}
+	if err := to.WriteRange(blobRange, bytes.NewReader(data), nil); err != nil {
+		return fmt.Errorf("blobbackup: writing %d-%d of %s: %v", r.Start, r.End, to.Name, err)
+	}
+	return nil
+}
+
+// previousSourceSnapshot returns the source snapshot recorded on the
+// destination blob by the last backup, or nil if there is none.
+func (e *Engine) previousSourceSnapshot(dst *storage.Blob) (*time.Time, error) {
+	if err := dst.GetProperties(nil); err != nil {
+		if apierror.IsStorageStatus(err, http.StatusNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("blobbackup: getting properties of %s: %v", dst.Name, err)
+	}
+	value, ok := dst.Metadata[metadataSourceSnapshot]
+	if !ok {
+		return nil, nil
+	}
+	t, err := time.Parse(snapshotTimeFormat, value)
+	if err != nil {
+		glog.Warningf("blobbackup: ignoring malformed %s %q on %s", metadataSourceSnapshot, value, dst.Name)
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func pageRanges(b *storage.Blob, options *storage.GetPageRangesOptions) ([]storage.PageRange, error) {
+	resp, err := b.GetPageRanges(options)
+	if err != nil {
+		return nil, fmt.Errorf("blobbackup: getting page ranges of %s: %v", b.Name, err)
+	}
+	return pageranges.Normalize(resp.PageList), nil
+}
+
+func snapshotExists(b *storage.Blob, snapshot time.Time) (bool, error) {
+	ref := b.Container.GetBlobReference(b.Name)
+	if err := ref.GetProperties(&storage.GetBlobPropertiesOptions{Snapshot: &snapshot}); err != nil {
+		if apierror.IsStorageStatus(err, http.StatusNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("blobbackup: getting snapshot %s of %s: %v", snapshot.Format(snapshotTimeFormat), b.Name, err)
+	}
+	return true, nil
+}
+
+func deleteSnapshot(b *storage.Blob, snapshot time.Time) {
+	ref := b.Container.GetBlobReference(b.Name)
+	if _, err := ref.DeleteIfExists(&storage.DeleteBlobOptions{Snapshot: &snapshot}); err != nil {
+		glog.Warningf("blobbackup: deleting snapshot %s of %s: %v", snapshot.Format(snapshotTimeFormat), b.Name, err)
+	}
+}
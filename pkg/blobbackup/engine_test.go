@@ -0,0 +1,226 @@
+package blobbackup
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/honcao/cloudprovider/pkg/internal/pageranges"
+	"github.com/honcao/cloudprovider/pkg/storageemulator"
+)
+
+// pageWrites counts the Put Page requests that write or clear pages.
+type pageWrites struct {
+	next http.RoundTripper
+
+	mu              sync.Mutex
+	updates, clears int
+}
+
+func (p *pageWrites) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The storage client sets headers without canonicalizing them.
+	if write := req.Header["x-ms-page-write"]; req.Method == http.MethodPut && len(write) == 1 {
+		p.mu.Lock()
+		switch write[0] {
+		case "update":
+			p.updates++
+		case "clear":
+			p.clears++
+		}
+		p.mu.Unlock()
+	}
+	return p.next.RoundTrip(req)
+}
+
+func (p *pageWrites) reset() (updates, clears int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	updates, clears = p.updates, p.clears
+	p.updates, p.clears = 0, 0
+	return updates, clears
+}
+
+// newTestContainer creates a container in a new account of e.
+func newTestContainer(t *testing.T, e *storageemulator.Emulator, account, name string, transport http.RoundTripper) *storage.Container {
+	if _, err := e.AddAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	client, err := e.NewClient(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.HTTPClient = &http.Client{Transport: transport}
+	blobs := client.GetBlobService()
+	container := blobs.GetContainerReference(name)
+	if err := container.Create(nil); err != nil {
+		t.Fatal(err)
+	}
+	return container
+}
+
+// writePage fills page i of b with s, or clears it if s is empty, and
+// updates data to match.
+func writePage(t *testing.T, b *storage.Blob, data []byte, i int, s string) {
+	r := storage.BlobRange{Start: uint64(i * pageranges.PageSize), End: uint64((i+1)*pageranges.PageSize - 1)}
+	page := data[r.Start : r.End+1]
+	if s == "" {
+		for j := range page {
+			page[j] = 0
+		}
+		if err := b.ClearRange(r, nil); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	copy(page, bytes.Repeat([]byte(s), pageranges.PageSize/len(s)))
+	if err := b.WriteRange(r, bytes.NewReader(page), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readBlob(t *testing.T, b *storage.Blob) []byte {
+	body, err := b.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sourceSnapshots returns the number of snapshots of the named blob.
+func sourceSnapshots(t *testing.T, c *storage.Container, name string) int {
+	resp, err := c.ListBlobs(storage.ListBlobsParameters{Prefix: name, Include: &storage.IncludeBlobDataset{Snapshots: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, b := range resp.Blobs {
+		if b.Name == name && !b.Snapshot.IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestIncrementalBackupAndRestore(t *testing.T) {
+	e := storageemulator.New()
+	t.Cleanup(e.Close)
+	writes := &pageWrites{next: e.Transport()}
+	src := newTestContainer(t, e, "source", "vhds", e.Transport())
+	dst := newTestContainer(t, e, "backup", "backups", writes)
+
+	const pages = 8
+	data := make([]byte, pages*pageranges.PageSize)
+	b := src.GetBlobReference("disk.vhd")
+	b.Properties.ContentLength = int64(len(data))
+	if err := b.PutPageBlob(nil); err != nil {
+		t.Fatal(err)
+	}
+	writePage(t, b, data, 0, "boot")
+	writePage(t, b, data, 1, "boot")
+	writePage(t, b, data, 5, "data")
+
+	engine := NewEngine(dst, Retention{MaxPoints: 2})
+	engine.ChunkSize = pageranges.PageSize
+	first, err := engine.Backup(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updates, clears := writes.reset(); updates != 3 || clears != 0 {
+		t.Errorf("the first backup wrote %d and cleared %d pages, want all 3 written", updates, clears)
+	}
+	want := append([]byte(nil), data...)
+
+	// The next backup writes the changed page and clears the cleared one.
+	writePage(t, b, data, 2, "logs")
+	writePage(t, b, data, 5, "")
+	second, err := engine.Backup(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updates, clears := writes.reset(); updates != 1 || clears != 1 {
+		t.Errorf("the second backup wrote %d and cleared %d pages, want 1 of each", updates, clears)
+	}
+	if n := sourceSnapshots(t, src, b.Name); n != 1 {
+		t.Errorf("%d source snapshots are left, want only the latest", n)
+	}
+	if !second.SourceSnapshot.After(first.SourceSnapshot) || second.Size != int64(len(data)) {
+		t.Errorf("second point %+v, first %+v", second, first)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		point Point
+		want  []byte
+	}{
+		{"first", first, want},
+		{"second", second, data},
+	} {
+		target := src.GetBlobReference("restored-" + tt.name + ".vhd")
+		if err := engine.Restore(context.Background(), b.Name, tt.point.Snapshot, target); err != nil {
+			t.Fatalf("Restore() of the %s point = %v", tt.name, err)
+		}
+		if got := readBlob(t, target); !bytes.Equal(got, tt.want) {
+			t.Errorf("the %s point restored %d bytes that differ from the source then", tt.name, len(got))
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	e := storageemulator.New()
+	t.Cleanup(e.Close)
+	src := newTestContainer(t, e, "source", "vhds", e.Transport())
+	dst := newTestContainer(t, e, "backup", "backups", e.Transport())
+
+	data := make([]byte, 2*pageranges.PageSize)
+	b := src.GetBlobReference("disk.vhd")
+	b.Properties.ContentLength = int64(len(data))
+	if err := b.PutPageBlob(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	engine := NewEngine(dst, Retention{MaxPoints: 2})
+	var taken []Point
+	for i, s := range []string{"one", "two", "six"} {
+		writePage(t, b, data, i%2, s)
+		point, err := engine.Backup(context.Background(), b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		taken = append(taken, point)
+	}
+	points, err := engine.Points(b.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || !points[0].Snapshot.Equal(taken[1].Snapshot) || !points[1].Snapshot.Equal(taken[2].Snapshot) {
+		t.Errorf("Points() = %+v, want the last 2 of %+v", points, taken)
+	}
+	if !points[1].SourceSnapshot.Equal(taken[2].SourceSnapshot) {
+		t.Errorf("point %+v does not record its source snapshot %s", points[1], taken[2].SourceSnapshot)
+	}
+
+	// Down to one point, the newest is kept.
+	engine.Retention = Retention{MaxPoints: 1}
+	if err := engine.Prune(b.Name); err != nil {
+		t.Fatal(err)
+	}
+	if points, err = engine.Points(b.Name); err != nil || len(points) != 1 || !points[0].Snapshot.Equal(taken[2].Snapshot) {
+		t.Errorf("Points() after pruning to one = %+v, %v, want the newest", points, err)
+	}
+	restored := src.GetBlobReference("restored.vhd")
+	if err := engine.Restore(context.Background(), b.Name, taken[2].Snapshot, restored); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, restored); !bytes.Equal(got, data) {
+		t.Errorf("the newest point restored %d bytes that differ from the source", len(got))
+	}
+}
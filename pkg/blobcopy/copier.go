@@ -0,0 +1,248 @@
+// Package blobcopy orchestrates server-side blob copies on top of
+// storage.Blob StartCopy/AbortCopy. Unlike storage.Blob.WaitForCopy it polls
+// with backoff, reports progress, honors context cancellation and can copy
+// between storage accounts by minting a read SAS for the source.
+package blobcopy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/golang/glog"
+)
+
+const (
+	defaultConcurrency     = 4
+	defaultPollInterval    = 1 * time.Second
+	defaultMaxPollInterval = 30 * time.Second
+	defaultSASExpiry       = 24 * time.Hour
+
+	copyStatusPending = "pending"
+	copyStatusSuccess = "success"
+	copyStatusAborted = "aborted"
+	copyStatusFailed  = "failed"
+)
+
+// Request describes a single blob copy.
+type Request struct {
+	// Source is the blob to copy from.
+	Source *storage.Blob
+	// Destination is the blob to copy to. Its Metadata is sent with the copy.
+	Destination *storage.Blob
+	// Options are passed through to StartCopy. Destiny.LeaseID is also used
+	// when the copy has to be aborted.
+	Options *storage.CopyOptions
+	// UseSAS forces a source SAS even when both blobs live in the same account.
+	UseSAS bool
+}
+
+// Progress is reported while a copy is pending and once it completes.
+type Progress struct {
+	CopyID      string
+	Status      string
+	BytesCopied int64
+	TotalBytes  int64
+}
+
+// ProgressFunc receives progress updates for a request.
+type ProgressFunc func(req Request, p Progress)
+
+// Copier runs blob copies and waits for them to finish.
+type Copier struct {
+	// Concurrency is the maximum number of copies CopyAll runs at once.
+	Concurrency int
+	// PollInterval is the initial delay between copy status polls.
+	PollInterval time.Duration
+	// MaxPollInterval caps the exponential poll backoff.
+	MaxPollInterval time.Duration
+	// SASExpiry is the lifetime of source SAS tokens for cross-account copies.
+	SASExpiry time.Duration
+	// OnProgress, if set, is called after every status poll.
+	OnProgress ProgressFunc
+}
+
+// NewCopier returns a Copier with default concurrency and polling settings.
+func NewCopier() *Copier {
+	return &Copier{
+		Concurrency:     defaultConcurrency,
+		PollInterval:    defaultPollInterval,
+		MaxPollInterval: defaultMaxPollInterval,
+		SASExpiry:       defaultSASExpiry,
+	}
+}
+
+// Copy starts the copy described by req and blocks until it succeeds, fails
+// or ctx is done. When ctx is done the pending copy is aborted and ctx.Err()
+// is returned.
+func (c *Copier) Copy(ctx context.Context, req Request) error {
+	if req.Source == nil || req.Destination == nil {
+		return fmt.Errorf("blobcopy: source and destination blobs are required")
+	}
+
+	sourceURL, err := c.sourceURL(req)
+	if err != nil {
+		return err
+	}
+
+	copyID, err := req.Destination.StartCopy(sourceURL, req.Options)
+	if err != nil {
+		return fmt.Errorf("blobcopy: starting copy of %s: %v", req.Source.Name, err)
+	}
+	glog.V(4).Infof("blobcopy: started copy %s from %s to %s", copyID, req.Source.Name, req.Destination.Name)
+
+	return c.wait(ctx, req, copyID)
+}
+
+// CopyAll runs all requests with at most c.Concurrency copies in flight and
+// returns one error per request, in the same order.
+func (c *Copier) CopyAll(ctx context.Context, reqs []Request) []error {
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	errs := make([]error, len(reqs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range reqs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = c.Copy(ctx, reqs[i])
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// wait polls the destination blob until the copy identified by copyID leaves
+// the pending state.
+func (c *Copier) wait(ctx context.Context, req Request, copyID string) error {
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	maxInterval := c.MaxPollInterval
+	if maxInterval <= 0 {
+		maxInterval = defaultMaxPollInterval
+	}
+
+	dst := req.Destination
+	for {
+		if err := dst.GetProperties(nil); err != nil {
+			return fmt.Errorf("blobcopy: getting properties of %s: %v", dst.Name, err)
+		}
+		if dst.Properties.CopyID != copyID {
+			return fmt.Errorf("blobcopy: copy id mismatch on %s: expected %s, got %s", dst.Name, copyID, dst.Properties.CopyID)
+		}
+
+		p := Progress{CopyID: copyID, Status: dst.Properties.CopyStatus}
+		p.BytesCopied, p.TotalBytes = parseCopyProgress(dst.Properties.CopyProgress)
+		if c.OnProgress != nil {
+			c.OnProgress(req, p)
+		}
+
+		switch dst.Properties.CopyStatus {
+		case copyStatusSuccess:
+			return nil
+		case copyStatusPending:
+		case copyStatusAborted:
+			return fmt.Errorf("blobcopy: copy %s to %s was aborted", copyID, dst.Name)
+		case copyStatusFailed:
+			return fmt.Errorf("blobcopy: copy %s to %s failed: %s", copyID, dst.Name, dst.Properties.CopyStatusDescription)
+		default:
+			return fmt.Errorf("blobcopy: unhandled copy status %q for %s", dst.Properties.CopyStatus, dst.Name)
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			c.abort(req, copyID)
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// abort makes a best effort to abort a pending copy.
+func (c *Copier) abort(req Request, copyID string) {
+	var options *storage.AbortCopyOptions
+	if req.Options != nil && req.Options.Destiny.LeaseID != "" {
+		options = &storage.AbortCopyOptions{LeaseID: req.Options.Destiny.LeaseID}
+	}
+	if err := req.Destination.AbortCopy(copyID, options); err != nil {
+		glog.Warningf("blobcopy: aborting copy %s to %s: %v", copyID, req.Destination.Name, err)
+		return
+	}
+	glog.V(2).Infof("blobcopy: aborted copy %s to %s", copyID, req.Destination.Name)
+}
+
+// sourceURL returns the URL StartCopy should read from. Copies between
+// different accounts need a SAS since the destination service cannot
+// authenticate as the source account.
+func (c *Copier) sourceURL(req Request) (string, error) {
+	src := req.Source.GetURL()
+	if !req.UseSAS && sameAccount(src, req.Destination.GetURL()) {
+		return src, nil
+	}
+
+	expiry := c.SASExpiry
+	if expiry <= 0 {
+		expiry = defaultSASExpiry
+	}
+	sasURL, err := req.Source.GetSASURI(storage.BlobSASOptions{
+		BlobServiceSASPermissions: storage.BlobServiceSASPermissions{Read: true},
+		SASOptions: storage.SASOptions{
+			Expiry:   time.Now().Add(expiry),
+			UseHTTPS: strings.HasPrefix(src, "https"),
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("blobcopy: creating SAS for %s: %v", req.Source.Name, err)
+	}
+	return sasURL, nil
+}
+
+func sameAccount(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Host, ub.Host)
+}
+
+// parseCopyProgress parses the x-ms-copy-progress "<copied>/<total>" value.
+func parseCopyProgress(s string) (copied, total int64) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0
+	}
+	copied, _ = strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+	total, _ = strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+	return copied, total
+}
@@ -0,0 +1,199 @@
+package blobcopy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/honcao/cloudprovider/pkg/storageemulator"
+)
+
+// newTestContainer creates a private container in an account of e,
+// registering the account unless it is the development one.
+func newTestContainer(t *testing.T, e *storageemulator.Emulator, account, name string) *storage.Container {
+	if account != storage.StorageEmulatorAccountName {
+		if _, err := e.AddAccount(account); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client, err := e.NewClient(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := client.GetBlobService()
+	container := blobs.GetContainerReference(name)
+	if err := container.Create(nil); err != nil {
+		t.Fatal(err)
+	}
+	return container
+}
+
+func newTestBlob(t *testing.T, c *storage.Container, name string, data []byte) *storage.Blob {
+	b := c.GetBlobReference(name)
+	if err := b.CreateBlockBlobFromReader(bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func readBlob(t *testing.T, b *storage.Blob) []byte {
+	body, err := b.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// progressLog records the progress reported to it.
+type progressLog struct {
+	mu       sync.Mutex
+	progress []Progress
+	times    []time.Time
+}
+
+func (l *progressLog) record(req Request, p Progress) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.progress = append(l.progress, p)
+	l.times = append(l.times, time.Now())
+}
+
+func TestCopyAcrossAccounts(t *testing.T) {
+	e := storageemulator.New()
+	t.Cleanup(e.Close)
+	src := newTestContainer(t, e, storage.StorageEmulatorAccountName, "images")
+	dst := newTestContainer(t, e, "backup", "images")
+	data := []byte(strings.Repeat("image", 1000))
+	source := newTestBlob(t, src, "base.vhd", data)
+
+	// The destination account cannot read the private source on its own.
+	if _, err := dst.GetBlobReference("direct.vhd").StartCopy(source.GetURL(), nil); err == nil {
+		t.Fatal("a copy from a private container of another account succeeded without a SAS")
+	}
+
+	log := &progressLog{}
+	c := NewCopier()
+	c.PollInterval = time.Millisecond
+	c.OnProgress = log.record
+	target := dst.GetBlobReference("base.vhd")
+	if err := c.Copy(context.Background(), Request{Source: source, Destination: target}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, target); !bytes.Equal(got, data) {
+		t.Errorf("copied %d bytes that differ from the source", len(got))
+	}
+	if n := len(log.progress); n != 1 || log.progress[0].Status != copyStatusSuccess || log.progress[0].BytesCopied != int64(len(data)) {
+		t.Errorf("progress %+v, want one success", log.progress)
+	}
+}
+
+func TestSourceURL(t *testing.T) {
+	e := storageemulator.New()
+	t.Cleanup(e.Close)
+	src := newTestContainer(t, e, storage.StorageEmulatorAccountName, "images").GetBlobReference("base.vhd")
+	same := newTestContainer(t, e, storage.StorageEmulatorAccountName, "copies").GetBlobReference("base.vhd")
+	other := newTestContainer(t, e, "backup", "images").GetBlobReference("base.vhd")
+	c := NewCopier()
+	for _, tt := range []struct {
+		name string
+		req  Request
+		sas  bool
+	}{
+		{"same account", Request{Source: src, Destination: same}, false},
+		{"same account, forced", Request{Source: src, Destination: same, UseSAS: true}, true},
+		{"other account", Request{Source: src, Destination: other}, true},
+	} {
+		u, err := c.sourceURL(tt.req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !strings.HasPrefix(u, src.GetURL()) || strings.Contains(u, "sig=") != tt.sas {
+			t.Errorf("%s: sourceURL() = %s, want a SAS %v", tt.name, u, tt.sas)
+		}
+	}
+}
+
+func TestWaitBacksOff(t *testing.T) {
+	e := storageemulator.New()
+	t.Cleanup(e.Close)
+	e.CopyDuration = 300 * time.Millisecond
+	c := newTestContainer(t, e, storage.StorageEmulatorAccountName, "images")
+	data := []byte(strings.Repeat("image", 1000))
+	source := newTestBlob(t, c, "base.vhd", data)
+
+	log := &progressLog{}
+	copier := NewCopier()
+	copier.PollInterval = 10 * time.Millisecond
+	copier.MaxPollInterval = 40 * time.Millisecond
+	copier.OnProgress = log.record
+	if err := copier.Copy(context.Background(), Request{Source: source, Destination: c.GetBlobReference("copy.vhd")}); err != nil {
+		t.Fatal(err)
+	}
+
+	last := log.progress[len(log.progress)-1]
+	if last.Status != copyStatusSuccess || last.BytesCopied != int64(len(data)) || last.TotalBytes != int64(len(data)) {
+		t.Errorf("last progress %+v, want success with every byte copied", last)
+	}
+	if log.progress[0].Status != copyStatusPending || log.progress[0].TotalBytes != int64(len(data)) {
+		t.Errorf("first progress %+v, want pending", log.progress[0])
+	}
+	// Polling every 10ms would take 30 polls; 10, 20 and then 40ms take
+	// under a dozen.
+	if n := len(log.progress); n > 12 {
+		t.Errorf("polled %d times, want backoff", n)
+	}
+	for i := 2; i < len(log.times); i++ {
+		if gap := log.times[i].Sub(log.times[i-1]); gap < 20*time.Millisecond {
+			t.Errorf("poll %d came %s after the previous one, want at least 20ms", i, gap)
+		}
+	}
+}
+
+func TestCancelAbortsCopy(t *testing.T) {
+	e := storageemulator.New()
+	t.Cleanup(e.Close)
+	e.CopyDuration = time.Hour
+	c := newTestContainer(t, e, storage.StorageEmulatorAccountName, "images")
+	source := newTestBlob(t, c, "base.vhd", []byte("image"))
+	for _, leased := range []bool{false, true} {
+		name := "copy.vhd"
+		if leased {
+			name = "leased.vhd"
+		}
+		target := newTestBlob(t, c, name, nil)
+		var options *storage.CopyOptions
+		if leased {
+			leaseID, err := target.AcquireLease(-1, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			options = &storage.CopyOptions{Destiny: storage.CopyOptionsConditions{LeaseID: leaseID}}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		copier := NewCopier()
+		copier.OnProgress = func(req Request, p Progress) { cancel() }
+		err := copier.Copy(ctx, Request{Source: source, Destination: target, Options: options})
+		if err != context.Canceled {
+			t.Errorf("Copy() leased %v = %v, want %v", leased, err, context.Canceled)
+		}
+
+		check := c.GetBlobReference(name)
+		if err := check.GetProperties(nil); err != nil {
+			t.Fatal(err)
+		}
+		if check.Properties.CopyStatus != copyStatusAborted {
+			t.Errorf("copy status with a lease %v is %q, want %q", leased, check.Properties.CopyStatus, copyStatusAborted)
+		}
+	}
+}
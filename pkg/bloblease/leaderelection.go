@@ -0,0 +1,180 @@
+package bloblease
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// LeaderCallbacks are invoked as leadership changes.
+type LeaderCallbacks struct {
+	// OnStartedLeading runs in its own goroutine once leadership is acquired.
+	// ctx is cancelled when leadership is lost or the elector stops; token is
+	// the fencing token of this term.
+	OnStartedLeading func(ctx context.Context, token int64)
+	// OnStoppedLeading is called after a term ends, once OnStartedLeading
+	// has returned.
+	OnStoppedLeading func()
+	// OnNewLeader is called when a different leader is observed.
+	OnNewLeader func(identity string)
+}
+
+// LeaderElectionConfig configures a LeaderElector.
+type LeaderElectionConfig struct {
+	// Lock is the lease the candidates compete for.
+	Lock *Lock
+	// RenewDeadline is how long the leader keeps retrying renewals before
+	// giving up leadership. It must be less than the lease duration.
+	RenewDeadline time.Duration
+	// RetryPeriod is the interval between acquire and renew attempts.
+	RetryPeriod time.Duration
+	// Callbacks are invoked on leadership changes.
+	Callbacks LeaderCallbacks
+	// ReleaseOnCancel releases the lease when Run's context is cancelled so
+	// another candidate can take over without waiting for it to expire.
+	ReleaseOnCancel bool
+}
+
+// LeaderElector runs a leader election among replicas sharing a Lock.
+type LeaderElector struct {
+	config         LeaderElectionConfig
+	observedLeader string
+}
+
+// NewLeaderElector validates config and returns a LeaderElector.
+func NewLeaderElector(config LeaderElectionConfig) (*LeaderElector, error) {
+	if config.Lock == nil {
+		return nil, fmt.Errorf("bloblease: leader election requires a lock")
+	}
+	if config.Callbacks.OnStartedLeading == nil {
+		return nil, fmt.Errorf("bloblease: OnStartedLeading callback must not be nil")
+	}
+	if config.RetryPeriod <= 0 {
+		config.RetryPeriod = config.Lock.LeaseDuration() / 6
+	}
+	if config.RenewDeadline <= 0 {
+		config.RenewDeadline = config.Lock.LeaseDuration() * 2 / 3
+	}
+	if config.RenewDeadline >= config.Lock.LeaseDuration() {
+		return nil, fmt.Errorf("bloblease: renew deadline %v must be less than the lease duration %v", config.RenewDeadline, config.Lock.LeaseDuration())
+	}
+	if config.RetryPeriod >= config.RenewDeadline {
+		return nil, fmt.Errorf("bloblease: retry period %v must be less than the renew deadline %v", config.RetryPeriod, config.RenewDeadline)
+	}
+	return &LeaderElector{config: config}, nil
+}
+
+// IsLeader reports whether this candidate currently holds the lease.
+func (le *LeaderElector) IsLeader() bool {
+	return le.config.Lock.Held()
+}
+
+// Run competes for leadership until ctx is done. Each time leadership is
+// acquired OnStartedLeading is started, and each time it is lost the term's
+// context is cancelled and OnStoppedLeading is called.
+func (le *LeaderElector) Run(ctx context.Context) {
+	for {
+		if !le.acquire(ctx) {
+			return
+		}
+		le.lead(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// acquire blocks until the lease is acquired or ctx is done.
+func (le *LeaderElector) acquire(ctx context.Context) bool {
+	lock := le.config.Lock
+	for {
+		ok, err := lock.TryAcquire()
+		if err != nil {
+			glog.Warningf("bloblease: %s failed to acquire %s: %v", lock.Identity(), lock.Name(), err)
+		}
+		if ok {
+			le.observe(lock.Identity())
+			return true
+		}
+		if err == nil {
+			le.observeHolder()
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(le.config.RetryPeriod):
+		}
+	}
+}
+
+// lead runs one leadership term.
+func (le *LeaderElector) lead(ctx context.Context) {
+	lock := le.config.Lock
+	termCtx, cancel := context.WithCancel(ctx)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		le.config.Callbacks.OnStartedLeading(termCtx, lock.Token())
+	}()
+
+	le.renew(termCtx)
+	cancel()
+	<-finished
+
+	// A term that ended on its own gives up whatever is left of the lease
+	// so the callbacks and IsLeader agree; a cancelled one only does if asked.
+	if ctx.Err() == nil || le.config.ReleaseOnCancel {
+		if err := lock.Release(); err != nil {
+			glog.Warningf("bloblease: %s failed to release %s: %v", lock.Identity(), lock.Name(), err)
+		}
+	}
+	if le.config.Callbacks.OnStoppedLeading != nil {
+		le.config.Callbacks.OnStoppedLeading()
+	}
+}
+
+// renew keeps the lease until ctx is done or it cannot be renewed within
+// RenewDeadline.
+func (le *LeaderElector) renew(ctx context.Context) {
+	lock := le.config.Lock
+	lastRenew := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(le.config.RetryPeriod):
+		}
+		err := lock.Renew()
+		if err == nil {
+			lastRenew = time.Now()
+			continue
+		}
+		if !lock.Held() || time.Since(lastRenew) >= le.config.RenewDeadline {
+			glog.Errorf("bloblease: %s lost leadership of %s: %v", lock.Identity(), lock.Name(), err)
+			return
+		}
+		glog.Warningf("bloblease: %s failed to renew %s: %v", lock.Identity(), lock.Name(), err)
+	}
+}
+
+func (le *LeaderElector) observeHolder() {
+	holder, _, err := le.config.Lock.Holder()
+	if err != nil {
+		glog.V(4).Infof("bloblease: reading holder of %s: %v", le.config.Lock.Name(), err)
+		return
+	}
+	le.observe(holder)
+}
+
+func (le *LeaderElector) observe(identity string) {
+	if identity == "" || identity == le.observedLeader {
+		return
+	}
+	le.observedLeader = identity
+	glog.V(2).Infof("bloblease: new leader of %s is %s", le.config.Lock.Name(), identity)
+	if le.config.Callbacks.OnNewLeader != nil {
+		le.config.Callbacks.OnNewLeader(identity)
+	}
+}
@@ -0,0 +1,132 @@
+package bloblease
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewLeaderElectorValidates(t *testing.T) {
+	lock := NewLock(nil, "lock", "a", testLeaseDuration)
+	started := func(context.Context, int64) {}
+	for _, tt := range []struct {
+		name   string
+		config LeaderElectionConfig
+		ok     bool
+	}{
+		{"no lock", LeaderElectionConfig{Callbacks: LeaderCallbacks{OnStartedLeading: started}}, false},
+		{"no callback", LeaderElectionConfig{Lock: lock}, false},
+		{"defaults", LeaderElectionConfig{Lock: lock, Callbacks: LeaderCallbacks{OnStartedLeading: started}}, true},
+		{"deadline past lease", LeaderElectionConfig{Lock: lock, RenewDeadline: testLeaseDuration, Callbacks: LeaderCallbacks{OnStartedLeading: started}}, false},
+		{"retry past deadline", LeaderElectionConfig{Lock: lock, RenewDeadline: time.Second, RetryPeriod: time.Second, Callbacks: LeaderCallbacks{OnStartedLeading: started}}, false},
+	} {
+		_, err := NewLeaderElector(tt.config)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: NewLeaderElector() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// waitFor returns the next value of c, or fails after a while.
+func waitFor(t *testing.T, what string, c <-chan int64) int64 {
+	select {
+	case v := <-c:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	return 0
+}
+
+func TestLeaderElectorLosesLease(t *testing.T) {
+	container := newTestContainer(t)
+	lock := NewLock(container, "leader", "a", testLeaseDuration)
+	started := make(chan int64, 2)
+	stopped := make(chan int64, 2)
+	le, err := NewLeaderElector(LeaderElectionConfig{
+		Lock:          lock,
+		RenewDeadline: time.Second,
+		RetryPeriod:   10 * time.Millisecond,
+		Callbacks: LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context, token int64) {
+				started <- token
+				<-ctx.Done()
+			},
+			OnStoppedLeading: func() { stopped <- 0 },
+		},
+		ReleaseOnCancel: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		le.Run(ctx)
+		close(done)
+	}()
+
+	if token := waitFor(t, "the first term", started); token != 1 {
+		t.Fatalf("first term has token %d, want 1", token)
+	}
+	if !le.IsLeader() {
+		t.Fatalf("IsLeader() = false while leading")
+	}
+
+	// Breaking the lease ends the term at the next renewal, and the
+	// elector competes again and wins a new term with a new token.
+	if err := NewLock(container, "leader", "operator", testLeaseDuration).Break(0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the end of the first term", stopped)
+	if token := waitFor(t, "the second term", started); token != 2 {
+		t.Fatalf("second term has token %d, want 2", token)
+	}
+
+	cancel()
+	waitFor(t, "the end of the second term", stopped)
+	<-done
+	if le.IsLeader() {
+		t.Fatalf("IsLeader() = true after Run returned")
+	}
+	// ReleaseOnCancel leaves the lease free for the next candidate.
+	mustAcquire(t, NewLock(container, "leader", "b", testLeaseDuration))
+}
+
+func TestLeaderElectorObservesLeader(t *testing.T) {
+	container := newTestContainer(t)
+	mustAcquire(t, NewLock(container, "leader", "a", testLeaseDuration))
+
+	observed := make(chan string, 1)
+	le, err := NewLeaderElector(LeaderElectionConfig{
+		Lock:          NewLock(container, "leader", "b", testLeaseDuration),
+		RenewDeadline: time.Second,
+		RetryPeriod:   10 * time.Millisecond,
+		Callbacks: LeaderCallbacks{
+			OnStartedLeading: func(context.Context, int64) {
+				t.Errorf("b started leading while a holds the lease")
+			},
+			OnNewLeader: func(identity string) { observed <- identity },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		le.Run(ctx)
+		close(done)
+	}()
+	select {
+	case identity := <-observed:
+		if identity != "a" {
+			t.Errorf("OnNewLeader(%q), want a", identity)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("OnNewLeader was not called")
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,262 @@
+// Package bloblease implements named locks and leader election on top of
+// blob leases, for controllers that run several replicas without access to
+// etcd. Each lock is an empty block blob; holding its lease holds the lock and
+// every acquisition bumps a fencing token kept in the blob metadata.
+//
+// Everything goes through storage.Blob, so a Lock can be exercised against a
+// fake blob endpoint by pointing the storage.Client HTTPClient at it.
+package bloblease
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+)
+
+const (
+	// Lease durations accepted by the blob service.
+	minLeaseDuration = 15 * time.Second
+	maxLeaseDuration = 60 * time.Second
+
+	metadataHolderIdentity = "holderidentity"
+	metadataFencingToken   = "fencingtoken"
+	metadataAcquireTime    = "acquiretime"
+)
+
+// Lock is a named lock backed by the lease of a single blob. A Lock is safe
+// for concurrent use.
+type Lock struct {
+	container *storage.Container
+	name      string
+	identity  string
+	leaseID   string
+	duration  time.Duration
+
+	mu    sync.Mutex
+	held  bool
+	token int64
+}
+
+// NewLock returns a lock on the blob called name in container, held on behalf
+// of identity. leaseDuration is clamped to the 15-60s range allowed for
+// blob leases.
+func NewLock(container *storage.Container, name, identity string, leaseDuration time.Duration) *Lock {
+	if leaseDuration < minLeaseDuration {
+		leaseDuration = minLeaseDuration
+	}
+	if leaseDuration > maxLeaseDuration {
+		leaseDuration = maxLeaseDuration
+	}
+	return &Lock{
+		container: container,
+		name:      name,
+		identity:  identity,
+		leaseID:   LeaseIDForIdentity(identity),
+		duration:  leaseDuration,
+	}
+}
+
+// LeaseIDForIdentity returns the lease ID proposed on behalf of identity. It
+// is stable, so a restarted holder with the same identity can pick up its own
+// lease and a holder can hand the lease over to a known successor.
+func LeaseIDForIdentity(identity string) string {
+	sum := md5.Sum([]byte(identity))
+	// Format as a version 3 (name based) GUID as required by the service.
+	sum[6] = (sum[6] & 0x0f) | 0x30
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// Name returns the name of the lock blob.
+func (l *Lock) Name() string {
+	return l.name
+}
+
+// Identity returns the identity the lock is held on behalf of.
+func (l *Lock) Identity() string {
+	return l.identity
+}
+
+// LeaseDuration returns the duration of the underlying lease.
+func (l *Lock) LeaseDuration() time.Duration {
+	return l.duration
+}
+
+// Held reports whether the lock is currently believed to be held.
+func (l *Lock) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held
+}
+
+// Token returns the fencing token of the current acquisition. Tokens grow
+// with every acquisition of the lock by any holder, so storage written under
+// the lock can reject writes carrying an older token.
+func (l *Lock) Token() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.token
+}
+
+// TryAcquire attempts to take the lock once. It returns false without an
+// error when another holder owns the lease.
+func (l *Lock) TryAcquire() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.ensureBlob(); err != nil {
+		return false, err
+	}
+
+	blob := l.blob()
+	if _, err := blob.AcquireLease(int(l.duration/time.Second), l.leaseID, nil); err != nil {
+		if apierror.IsStorageStatus(err, http.StatusConflict) {
+			return false, nil
+		}
+		return false, fmt.Errorf("bloblease: acquiring lease on %s: %v", l.name, err)
+	}
+
+	token, err := l.bumpToken(blob)
+	if err != nil {
+		// Without a new token the acquisition is not safe to use.
+		if rerr := blob.ReleaseLease(l.leaseID, nil); rerr != nil {
+			glog.Warningf("bloblease: releasing lease on %s after failed token update: %v", l.name, rerr)
+		}
+		return false, err
+	}
+
+	l.held = true
+	l.token = token
+	glog.V(2).Infof("bloblease: %s acquired %s with fencing token %d", l.identity, l.name, token)
+	return true, nil
+}
+
+// Renew extends the lease. An error means the lock may have been lost.
+func (l *Lock) Renew() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.held {
+		return fmt.Errorf("bloblease: %s is not held by %s", l.name, l.identity)
+	}
+	if err := l.blob().RenewLease(l.leaseID, nil); err != nil {
+		if apierror.IsStorageStatus(err, http.StatusConflict) {
+			l.held = false
+		}
+		return fmt.Errorf("bloblease: renewing lease on %s: %v", l.name, err)
+	}
+	return nil
+}
+
+// Release gives up the lock so another holder can take it immediately.
+func (l *Lock) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.held {
+		return nil
+	}
+	l.held = false
+	if err := l.blob().ReleaseLease(l.leaseID, nil); err != nil {
+		if apierror.IsStorageStatus(err, http.StatusConflict) {
+			// Already lost, nothing to release.
+			return nil
+		}
+		return fmt.Errorf("bloblease: releasing lease on %s: %v", l.name, err)
+	}
+	glog.V(2).Infof("bloblease: %s released %s", l.identity, l.name)
+	return nil
+}
+
+// Handover transfers a held lock to successor without letting it become
+// free in between. The successor takes it over by calling TryAcquire, which
+// re-acquires its own lease ID and bumps the fencing token.
+func (l *Lock) Handover(successor string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.held {
+		return fmt.Errorf("bloblease: %s is not held by %s", l.name, l.identity)
+	}
+	if _, err := l.blob().ChangeLease(l.leaseID, LeaseIDForIdentity(successor), nil); err != nil {
+		return fmt.Errorf("bloblease: handing %s over to %s: %v", l.name, successor, err)
+	}
+	l.held = false
+	glog.V(2).Infof("bloblease: %s handed %s over to %s", l.identity, l.name, successor)
+	return nil
+}
+
+// Break ends the current lease, whoever holds it, after breakPeriod. It is
+// meant for operators recovering from a stuck holder.
+func (l *Lock) Break(breakPeriod time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.blob().BreakLeaseWithBreakPeriod(int(breakPeriod/time.Second), nil); err != nil {
+		return fmt.Errorf("bloblease: breaking lease on %s: %v", l.name, err)
+	}
+	l.held = false
+	return nil
+}
+
+// Holder returns the identity and fencing token recorded by the most recent
+// acquisition of the lock.
+func (l *Lock) Holder() (string, int64, error) {
+	blob := l.blob()
+	if err := blob.GetMetadata(nil); err != nil {
+		if apierror.IsStorageStatus(err, http.StatusNotFound) {
+			return "", 0, nil
+		}
+		return "", 0, fmt.Errorf("bloblease: reading metadata of %s: %v", l.name, err)
+	}
+	token, _ := strconv.ParseInt(blob.Metadata[metadataFencingToken], 10, 64)
+	return blob.Metadata[metadataHolderIdentity], token, nil
+}
+
+func (l *Lock) blob() *storage.Blob {
+	return l.container.GetBlobReference(l.name)
+}
+
+// ensureBlob creates the lock blob if it does not exist yet. It never
+// overwrites an existing blob, which would reset the fencing token.
+func (l *Lock) ensureBlob() error {
+	blob := l.blob()
+	exists, err := blob.Exists()
+	if err != nil {
+		return fmt.Errorf("bloblease: checking %s: %v", l.name, err)
+	}
+	if exists {
+		return nil
+	}
+	err = blob.CreateBlockBlob(&storage.PutBlobOptions{IfNoneMatch: "*"})
+	if err != nil && !apierror.IsStorageStatus(err, http.StatusConflict) && !apierror.IsStorageStatus(err, http.StatusPreconditionFailed) {
+		return fmt.Errorf("bloblease: creating %s: %v", l.name, err)
+	}
+	return nil
+}
+
+// bumpToken increments the fencing token under the lease just acquired.
+func (l *Lock) bumpToken(blob *storage.Blob) (int64, error) {
+	if err := blob.GetMetadata(&storage.GetBlobMetadataOptions{LeaseID: l.leaseID}); err != nil {
+		return 0, fmt.Errorf("bloblease: reading metadata of %s: %v", l.name, err)
+	}
+	token, _ := strconv.ParseInt(blob.Metadata[metadataFencingToken], 10, 64)
+	token++
+
+	blob.Metadata = storage.BlobMetadata{
+		metadataHolderIdentity: l.identity,
+		metadataFencingToken:   strconv.FormatInt(token, 10),
+		metadataAcquireTime:    time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := blob.SetMetadata(&storage.SetBlobMetadataOptions{LeaseID: l.leaseID}); err != nil {
+		return 0, fmt.Errorf("bloblease: writing fencing token of %s: %v", l.name, err)
+	}
+	return token, nil
+}
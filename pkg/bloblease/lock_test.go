@@ -0,0 +1,247 @@
+package bloblease
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/honcao/cloudprovider/pkg/storageemulator"
+)
+
+const testLeaseDuration = 15 * time.Second
+
+func newTestContainer(t *testing.T) *storage.Container {
+	e := storageemulator.New()
+	t.Cleanup(e.Close)
+	client, err := e.NewClient(storage.StorageEmulatorAccountName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := client.GetBlobService()
+	container := blobs.GetContainerReference("locks")
+	if err := container.Create(nil); err != nil {
+		t.Fatal(err)
+	}
+	return container
+}
+
+func mustAcquire(t *testing.T, l *Lock) {
+	ok, err := l.TryAcquire()
+	if err != nil || !ok {
+		t.Fatalf("%s: TryAcquire() = %v, %v, want true", l.Identity(), ok, err)
+	}
+}
+
+func mustNotAcquire(t *testing.T, l *Lock) {
+	ok, err := l.TryAcquire()
+	if err != nil || ok {
+		t.Fatalf("%s: TryAcquire() = %v, %v, want false", l.Identity(), ok, err)
+	}
+}
+
+func checkHolder(t *testing.T, l *Lock, identity string, token int64) {
+	holder, got, err := l.Holder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder != identity || got != token {
+		t.Fatalf("Holder() = %s, %d, want %s, %d", holder, got, identity, token)
+	}
+}
+
+func TestLeaseIDForIdentity(t *testing.T) {
+	a, b := LeaseIDForIdentity("a"), LeaseIDForIdentity("b")
+	if a != LeaseIDForIdentity("a") {
+		t.Errorf("lease ID of a is not stable")
+	}
+	if a == b {
+		t.Errorf("a and b have the same lease ID %s", a)
+	}
+	if len(a) != 36 || a[14] != '3' {
+		t.Errorf("lease ID %s is not a version 3 GUID", a)
+	}
+}
+
+func TestNewLockClampsDuration(t *testing.T) {
+	for _, tt := range []struct {
+		in, want time.Duration
+	}{
+		{time.Second, minLeaseDuration},
+		{30 * time.Second, 30 * time.Second},
+		{time.Hour, maxLeaseDuration},
+	} {
+		if got := NewLock(nil, "l", "a", tt.in).LeaseDuration(); got != tt.want {
+			t.Errorf("NewLock(%v).LeaseDuration() = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLockAcquireRenewRelease(t *testing.T) {
+	container := newTestContainer(t)
+	a := NewLock(container, "lock", "a", testLeaseDuration)
+	b := NewLock(container, "lock", "b", testLeaseDuration)
+
+	checkHolder(t, a, "", 0)
+	mustAcquire(t, a)
+	if !a.Held() || a.Token() != 1 {
+		t.Fatalf("a: Held() = %v, Token() = %d, want true, 1", a.Held(), a.Token())
+	}
+	mustNotAcquire(t, b)
+	if err := a.Renew(); err != nil {
+		t.Fatalf("a: Renew() = %v", err)
+	}
+	if err := b.Renew(); err == nil {
+		t.Fatalf("b: Renew() of a lock b does not hold succeeded")
+	}
+
+	if err := a.Release(); err != nil {
+		t.Fatalf("a: Release() = %v", err)
+	}
+	if a.Held() {
+		t.Fatalf("a: Held() = true after Release")
+	}
+	if err := a.Release(); err != nil {
+		t.Fatalf("a: second Release() = %v", err)
+	}
+	mustAcquire(t, b)
+	checkHolder(t, a, "b", 2)
+}
+
+func TestLockReacquireOwnLease(t *testing.T) {
+	container := newTestContainer(t)
+	a := NewLock(container, "lock", "a", testLeaseDuration)
+	mustAcquire(t, a)
+
+	// A restarted holder with the same identity picks its lease up again.
+	restarted := NewLock(container, "lock", "a", testLeaseDuration)
+	mustAcquire(t, restarted)
+	if restarted.Token() != 2 {
+		t.Fatalf("Token() = %d after reacquiring, want 2", restarted.Token())
+	}
+}
+
+func TestLockHandover(t *testing.T) {
+	container := newTestContainer(t)
+	a := NewLock(container, "lock", "a", testLeaseDuration)
+	b := NewLock(container, "lock", "b", testLeaseDuration)
+	c := NewLock(container, "lock", "c", testLeaseDuration)
+
+	if err := a.Handover("b"); err == nil {
+		t.Fatalf("Handover() of a lock a does not hold succeeded")
+	}
+	mustAcquire(t, a)
+	if err := a.Handover("b"); err != nil {
+		t.Fatalf("Handover() = %v", err)
+	}
+	if a.Held() {
+		t.Fatalf("a: Held() = true after Handover")
+	}
+	if err := a.Renew(); err == nil {
+		t.Fatalf("a: Renew() after Handover succeeded")
+	}
+	// The lease never became free, so only the successor gets it.
+	mustNotAcquire(t, c)
+	mustAcquire(t, b)
+	checkHolder(t, b, "b", 2)
+}
+
+func TestLockFencingToken(t *testing.T) {
+	container := newTestContainer(t)
+	identities := []string{"a", "b", "a", "c", "c"}
+	for i, identity := range identities {
+		l := NewLock(container, "lock", identity, testLeaseDuration)
+		mustAcquire(t, l)
+		if want := int64(i + 1); l.Token() != want {
+			t.Fatalf("acquisition %d by %s: Token() = %d, want %d", i, identity, l.Token(), want)
+		}
+		blob := container.GetBlobReference("lock")
+		if err := blob.GetMetadata(nil); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := blob.Metadata[metadataFencingToken], string('1'+byte(i)); got != want {
+			t.Fatalf("acquisition %d: metadata %s = %q, want %q", i, metadataFencingToken, got, want)
+		}
+		if got := blob.Metadata[metadataHolderIdentity]; got != identity {
+			t.Fatalf("acquisition %d: metadata %s = %q, want %q", i, metadataHolderIdentity, got, identity)
+		}
+		if err := l.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLockBreak(t *testing.T) {
+	container := newTestContainer(t)
+	a := NewLock(container, "lock", "a", testLeaseDuration)
+	operator := NewLock(container, "lock", "operator", testLeaseDuration)
+	mustAcquire(t, a)
+
+	if err := operator.Break(0); err != nil {
+		t.Fatalf("Break() = %v", err)
+	}
+	if err := a.Renew(); err == nil {
+		t.Fatalf("Renew() of a broken lease succeeded")
+	}
+	if a.Held() {
+		t.Fatalf("Held() = true after the lease was broken")
+	}
+	mustAcquire(t, operator)
+	if operator.Token() != 2 {
+		t.Fatalf("Token() = %d, want 2", operator.Token())
+	}
+}
+
+func TestMutex(t *testing.T) {
+	container := newTestContainer(t)
+	a := NewMutex(NewLock(container, "lock", "a", testLeaseDuration))
+	b := NewMutex(NewLock(container, "lock", "b", testLeaseDuration))
+	b.RetryPeriod = 10 * time.Millisecond
+
+	if err := a.Unlock(); err == nil {
+		t.Fatalf("Unlock() of an unlocked mutex succeeded")
+	}
+	token, err := a.Lock(context.Background())
+	if err != nil || token != 1 {
+		t.Fatalf("a: Lock() = %d, %v, want 1", token, err)
+	}
+	if a.Lost() == nil {
+		t.Fatalf("a: Lost() = nil while locked")
+	}
+	lost := a.Lost()
+	if _, err := a.Lock(context.Background()); err == nil {
+		t.Fatalf("a: second Lock() succeeded")
+	}
+	if a.Lost() != lost {
+		t.Fatalf("a: second Lock() replaced the renewal")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := b.Lock(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("b: Lock() of a locked mutex = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	locked := make(chan int64)
+	go func() {
+		token, err := b.Lock(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- token
+	}()
+	if err := a.Unlock(); err != nil {
+		t.Fatalf("a: Unlock() = %v", err)
+	}
+	select {
+	case token := <-locked:
+		if token != 2 {
+			t.Fatalf("b: Lock() = %d, want 2", token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("b did not get the mutex after a unlocked it")
+	}
+	if err := b.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,139 @@
+package bloblease
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Mutex is a blocking distributed mutex. While locked it renews its lease in
+// the background and closes the channel returned by Lost if renewal fails.
+type Mutex struct {
+	lock *Lock
+
+	// RetryPeriod is how often Lock retries while another holder owns the
+	// lease. It defaults to a third of the lease duration.
+	RetryPeriod time.Duration
+
+	mu sync.Mutex
+	// held is set from the start of Lock until Unlock, so that a second
+	// Lock cannot start a second renewal.
+	held   bool
+	cancel context.CancelFunc
+	done   chan struct{}
+	lost   chan struct{}
+}
+
+// NewMutex returns a Mutex on top of lock.
+func NewMutex(lock *Lock) *Mutex {
+	return &Mutex{lock: lock}
+}
+
+// Lock blocks until the mutex is acquired or ctx is done, and returns the
+// fencing token of the acquisition. It fails if the mutex is already locked
+// or being locked.
+func (m *Mutex) Lock(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	if m.held {
+		m.mu.Unlock()
+		return 0, fmt.Errorf("bloblease: lock of locked mutex %s", m.lock.Name())
+	}
+	m.held = true
+	m.mu.Unlock()
+
+	retry := m.RetryPeriod
+	if retry <= 0 {
+		retry = m.lock.LeaseDuration() / 3
+	}
+
+	for {
+		ok, err := m.lock.TryAcquire()
+		if err != nil {
+			glog.Warningf("bloblease: acquiring %s: %v", m.lock.Name(), err)
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			m.mu.Lock()
+			m.held = false
+			m.mu.Unlock()
+			return 0, ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+
+	renewCtx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	m.lost = make(chan struct{})
+	done, lost := m.done, m.lost
+	m.mu.Unlock()
+
+	go m.renew(renewCtx, done, lost)
+	return m.lock.Token(), nil
+}
+
+// Lost returns a channel that is closed when the lease of the current
+// acquisition could not be renewed. It returns nil if the mutex is not locked.
+func (m *Mutex) Lost() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lost
+}
+
+// Unlock stops renewing and releases the lease.
+func (m *Mutex) Unlock() error {
+	m.mu.Lock()
+	cancel, done := m.cancel, m.done
+	if cancel != nil {
+		m.held = false
+		m.cancel, m.done, m.lost = nil, nil, nil
+	}
+	m.mu.Unlock()
+
+	if cancel == nil {
+		return fmt.Errorf("bloblease: unlock of unlocked mutex %s", m.lock.Name())
+	}
+	cancel()
+	<-done
+	return m.lock.Release()
+}
+
+func (m *Mutex) renew(ctx context.Context, done, lost chan struct{}) {
+	defer close(done)
+
+	duration := m.lock.LeaseDuration()
+	ticker := time.NewTicker(duration / 6)
+	defer ticker.Stop()
+	lastRenew := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Since(lastRenew) < duration/3 {
+			continue
+		}
+		err := m.lock.Renew()
+		if err == nil {
+			lastRenew = time.Now()
+			continue
+		}
+		// Transient failures are retried until the lease is about to
+		// expire; a lease taken by someone else is lost right away.
+		if m.lock.Held() && time.Since(lastRenew) < duration*2/3 {
+			glog.Warningf("bloblease: renewing %s: %v", m.lock.Name(), err)
+			continue
+		}
+		glog.Errorf("bloblease: lost %s: %v", m.lock.Name(), err)
+		close(lost)
+		return
+	}
+}
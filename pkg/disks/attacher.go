@@ -0,0 +1,489 @@
+// Package disks attaches data disks to the VMs of nodes and detaches them,
+// for the volumes of pods. Both managed disks, given by resource ID, and
+// unmanaged disks, given by the URI of their VHD blob, are supported, on VMs
+// and on scale set VMs.
+//
+// Attaching a disk rewrites the data disks of the whole VM, so two volumes
+// attached to one node at the same time would each drop the disk of the
+// other. An Attacher therefore serializes the operations on each VM, and
+// picks the lowest logical unit number (LUN) the VM has free.
+package disks
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/resourceid"
+)
+
+const (
+	defaultPollInterval = 5 * time.Second
+	defaultTimeout      = 10 * time.Minute
+
+	computeProvider     = "Microsoft.Compute"
+	scaleSetsType       = "virtualMachineScaleSets"
+	disksType           = "disks"
+	virtualMachinesType = "virtualMachines"
+
+	provisioningSucceeded = "Succeeded"
+	provisioningFailed    = "Failed"
+)
+
+// Disk is a data disk to attach.
+type Disk struct {
+	// Name is the name of the disk on the VM. It defaults to the name of the
+	// managed disk and is required for VHDs.
+	Name string
+	// ManagedDiskID is the resource ID of a managed disk, as the disks of
+	// disk.DisksClient have.
+	ManagedDiskID string
+	// VHDURI is the URI of the page blob of an unmanaged disk.
+	VHDURI string
+	// Caching is the host caching of the disk. It defaults to None.
+	Caching compute.CachingTypes
+}
+
+// VirtualMachinesClient is the subset of compute.VirtualMachinesClient the
+// Attacher uses.
+type VirtualMachinesClient interface {
+	Get(resourceGroupName string, VMName string, expand compute.InstanceViewTypes) (compute.VirtualMachine, error)
+	CreateOrUpdate(resourceGroupName string, VMName string, parameters compute.VirtualMachine, cancel <-chan struct{}) (<-chan compute.VirtualMachine, <-chan error)
+}
+
+var _ VirtualMachinesClient = compute.VirtualMachinesClient{}
+
+// VirtualMachineScaleSetVMsClient is the subset of ScaleSetVMsClient the
+// Attacher uses.
+type VirtualMachineScaleSetVMsClient interface {
+	Get(resourceGroupName string, VMScaleSetName string, instanceID string) (compute.VirtualMachineScaleSetVM, error)
+	Update(resourceGroupName string, VMScaleSetName string, instanceID string, parameters compute.VirtualMachineScaleSetVM, cancel <-chan struct{}) (<-chan compute.VirtualMachineScaleSetVM, <-chan error)
+}
+
+var _ VirtualMachineScaleSetVMsClient = ScaleSetVMsClient{}
+
+// VirtualMachineSizesClient is the subset of
+// compute.VirtualMachineSizesClient the Attacher uses.
+type VirtualMachineSizesClient interface {
+	List(location string) (compute.VirtualMachineSizeListResult, error)
+}
+
+var _ VirtualMachineSizesClient = compute.VirtualMachineSizesClient{}
+
+// Config configures an Attacher.
+type Config struct {
+	VirtualMachines VirtualMachinesClient
+	// ScaleSetVMs, if set, attaches disks to scale set VMs. Stamps whose
+	// compute API version predates 2017-12-01 cannot update scale set VMs
+	// one by one; there AttachDisk and DetachDisk return
+	// ErrScaleSetVMUpdateUnsupported for them.
+	ScaleSetVMs VirtualMachineScaleSetVMsClient
+	// Sizes tells how many data disks each VM size takes.
+	Sizes VirtualMachineSizesClient
+	// PollInterval is how often a VM still updating after a change is read
+	// again. It defaults to 5s.
+	PollInterval time.Duration
+	// Timeout bounds the wait for a VM to finish updating. It defaults to
+	// 10m.
+	Timeout time.Duration
+}
+
+// Attacher attaches data disks to VMs and detaches them.
+type Attacher struct {
+	config Config
+
+	// mu guards locks, which holds a lock per VM.
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+
+	// sizesMu guards maxDisks, the number of data disks of VM sizes, by
+	// location and size.
+	sizesMu  sync.Mutex
+	maxDisks map[string]int32
+}
+
+// NewAttacher validates config and returns an Attacher.
+func NewAttacher(config Config) (*Attacher, error) {
+	if config.VirtualMachines == nil || config.Sizes == nil {
+		return nil, fmt.Errorf("disks: virtual machine and size clients are required")
+	}
+	if config.PollInterval == 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	return &Attacher{
+		config:   config,
+		locks:    map[string]*sync.Mutex{},
+		maxDisks: map[string]int32{},
+	}, nil
+}
+
+// AttachDisk attaches disk to the VM vmID, a VM or scale set VM resource
+// ID, at the lowest free LUN, and returns the LUN once the VM has finished
+// updating. A disk that is already attached keeps its LUN.
+func (a *Attacher) AttachDisk(vmID string, disk Disk) (int32, error) {
+	if err := disk.validate(); err != nil {
+		return 0, err
+	}
+	id, err := a.parseVMID(vmID)
+	if err != nil {
+		return 0, err
+	}
+	defer a.lock(id)()
+
+	m, err := a.get(id)
+	if err != nil {
+		return 0, err
+	}
+	disks := m.dataDisks()
+	name := disk.name()
+	used := map[int32]bool{}
+	for _, d := range disks {
+		if diskMatches(d, disk.ManagedDiskID) || diskMatches(d, disk.VHDURI) {
+			if d.Lun == nil {
+				return 0, fmt.Errorf("disks: disk %s is attached to VM %s without a LUN", name, id.Name())
+			}
+			glog.V(2).Infof("disks: disk %s is already attached to VM %s at LUN %d", name, id.Name(), *d.Lun)
+			return *d.Lun, nil
+		}
+		if d.Name != nil && strings.EqualFold(*d.Name, name) {
+			return 0, fmt.Errorf("disks: VM %s already has another disk named %s", id.Name(), name)
+		}
+		if d.Lun != nil {
+			used[*d.Lun] = true
+		}
+	}
+
+	max, err := a.maxDataDisks(m.location(), m.size())
+	if err != nil {
+		return 0, err
+	}
+	lun := int32(-1)
+	for l := int32(0); l < max; l++ {
+		if !used[l] {
+			lun = l
+			break
+		}
+	}
+	if lun < 0 {
+		return 0, fmt.Errorf("disks: VM %s has all %d data disks of size %s attached", id.Name(), max, m.size())
+	}
+
+	caching := disk.Caching
+	if caching == "" {
+		caching = compute.CachingTypesNone
+	}
+	d := compute.DataDisk{
+		Name:         &name,
+		Lun:          &lun,
+		Caching:      caching,
+		CreateOption: compute.DiskCreateOptionTypesAttach,
+	}
+	if disk.ManagedDiskID != "" {
+		diskID := disk.ManagedDiskID
+		d.ManagedDisk = &compute.ManagedDiskParameters{ID: &diskID}
+	} else {
+		uri := disk.VHDURI
+		d.Vhd = &compute.VirtualHardDisk{URI: &uri}
+	}
+	glog.V(2).Infof("disks: attaching disk %s to VM %s at LUN %d", name, id.Name(), lun)
+	if err := a.update(m, append(disks, d)); err == ErrScaleSetVMUpdateUnsupported {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("disks: attaching disk %s to VM %s: %v", name, id.Name(), err)
+	}
+	return lun, nil
+}
+
+// DetachDisk detaches the disk with the name, managed disk ID or VHD URI
+// nameOrURI from the VM vmID and waits for the VM to finish updating. A
+// disk that is not attached is left as is.
+func (a *Attacher) DetachDisk(vmID string, nameOrURI string) error {
+	if nameOrURI == "" {
+		return fmt.Errorf("disks: a disk name or URI is required")
+	}
+	id, err := a.parseVMID(vmID)
+	if err != nil {
+		return err
+	}
+	defer a.lock(id)()
+
+	m, err := a.get(id)
+	if err != nil {
+		return err
+	}
+	disks := []compute.DataDisk{}
+	found := false
+	for _, d := range m.dataDisks() {
+		if diskMatches(d, nameOrURI) || d.Name != nil && strings.EqualFold(*d.Name, nameOrURI) {
+			found = true
+			continue
+		}
+		disks = append(disks, d)
+	}
+	if !found {
+		glog.V(2).Infof("disks: disk %s is not attached to VM %s", nameOrURI, id.Name())
+		return nil
+	}
+	glog.V(2).Infof("disks: detaching disk %s from VM %s", nameOrURI, id.Name())
+	if err := a.update(m, disks); err == ErrScaleSetVMUpdateUnsupported {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("disks: detaching disk %s from VM %s: %v", nameOrURI, id.Name(), err)
+	}
+	return nil
+}
+
+// parseVMID parses the resource ID of a VM or scale set VM.
+func (a *Attacher) parseVMID(vmID string) (resourceid.ID, error) {
+	id, err := resourceid.Parse(vmID)
+	if err != nil {
+		return resourceid.ID{}, err
+	}
+	if id.ResourceGroup == "" || !strings.EqualFold(id.Provider(), computeProvider) || !strings.EqualFold(id.Resources[len(id.Resources)-1].Type, virtualMachinesType) {
+		return resourceid.ID{}, fmt.Errorf("disks: %s is not the ID of a VM", vmID)
+	}
+	if _, ok := id.NameOf(scaleSetsType); ok && a.config.ScaleSetVMs == nil {
+		return resourceid.ID{}, fmt.Errorf("disks: %s is a scale set VM but no scale set VM client is configured", vmID)
+	}
+	return id, nil
+}
+
+// lock locks the VM id and returns the function unlocking it.
+func (a *Attacher) lock(id resourceid.ID) func() {
+	a.mu.Lock()
+	l, ok := a.locks[id.Key()]
+	if !ok {
+		l = &sync.Mutex{}
+		a.locks[id.Key()] = l
+	}
+	a.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// maxDataDisks returns the number of data disks VMs of the size take.
+func (a *Attacher) maxDataDisks(location, size string) (int32, error) {
+	key := strings.ToLower(location + "/" + size)
+	a.sizesMu.Lock()
+	defer a.sizesMu.Unlock()
+	if max, ok := a.maxDisks[key]; ok {
+		return max, nil
+	}
+
+	result, err := a.config.Sizes.List(location)
+	if err != nil {
+		return 0, fmt.Errorf("disks: listing VM sizes of location %s: %v", location, err)
+	}
+	if result.Value != nil {
+		for _, s := range *result.Value {
+			if s.Name != nil && s.MaxDataDiskCount != nil {
+				a.maxDisks[strings.ToLower(location+"/"+*s.Name)] = *s.MaxDataDiskCount
+			}
+		}
+	}
+	max, ok := a.maxDisks[key]
+	if !ok {
+		return 0, fmt.Errorf("disks: location %s has no VM size %s", location, size)
+	}
+	return max, nil
+}
+
+// machine is a VM or a scale set VM.
+type machine struct {
+	id         resourceid.ID
+	vm         *compute.VirtualMachine
+	scaleSetVM *compute.VirtualMachineScaleSetVM
+}
+
+func (a *Attacher) get(id resourceid.ID) (machine, error) {
+	m := machine{id: id}
+	if scaleSet, ok := id.NameOf(scaleSetsType); ok {
+		vm, err := a.config.ScaleSetVMs.Get(id.ResourceGroup, scaleSet, id.Name())
+		if err != nil {
+			return machine{}, fmt.Errorf("disks: getting VM %s of scale set %s: %v", id.Name(), scaleSet, err)
+		}
+		m.scaleSetVM = &vm
+	} else {
+		vm, err := a.config.VirtualMachines.Get(id.ResourceGroup, id.Name(), "")
+		if err != nil {
+			return machine{}, fmt.Errorf("disks: getting VM %s: %v", id.Name(), err)
+		}
+		m.vm = &vm
+	}
+	if m.storageProfile() == nil {
+		return machine{}, fmt.Errorf("disks: VM %s has no storage profile", id.Name())
+	}
+	return m, nil
+}
+
+// update writes the data disks disks to the VM of m and waits for it to
+// finish updating.
+func (a *Attacher) update(m machine, disks []compute.DataDisk) error {
+	// The VM is sent as read with only its data disks replaced: a PUT
+	// replaces what it leaves out, and a VM without its network or OS
+	// profile is turned down or, worse, changed.
+	var state string
+	if m.scaleSetVM != nil {
+		scaleSet, _ := m.id.NameOf(scaleSetsType)
+		vm := *m.scaleSetVM
+		props := *vm.VirtualMachineScaleSetVMProperties
+		storage := *props.StorageProfile
+		storage.DataDisks = &disks
+		props.StorageProfile = &storage
+		// Leave out what the service computes.
+		props.InstanceView = nil
+		props.ProvisioningState = nil
+		vm.VirtualMachineScaleSetVMProperties = &props
+		vm.Resources = nil
+		resultc, errc := a.config.ScaleSetVMs.Update(m.id.ResourceGroup, scaleSet, m.id.Name(), vm, nil)
+		if err := <-errc; err != nil {
+			return err
+		}
+		updated := <-resultc
+		state = machine{scaleSetVM: &updated}.provisioningState()
+	} else {
+		vm := *m.vm
+		props := *vm.VirtualMachineProperties
+		storage := *props.StorageProfile
+		storage.DataDisks = &disks
+		props.StorageProfile = &storage
+		props.InstanceView = nil
+		props.ProvisioningState = nil
+		vm.VirtualMachineProperties = &props
+		vm.Resources = nil
+		resultc, errc := a.config.VirtualMachines.CreateOrUpdate(m.id.ResourceGroup, m.id.Name(), vm, nil)
+		if err := <-errc; err != nil {
+			return err
+		}
+		updated := <-resultc
+		state = machine{vm: &updated}.provisioningState()
+	}
+	return a.waitProvisioned(m.id, state)
+}
+
+// waitProvisioned waits for the VM id, last seen in the provisioning state
+// state, to finish updating.
+func (a *Attacher) waitProvisioned(id resourceid.ID, state string) error {
+	deadline := time.Now().Add(a.config.Timeout)
+	for {
+		switch {
+		case strings.EqualFold(state, provisioningSucceeded):
+			return nil
+		case strings.EqualFold(state, provisioningFailed):
+			return fmt.Errorf("VM %s failed to provision", id.Name())
+		case time.Now().After(deadline):
+			return fmt.Errorf("VM %s is still %s after %v", id.Name(), state, a.config.Timeout)
+		}
+		glog.V(2).Infof("disks: waiting for VM %s, which is %s", id.Name(), state)
+		time.Sleep(a.config.PollInterval)
+		m, err := a.get(id)
+		if err != nil {
+			return err
+		}
+		state = m.provisioningState()
+	}
+}
+
+func (m machine) storageProfile() *compute.StorageProfile {
+	if m.scaleSetVM != nil {
+		if m.scaleSetVM.VirtualMachineScaleSetVMProperties == nil {
+			return nil
+		}
+		return m.scaleSetVM.StorageProfile
+	}
+	if m.vm == nil || m.vm.VirtualMachineProperties == nil {
+		return nil
+	}
+	return m.vm.StorageProfile
+}
+
+func (m machine) dataDisks() []compute.DataDisk {
+	profile := m.storageProfile()
+	if profile == nil || profile.DataDisks == nil {
+		return []compute.DataDisk{}
+	}
+	return append([]compute.DataDisk{}, *profile.DataDisks...)
+}
+
+func (m machine) location() string {
+	if m.scaleSetVM != nil && m.scaleSetVM.Location != nil {
+		return *m.scaleSetVM.Location
+	}
+	if m.vm != nil && m.vm.Location != nil {
+		return *m.vm.Location
+	}
+	return ""
+}
+
+// size returns the VM size, which scale set VMs have as their SKU.
+func (m machine) size() string {
+	if m.scaleSetVM != nil {
+		if m.scaleSetVM.Sku != nil && m.scaleSetVM.Sku.Name != nil {
+			return *m.scaleSetVM.Sku.Name
+		}
+		if m.scaleSetVM.VirtualMachineScaleSetVMProperties != nil && m.scaleSetVM.HardwareProfile != nil {
+			return string(m.scaleSetVM.HardwareProfile.VMSize)
+		}
+		return ""
+	}
+	if m.vm != nil && m.vm.VirtualMachineProperties != nil && m.vm.HardwareProfile != nil {
+		return string(m.vm.HardwareProfile.VMSize)
+	}
+	return ""
+}
+
+func (m machine) provisioningState() string {
+	if m.scaleSetVM != nil && m.scaleSetVM.VirtualMachineScaleSetVMProperties != nil && m.scaleSetVM.ProvisioningState != nil {
+		return *m.scaleSetVM.ProvisioningState
+	}
+	if m.vm != nil && m.vm.VirtualMachineProperties != nil && m.vm.ProvisioningState != nil {
+		return *m.vm.ProvisioningState
+	}
+	return ""
+}
+
+func (disk Disk) validate() error {
+	if (disk.ManagedDiskID == "") == (disk.VHDURI == "") {
+		return fmt.Errorf("disks: exactly one of a managed disk ID and a VHD URI is required")
+	}
+	if disk.ManagedDiskID != "" {
+		id, err := resourceid.Parse(disk.ManagedDiskID)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(id.Type(), computeProvider+"/"+disksType) {
+			return fmt.Errorf("disks: %s is not the ID of a managed disk", disk.ManagedDiskID)
+		}
+	}
+	if disk.VHDURI != "" && disk.Name == "" {
+		return fmt.Errorf("disks: VHD %s needs a name", disk.VHDURI)
+	}
+	return nil
+}
+
+// name returns the name of disk on the VM.
+func (disk Disk) name() string {
+	if disk.Name != "" {
+		return disk.Name
+	}
+	id, _ := resourceid.Parse(disk.ManagedDiskID)
+	return id.Name()
+}
+
+// diskMatches reports whether the data disk d is the managed disk or VHD
+// uri.
+func diskMatches(d compute.DataDisk, uri string) bool {
+	if uri == "" {
+		return false
+	}
+	if d.ManagedDisk != nil && d.ManagedDisk.ID != nil && strings.EqualFold(*d.ManagedDisk.ID, uri) {
+		return true
+	}
+	return d.Vhd != nil && d.Vhd.URI != nil && strings.EqualFold(*d.Vhd.URI, uri)
+}
@@ -0,0 +1,170 @@
+package disks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+)
+
+const (
+	testVMID         = "/subscriptions/sub/resourceGroups/group/providers/Microsoft.Compute/virtualMachines/node-0"
+	testScaleSetVMID = "/subscriptions/sub/resourceGroups/group/providers/Microsoft.Compute/virtualMachineScaleSets/pool/virtualMachines/3"
+	testDiskID       = "/subscriptions/sub/resourceGroups/group/providers/Microsoft.Compute/disks/data-0"
+)
+
+func stringPtr(s string) *string { return &s }
+
+func int32Ptr(i int32) *int32 { return &i }
+
+// fakeVMs holds one VM and records what updates send.
+type fakeVMs struct {
+	vm   compute.VirtualMachine
+	sent []compute.VirtualMachine
+}
+
+func (f *fakeVMs) Get(resourceGroupName string, VMName string, expand compute.InstanceViewTypes) (compute.VirtualMachine, error) {
+	return f.vm, nil
+}
+
+func (f *fakeVMs) CreateOrUpdate(resourceGroupName string, VMName string, parameters compute.VirtualMachine, cancel <-chan struct{}) (<-chan compute.VirtualMachine, <-chan error) {
+	f.sent = append(f.sent, parameters)
+	f.vm.StorageProfile.DataDisks = parameters.StorageProfile.DataDisks
+	resultc, errc := make(chan compute.VirtualMachine, 1), make(chan error, 1)
+	resultc <- f.vm
+	close(errc)
+	return resultc, errc
+}
+
+// fakeScaleSetVMs holds one scale set VM and records what updates send.
+type fakeScaleSetVMs struct {
+	vm   compute.VirtualMachineScaleSetVM
+	err  error
+	sent []compute.VirtualMachineScaleSetVM
+}
+
+func (f *fakeScaleSetVMs) Get(resourceGroupName string, VMScaleSetName string, instanceID string) (compute.VirtualMachineScaleSetVM, error) {
+	return f.vm, nil
+}
+
+func (f *fakeScaleSetVMs) Update(resourceGroupName string, VMScaleSetName string, instanceID string, parameters compute.VirtualMachineScaleSetVM, cancel <-chan struct{}) (<-chan compute.VirtualMachineScaleSetVM, <-chan error) {
+	resultc, errc := make(chan compute.VirtualMachineScaleSetVM, 1), make(chan error, 1)
+	if f.err != nil {
+		errc <- f.err
+	} else {
+		f.sent = append(f.sent, parameters)
+		f.vm.StorageProfile.DataDisks = parameters.StorageProfile.DataDisks
+	}
+	resultc <- f.vm
+	close(errc)
+	return resultc, errc
+}
+
+type fakeSizes struct{}
+
+func (fakeSizes) List(location string) (compute.VirtualMachineSizeListResult, error) {
+	return compute.VirtualMachineSizeListResult{Value: &[]compute.VirtualMachineSize{
+		{Name: stringPtr("Standard_D2_v2"), MaxDataDiskCount: int32Ptr(8)},
+	}}, nil
+}
+
+func newTestAttacher(t *testing.T) (*Attacher, *fakeVMs, *fakeScaleSetVMs) {
+	storageProfile := func() *compute.StorageProfile {
+		return &compute.StorageProfile{
+			ImageReference: &compute.ImageReference{Publisher: stringPtr("Canonical"), Offer: stringPtr("UbuntuServer"), Sku: stringPtr("16.04-LTS")},
+			OsDisk:         &compute.OSDisk{Name: stringPtr("os")},
+		}
+	}
+	osProfile := &compute.OSProfile{ComputerName: stringPtr("node-0"), AdminUsername: stringPtr("azureuser")}
+	networkProfile := &compute.NetworkProfile{NetworkInterfaces: &[]compute.NetworkInterfaceReference{{ID: stringPtr("nic-0")}}}
+	vms := &fakeVMs{vm: compute.VirtualMachine{
+		Location: stringPtr("local"),
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			HardwareProfile:   &compute.HardwareProfile{VMSize: compute.VirtualMachineSizeTypesStandardD2V2},
+			StorageProfile:    storageProfile(),
+			OsProfile:         osProfile,
+			NetworkProfile:    networkProfile,
+			InstanceView:      &compute.VirtualMachineInstanceView{},
+			ProvisioningState: stringPtr(provisioningSucceeded),
+		},
+	}}
+	scaleSetVMs := &fakeScaleSetVMs{vm: compute.VirtualMachineScaleSetVM{
+		Location: stringPtr("local"),
+		Sku:      &compute.Sku{Name: stringPtr("Standard_D2_v2")},
+		VirtualMachineScaleSetVMProperties: &compute.VirtualMachineScaleSetVMProperties{
+			HardwareProfile:   &compute.HardwareProfile{VMSize: compute.VirtualMachineSizeTypesStandardD2V2},
+			StorageProfile:    storageProfile(),
+			OsProfile:         osProfile,
+			NetworkProfile:    networkProfile,
+			InstanceView:      &compute.VirtualMachineInstanceView{},
+			ProvisioningState: stringPtr(provisioningSucceeded),
+		},
+	}}
+	a, err := NewAttacher(Config{
+		VirtualMachines: vms,
+		ScaleSetVMs:     scaleSetVMs,
+		Sizes:           fakeSizes{},
+		PollInterval:    time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, vms, scaleSetVMs
+}
+
+func TestAttachDiskKeepsTheRestOfTheVM(t *testing.T) {
+	a, vms, scaleSetVMs := newTestAttacher(t)
+	for _, vmID := range []string{testVMID, testScaleSetVMID} {
+		lun, err := a.AttachDisk(vmID, Disk{ManagedDiskID: testDiskID})
+		if err != nil || lun != 0 {
+			t.Fatalf("AttachDisk(%s) = %d, %v", vmID, lun, err)
+		}
+	}
+	if len(vms.sent) != 1 || len(scaleSetVMs.sent) != 1 {
+		t.Fatalf("sent %d VM and %d scale set VM updates, want one each", len(vms.sent), len(scaleSetVMs.sent))
+	}
+	vm, scaleSetVM := vms.sent[0], scaleSetVMs.sent[0]
+	if scaleSetVM.Sku == nil {
+		t.Errorf("scale set VM update lacks the SKU")
+	}
+	for _, tt := range []struct {
+		name     string
+		hardware *compute.HardwareProfile
+		storage  *compute.StorageProfile
+		os       *compute.OSProfile
+		network  *compute.NetworkProfile
+		view     *compute.VirtualMachineInstanceView
+	}{
+		{"VM", vm.HardwareProfile, vm.StorageProfile, vm.OsProfile, vm.NetworkProfile, vm.InstanceView},
+		{"scale set VM", scaleSetVM.HardwareProfile, scaleSetVM.StorageProfile, scaleSetVM.OsProfile, scaleSetVM.NetworkProfile, scaleSetVM.InstanceView},
+	} {
+		if tt.hardware == nil || tt.os == nil || tt.network == nil {
+			t.Errorf("%s update lacks the hardware, OS or network profile", tt.name)
+		}
+		if tt.storage.ImageReference == nil || tt.storage.OsDisk == nil {
+			t.Errorf("%s update lacks the image reference or the OS disk", tt.name)
+		}
+		if tt.view != nil {
+			t.Errorf("%s update carries the instance view", tt.name)
+		}
+		if disks := tt.storage.DataDisks; disks == nil || len(*disks) != 1 || *(*disks)[0].Name != "data-0" || *(*disks)[0].Lun != 0 {
+			t.Errorf("%s data disks %v, want data-0 at LUN 0", tt.name, disks)
+		}
+	}
+	// What was read is left as is.
+	if a.config.VirtualMachines.(*fakeVMs).vm.InstanceView == nil {
+		t.Errorf("the VM read lost its instance view")
+	}
+}
+
+func TestScaleSetVMUpdateUnsupported(t *testing.T) {
+	a, _, scaleSetVMs := newTestAttacher(t)
+	scaleSetVMs.err = ErrScaleSetVMUpdateUnsupported
+	if _, err := a.AttachDisk(testScaleSetVMID, Disk{ManagedDiskID: testDiskID}); err != ErrScaleSetVMUpdateUnsupported {
+		t.Errorf("AttachDisk() = %v, want %v", err, ErrScaleSetVMUpdateUnsupported)
+	}
+	scaleSetVMs.vm.StorageProfile.DataDisks = &[]compute.DataDisk{{Name: stringPtr("data-0"), Lun: int32Ptr(0)}}
+	if err := a.DetachDisk(testScaleSetVMID, "data-0"); err != ErrScaleSetVMUpdateUnsupported {
+		t.Errorf("DetachDisk() = %v, want %v", err, ErrScaleSetVMUpdateUnsupported)
+	}
+}
@@ -0,0 +1,112 @@
+package disks
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+)
+
+// minScaleSetVMAPIVersion is the first compute API version that updates the
+// VMs of a scale set one by one, which the vendored SDK predates.
+const minScaleSetVMAPIVersion = "2017-12-01"
+
+// ErrScaleSetVMUpdateUnsupported is returned when the compute API version
+// of the stamp lacks updates of single scale set VMs.
+var ErrScaleSetVMUpdateUnsupported = errors.New("disks: the compute API version of the stamp lacks updates of single scale set VMs, which need " + minScaleSetVMAPIVersion + " or later")
+
+// ScaleSetVMsClient adds Update to compute.VirtualMachineScaleSetVMsClient.
+type ScaleSetVMsClient struct {
+	compute.VirtualMachineScaleSetVMsClient
+	// APIVersion is the compute API version of the stamp. It defaults to
+	// compute.APIVersion.
+	APIVersion string
+}
+
+// Update updates the scale set VM instanceID, e.g. its data disks. It
+// fails with ErrScaleSetVMUpdateUnsupported on compute API versions before
+// 2017-12-01. This method may poll for completion. Polling can be canceled
+// by passing the cancel channel argument.
+func (client ScaleSetVMsClient) Update(resourceGroupName string, VMScaleSetName string, instanceID string, parameters compute.VirtualMachineScaleSetVM, cancel <-chan struct{}) (<-chan compute.VirtualMachineScaleSetVM, <-chan error) {
+	resultChan := make(chan compute.VirtualMachineScaleSetVM, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		var err error
+		var result compute.VirtualMachineScaleSetVM
+		defer func() {
+			if err != nil {
+				errChan <- err
+			}
+			resultChan <- result
+			close(resultChan)
+			close(errChan)
+		}()
+		// API versions are dates, which compare as strings.
+		if client.apiVersion() < minScaleSetVMAPIVersion {
+			err = ErrScaleSetVMUpdateUnsupported
+			return
+		}
+		req, err := client.updatePreparer(resourceGroupName, VMScaleSetName, instanceID, parameters, cancel)
+		if err != nil {
+			err = autorest.NewErrorWithError(err, "disks.ScaleSetVMsClient", "Update", nil, "Failure preparing request")
+			return
+		}
+
+		resp, err := autorest.SendWithSender(client, req, azure.DoPollForAsynchronous(client.PollingDelay))
+		if err != nil {
+			result.Response = autorest.Response{Response: resp}
+			err = autorest.NewErrorWithError(err, "disks.ScaleSetVMsClient", "Update", resp, "Failure sending request")
+			if apierror.IsUnsupported(err) {
+				err = ErrScaleSetVMUpdateUnsupported
+			}
+			return
+		}
+
+		err = autorest.Respond(
+			resp,
+			client.ByInspecting(),
+			azure.WithErrorUnlessStatusCode(http.StatusOK, http.StatusAccepted),
+			autorest.ByUnmarshallingJSON(&result),
+			autorest.ByClosing())
+		result.Response = autorest.Response{Response: resp}
+		if err != nil {
+			err = autorest.NewErrorWithError(err, "disks.ScaleSetVMsClient", "Update", resp, "Failure responding to request")
+			if apierror.IsUnsupported(err) {
+				err = ErrScaleSetVMUpdateUnsupported
+			}
+		}
+	}()
+	return resultChan, errChan
+}
+
+func (client ScaleSetVMsClient) updatePreparer(resourceGroupName string, VMScaleSetName string, instanceID string, parameters compute.VirtualMachineScaleSetVM, cancel <-chan struct{}) (*http.Request, error) {
+	pathParameters := map[string]interface{}{
+		"instanceId":        autorest.Encode("path", instanceID),
+		"resourceGroupName": autorest.Encode("path", resourceGroupName),
+		"subscriptionId":    autorest.Encode("path", client.SubscriptionID),
+		"vmScaleSetName":    autorest.Encode("path", VMScaleSetName),
+	}
+
+	queryParameters := map[string]interface{}{
+		"api-version": client.apiVersion(),
+	}
+
+	preparer := autorest.CreatePreparer(
+		autorest.AsJSON(),
+		autorest.AsPut(),
+		autorest.WithBaseURL(client.BaseURI),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Compute/virtualMachineScaleSets/{vmScaleSetName}/virtualmachines/{instanceId}", pathParameters),
+		autorest.WithJSON(parameters),
+		autorest.WithQueryParameters(queryParameters))
+	return preparer.Prepare(&http.Request{Cancel: cancel})
+}
+
+func (client ScaleSetVMsClient) apiVersion() string {
+	if client.APIVersion == "" {
+		return compute.APIVersion
+	}
+	return client.APIVersion
+}
@@ -0,0 +1,50 @@
+package disks
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+)
+
+func TestScaleSetVMsClientUpdate(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		apiVersion string
+		status     int
+		body       string
+		sent       bool
+		err        error
+	}{
+		{"default API version", "", http.StatusOK, `{}`, false, ErrScaleSetVMUpdateUnsupported},
+		{"old API version", "2016-03-30", http.StatusOK, `{}`, false, ErrScaleSetVMUpdateUnsupported},
+		{"updated", "2017-12-01", http.StatusOK, `{"name":"1"}`, true, nil},
+		{"unknown API version", "2017-12-01", http.StatusBadRequest, `{"error":{"code":"InvalidApiVersionParameter","message":"The api-version '2017-12-01' is invalid."}}`, true, ErrScaleSetVMUpdateUnsupported},
+	} {
+		var apiVersions []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiVersions = append(apiVersions, r.URL.Query().Get("api-version"))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(tt.status)
+			io.WriteString(w, tt.body)
+		}))
+		client := ScaleSetVMsClient{
+			VirtualMachineScaleSetVMsClient: compute.NewVirtualMachineScaleSetVMsClientWithBaseURI(server.URL, "sub"),
+			APIVersion:                      tt.apiVersion,
+		}
+		_, errc := client.Update("group", "pool", "1", compute.VirtualMachineScaleSetVM{}, nil)
+		err := <-errc
+		server.Close()
+
+		if tt.err != nil && err != tt.err || tt.err == nil && err != nil {
+			t.Errorf("%s: Update() = %v, want %v", tt.name, err, tt.err)
+		}
+		if sent := len(apiVersions) > 0; sent != tt.sent {
+			t.Errorf("%s: sent %d requests, want any %v", tt.name, len(apiVersions), tt.sent)
+		} else if sent && apiVersions[0] != tt.apiVersion {
+			t.Errorf("%s: sent API version %s, want %s", tt.name, apiVersions[0], tt.apiVersion)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package disktransfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/internal/pageranges"
+)
+
+const (
+	// A VHD ends with a 512 byte footer that starts with vhdCookie and
+	// gives the disk type, big endian, at vhdDiskTypeOffset.
+	vhdFooterSize     = 512
+	vhdCookie         = "conectix"
+	vhdDiskTypeOffset = 60
+	vhdFixed          = 2
+	// vhdAlignment is the alignment managed disks require of the virtual
+	// size of a VHD, its size without the footer.
+	vhdAlignment = 1024 * 1024
+
+	partialSuffix = ".partial"
+)
+
+// source is a VHD a transfer reads.
+type source interface {
+	// properties returns the size of the VHD. The Content-MD5 of a page
+	// blob is not read: the service leaves it as it was set, so it is stale
+	// once pages are written, while ranged reads check each range anyway.
+	properties(ctx context.Context) (int64, error)
+	// pageRanges returns the ranges of the VHD that hold data.
+	pageRanges(ctx context.Context) ([]storage.PageRange, error)
+	// readRange reads the range r, which is at most maxChunkSize bytes.
+	readRange(ctx context.Context, r storage.PageRange) ([]byte, error)
+}
+
+// sink is where a transfer writes a VHD.
+type sink interface {
+	// create prepares an empty VHD of size bytes.
+	create(size int64) error
+	// writeAt writes data at off. It is called concurrently.
+	writeAt(off int64, data []byte) error
+	// commit completes the VHD, whose MD5 is md5sum.
+	commit(md5sum string) error
+	// abort removes the incomplete VHD.
+	abort()
+}
+
+// sasSource reads the page blob of a disk through the SAS URL access was
+// granted with. The blob cannot be reached with a storage.Client, which
+// only signs requests with account credentials.
+type sasSource struct {
+	client *http.Client
+	uri    string
+}
+
+func (s *sasSource) properties(ctx context.Context) (int64, error) {
+	resp, err := s.do(ctx, http.MethodHead, nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("disktransfer: getting properties of the disk blob: %v", err)
+	}
+	resp.Body.Close()
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("disktransfer: the disk blob has no valid size: %v", err)
+	}
+	return size, nil
+}
+
+func (s *sasSource) pageRanges(ctx context.Context) ([]storage.PageRange, error) {
+	resp, err := s.do(ctx, http.MethodGet, url.Values{"comp": {"pagelist"}}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("disktransfer: getting page ranges of the disk blob: %v", err)
+	}
+	defer resp.Body.Close()
+	var list storage.GetPageRangesResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("disktransfer: getting page ranges of the disk blob: %v", err)
+	}
+	return list.PageList, nil
+}
+
+func (s *sasSource) readRange(ctx context.Context, r storage.PageRange) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, nil, map[string]string{
+		"x-ms-range":                 fmt.Sprintf("bytes=%d-%d", r.Start, r.End),
+		"x-ms-range-get-content-md5": "true",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("disktransfer: reading %d-%d of the disk blob: %v", r.Start, r.End, err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("disktransfer: reading %d-%d of the disk blob: %v", r.Start, r.End, err)
+	}
+	if err := checkRange(r, data, resp.Header.Get("Content-MD5")); err != nil {
+		return nil, fmt.Errorf("disktransfer: reading the disk blob: %v", err)
+	}
+	return data, nil
+}
+
+// do sends a request for the blob with the query parameters query added to
+// those of the SAS, and fails unless it succeeds.
+func (s *sasSource) do(ctx context.Context, method string, query url.Values, headers map[string]string) (*http.Response, error) {
+	u, err := url.Parse(s.uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAS URL: %v", err)
+	}
+	if len(query) > 0 {
+		q := u.Query()
+		for k, v := range query {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", storage.DefaultAPIVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return resp, nil
+}
+
+// blobSource reads a page blob with a storage.Client.
+type blobSource struct {
+	blob *storage.Blob
+}
+
+func (s *blobSource) properties(ctx context.Context) (int64, error) {
+	if err := s.blob.GetProperties(nil); err != nil {
+		return 0, fmt.Errorf("disktransfer: getting properties of %s: %v", s.blob.Name, err)
+	}
+	return s.blob.Properties.ContentLength, nil
+}
+
+func (s *blobSource) pageRanges(ctx context.Context) ([]storage.PageRange, error) {
+	resp, err := s.blob.GetPageRanges(nil)
+	if err != nil {
+		return nil, fmt.Errorf("disktransfer: getting page ranges of %s: %v", s.blob.Name, err)
+	}
+	return resp.PageList, nil
+}
+
+func (s *blobSource) readRange(ctx context.Context, r storage.PageRange) ([]byte, error) {
+	// Ranged reads update the blob's properties, so each chunk uses its own
+	// reference.
+	b := s.blob.Container.GetBlobReference(s.blob.Name)
+	body, err := b.GetRange(&storage.GetBlobRangeOptions{
+		Range:              &storage.BlobRange{Start: uint64(r.Start), End: uint64(r.End)},
+		GetRangeContentMD5: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("disktransfer: reading %d-%d of %s: %v", r.Start, r.End, b.Name, err)
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("disktransfer: reading %d-%d of %s: %v", r.Start, r.End, b.Name, err)
+	}
+	if err := checkRange(r, data, b.Properties.ContentMD5); err != nil {
+		return nil, fmt.Errorf("disktransfer: reading %s: %v", b.Name, err)
+	}
+	return data, nil
+}
+
+// fileSource reads a local VHD file.
+type fileSource struct {
+	file *os.File
+	size int64
+}
+
+func (s *fileSource) properties(ctx context.Context) (int64, error) {
+	return s.size, nil
+}
+
+// pageRanges returns the whole file, since holes in it cannot be told from
+// zeros. The chunks of zeros are not uploaded though.
+func (s *fileSource) pageRanges(ctx context.Context) ([]storage.PageRange, error) {
+	if s.size == 0 {
+		return nil, nil
+	}
+	return []storage.PageRange{{Start: 0, End: s.size - 1}}, nil
+}
+
+func (s *fileSource) readRange(ctx context.Context, r storage.PageRange) ([]byte, error) {
+	data := make([]byte, r.End-r.Start+1)
+	if _, err := s.file.ReadAt(data, r.Start); err != nil {
+		return nil, fmt.Errorf("disktransfer: reading %d-%d of %s: %v", r.Start, r.End, s.file.Name(), err)
+	}
+	return data, nil
+}
+
+// fileSink writes a local file, through a partial file it renames once
+// complete.
+type fileSink struct {
+	path string
+	file *os.File
+}
+
+func (s *fileSink) create(size int64) error {
+	f, err := os.Create(s.path + partialSuffix)
+	if err != nil {
+		return fmt.Errorf("disktransfer: %v", err)
+	}
+	// Truncating leaves holes the pages without data are never written to.
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("disktransfer: %v", err)
+	}
+	s.file = f
+	return nil
+}
+
+func (s *fileSink) writeAt(off int64, data []byte) error {
+	if _, err := s.file.WriteAt(data, off); err != nil {
+		return fmt.Errorf("disktransfer: %v", err)
+	}
+	return nil
+}
+
+func (s *fileSink) commit(md5sum string) error {
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("disktransfer: %v", err)
+	}
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("disktransfer: %v", err)
+	}
+	if err := os.Rename(s.file.Name(), s.path); err != nil {
+		return fmt.Errorf("disktransfer: %v", err)
+	}
+	return nil
+}
+
+func (s *fileSink) abort() {
+	s.file.Close()
+	if err := os.Remove(s.file.Name()); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("disktransfer: removing %s: %v", s.file.Name(), err)
+	}
+}
+
+// blobSink writes a page blob.
+type blobSink struct {
+	blob *storage.Blob
+}
+
+func (s *blobSink) create(size int64) error {
+	s.blob.Properties.ContentLength = size
+	s.blob.Properties.BlobType = storage.BlobTypePage
+	if err := s.blob.PutPageBlob(nil); err != nil {
+		return fmt.Errorf("disktransfer: creating %s: %v", s.blob.Name, err)
+	}
+	return nil
+}
+
+func (s *blobSink) writeAt(off int64, data []byte) error {
+	b := s.blob.Container.GetBlobReference(s.blob.Name)
+	r := storage.BlobRange{Start: uint64(off), End: uint64(off) + uint64(len(data)) - 1}
+	if err := b.WriteRange(r, bytes.NewReader(data), nil); err != nil {
+		return fmt.Errorf("disktransfer: writing %d-%d of %s: %v", r.Start, r.End, b.Name, err)
+	}
+	return nil
+}
+
+func (s *blobSink) commit(md5sum string) error {
+	s.blob.Properties.ContentMD5 = md5sum
+	if err := s.blob.SetProperties(nil); err != nil {
+		return fmt.Errorf("disktransfer: setting the MD5 of %s: %v", s.blob.Name, err)
+	}
+	return nil
+}
+
+func (s *blobSink) abort() {
+	deleteBlob(s.blob)
+}
+
+func deleteBlob(b *storage.Blob) {
+	if _, err := b.DeleteIfExists(nil); err != nil {
+		glog.Warningf("disktransfer: deleting %s: %v", b.Name, err)
+	}
+}
+
+// checkRange checks that data is all of the range r and, if the service
+// sent the MD5 of the range, that it matches.
+func checkRange(r storage.PageRange, data []byte, md5sum string) error {
+	if int64(len(data)) != r.End-r.Start+1 {
+		return fmt.Errorf("short read of %d-%d: got %d bytes", r.Start, r.End, len(data))
+	}
+	if md5sum == "" {
+		return nil
+	}
+	sum := md5.Sum(data)
+	if got := base64.StdEncoding.EncodeToString(sum[:]); got != md5sum {
+		return fmt.Errorf("range %d-%d has MD5 %s, the service sent %s", r.Start, r.End, got, md5sum)
+	}
+	return nil
+}
+
+// checkVHD checks that r, of size bytes, is a fixed VHD managed disks can
+// be imported from.
+func checkVHD(r io.ReaderAt, size int64) error {
+	if size < vhdFooterSize || size%pageranges.PageSize != 0 {
+		return fmt.Errorf("%d bytes is not the size of a VHD", size)
+	}
+	footer := make([]byte, vhdFooterSize)
+	if _, err := r.ReadAt(footer, size-vhdFooterSize); err != nil {
+		return err
+	}
+	if string(footer[:len(vhdCookie)]) != vhdCookie {
+		return fmt.Errorf("not a VHD, it has no VHD footer")
+	}
+	if t := binary.BigEndian.Uint32(footer[vhdDiskTypeOffset:]); t != vhdFixed {
+		return fmt.Errorf("VHD type %d is not fixed; convert the VHD to a fixed one", t)
+	}
+	if (size-vhdFooterSize)%vhdAlignment != 0 {
+		return fmt.Errorf("virtual size %d is not a whole number of MiB", size-vhdFooterSize)
+	}
+	return nil
+}
@@ -0,0 +1,501 @@
+// Package disktransfer moves managed disks and snapshots between stamps as
+// VHDs. An export grants read access to the disk, which yields a SAS URL of
+// its page blob, reads the pages that hold data in parallel ranged reads into
+// a local file or a page blob of another storage account, and revokes the
+// access again whatever happens. An import uploads a VHD file to a page blob
+// and creates a managed disk from it.
+//
+// Every transfer computes the MD5 of the whole VHD, which is what the
+// Content-MD5 of a blob holds, so the two ends of a move can be compared.
+// Each ranged read is checked against the MD5 the service computes for the
+// range, and uploaded blobs are read back and compared with the MD5 of what
+// was sent before a disk is created from them.
+package disktransfer
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/disk"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+	"github.com/honcao/cloudprovider/pkg/internal/pageranges"
+)
+
+const (
+	// maxChunkSize is the largest body accepted by Put Page and the largest
+	// range the service computes an MD5 for.
+	maxChunkSize = 4 * 1024 * 1024
+
+	defaultConcurrency    = 8
+	defaultAccessDuration = 4 * time.Hour
+	defaultRetries        = 3
+	retryDelay            = 2 * time.Second
+
+	// PhaseCopy is the transfer of a VHD.
+	PhaseCopy = "copy"
+	// PhaseVerify is the read back of an uploaded VHD.
+	PhaseVerify = "verify"
+)
+
+// zeros are hashed for the pages of a VHD that hold no data.
+var zeros = make([]byte, 64*1024)
+
+// AccessClient is the part of disk.DisksClient and disk.SnapshotsClient that
+// grants read access to a disk or snapshot.
+type AccessClient interface {
+	GrantAccess(resourceGroupName string, name string, grantAccessData disk.GrantAccessData, cancel <-chan struct{}) (<-chan disk.AccessURI, <-chan error)
+	RevokeAccess(resourceGroupName string, name string, cancel <-chan struct{}) (<-chan disk.OperationStatusResponse, <-chan error)
+}
+
+var (
+	_ AccessClient = disk.DisksClient{}
+	_ AccessClient = disk.SnapshotsClient{}
+)
+
+// DisksClient is the subset of disk.DisksClient the Transferer uses.
+type DisksClient interface {
+	AccessClient
+	Get(resourceGroupName string, diskName string) (disk.Model, error)
+	CreateOrUpdate(resourceGroupName string, diskName string, diskParameter disk.Model, cancel <-chan struct{}) (<-chan disk.Model, <-chan error)
+}
+
+var _ DisksClient = disk.DisksClient{}
+
+// Progress is reported after every chunk of a transfer.
+type Progress struct {
+	// Phase is PhaseCopy or PhaseVerify.
+	Phase string
+	// Name is the disk, snapshot or file being transferred.
+	Name string
+	// Bytes is the part of the VHD done so far, pages without data
+	// included.
+	Bytes int64
+	// TotalBytes is the size of the VHD.
+	TotalBytes int64
+}
+
+// ProgressFunc receives progress updates. Calls are not concurrent.
+type ProgressFunc func(p Progress)
+
+// Config configures a Transferer.
+type Config struct {
+	Disks DisksClient
+	// Snapshots is needed to export snapshots.
+	Snapshots AccessClient
+	// HTTPClient reads the SAS URLs of disks. It defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client
+	// ChunkSize is the size of each ranged read and write. It is rounded
+	// down to a multiple of 512 and capped at 4 MiB, the default.
+	ChunkSize int64
+	// Concurrency is the number of chunks transferred in parallel. It
+	// defaults to 8.
+	Concurrency int
+	// AccessDuration is how long the SAS URL of an exported disk is valid.
+	// It must cover the whole export and defaults to 4h.
+	AccessDuration time.Duration
+	// OnProgress, if set, is called after every chunk.
+	OnProgress ProgressFunc
+}
+
+// Transferer exports and imports disks.
+type Transferer struct {
+	config Config
+}
+
+// NewTransferer returns a Transferer for config.
+func NewTransferer(config Config) (*Transferer, error) {
+	if config.Disks == nil {
+		return nil, fmt.Errorf("disktransfer: a disks client is required")
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.ChunkSize <= 0 || config.ChunkSize > maxChunkSize {
+		config.ChunkSize = maxChunkSize
+	}
+	config.ChunkSize -= config.ChunkSize % pageranges.PageSize
+	if config.ChunkSize == 0 {
+		config.ChunkSize = pageranges.PageSize
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = defaultConcurrency
+	}
+	if config.AccessDuration <= 0 {
+		config.AccessDuration = defaultAccessDuration
+	}
+	return &Transferer{config: config}, nil
+}
+
+// Source is a managed disk or snapshot to export.
+type Source struct {
+	ResourceGroup string
+	Name          string
+	// Snapshot is set if Name is a snapshot rather than a disk. Disks
+	// must not be attached to a running VM while they are exported, so
+	// exporting a snapshot of a disk in use is the safe way to move it.
+	Snapshot bool
+}
+
+// Target is the managed disk an import creates.
+type Target struct {
+	ResourceGroup string
+	Name          string
+	Location      string
+	// AccountType is the storage of the disk. It defaults to
+	// Standard_LRS.
+	AccountType disk.StorageAccountTypes
+	// StorageAccountID is the resource ID of the storage account holding
+	// the VHD blob, which newer compute API versions require.
+	StorageAccountID string
+	Tags             map[string]string
+}
+
+// Result describes a transferred VHD.
+type Result struct {
+	// Size is the size of the VHD in bytes.
+	Size int64
+	// MD5 is the base64 encoded MD5 of the whole VHD, as in Content-MD5.
+	MD5 string
+}
+
+// ExportToFile exports src into the local file path, which is replaced.
+// The VHD is written to path.partial first and renamed once complete, and
+// pages without data are left as holes in the file.
+func (t *Transferer) ExportToFile(ctx context.Context, src Source, path string) (Result, error) {
+	return t.export(ctx, src, &fileSink{path: path})
+}
+
+// ExportToBlob exports src into the page blob dst, which is replaced and
+// usually lives in another storage account. The MD5 of the VHD is set as the
+// Content-MD5 of dst, and dst is read back and compared with it.
+func (t *Transferer) ExportToBlob(ctx context.Context, src Source, dst *storage.Blob) (Result, error) {
+	result, err := t.export(ctx, src, &blobSink{blob: dst})
+	if err != nil {
+		return Result{}, err
+	}
+	if err := t.verify(ctx, dst, result); err != nil {
+		return Result{}, err
+	}
+	return result, nil
+}
+
+// export grants access to src, copies it into dst and revokes the access.
+func (t *Transferer) export(ctx context.Context, src Source, dst sink) (result Result, err error) {
+	client := AccessClient(t.config.Disks)
+	kind := "disk"
+	if src.Snapshot {
+		if t.config.Snapshots == nil {
+			return Result{}, fmt.Errorf("disktransfer: a snapshots client is required to export snapshot %s", src.Name)
+		}
+		client = t.config.Snapshots
+		kind = "snapshot"
+	}
+
+	seconds := int32(t.config.AccessDuration / time.Second)
+	resultc, errc := client.GrantAccess(src.ResourceGroup, src.Name, disk.GrantAccessData{
+		Access:            disk.Read,
+		DurationInSeconds: &seconds,
+	}, ctx.Done())
+	// Access is revoked whatever happens, even if the grant failed half
+	// way, since a disk with an active SAS cannot be attached.
+	defer func() {
+		_, errc := client.RevokeAccess(src.ResourceGroup, src.Name, nil)
+		if rerr := <-errc; rerr != nil {
+			glog.Warningf("disktransfer: revoking access to %s %s: %v", kind, src.Name, rerr)
+			if err == nil {
+				err = fmt.Errorf("disktransfer: revoking access to %s %s: %v", kind, src.Name, rerr)
+			}
+			return
+		}
+		glog.V(2).Infof("disktransfer: revoked access to %s %s", kind, src.Name)
+	}()
+	if err := <-errc; err != nil {
+		return Result{}, fmt.Errorf("disktransfer: granting access to %s %s: %v", kind, src.Name, err)
+	}
+	access := <-resultc
+	if access.AccessURIOutput == nil || access.AccessURIRaw == nil || access.AccessSAS == nil {
+		return Result{}, fmt.Errorf("disktransfer: granting access to %s %s returned no SAS", kind, src.Name)
+	}
+	glog.V(2).Infof("disktransfer: exporting %s %s", kind, src.Name)
+
+	return t.copy(ctx, src.Name, &sasSource{client: t.config.HTTPClient, uri: *access.AccessSAS}, dst)
+}
+
+// ImportFile uploads the VHD file path into the page blob staging and
+// creates the managed disk target from it. If md5sum is set, the file must
+// have that MD5, e.g. the one its export reported. The file must be a fixed
+// VHD whose size is a whole number of MiB plus its 512 byte footer, as
+// managed disks require. staging is left in place.
+func (t *Transferer) ImportFile(ctx context.Context, path, md5sum string, staging *storage.Blob, target Target) (disk.Model, Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return disk.Model{}, Result{}, fmt.Errorf("disktransfer: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return disk.Model{}, Result{}, fmt.Errorf("disktransfer: %v", err)
+	}
+	if err := checkVHD(f, info.Size()); err != nil {
+		return disk.Model{}, Result{}, fmt.Errorf("disktransfer: %s: %v", path, err)
+	}
+	if err := t.checkAbsent(target); err != nil {
+		return disk.Model{}, Result{}, err
+	}
+
+	glog.V(2).Infof("disktransfer: uploading %s to %s", path, staging.Name)
+	result, err := t.copy(ctx, path, &fileSource{file: f, size: info.Size()}, &blobSink{blob: staging})
+	if err != nil {
+		return disk.Model{}, Result{}, err
+	}
+	if md5sum != "" && md5sum != result.MD5 {
+		deleteBlob(staging)
+		return disk.Model{}, Result{}, fmt.Errorf("disktransfer: %s has MD5 %s, expected %s", path, result.MD5, md5sum)
+	}
+	if err := t.verify(ctx, staging, result); err != nil {
+		return disk.Model{}, Result{}, err
+	}
+
+	model, err := t.ImportBlob(staging, target)
+	if err != nil {
+		return disk.Model{}, Result{}, err
+	}
+	return model, result, nil
+}
+
+// ImportBlob creates the managed disk target from the fixed VHD in the page
+// blob vhd, e.g. one ExportToBlob wrote. The blob must stay in place until
+// the disk is created.
+func (t *Transferer) ImportBlob(vhd *storage.Blob, target Target) (disk.Model, error) {
+	if err := t.checkAbsent(target); err != nil {
+		return disk.Model{}, err
+	}
+	accountType := target.AccountType
+	if accountType == "" {
+		accountType = disk.StandardLRS
+	}
+	source := vhd.GetURL()
+	creation := &disk.CreationData{
+		CreateOption: disk.Import,
+		SourceURI:    &source,
+	}
+	if target.StorageAccountID != "" {
+		creation.StorageAccountID = stringPtr(target.StorageAccountID)
+	}
+	model := disk.Model{
+		Location: stringPtr(target.Location),
+		Properties: &disk.Properties{
+			AccountType:  accountType,
+			CreationData: creation,
+		},
+	}
+	if len(target.Tags) > 0 {
+		tags := make(map[string]*string, len(target.Tags))
+		for k, v := range target.Tags {
+			tags[k] = stringPtr(v)
+		}
+		model.Tags = &tags
+	}
+
+	glog.V(2).Infof("disktransfer: importing disk %s from %s", target.Name, source)
+	resultc, errc := t.config.Disks.CreateOrUpdate(target.ResourceGroup, target.Name, model, nil)
+	if err := <-errc; err != nil {
+		return disk.Model{}, fmt.Errorf("disktransfer: importing disk %s: %v", target.Name, err)
+	}
+	return <-resultc, nil
+}
+
+// checkAbsent fails if the disk target already exists, so an import never
+// replaces a disk.
+func (t *Transferer) checkAbsent(target Target) error {
+	_, err := t.config.Disks.Get(target.ResourceGroup, target.Name)
+	if err == nil {
+		return fmt.Errorf("disktransfer: disk %s already exists in resource group %s", target.Name, target.ResourceGroup)
+	}
+	if !apierror.IsNotFound(err) {
+		return fmt.Errorf("disktransfer: getting disk %s: %v", target.Name, err)
+	}
+	return nil
+}
+
+// copy transfers src into dst and commits dst with the MD5 of the VHD.
+func (t *Transferer) copy(ctx context.Context, name string, src source, dst sink) (Result, error) {
+	size, err := src.properties(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	if size%pageranges.PageSize != 0 {
+		return Result{}, fmt.Errorf("disktransfer: %s is %d bytes, not a multiple of %d", name, size, pageranges.PageSize)
+	}
+	if err := dst.create(size); err != nil {
+		return Result{}, err
+	}
+	sum, err := t.transfer(ctx, PhaseCopy, name, src, size, dst.writeAt)
+	if err == nil {
+		err = dst.commit(sum)
+	}
+	if err != nil {
+		dst.abort()
+		return Result{}, err
+	}
+	glog.V(2).Infof("disktransfer: transferred %s, %d bytes with MD5 %s", name, size, sum)
+	return Result{Size: size, MD5: sum}, nil
+}
+
+// verify reads the blob b back and compares it with result.
+func (t *Transferer) verify(ctx context.Context, b *storage.Blob, result Result) error {
+	sum, err := t.transfer(ctx, PhaseVerify, b.Name, &blobSource{blob: b}, result.Size, nil)
+	if err != nil {
+		return err
+	}
+	if sum != result.MD5 {
+		deleteBlob(b)
+		return fmt.Errorf("disktransfer: %s reads back with MD5 %s, expected %s", b.Name, sum, result.MD5)
+	}
+	glog.V(2).Infof("disktransfer: verified %s", b.Name)
+	return nil
+}
+
+// chunkResult is a chunk read, and written, by a worker of transfer.
+type chunkResult struct {
+	index int
+	data  []byte
+	err   error
+}
+
+// transfer reads the pages of src that hold data in parallel chunks, passes
+// the chunks that are not all zeros to write, if set, and returns the MD5 of
+// the whole VHD, which it computes in order as the chunks come in.
+func (t *Transferer) transfer(ctx context.Context, phase, name string, src source, size int64, write func(off int64, data []byte) error) (string, error) {
+	ranges, err := src.pageRanges(ctx)
+	if err != nil {
+		glog.Warningf("disktransfer: %v; reading all of %s", err, name)
+		ranges = nil
+		if size > 0 {
+			ranges = []storage.PageRange{{Start: 0, End: size - 1}}
+		}
+	}
+	chunks := pageranges.Split(pageranges.Clamp(pageranges.Normalize(ranges), size), t.config.ChunkSize)
+
+	results := make(chan chunkResult, t.config.Concurrency)
+	// Chunks read ahead of the one to hash next wait in memory, so only a
+	// window of chunks is read ahead.
+	window := 2 * t.config.Concurrency
+	pending := map[int][]byte{}
+	h := md5.New()
+	var (
+		next, dispatched, inflight int
+		hashed                     int64
+		firstErr                   error
+	)
+	for next < len(chunks) {
+		for inflight < t.config.Concurrency && dispatched < len(chunks) && dispatched-next < window {
+			go func(i int) {
+				data, err := t.transferChunk(ctx, src, chunks[i], write)
+				results <- chunkResult{index: i, data: data, err: err}
+			}(dispatched)
+			dispatched++
+			inflight++
+		}
+
+		var r chunkResult
+		select {
+		case r = <-results:
+			inflight--
+		case <-ctx.Done():
+			r.err = ctx.Err()
+		}
+		if r.err != nil {
+			firstErr = r.err
+			break
+		}
+		pending[r.index] = r.data
+
+		for {
+			data, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			hashZeros(h, chunks[next].Start-hashed)
+			h.Write(data)
+			hashed = chunks[next].End + 1
+			next++
+			t.progress(phase, name, hashed, size)
+		}
+	}
+	for ; inflight > 0; inflight-- {
+		<-results
+	}
+	if firstErr != nil {
+		return "", firstErr
+	}
+	hashZeros(h, size-hashed)
+	t.progress(phase, name, size, size)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// transferChunk reads the chunk r of src and writes it unless it is all
+// zeros, retrying failures.
+func (t *Transferer) transferChunk(ctx context.Context, src source, r storage.PageRange, write func(off int64, data []byte) error) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < defaultRetries; attempt++ {
+		if attempt > 0 {
+			glog.V(4).Infof("disktransfer: retrying %d-%d: %v", r.Start, r.End, err)
+			select {
+			case <-time.After(time.Duration(attempt) * retryDelay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		var data []byte
+		data, err = src.readRange(ctx, r)
+		if err == nil && write != nil && !allZeros(data) {
+			err = write(r.Start, data)
+		}
+		if err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+func (t *Transferer) progress(phase, name string, bytes, total int64) {
+	if t.config.OnProgress != nil {
+		t.config.OnProgress(Progress{Phase: phase, Name: name, Bytes: bytes, TotalBytes: total})
+	}
+}
+
+// hashZeros writes n zero bytes to h.
+func hashZeros(h hash.Hash, n int64) {
+	for n > 0 {
+		chunk := int64(len(zeros))
+		if chunk > n {
+			chunk = n
+		}
+		h.Write(zeros[:chunk])
+		n -= chunk
+	}
+}
+
+func allZeros(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,66 @@
+package disktransfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/honcao/cloudprovider/pkg/internal/pageranges"
+	"github.com/honcao/cloudprovider/pkg/storageemulator"
+)
+
+func TestCopyIgnoresStaleContentMD5(t *testing.T) {
+	e := storageemulator.New()
+	t.Cleanup(e.Close)
+	client, err := e.NewClient(storage.StorageEmulatorAccountName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := client.GetBlobService()
+	container := blobs.GetContainerReference("vhds")
+	if err := container.Create(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The blob was uploaded with an MD5, and a page was written since.
+	size := int64(4 * pageranges.PageSize)
+	want := make([]byte, size)
+	copy(want[pageranges.PageSize:], bytes.Repeat([]byte("disk"), pageranges.PageSize/2))
+	b := container.GetBlobReference("disk.vhd")
+	b.Properties.ContentLength = size
+	if err := b.PutPageBlob(nil); err != nil {
+		t.Fatal(err)
+	}
+	page := storage.BlobRange{Start: pageranges.PageSize, End: 3*pageranges.PageSize - 1}
+	if err := b.WriteRange(page, bytes.NewReader(want[page.Start:page.End+1]), nil); err != nil {
+		t.Fatal(err)
+	}
+	stale := md5.Sum(make([]byte, size))
+	b.Properties.ContentMD5 = base64.StdEncoding.EncodeToString(stale[:])
+	if err := b.SetProperties(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &Transferer{config: Config{ChunkSize: pageranges.PageSize, Concurrency: 2}}
+	path := filepath.Join(t.TempDir(), "disk.vhd")
+	result, err := tr.copy(context.Background(), b.Name, &blobSource{blob: b}, &fileSink{path: path})
+	if err != nil {
+		t.Fatalf("copy() = %v", err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("copy() wrote %d bytes that differ from the blob", len(got))
+	}
+	sum := md5.Sum(want)
+	if result.Size != size || result.MD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("copy() = %+v, want %d bytes with the MD5 of the data", result, size)
+	}
+}
@@ -0,0 +1,62 @@
+package instances
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache holds values for a fixed time after they are stored.
+type ttlCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	// nextSweep is when expired entries are next dropped, so that keys
+	// that are not read again do not pile up.
+	nextSweep time.Time
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newTTLCache(ttl time.Duration, now func() time.Time) *ttlCache {
+	return &ttlCache{
+		ttl:     ttl,
+		now:     now,
+		entries: map[string]cacheEntry{},
+	}
+}
+
+// get returns the value stored under key, unless it has expired.
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+// set stores value under key for the TTL of the cache.
+func (c *ttlCache) set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if !now.Before(c.nextSweep) {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = now.Add(c.ttl)
+	}
+	c.entries[key] = cacheEntry{value: value, expires: now.Add(c.ttl)}
+}
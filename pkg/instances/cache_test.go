@@ -0,0 +1,32 @@
+package instances
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCache(t *testing.T) {
+	now := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	c := newTTLCache(time.Minute, func() time.Time { return now })
+	c.set("a", 1)
+	now = now.Add(30 * time.Second)
+	c.set("b", 2)
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Errorf("get(a) = %v, %v, want 1", v, ok)
+	}
+
+	now = now.Add(30 * time.Second)
+	if _, ok := c.get("a"); ok {
+		t.Errorf("get(a) found it a TTL after it was set")
+	}
+	if v, ok := c.get("b"); !ok || v != 2 {
+		t.Errorf("get(b) = %v, %v, want 2", v, ok)
+	}
+
+	// Keys that are not read again are dropped by a later set.
+	now = now.Add(time.Minute)
+	c.set("c", 3)
+	if len(c.entries) != 1 {
+		t.Errorf("%d entries are kept, want only c", len(c.entries))
+	}
+}
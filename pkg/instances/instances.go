@@ -0,0 +1,500 @@
+// Package instances is the node lifecycle half of a Kubernetes cloud
+// provider for Azure and Azure Stack: it tells the addresses, instance ID
+// and type of a node and whether its VM still exists or is shut down. Nodes
+// are backed by VMs of availability sets or by scale set VMs. Lookups are
+// kept in memory for a while, as the node controllers ask for every node
+// every few seconds.
+package instances
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+	"github.com/honcao/cloudprovider/pkg/resourceid"
+)
+
+const (
+	defaultCacheTTL = time.Minute
+
+	// The computer names of scale set VMs are the scale set name followed
+	// by the instance ID in 6 base 36 digits.
+	scaleSetInstanceIDLength = 6
+
+	scaleSetsType       = "virtualMachineScaleSets"
+	virtualMachinesType = "virtualMachines"
+	interfacesType      = "networkInterfaces"
+	ipConfigurationType = "ipConfigurations"
+
+	powerStatePrefix = "PowerState/"
+)
+
+// ErrInstanceNotFound is returned when the VM of a node does not exist.
+var ErrInstanceNotFound = errors.New("instances: instance not found")
+
+// shutdownPowerStates are the power states of VMs that are not running and
+// will not come back by themselves.
+var shutdownPowerStates = map[string]bool{
+	"stopped":      true,
+	"deallocating": true,
+	"deallocated":  true,
+}
+
+// NodeAddressType is the type of a NodeAddress, as in the Kubernetes API.
+type NodeAddressType string
+
+// Address types of nodes.
+const (
+	NodeHostName   NodeAddressType = "Hostname"
+	NodeInternalIP NodeAddressType = "InternalIP"
+	NodeExternalIP NodeAddressType = "ExternalIP"
+)
+
+// NodeAddress is an address of a node.
+type NodeAddress struct {
+	Type    NodeAddressType
+	Address string
+}
+
+// VirtualMachinesClient is the subset of compute.VirtualMachinesClient
+// Instances uses.
+type VirtualMachinesClient interface {
+	Get(resourceGroupName string, VMName string, expand compute.InstanceViewTypes) (compute.VirtualMachine, error)
+}
+
+var _ VirtualMachinesClient = compute.VirtualMachinesClient{}
+
+// VirtualMachineScaleSetVMsClient is the subset of
+// compute.VirtualMachineScaleSetVMsClient Instances uses.
+type VirtualMachineScaleSetVMsClient interface {
+	Get(resourceGroupName string, VMScaleSetName string, instanceID string) (compute.VirtualMachineScaleSetVM, error)
+	GetInstanceView(resourceGroupName string, VMScaleSetName string, instanceID string) (compute.VirtualMachineScaleSetVMInstanceView, error)
+}
+
+var _ VirtualMachineScaleSetVMsClient = compute.VirtualMachineScaleSetVMsClient{}
+
+// InterfacesClient is the subset of network.InterfacesClient Instances
+// uses.
+type InterfacesClient interface {
+	Get(resourceGroupName string, networkInterfaceName string, expand string) (network.Interface, error)
+	GetVirtualMachineScaleSetNetworkInterface(resourceGroupName string, virtualMachineScaleSetName string, virtualmachineIndex string, networkInterfaceName string, expand string) (network.Interface, error)
+}
+
+var _ InterfacesClient = network.InterfacesClient{}
+
+// PublicIPAddressesClient is the subset of network.PublicIPAddressesClient
+// Instances uses.
+type PublicIPAddressesClient interface {
+	Get(resourceGroupName string, publicIPAddressName string, expand string) (network.PublicIPAddress, error)
+	GetVirtualMachineScaleSetPublicIPAddress(resourceGroupName string, virtualMachineScaleSetName string, virtualmachineIndex string, networkInterfaceName string, IPConfigurationName string, publicIPAddressName string, expand string) (network.PublicIPAddress, error)
+}
+
+var _ PublicIPAddressesClient = network.PublicIPAddressesClient{}
+
+// Config configures Instances.
+type Config struct {
+	// ResourceGroup holds the VMs of nodes looked up by name. Lookups by
+	// provider ID take the resource group from the ID.
+	ResourceGroup     string
+	VirtualMachines   VirtualMachinesClient
+	Interfaces        InterfacesClient
+	PublicIPAddresses PublicIPAddressesClient
+	// ScaleSetVMs, if set, backs the nodes of scale sets. Nodes are looked
+	// up by name among scale set VMs when no VM has their name, assuming
+	// the scale set computer name prefix is the scale set name.
+	ScaleSetVMs VirtualMachineScaleSetVMsClient
+	// CacheTTL is how long VMs and addresses are kept. It defaults to 1m.
+	CacheTTL time.Duration
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// Instances answers the questions of Kubernetes about the VMs of nodes.
+type Instances struct {
+	config    Config
+	vms       *ttlCache
+	addresses *ttlCache
+}
+
+// NewInstances validates config and returns Instances.
+func NewInstances(config Config) (*Instances, error) {
+	if config.ResourceGroup == "" {
+		return nil, fmt.Errorf("instances: a resource group is required")
+	}
+	if config.VirtualMachines == nil || config.Interfaces == nil || config.PublicIPAddresses == nil {
+		return nil, fmt.Errorf("instances: virtual machine, interface and public IP address clients are required")
+	}
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = defaultCacheTTL
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	return &Instances{
+		config:    config,
+		vms:       newTTLCache(config.CacheTTL, config.Now),
+		addresses: newTTLCache(config.CacheTTL, config.Now),
+	}, nil
+}
+
+// vm is what Instances needs to know of a VM or scale set VM.
+type vm struct {
+	id resourceid.ID
+	// nodeName is the lower case computer name, which is the name of the
+	// node.
+	nodeName string
+	size     string
+	// primaryNIC is the ID of the primary network interface.
+	primaryNIC string
+	// powerState is e.g. "running", or empty when unknown.
+	powerState string
+}
+
+// NodeAddresses returns the addresses of the node nodeName: the private
+// and public IP of the primary IP configuration of its primary network
+// interface, and its host name.
+func (i *Instances) NodeAddresses(nodeName string) ([]NodeAddress, error) {
+	v, err := i.vmByNodeName(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	return i.nodeAddresses(v)
+}
+
+// NodeAddressesByProviderID returns the addresses of the node with the
+// provider ID providerID.
+func (i *Instances) NodeAddressesByProviderID(providerID string) ([]NodeAddress, error) {
+	v, err := i.vmByProviderID(providerID)
+	if err != nil {
+		return nil, err
+	}
+	return i.nodeAddresses(v)
+}
+
+// InstanceID returns the resource ID of the VM of the node nodeName.
+func (i *Instances) InstanceID(nodeName string) (string, error) {
+	v, err := i.vmByNodeName(nodeName)
+	if err != nil {
+		return "", err
+	}
+	return v.id.String(), nil
+}
+
+// InstanceType returns the VM size of the node nodeName, e.g.
+// Standard_D2_v2.
+func (i *Instances) InstanceType(nodeName string) (string, error) {
+	v, err := i.vmByNodeName(nodeName)
+	if err != nil {
+		return "", err
+	}
+	return v.size, nil
+}
+
+// InstanceTypeByProviderID returns the VM size of the node with the
+// provider ID providerID.
+func (i *Instances) InstanceTypeByProviderID(providerID string) (string, error) {
+	v, err := i.vmByProviderID(providerID)
+	if err != nil {
+		return "", err
+	}
+	return v.size, nil
+}
+
+// InstanceExistsByProviderID reports whether the VM of the node with the
+// provider ID providerID exists.
+func (i *Instances) InstanceExistsByProviderID(providerID string) (bool, error) {
+	_, err := i.vmByProviderID(providerID)
+	if err == ErrInstanceNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// InstanceShutdownByProviderID reports whether the VM of the node with the
+// provider ID providerID is stopped or deallocated.
+func (i *Instances) InstanceShutdownByProviderID(providerID string) (bool, error) {
+	v, err := i.vmByProviderID(providerID)
+	if err != nil {
+		return false, err
+	}
+	return shutdownPowerStates[v.powerState], nil
+}
+
+// vmByNodeName returns the VM of the node nodeName, a VM of that name or
+// else a scale set VM with that computer name.
+func (i *Instances) vmByNodeName(nodeName string) (*vm, error) {
+	key := "name:" + strings.ToLower(nodeName)
+	if v, ok := i.vms.get(key); ok {
+		return v.(*vm), nil
+	}
+
+	v, err := i.getVM(i.config.ResourceGroup, nodeName)
+	if apierror.IsNotFound(err) && i.config.ScaleSetVMs != nil {
+		if scaleSet, instanceID, ok := SplitScaleSetComputerName(nodeName); ok {
+			v, err = i.getScaleSetVM(i.config.ResourceGroup, scaleSet, instanceID)
+		}
+	}
+	if apierror.IsNotFound(err) {
+		return nil, ErrInstanceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	i.vms.set(key, v)
+	i.vms.set("id:"+v.id.Key(), v)
+	return v, nil
+}
+
+// vmByProviderID returns the VM named by a provider ID.
+func (i *Instances) vmByProviderID(providerID string) (*vm, error) {
+	id, err := resourceid.ParseProviderID(providerID)
+	if err != nil {
+		return nil, err
+	}
+	key := "id:" + id.Key()
+	if v, ok := i.vms.get(key); ok {
+		return v.(*vm), nil
+	}
+
+	var v *vm
+	if scaleSet, ok := id.NameOf(scaleSetsType); ok {
+		if i.config.ScaleSetVMs == nil {
+			return nil, fmt.Errorf("instances: %s is a scale set VM but no scale set VM client is configured", providerID)
+		}
+		v, err = i.getScaleSetVM(id.ResourceGroup, scaleSet, id.Name())
+	} else {
+		v, err = i.getVM(id.ResourceGroup, id.Name())
+	}
+	if apierror.IsNotFound(err) {
+		return nil, ErrInstanceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	i.vms.set(key, v)
+	return v, nil
+}
+
+func (i *Instances) getVM(resourceGroup, name string) (*vm, error) {
+	result, err := i.config.VirtualMachines.Get(resourceGroup, name, compute.InstanceView)
+	if err != nil {
+		return nil, err
+	}
+	if result.ID == nil || result.VirtualMachineProperties == nil {
+		return nil, fmt.Errorf("instances: VM %s has no properties", name)
+	}
+	id, err := resourceid.Parse(*result.ID)
+	if err != nil {
+		return nil, err
+	}
+	p := result.VirtualMachineProperties
+	v := &vm{
+		id:         id,
+		nodeName:   computerName(p.OsProfile, name),
+		size:       vmSize(p.HardwareProfile),
+		primaryNIC: primaryNIC(p.NetworkProfile),
+	}
+	if p.InstanceView != nil {
+		v.powerState = powerState(p.InstanceView.Statuses)
+	}
+	glog.V(2).Infof("instances: VM %s is node %s, power state %q", id, v.nodeName, v.powerState)
+	return v, nil
+}
+
+func (i *Instances) getScaleSetVM(resourceGroup, scaleSet, instanceID string) (*vm, error) {
+	result, err := i.config.ScaleSetVMs.Get(resourceGroup, scaleSet, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if result.ID == nil || result.VirtualMachineScaleSetVMProperties == nil {
+		return nil, fmt.Errorf("instances: VM %s of scale set %s has no properties", instanceID, scaleSet)
+	}
+	id, err := resourceid.Parse(*result.ID)
+	if err != nil {
+		return nil, err
+	}
+	p := result.VirtualMachineScaleSetVMProperties
+	v := &vm{
+		id:         id,
+		nodeName:   computerName(p.OsProfile, ScaleSetComputerName(scaleSet, instanceID)),
+		size:       vmSize(p.HardwareProfile),
+		primaryNIC: primaryNIC(p.NetworkProfile),
+	}
+	if v.size == "" && result.Sku != nil && result.Sku.Name != nil {
+		v.size = *result.Sku.Name
+	}
+	// The VM itself only comes with an instance view in recent API
+	// versions.
+	view, err := i.config.ScaleSetVMs.GetInstanceView(resourceGroup, scaleSet, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	v.powerState = powerState(view.Statuses)
+	glog.V(2).Infof("instances: VM %s is node %s, power state %q", id, v.nodeName, v.powerState)
+	return v, nil
+}
+
+// nodeAddresses returns the addresses of v.
+func (i *Instances) nodeAddresses(v *vm) ([]NodeAddress, error) {
+	key := v.id.Key()
+	if addresses, ok := i.addresses.get(key); ok {
+		return addresses.([]NodeAddress), nil
+	}
+	if v.primaryNIC == "" {
+		return nil, fmt.Errorf("instances: VM %s has no network interface", v.id)
+	}
+	nicID, err := resourceid.Parse(v.primaryNIC)
+	if err != nil {
+		return nil, err
+	}
+	nic, err := i.getInterface(nicID)
+	if err != nil {
+		return nil, fmt.Errorf("instances: getting network interface %s of VM %s: %v", nicID.Name(), v.id, err)
+	}
+	ipConfig := primaryIPConfiguration(nic)
+	if ipConfig == nil || ipConfig.PrivateIPAddress == nil || *ipConfig.PrivateIPAddress == "" {
+		return nil, fmt.Errorf("instances: network interface %s of VM %s has no private IP address", nicID.Name(), v.id)
+	}
+
+	addresses := []NodeAddress{{Type: NodeInternalIP, Address: *ipConfig.PrivateIPAddress}}
+	if ipConfig.PublicIPAddress != nil && ipConfig.PublicIPAddress.ID != nil {
+		pipID, err := resourceid.Parse(*ipConfig.PublicIPAddress.ID)
+		if err != nil {
+			return nil, err
+		}
+		pip, err := i.getPublicIPAddress(pipID)
+		if err != nil {
+			return nil, fmt.Errorf("instances: getting public IP address %s of VM %s: %v", pipID.Name(), v.id, err)
+		}
+		// Dynamic addresses are only allocated while the VM runs.
+		if pip.PublicIPAddressPropertiesFormat != nil && pip.IPAddress != nil && *pip.IPAddress != "" {
+			addresses = append(addresses, NodeAddress{Type: NodeExternalIP, Address: *pip.IPAddress})
+		}
+	}
+	addresses = append(addresses, NodeAddress{Type: NodeHostName, Address: v.nodeName})
+	i.addresses.set(key, addresses)
+	return addresses, nil
+}
+
+// getInterface gets a network interface, of a VM or of a scale set VM.
+func (i *Instances) getInterface(id resourceid.ID) (network.Interface, error) {
+	if scaleSet, ok := id.NameOf(scaleSetsType); ok {
+		index, _ := id.NameOf(virtualMachinesType)
+		return i.config.Interfaces.GetVirtualMachineScaleSetNetworkInterface(id.ResourceGroup, scaleSet, index, id.Name(), "")
+	}
+	return i.config.Interfaces.Get(id.ResourceGroup, id.Name(), "")
+}
+
+// getPublicIPAddress gets a public IP address, standalone or of a scale
+// set VM.
+func (i *Instances) getPublicIPAddress(id resourceid.ID) (network.PublicIPAddress, error) {
+	if scaleSet, ok := id.NameOf(scaleSetsType); ok {
+		index, _ := id.NameOf(virtualMachinesType)
+		nic, _ := id.NameOf(interfacesType)
+		ipConfig, _ := id.NameOf(ipConfigurationType)
+		return i.config.PublicIPAddresses.GetVirtualMachineScaleSetPublicIPAddress(id.ResourceGroup, scaleSet, index, nic, ipConfig, id.Name(), "")
+	}
+	return i.config.PublicIPAddresses.Get(id.ResourceGroup, id.Name(), "")
+}
+
+// SplitScaleSetComputerName splits the computer name of a scale set VM into
+// the scale set name and the instance ID, e.g. "pool-vmss00000a" into
+// "pool-vmss" and "10". It returns false for names that cannot be those of
+// scale set VMs.
+func SplitScaleSetComputerName(name string) (string, string, bool) {
+	if len(name) <= scaleSetInstanceIDLength {
+		return "", "", false
+	}
+	split := len(name) - scaleSetInstanceIDLength
+	instanceID, err := strconv.ParseUint(name[split:], 36, 64)
+	if err != nil {
+		return "", "", false
+	}
+	return name[:split], strconv.FormatUint(instanceID, 10), true
+}
+
+// ScaleSetComputerName returns the default computer name of the VM
+// instanceID of a scale set, e.g. "pool-vmss00000a" for "pool-vmss" and
+// "10", as SplitScaleSetComputerName splits it. Instance IDs that are not
+// numbers are appended as they are.
+func ScaleSetComputerName(scaleSet, instanceID string) string {
+	n, err := strconv.ParseUint(instanceID, 10, 64)
+	if err != nil {
+		return scaleSet + instanceID
+	}
+	suffix := strconv.FormatUint(n, 36)
+	if len(suffix) < scaleSetInstanceIDLength {
+		suffix = strings.Repeat("0", scaleSetInstanceIDLength-len(suffix)) + suffix
+	}
+	return scaleSet + suffix
+}
+
+func computerName(profile *compute.OSProfile, fallback string) string {
+	if profile != nil && profile.ComputerName != nil && *profile.ComputerName != "" {
+		return strings.ToLower(*profile.ComputerName)
+	}
+	return strings.ToLower(fallback)
+}
+
+func vmSize(profile *compute.HardwareProfile) string {
+	if profile == nil {
+		return ""
+	}
+	return string(profile.VMSize)
+}
+
+// primaryNIC returns the ID of the network interface marked primary, or of
+// the only one.
+func primaryNIC(profile *compute.NetworkProfile) string {
+	if profile == nil || profile.NetworkInterfaces == nil {
+		return ""
+	}
+	nics := *profile.NetworkInterfaces
+	for _, nic := range nics {
+		if nic.ID != nil && nic.NetworkInterfaceReferenceProperties != nil && nic.Primary != nil && *nic.Primary {
+			return *nic.ID
+		}
+	}
+	if len(nics) == 1 && nics[0].ID != nil {
+		return *nics[0].ID
+	}
+	return ""
+}
+
+// primaryIPConfiguration returns the IP configuration of nic marked
+// primary, or the first one.
+func primaryIPConfiguration(nic network.Interface) *network.InterfaceIPConfigurationPropertiesFormat {
+	if nic.InterfacePropertiesFormat == nil || nic.IPConfigurations == nil || len(*nic.IPConfigurations) == 0 {
+		return nil
+	}
+	configs := *nic.IPConfigurations
+	for _, c := range configs {
+		if c.InterfaceIPConfigurationPropertiesFormat != nil && c.Primary != nil && *c.Primary {
+			return c.InterfaceIPConfigurationPropertiesFormat
+		}
+	}
+	return configs[0].InterfaceIPConfigurationPropertiesFormat
+}
+
+// powerState returns the power state among the statuses of an instance
+// view, e.g. "running".
+func powerState(statuses *[]compute.InstanceViewStatus) string {
+	if statuses == nil {
+		return ""
+	}
+	for _, s := range *statuses {
+		if s.Code != nil && strings.HasPrefix(*s.Code, powerStatePrefix) {
+			return strings.ToLower(strings.TrimPrefix(*s.Code, powerStatePrefix))
+		}
+	}
+	return ""
+}
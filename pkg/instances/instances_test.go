@@ -0,0 +1,249 @@
+package instances
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+const (
+	testGroupID    = "/subscriptions/sub/resourceGroups/cluster"
+	testComputeID  = testGroupID + "/providers/Microsoft.Compute"
+	testNetworkID  = testGroupID + "/providers/Microsoft.Network"
+	testScaleSetID = testComputeID + "/virtualMachineScaleSets/pool"
+)
+
+var errNotFound = autorest.DetailedError{StatusCode: http.StatusNotFound}
+
+func unmarshal(t *testing.T, data string, v interface{}) {
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeResources holds resources by name and counts the gets of each.
+type fakeResources struct {
+	t      *testing.T
+	bodies map[string]string
+	gets   map[string]int
+}
+
+func newFakeResources(t *testing.T, bodies map[string]string) *fakeResources {
+	return &fakeResources{t: t, bodies: bodies, gets: map[string]int{}}
+}
+
+// get unmarshals the resource name into v.
+func (f *fakeResources) get(name string, v interface{}) error {
+	f.gets[name]++
+	body, ok := f.bodies[name]
+	if !ok {
+		return errNotFound
+	}
+	unmarshal(f.t, body, v)
+	return nil
+}
+
+type fakeVMs struct{ *fakeResources }
+
+func (f fakeVMs) Get(resourceGroupName string, VMName string, expand compute.InstanceViewTypes) (vm compute.VirtualMachine, err error) {
+	return vm, f.get(resourceGroupName+"/"+VMName, &vm)
+}
+
+type fakeScaleSetVMs struct{ *fakeResources }
+
+func (f fakeScaleSetVMs) Get(resourceGroupName string, VMScaleSetName string, instanceID string) (vm compute.VirtualMachineScaleSetVM, err error) {
+	return vm, f.get(resourceGroupName+"/"+VMScaleSetName+"/"+instanceID, &vm)
+}
+
+func (f fakeScaleSetVMs) GetInstanceView(resourceGroupName string, VMScaleSetName string, instanceID string) (view compute.VirtualMachineScaleSetVMInstanceView, err error) {
+	return view, f.get(resourceGroupName+"/"+VMScaleSetName+"/"+instanceID+"/instanceView", &view)
+}
+
+type fakeInterfaces struct{ *fakeResources }
+
+func (f fakeInterfaces) Get(resourceGroupName string, networkInterfaceName string, expand string) (nic network.Interface, err error) {
+	return nic, f.get(resourceGroupName+"/"+networkInterfaceName, &nic)
+}
+
+func (f fakeInterfaces) GetVirtualMachineScaleSetNetworkInterface(resourceGroupName string, virtualMachineScaleSetName string, virtualmachineIndex string, networkInterfaceName string, expand string) (nic network.Interface, err error) {
+	return nic, f.get(resourceGroupName+"/"+virtualMachineScaleSetName+"/"+virtualmachineIndex+"/"+networkInterfaceName, &nic)
+}
+
+type fakePublicIPAddresses struct{ *fakeResources }
+
+func (f fakePublicIPAddresses) Get(resourceGroupName string, publicIPAddressName string, expand string) (pip network.PublicIPAddress, err error) {
+	return pip, f.get(resourceGroupName+"/"+publicIPAddressName, &pip)
+}
+
+func (f fakePublicIPAddresses) GetVirtualMachineScaleSetPublicIPAddress(resourceGroupName string, virtualMachineScaleSetName string, virtualmachineIndex string, networkInterfaceName string, IPConfigurationName string, publicIPAddressName string, expand string) (pip network.PublicIPAddress, err error) {
+	return pip, f.get(strings.Join([]string{resourceGroupName, virtualMachineScaleSetName, virtualmachineIndex, networkInterfaceName, IPConfigurationName, publicIPAddressName}, "/"), &pip)
+}
+
+// testResources are a VM of an availability set, node0, and the VM 10 of
+// scale set pool, each with a public IP address.
+var testResources = map[string]string{
+	"cluster/node0": `{"id":"` + testComputeID + `/virtualMachines/node0","name":"node0","properties":{
+		"hardwareProfile":{"vmSize":"Standard_D2_v2"},
+		"osProfile":{"computerName":"Node0"},
+		"networkProfile":{"networkInterfaces":[
+			{"id":"` + testNetworkID + `/networkInterfaces/node0-secondary","properties":{"primary":false}},
+			{"id":"` + testNetworkID + `/networkInterfaces/node0-nic","properties":{"primary":true}}]},
+		"instanceView":{"statuses":[{"code":"ProvisioningState/succeeded"},{"code":"PowerState/running"}]}}}`,
+	"cluster/node0-nic": `{"properties":{"ipConfigurations":[
+		{"name":"ipconfig2","properties":{"privateIPAddress":"10.0.0.5"}},
+		{"name":"ipconfig1","properties":{"primary":true,"privateIPAddress":"10.0.0.4",
+		 "publicIPAddress":{"id":"` + testNetworkID + `/publicIPAddresses/node0-pip"}}}]}}`,
+	"cluster/node0-pip": `{"properties":{"ipAddress":"192.0.2.4"}}`,
+
+	"cluster/pool/10": `{"id":"` + testScaleSetID + `/virtualMachines/10","instanceId":"10","sku":{"name":"Standard_DS2_v2"},"properties":{
+		"networkProfile":{"networkInterfaces":[{"id":"` + testScaleSetID + `/virtualMachines/10/networkInterfaces/nic0"}]}}}`,
+	"cluster/pool/10/instanceView": `{"statuses":[{"code":"ProvisioningState/succeeded"},{"code":"PowerState/deallocated"}]}`,
+	"cluster/pool/10/nic0": `{"properties":{"ipConfigurations":[{"name":"ipconfig1","properties":{"privateIPAddress":"10.0.1.4",
+		"publicIPAddress":{"id":"` + testScaleSetID + `/virtualMachines/10/networkInterfaces/nic0/ipConfigurations/ipconfig1/publicIPAddresses/pip0"}}}]}}`,
+	// A dynamic address of a deallocated VM has no IP address.
+	"cluster/pool/10/nic0/ipconfig1/pip0": `{"properties":{"publicIPAllocationMethod":"Dynamic"}}`,
+}
+
+func newTestInstances(t *testing.T, now *time.Time) (*Instances, *fakeResources) {
+	f := newFakeResources(t, testResources)
+	config := Config{
+		ResourceGroup:     "cluster",
+		VirtualMachines:   fakeVMs{f},
+		ScaleSetVMs:       fakeScaleSetVMs{f},
+		Interfaces:        fakeInterfaces{f},
+		PublicIPAddresses: fakePublicIPAddresses{f},
+	}
+	if now != nil {
+		config.Now = func() time.Time { return *now }
+	}
+	i, err := NewInstances(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i, f
+}
+
+func TestNodeAddresses(t *testing.T) {
+	i, _ := newTestInstances(t, nil)
+	for _, tt := range []struct {
+		node string
+		want []NodeAddress
+	}{
+		{"node0", []NodeAddress{
+			{NodeInternalIP, "10.0.0.4"},
+			{NodeExternalIP, "192.0.2.4"},
+			{NodeHostName, "node0"},
+		}},
+		// No VM is named so, and its computer name is that of the VM 10
+		// of scale set pool.
+		{"pool00000a", []NodeAddress{
+			{NodeInternalIP, "10.0.1.4"},
+			{NodeHostName, "pool00000a"},
+		}},
+	} {
+		got, err := i.NodeAddresses(tt.node)
+		if err != nil {
+			t.Errorf("NodeAddresses(%s) = %v", tt.node, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("NodeAddresses(%s) = %v, want %v", tt.node, got, tt.want)
+		}
+	}
+	if _, err := i.NodeAddresses("node1"); err != ErrInstanceNotFound {
+		t.Errorf("NodeAddresses() of a missing node = %v, want %v", err, ErrInstanceNotFound)
+	}
+}
+
+func TestScaleSetVM(t *testing.T) {
+	i, _ := newTestInstances(t, nil)
+	providerID := "azure://" + testScaleSetID + "/virtualMachines/10"
+	if id, err := i.InstanceID("pool00000a"); err != nil || id != testScaleSetID+"/virtualMachines/10" {
+		t.Errorf("InstanceID() = %s, %v", id, err)
+	}
+	// The size comes from the SKU of the scale set VM.
+	if size, err := i.InstanceTypeByProviderID(providerID); err != nil || size != "Standard_DS2_v2" {
+		t.Errorf("InstanceTypeByProviderID() = %s, %v, want Standard_DS2_v2", size, err)
+	}
+	// The power state comes from the instance view.
+	if shutdown, err := i.InstanceShutdownByProviderID(providerID); err != nil || !shutdown {
+		t.Errorf("InstanceShutdownByProviderID() = %v, %v, want the deallocated VM shut down", shutdown, err)
+	}
+	for _, tt := range []struct {
+		providerID string
+		want       bool
+	}{
+		{providerID, true},
+		{"azure://" + testScaleSetID + "/virtualMachines/11", false},
+		{"azure://" + testComputeID + "/virtualMachines/node0", true},
+		{"azure://" + testComputeID + "/virtualMachines/node1", false},
+	} {
+		if exists, err := i.InstanceExistsByProviderID(tt.providerID); err != nil || exists != tt.want {
+			t.Errorf("InstanceExistsByProviderID(%s) = %v, %v, want %v", tt.providerID, exists, err, tt.want)
+		}
+	}
+}
+
+func TestLookupsAreCached(t *testing.T) {
+	now := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	i, f := newTestInstances(t, &now)
+	for n := 0; n < 3; n++ {
+		if _, err := i.NodeAddresses("node0"); err != nil {
+			t.Fatal(err)
+		}
+		if size, err := i.InstanceTypeByProviderID("azure://" + testComputeID + "/virtualMachines/node0"); err != nil || size != "Standard_D2_v2" {
+			t.Fatalf("InstanceTypeByProviderID() = %s, %v", size, err)
+		}
+	}
+	// The VM found by name is kept by its ID too.
+	if f.gets["cluster/node0"] != 1 || f.gets["cluster/node0-nic"] != 1 || f.gets["cluster/node0-pip"] != 1 {
+		t.Errorf("gets %v, want each resource once", f.gets)
+	}
+
+	now = now.Add(defaultCacheTTL)
+	if _, err := i.NodeAddresses("node0"); err != nil {
+		t.Fatal(err)
+	}
+	if f.gets["cluster/node0"] != 2 || f.gets["cluster/node0-nic"] != 2 {
+		t.Errorf("gets %v, want each resource again past the TTL", f.gets)
+	}
+
+	// Missing VMs are not kept.
+	for n := 0; n < 2; n++ {
+		i.InstanceExistsByProviderID("azure://" + testComputeID + "/virtualMachines/node1")
+	}
+	if f.gets["cluster/node1"] != 2 {
+		t.Errorf("got the missing VM %d times, want every time", f.gets["cluster/node1"])
+	}
+}
+
+func TestScaleSetComputerName(t *testing.T) {
+	for _, tt := range []struct {
+		scaleSet, instanceID, name string
+	}{
+		{"pool", "0", "pool000000"},
+		{"pool-vmss", "10", "pool-vmss00000a"},
+		{"k8s-agentpool-12345678-vmss", "46655", "k8s-agentpool-12345678-vmss000zzz"},
+		{"pool", "2176782335", "poolzzzzzz"},
+	} {
+		if got := ScaleSetComputerName(tt.scaleSet, tt.instanceID); got != tt.name {
+			t.Errorf("ScaleSetComputerName(%s, %s) = %s, want %s", tt.scaleSet, tt.instanceID, got, tt.name)
+		}
+		scaleSet, instanceID, ok := SplitScaleSetComputerName(tt.name)
+		if !ok || scaleSet != tt.scaleSet || instanceID != tt.instanceID {
+			t.Errorf("SplitScaleSetComputerName(%s) = %s, %s, %v, want %s, %s", tt.name, scaleSet, instanceID, ok, tt.scaleSet, tt.instanceID)
+		}
+	}
+	for _, name := range []string{"node-0", "pool", "pool00000-"} {
+		if scaleSet, instanceID, ok := SplitScaleSetComputerName(name); ok {
+			t.Errorf("SplitScaleSetComputerName(%s) = %s, %s, want no scale set VM", name, scaleSet, instanceID)
+		}
+	}
+}
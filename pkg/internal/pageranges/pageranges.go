@@ -0,0 +1,90 @@
+// Package pageranges computes with the page ranges of page blobs, as Get
+// Page Ranges returns them and Put Page takes them, for the packages that
+// copy page blobs a range at a time.
+package pageranges
+
+import (
+	"sort"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// PageSize is the page blob alignment required by Put Page.
+const PageSize = 512
+
+// Normalize sorts ranges and merges overlapping or adjacent ones.
+func Normalize(in []storage.PageRange) []storage.PageRange {
+	if len(in) == 0 {
+		return nil
+	}
+	ranges := make([]storage.PageRange, len(in))
+	copy(ranges, in)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	out := []storage.PageRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &out[len(out)-1]
+		if r.Start <= last.End+1 {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// Subtract returns the parts of a that are not covered by b. Both inputs
+// must be normalized.
+func Subtract(a, b []storage.PageRange) []storage.PageRange {
+	var out []storage.PageRange
+	j := 0
+	for _, r := range a {
+		start := r.Start
+		for j < len(b) && b[j].End < start {
+			j++
+		}
+		for k := j; k < len(b) && b[k].Start <= r.End; k++ {
+			if b[k].Start > start {
+				out = append(out, storage.PageRange{Start: start, End: b[k].Start - 1})
+			}
+			start = b[k].End + 1
+		}
+		if start <= r.End {
+			out = append(out, storage.PageRange{Start: start, End: r.End})
+		}
+	}
+	return out
+}
+
+// Clamp drops the parts of ranges that lie beyond size bytes.
+func Clamp(ranges []storage.PageRange, size int64) []storage.PageRange {
+	var out []storage.PageRange
+	for _, r := range ranges {
+		if r.Start >= size {
+			continue
+		}
+		if r.End >= size {
+			r.End = size - 1
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// Split cuts ranges into pieces of at most chunkSize bytes so each piece
+// fits in a single Put Page request.
+func Split(ranges []storage.PageRange, chunkSize int64) []storage.PageRange {
+	var out []storage.PageRange
+	for _, r := range ranges {
+		for start := r.Start; start <= r.End; start += chunkSize {
+			end := start + chunkSize - 1
+			if end > r.End {
+				end = r.End
+			}
+			out = append(out, storage.PageRange{Start: start, End: end})
+		}
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+package pageranges
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// r returns the page range start-end.
+func r(start, end int64) storage.PageRange {
+	return storage.PageRange{Start: start, End: end}
+}
+
+func TestNormalize(t *testing.T) {
+	for _, tt := range []struct {
+		in   []storage.PageRange
+		want []storage.PageRange
+	}{
+		{nil, nil},
+		{[]storage.PageRange{r(0, 511)}, []storage.PageRange{r(0, 511)}},
+		{[]storage.PageRange{r(1024, 1535), r(0, 511)}, []storage.PageRange{r(0, 511), r(1024, 1535)}},
+		{[]storage.PageRange{r(512, 1023), r(0, 511)}, []storage.PageRange{r(0, 1023)}},
+		{[]storage.PageRange{r(0, 2047), r(512, 1023)}, []storage.PageRange{r(0, 2047)}},
+		{[]storage.PageRange{r(0, 1023), r(512, 1535)}, []storage.PageRange{r(0, 1535)}},
+	} {
+		if got := Normalize(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Normalize(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSubtract(t *testing.T) {
+	for _, tt := range []struct {
+		a, b []storage.PageRange
+		want []storage.PageRange
+	}{
+		{[]storage.PageRange{r(0, 2047)}, nil, []storage.PageRange{r(0, 2047)}},
+		{[]storage.PageRange{r(0, 2047)}, []storage.PageRange{r(0, 2047)}, nil},
+		{[]storage.PageRange{r(0, 2047)}, []storage.PageRange{r(512, 1023)}, []storage.PageRange{r(0, 511), r(1024, 2047)}},
+		{[]storage.PageRange{r(0, 1023), r(2048, 3071)}, []storage.PageRange{r(512, 2559)}, []storage.PageRange{r(0, 511), r(2560, 3071)}},
+		{[]storage.PageRange{r(1024, 1535)}, []storage.PageRange{r(0, 511), r(2048, 2559)}, []storage.PageRange{r(1024, 1535)}},
+	} {
+		if got := Subtract(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Subtract(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestClampAndSplit(t *testing.T) {
+	ranges := []storage.PageRange{r(0, 1535), r(2048, 4095), r(8192, 8703)}
+	clamped := Clamp(ranges, 3072)
+	if want := []storage.PageRange{r(0, 1535), r(2048, 3071)}; !reflect.DeepEqual(clamped, want) {
+		t.Errorf("Clamp() = %v, want %v", clamped, want)
+	}
+	if got, want := Split(clamped, 1024), []storage.PageRange{r(0, 1023), r(1024, 1535), r(2048, 3071)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Split() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,37 @@
+// Package tags reads the tags of ARM resources and matches them against
+// selectors, for the packages that pick resources by tag.
+package tags
+
+import "strings"
+
+// AnyValue matches every value of a tag in a selector.
+const AnyValue = "*"
+
+// Get returns the value of the tag key, whose name is matched without
+// regard to case as ARM does.
+func Get(tags *map[string]*string, key string) (string, bool) {
+	if tags == nil {
+		return "", false
+	}
+	for k, v := range *tags {
+		if strings.EqualFold(k, key) {
+			if v == nil {
+				return "", true
+			}
+			return *v, true
+		}
+	}
+	return "", false
+}
+
+// Match reports whether tags has every tag of selector with its value, or
+// with any value where the selector has AnyValue.
+func Match(tags *map[string]*string, selector map[string]string) bool {
+	for key, want := range selector {
+		value, ok := Get(tags, key)
+		if !ok || want != AnyValue && value != want {
+			return false
+		}
+	}
+	return true
+}
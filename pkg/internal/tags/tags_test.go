@@ -0,0 +1,26 @@
+package tags
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	backup, empty := "nightly", ""
+	tags := &map[string]*string{"Backup": &backup, "owner": &empty, "team": nil}
+	for _, tt := range []struct {
+		selector map[string]string
+		want     bool
+	}{
+		{nil, true},
+		{map[string]string{"backup": "nightly"}, true},
+		{map[string]string{"BACKUP": AnyValue, "owner": ""}, true},
+		{map[string]string{"team": AnyValue}, true},
+		{map[string]string{"backup": "Nightly"}, false},
+		{map[string]string{"backup": "nightly", "env": AnyValue}, false},
+	} {
+		if got := Match(tags, tt.selector); got != tt.want {
+			t.Errorf("Match(%v) = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+	if Match(nil, map[string]string{"backup": AnyValue}) {
+		t.Errorf("Match() of a resource without tags = true")
+	}
+}
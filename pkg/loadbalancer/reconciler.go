@@ -0,0 +1,916 @@
+// Package loadbalancer exposes services of type LoadBalancer through Azure
+// load balancers. A Reconciler compares the frontend IP configuration,
+// probes and rules a service needs with those of the load balancer and
+// writes the load balancer only when they differ. Services share two load
+// balancers per cluster, a public and an internal one, so everything that
+// belongs to a service is named after it and left alone by the others.
+// Nodes are put in the backend pool through their network interfaces.
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+	"github.com/honcao/cloudprovider/pkg/resourceid"
+)
+
+const (
+	networkProvider        = "Microsoft.Network"
+	loadBalancersType      = "loadBalancers"
+	frontendsType          = "frontendIPConfigurations"
+	backendPoolsType       = "backendAddressPools"
+	probesType             = "probes"
+	loadBalancingRulesType = "loadBalancingRules"
+	scaleSetsType          = "virtualMachineScaleSets"
+
+	defaultBackendPoolName = "kubernetes"
+	internalSuffix         = "-internal"
+	defaultHealthProbePath = "/healthz"
+	healthProbeSuffix      = "health"
+
+	probeIntervalSeconds = 5
+	probeCount           = 2
+
+	// maxPrefixLength keeps the names of rules and probes, which add the
+	// protocol and port to the prefix, under the 80 character limit.
+	maxPrefixLength = 33
+
+	tagService = "service"
+
+	// updateAttempts bounds how often a write that lost a race is retried.
+	updateAttempts = 5
+)
+
+// validServiceID matches the service IDs names can be derived from.
+var validServiceID = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// errPreconditionFailed is returned by writes whose ETag no longer matches.
+var errPreconditionFailed = errors.New("loadbalancer: changed since it was read")
+
+// Port is a port a service exposes.
+type Port struct {
+	Protocol network.TransportProtocol
+	// Port is the frontend port.
+	Port int32
+	// NodePort is the port the service listens on on every node, and the
+	// backend port of the rule.
+	NodePort int32
+}
+
+// ServiceSpec is what a service asks of the load balancer.
+type ServiceSpec struct {
+	// ID uniquely and durably identifies the service, e.g. its Kubernetes
+	// UID. The names of its frontend, rules, probes and public IP address
+	// derive from it.
+	ID    string
+	Ports []Port
+	// SessionAffinity sends the requests of a client to the same node, as
+	// the ClientIP affinity of Kubernetes.
+	SessionAffinity bool
+	// Internal puts the service on the internal load balancer, with a
+	// private IP address in the subnet of the cluster.
+	Internal bool
+	// LoadBalancerIP is the private IP address of an internal service. It
+	// is allocated dynamically if empty.
+	LoadBalancerIP string
+	// SourceRanges are the CIDRs allowed to reach the service. Load
+	// balancers cannot filter traffic; they are enforced by the network
+	// security group of the cluster.
+	SourceRanges []string
+	// HealthProbePath turns the probes of TCP ports into HTTP probes of
+	// that path.
+	HealthProbePath string
+	// HealthCheckNodePort, if set, replaces the probes of every port by an
+	// HTTP probe of that node port, as used for the Local external traffic
+	// policy of Kubernetes. HealthProbePath defaults to /healthz then.
+	HealthCheckNodePort int32
+}
+
+// Status is the outcome of Reconcile.
+type Status struct {
+	// IP is the frontend IP address of the service.
+	IP string
+}
+
+// LoadBalancersClient is the subset of network.LoadBalancersClient the
+// reconciler uses.
+type LoadBalancersClient interface {
+	Get(resourceGroupName string, loadBalancerName string, expand string) (network.LoadBalancer, error)
+	CreateOrUpdatePreparer(resourceGroupName string, loadBalancerName string, parameters network.LoadBalancer, cancel <-chan struct{}) (*http.Request, error)
+	CreateOrUpdateSender(req *http.Request) (*http.Response, error)
+	CreateOrUpdateResponder(resp *http.Response) (network.LoadBalancer, error)
+}
+
+var _ LoadBalancersClient = network.LoadBalancersClient{}
+
+// PublicIPAddressesClient is the subset of network.PublicIPAddressesClient
+// the reconciler uses.
+type PublicIPAddressesClient interface {
+	Get(resourceGroupName string, publicIPAddressName string, expand string) (network.PublicIPAddress, error)
+	CreateOrUpdate(resourceGroupName string, publicIPAddressName string, parameters network.PublicIPAddress, cancel <-chan struct{}) (<-chan network.PublicIPAddress, <-chan error)
+	Delete(resourceGroupName string, publicIPAddressName string, cancel <-chan struct{}) (<-chan autorest.Response, <-chan error)
+}
+
+var _ PublicIPAddressesClient = network.PublicIPAddressesClient{}
+
+// InterfacesClient is the subset of network.InterfacesClient the
+// reconciler uses.
+type InterfacesClient interface {
+	Get(resourceGroupName string, networkInterfaceName string, expand string) (network.Interface, error)
+	CreateOrUpdatePreparer(resourceGroupName string, networkInterfaceName string, parameters network.Interface, cancel <-chan struct{}) (*http.Request, error)
+	CreateOrUpdateSender(req *http.Request) (*http.Response, error)
+	CreateOrUpdateResponder(resp *http.Response) (network.Interface, error)
+}
+
+var _ InterfacesClient = network.InterfacesClient{}
+
+// Config configures a Reconciler.
+type Config struct {
+	SubscriptionID string
+	// ResourceGroup holds the load balancers and public IP addresses.
+	ResourceGroup string
+	Location      string
+	// LoadBalancerName is the name of the public load balancer. The
+	// internal one has "-internal" appended.
+	LoadBalancerName string
+	// BackendPoolName is the name of the backend pool of the nodes. It
+	// defaults to "kubernetes".
+	BackendPoolName string
+	// SubnetID is the resource ID of the subnet of internal frontends.
+	SubnetID string
+
+	LoadBalancers     LoadBalancersClient
+	PublicIPAddresses PublicIPAddressesClient
+	Interfaces        InterfacesClient
+}
+
+// Reconciler brings load balancers in line with services.
+type Reconciler struct {
+	config Config
+	// mu serializes reconciles, which read and write whole load balancers
+	// shared by services.
+	mu sync.Mutex
+}
+
+// NewReconciler validates config and returns a Reconciler.
+func NewReconciler(config Config) (*Reconciler, error) {
+	if config.SubscriptionID == "" || config.ResourceGroup == "" || config.Location == "" {
+		return nil, fmt.Errorf("loadbalancer: a subscription, resource group and location are required")
+	}
+	if config.LoadBalancerName == "" {
+		return nil, fmt.Errorf("loadbalancer: a load balancer name is required")
+	}
+	if config.LoadBalancers == nil || config.PublicIPAddresses == nil || config.Interfaces == nil {
+		return nil, fmt.Errorf("loadbalancer: load balancer, public IP address and interface clients are required")
+	}
+	if config.BackendPoolName == "" {
+		config.BackendPoolName = defaultBackendPoolName
+	}
+	return &Reconciler{config: config}, nil
+}
+
+// Reconcile exposes the service spec on its load balancer, creating the load
+// balancer and public IP address as needed, and makes the primary IP
+// configurations of the network interfaces nics, given by resource ID, the
+// members of the backend pool. The network interfaces of scale set VMs
+// belong to the scale set model and are left alone.
+func (r *Reconciler) Reconcile(spec ServiceSpec, nics []string) (Status, error) {
+	if err := spec.validate(); err != nil {
+		return Status{}, err
+	}
+	if spec.Internal && r.config.SubnetID == "" {
+		return Status{}, fmt.Errorf("loadbalancer: service %s is internal but no subnet is configured", spec.ID)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := spec.prefix()
+	name, other := r.config.LoadBalancerName, r.internalName()
+	if spec.Internal {
+		name, other = other, name
+	}
+	// The service may have switched between internal and public.
+	if err := r.removeService(other, prefix); err != nil {
+		return Status{}, err
+	}
+	var pip network.PublicIPAddress
+	var err error
+	if spec.Internal {
+		err = r.deletePublicIP(prefix)
+	} else {
+		pip, err = r.ensurePublicIP(spec, prefix)
+	}
+	if err != nil {
+		return Status{}, err
+	}
+
+	lb, err := r.updateLoadBalancer(name, true, func(lb *network.LoadBalancer) bool {
+		changed := r.ensureFrontend(lb, name, spec, prefix, pip)
+		changed = r.ensureBackendPool(lb, name) || changed
+		return r.ensureProbesAndRules(lb, name, spec, prefix) || changed
+	})
+	if err != nil {
+		return Status{}, err
+	}
+
+	if err := r.syncBackendPool(r.childID(name, backendPoolsType, r.config.BackendPoolName), lb, nics); err != nil {
+		return Status{}, err
+	}
+
+	status := Status{}
+	if spec.Internal {
+		if fe := findFrontend(lb, prefix); fe != nil && fe.FrontendIPConfigurationPropertiesFormat != nil && fe.PrivateIPAddress != nil {
+			status.IP = *fe.PrivateIPAddress
+		}
+	} else if pip.PublicIPAddressPropertiesFormat != nil && pip.IPAddress != nil {
+		status.IP = *pip.IPAddress
+	}
+	return status, nil
+}
+
+// Delete removes the frontend, rules, probes and public IP address of the
+// service. The load balancers and their backend pools stay for the other
+// services.
+func (r *Reconciler) Delete(spec ServiceSpec) error {
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := spec.prefix()
+	for _, name := range []string{r.config.LoadBalancerName, r.internalName()} {
+		if err := r.removeService(name, prefix); err != nil {
+			return err
+		}
+	}
+	return r.deletePublicIP(prefix)
+}
+
+func (r *Reconciler) internalName() string {
+	return r.config.LoadBalancerName + internalSuffix
+}
+
+// childID returns the resource ID of a part of the load balancer name.
+func (r *Reconciler) childID(name, childType, childName string) string {
+	return resourceid.New(r.config.SubscriptionID, r.config.ResourceGroup, networkProvider, loadBalancersType, name).Child(childType, childName).String()
+}
+
+// getLoadBalancer returns the load balancer name, or an empty one to create
+// if it does not exist.
+func (r *Reconciler) getLoadBalancer(name string) (network.LoadBalancer, bool, error) {
+	lb, err := r.config.LoadBalancers.Get(r.config.ResourceGroup, name, "")
+	if apierror.IsNotFound(err) {
+		location := r.config.Location
+		return network.LoadBalancer{
+			Location:                     &location,
+			LoadBalancerPropertiesFormat: &network.LoadBalancerPropertiesFormat{},
+		}, false, nil
+	}
+	if err != nil {
+		return network.LoadBalancer{}, false, fmt.Errorf("loadbalancer: getting load balancer %s: %v", name, err)
+	}
+	if lb.LoadBalancerPropertiesFormat == nil {
+		lb.LoadBalancerPropertiesFormat = &network.LoadBalancerPropertiesFormat{}
+	}
+	return lb, true, nil
+}
+
+// updateLoadBalancer reads the load balancer name, applies update to it and
+// writes it if update reports a change, starting over when the load
+// balancer changed in between. A missing load balancer is created if
+// create is set, and left alone otherwise. It returns the load balancer as
+// written, or as read if unchanged.
+func (r *Reconciler) updateLoadBalancer(name string, create bool, update func(lb *network.LoadBalancer) bool) (network.LoadBalancer, error) {
+	for attempt := 1; ; attempt++ {
+		lb, exists, err := r.getLoadBalancer(name)
+		if err != nil || (!exists && !create) {
+			return lb, err
+		}
+		if !update(&lb) && exists {
+			glog.V(2).Infof("loadbalancer: load balancer %s is up to date", name)
+			return lb, nil
+		}
+		lb, err = r.putLoadBalancer(name, lb)
+		if err != errPreconditionFailed {
+			return lb, err
+		}
+		if attempt == updateAttempts {
+			return network.LoadBalancer{}, fmt.Errorf("loadbalancer: load balancer %s kept changing while being updated", name)
+		}
+		glog.V(2).Infof("loadbalancer: load balancer %s changed while being updated, retrying", name)
+	}
+}
+
+// putLoadBalancer writes lb on condition that the load balancer still has
+// the ETag lb was read with, or, for a new load balancer without one, that
+// it still does not exist.
+func (r *Reconciler) putLoadBalancer(name string, lb network.LoadBalancer) (network.LoadBalancer, error) {
+	glog.V(2).Infof("loadbalancer: updating load balancer %s", name)
+	etag := lb.Etag
+	// Leave out what the service computes.
+	lb.Etag = nil
+	lb.ProvisioningState = nil
+	req, err := r.config.LoadBalancers.CreateOrUpdatePreparer(r.config.ResourceGroup, name, lb, nil)
+	if err != nil {
+		return network.LoadBalancer{}, fmt.Errorf("loadbalancer: preparing update of load balancer %s: %v", name, err)
+	}
+	if etag != nil {
+		req.Header.Set("If-Match", *etag)
+	} else {
+		req.Header.Set("If-None-Match", "*")
+	}
+	resp, err := r.config.LoadBalancers.CreateOrUpdateSender(req)
+	var result network.LoadBalancer
+	if err == nil {
+		result, err = r.config.LoadBalancers.CreateOrUpdateResponder(resp)
+	}
+	if resp != nil && resp.StatusCode == http.StatusPreconditionFailed {
+		return network.LoadBalancer{}, errPreconditionFailed
+	}
+	if err != nil {
+		return network.LoadBalancer{}, fmt.Errorf("loadbalancer: updating load balancer %s: %v", name, err)
+	}
+	return result, nil
+}
+
+// removeService removes what belongs to the service prefix from the load
+// balancer name, if it exists.
+func (r *Reconciler) removeService(name, prefix string) error {
+	_, err := r.updateLoadBalancer(name, false, func(lb *network.LoadBalancer) bool {
+		changed := false
+		if lb.LoadBalancingRules != nil {
+			kept := []network.LoadBalancingRule{}
+			for _, rule := range *lb.LoadBalancingRules {
+				if owned(rule.Name, prefix) {
+					changed = true
+					continue
+				}
+				kept = append(kept, rule)
+			}
+			lb.LoadBalancingRules = &kept
+		}
+		if lb.Probes != nil {
+			kept := []network.Probe{}
+			for _, probe := range *lb.Probes {
+				if owned(probe.Name, prefix) {
+					changed = true
+					continue
+				}
+				kept = append(kept, probe)
+			}
+			lb.Probes = &kept
+		}
+		if lb.FrontendIPConfigurations != nil {
+			kept := []network.FrontendIPConfiguration{}
+			for _, fe := range *lb.FrontendIPConfigurations {
+				if owned(fe.Name, prefix) {
+					changed = true
+					continue
+				}
+				kept = append(kept, fe)
+			}
+			lb.FrontendIPConfigurations = &kept
+		}
+		if changed {
+			glog.V(2).Infof("loadbalancer: removing service %s from load balancer %s", prefix, name)
+		}
+		return changed
+	})
+	return err
+}
+
+// ensureFrontend adds or fixes the frontend IP configuration of the
+// service and reports whether it changed lb.
+func (r *Reconciler) ensureFrontend(lb *network.LoadBalancer, name string, spec ServiceSpec, prefix string, pip network.PublicIPAddress) bool {
+	want := network.FrontendIPConfigurationPropertiesFormat{}
+	if spec.Internal {
+		want.Subnet = &network.Subnet{ID: stringPtr(r.config.SubnetID)}
+		want.PrivateIPAllocationMethod = network.Dynamic
+		if spec.LoadBalancerIP != "" {
+			ip := spec.LoadBalancerIP
+			want.PrivateIPAllocationMethod = network.Static
+			want.PrivateIPAddress = &ip
+		}
+	} else {
+		want.PublicIPAddress = &network.PublicIPAddress{ID: pip.ID}
+	}
+
+	if fe := findFrontend(*lb, prefix); fe != nil {
+		have := fe.FrontendIPConfigurationPropertiesFormat
+		if have != nil && frontendMatches(*have, want) {
+			return false
+		}
+		fe.FrontendIPConfigurationPropertiesFormat = &want
+		return true
+	}
+	frontends := append(derefFrontends(lb.FrontendIPConfigurations), network.FrontendIPConfiguration{
+		Name:                                    stringPtr(prefix),
+		ID:                                      stringPtr(r.childID(name, frontendsType, prefix)),
+		FrontendIPConfigurationPropertiesFormat: &want,
+	})
+	lb.FrontendIPConfigurations = &frontends
+	return true
+}
+
+// ensureBackendPool adds the backend pool of the nodes and reports whether
+// it changed lb.
+func (r *Reconciler) ensureBackendPool(lb *network.LoadBalancer, name string) bool {
+	pools := []network.BackendAddressPool{}
+	if lb.BackendAddressPools != nil {
+		pools = *lb.BackendAddressPools
+	}
+	for _, pool := range pools {
+		if pool.Name != nil && strings.EqualFold(*pool.Name, r.config.BackendPoolName) {
+			return false
+		}
+	}
+	pools = append(pools, network.BackendAddressPool{
+		Name: stringPtr(r.config.BackendPoolName),
+		ID:   stringPtr(r.childID(name, backendPoolsType, r.config.BackendPoolName)),
+	})
+	lb.BackendAddressPools = &pools
+	return true
+}
+
+// ensureProbesAndRules makes the probes and rules of the service those of
+// spec and reports whether it changed lb.
+func (r *Reconciler) ensureProbesAndRules(lb *network.LoadBalancer, name string, spec ServiceSpec, prefix string) bool {
+	wantProbes, wantRules := r.desiredProbesAndRules(name, spec, prefix)
+	changed := false
+
+	probes := []network.Probe{}
+	pendingProbes := map[string]network.Probe{}
+	for _, probe := range wantProbes {
+		pendingProbes[strings.ToLower(*probe.Name)] = probe
+	}
+	for _, probe := range derefProbes(lb.Probes) {
+		if !owned(probe.Name, prefix) {
+			probes = append(probes, probe)
+			continue
+		}
+		key := strings.ToLower(*probe.Name)
+		want, ok := pendingProbes[key]
+		if !ok {
+			changed = true
+			continue
+		}
+		delete(pendingProbes, key)
+		if probe.ProbePropertiesFormat == nil || !probeMatches(*probe.ProbePropertiesFormat, *want.ProbePropertiesFormat) {
+			probe.ProbePropertiesFormat = want.ProbePropertiesFormat
+			changed = true
+		}
+		probes = append(probes, probe)
+	}
+	for _, probe := range wantProbes {
+		if _, ok := pendingProbes[strings.ToLower(*probe.Name)]; ok {
+			probes = append(probes, probe)
+			changed = true
+		}
+	}
+
+	rules := []network.LoadBalancingRule{}
+	pendingRules := map[string]network.LoadBalancingRule{}
+	for _, rule := range wantRules {
+		pendingRules[strings.ToLower(*rule.Name)] = rule
+	}
+	for _, rule := range derefRules(lb.LoadBalancingRules) {
+		if !owned(rule.Name, prefix) {
+			rules = append(rules, rule)
+			continue
+		}
+		key := strings.ToLower(*rule.Name)
+		want, ok := pendingRules[key]
+		if !ok {
+			changed = true
+			continue
+		}
+		delete(pendingRules, key)
+		if rule.LoadBalancingRulePropertiesFormat == nil || !ruleMatches(*rule.LoadBalancingRulePropertiesFormat, *want.LoadBalancingRulePropertiesFormat) {
+			rule.LoadBalancingRulePropertiesFormat = want.LoadBalancingRulePropertiesFormat
+			changed = true
+		}
+		rules = append(rules, rule)
+	}
+	for _, rule := range wantRules {
+		if _, ok := pendingRules[strings.ToLower(*rule.Name)]; ok {
+			rules = append(rules, rule)
+			changed = true
+		}
+	}
+
+	lb.Probes = &probes
+	lb.LoadBalancingRules = &rules
+	return changed
+}
+
+// desiredProbesAndRules returns the probes and rules of the service. Every
+// port gets a rule named <prefix>-<protocol>-<port>, and TCP ports a probe
+// of the same name, unless a health check node port is probed for all.
+func (r *Reconciler) desiredProbesAndRules(name string, spec ServiceSpec, prefix string) ([]network.Probe, []network.LoadBalancingRule) {
+	var probes []network.Probe
+	var rules []network.LoadBalancingRule
+	distribution := network.Default
+	if spec.SessionAffinity {
+		distribution = network.SourceIP
+	}
+
+	healthProbe := ""
+	if spec.HealthCheckNodePort != 0 {
+		path := spec.HealthProbePath
+		if path == "" {
+			path = defaultHealthProbePath
+		}
+		healthProbe = prefix + "-" + healthProbeSuffix
+		probes = append(probes, newProbe(r.childID(name, probesType, healthProbe), healthProbe, network.ProbeProtocolHTTP, spec.HealthCheckNodePort, path))
+	}
+
+	for _, port := range spec.Ports {
+		ruleName := fmt.Sprintf("%s-%s-%d", prefix, port.Protocol, port.Port)
+		var probe *network.SubResource
+		switch {
+		case healthProbe != "":
+			probe = &network.SubResource{ID: stringPtr(r.childID(name, probesType, healthProbe))}
+		case port.Protocol == network.TransportProtocolTCP:
+			protocol := network.ProbeProtocolTCP
+			if spec.HealthProbePath != "" {
+				protocol = network.ProbeProtocolHTTP
+			}
+			probes = append(probes, newProbe(r.childID(name, probesType, ruleName), ruleName, protocol, port.NodePort, spec.HealthProbePath))
+			probe = &network.SubResource{ID: stringPtr(r.childID(name, probesType, ruleName))}
+		}
+		// Load balancers cannot probe UDP, so UDP rules go without a probe.
+		rules = append(rules, network.LoadBalancingRule{
+			Name: stringPtr(ruleName),
+			ID:   stringPtr(r.childID(name, loadBalancingRulesType, ruleName)),
+			LoadBalancingRulePropertiesFormat: &network.LoadBalancingRulePropertiesFormat{
+				FrontendIPConfiguration: &network.SubResource{ID: stringPtr(r.childID(name, frontendsType, prefix))},
+				BackendAddressPool:      &network.SubResource{ID: stringPtr(r.childID(name, backendPoolsType, r.config.BackendPoolName))},
+				Probe:                   probe,
+				Protocol:                port.Protocol,
+				LoadDistribution:        distribution,
+				FrontendPort:            int32Ptr(port.Port),
+				BackendPort:             int32Ptr(port.NodePort),
+				EnableFloatingIP:        boolPtr(false),
+			},
+		})
+	}
+	return probes, rules
+}
+
+// ensurePublicIP returns the public IP address of the service, creating it
+// if needed.
+func (r *Reconciler) ensurePublicIP(spec ServiceSpec, prefix string) (network.PublicIPAddress, error) {
+	name := r.publicIPName(prefix)
+	pip, err := r.config.PublicIPAddresses.Get(r.config.ResourceGroup, name, "")
+	if err == nil {
+		return pip, nil
+	}
+	if !apierror.IsNotFound(err) {
+		return network.PublicIPAddress{}, fmt.Errorf("loadbalancer: getting public IP address %s: %v", name, err)
+	}
+
+	location := r.config.Location
+	id := spec.ID
+	glog.V(2).Infof("loadbalancer: creating public IP address %s for service %s", name, spec.ID)
+	resultc, errc := r.config.PublicIPAddresses.CreateOrUpdate(r.config.ResourceGroup, name, network.PublicIPAddress{
+		Location: &location,
+		Tags:     &map[string]*string{tagService: &id},
+		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
+			PublicIPAllocationMethod: network.Static,
+		},
+	}, nil)
+	if err := <-errc; err != nil {
+		return network.PublicIPAddress{}, fmt.Errorf("loadbalancer: creating public IP address %s: %v", name, err)
+	}
+	return <-resultc, nil
+}
+
+// deletePublicIP deletes the public IP address of the service, if any.
+func (r *Reconciler) deletePublicIP(prefix string) error {
+	name := r.publicIPName(prefix)
+	_, errc := r.config.PublicIPAddresses.Delete(r.config.ResourceGroup, name, nil)
+	if err := <-errc; err != nil && !apierror.IsNotFound(err) {
+		return fmt.Errorf("loadbalancer: deleting public IP address %s: %v", name, err)
+	}
+	return nil
+}
+
+func (r *Reconciler) publicIPName(prefix string) string {
+	return r.config.LoadBalancerName + "-" + prefix
+}
+
+// syncBackendPool makes the network interfaces nics, and only them, members
+// of the backend pool poolID of lb.
+func (r *Reconciler) syncBackendPool(poolID string, lb network.LoadBalancer, nics []string) error {
+	want := map[string]bool{}
+	for _, nic := range nics {
+		id, err := resourceid.Parse(nic)
+		if err != nil {
+			return err
+		}
+		if _, ok := id.NameOf(scaleSetsType); ok {
+			glog.V(2).Infof("loadbalancer: leaving network interface %s to its scale set", nic)
+			continue
+		}
+		want[id.Key()] = true
+		if err := r.updateInterface(id, poolID, true); err != nil {
+			return err
+		}
+	}
+
+	for _, pool := range derefPools(lb.BackendAddressPools) {
+		if pool.ID == nil || !strings.EqualFold(*pool.ID, poolID) || pool.BackendAddressPoolPropertiesFormat == nil || pool.BackendIPConfigurations == nil {
+			continue
+		}
+		for _, ipConfig := range *pool.BackendIPConfigurations {
+			if ipConfig.ID == nil {
+				continue
+			}
+			id, err := resourceid.Parse(*ipConfig.ID)
+			if err != nil {
+				return err
+			}
+			nic, _ := id.Parent()
+			if _, ok := nic.NameOf(scaleSetsType); ok || want[nic.Key()] {
+				continue
+			}
+			want[nic.Key()] = true
+			if err := r.updateInterface(nic, poolID, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateInterface adds the backend pool poolID to the primary IP
+// configuration of the network interface id, or removes it from all of
+// them, writing the network interface if that changes it.
+func (r *Reconciler) updateInterface(id resourceid.ID, poolID string, member bool) error {
+	for attempt := 1; ; attempt++ {
+		err := r.tryUpdateInterface(id, poolID, member)
+		if err != errPreconditionFailed {
+			return err
+		}
+		if attempt == updateAttempts {
+			return fmt.Errorf("loadbalancer: network interface %s kept changing while being updated", id.Name())
+		}
+		glog.V(2).Infof("loadbalancer: network interface %s changed while being updated, retrying", id.Name())
+	}
+}
+
+// tryUpdateInterface is one attempt of updateInterface. It returns
+// errPreconditionFailed if the network interface changed after it was read.
+func (r *Reconciler) tryUpdateInterface(id resourceid.ID, poolID string, member bool) error {
+	nic, err := r.config.Interfaces.Get(id.ResourceGroup, id.Name(), "")
+	if err != nil {
+		return fmt.Errorf("loadbalancer: getting network interface %s: %v", id.Name(), err)
+	}
+	if nic.InterfacePropertiesFormat == nil || nic.IPConfigurations == nil || len(*nic.IPConfigurations) == 0 {
+		return fmt.Errorf("loadbalancer: network interface %s has no IP configurations", id.Name())
+	}
+
+	changed := false
+	configs := *nic.IPConfigurations
+	primary := 0
+	for i, c := range configs {
+		if c.InterfaceIPConfigurationPropertiesFormat != nil && c.Primary != nil && *c.Primary {
+			primary = i
+		}
+	}
+	for i := range configs {
+		props := configs[i].InterfaceIPConfigurationPropertiesFormat
+		if props == nil {
+			continue
+		}
+		var pools []network.BackendAddressPool
+		in := false
+		if props.LoadBalancerBackendAddressPools != nil {
+			for _, pool := range *props.LoadBalancerBackendAddressPools {
+				if pool.ID != nil && strings.EqualFold(*pool.ID, poolID) {
+					in = true
+					if !member {
+						changed = true
+						continue
+					}
+				}
+				pools = append(pools, pool)
+			}
+		}
+		if member && i == primary && !in {
+			pools = append(pools, network.BackendAddressPool{ID: stringPtr(poolID)})
+			changed = true
+		}
+		props.LoadBalancerBackendAddressPools = &pools
+	}
+	if !changed {
+		return nil
+	}
+
+	if member {
+		glog.V(2).Infof("loadbalancer: adding network interface %s to backend pool %s", id.Name(), poolID)
+	} else {
+		glog.V(2).Infof("loadbalancer: removing network interface %s from backend pool %s", id.Name(), poolID)
+	}
+	etag := nic.Etag
+	nic.Etag = nil
+	nic.ProvisioningState = nil
+	req, err := r.config.Interfaces.CreateOrUpdatePreparer(id.ResourceGroup, id.Name(), nic, nil)
+	if err != nil {
+		return fmt.Errorf("loadbalancer: preparing update of network interface %s: %v", id.Name(), err)
+	}
+	if etag != nil {
+		req.Header.Set("If-Match", *etag)
+	}
+	resp, err := r.config.Interfaces.CreateOrUpdateSender(req)
+	if err == nil {
+		_, err = r.config.Interfaces.CreateOrUpdateResponder(resp)
+	}
+	if resp != nil && resp.StatusCode == http.StatusPreconditionFailed {
+		return errPreconditionFailed
+	}
+	if err != nil {
+		return fmt.Errorf("loadbalancer: updating network interface %s: %v", id.Name(), err)
+	}
+	return nil
+}
+
+func (spec ServiceSpec) validate() error {
+	if !validServiceID.MatchString(spec.ID) {
+		return fmt.Errorf("loadbalancer: service ID %q must be letters, digits and hyphens", spec.ID)
+	}
+	if len(spec.Ports) == 0 {
+		return fmt.Errorf("loadbalancer: service %s has no ports", spec.ID)
+	}
+	seen := map[string]bool{}
+	for _, port := range spec.Ports {
+		if port.Protocol != network.TransportProtocolTCP && port.Protocol != network.TransportProtocolUDP {
+			return fmt.Errorf("loadbalancer: service %s has port %d with unsupported protocol %q", spec.ID, port.Port, port.Protocol)
+		}
+		if port.Port < 1 || port.Port > 65535 || port.NodePort < 1 || port.NodePort > 65535 {
+			return fmt.Errorf("loadbalancer: service %s has port %d with node port %d out of range", spec.ID, port.Port, port.NodePort)
+		}
+		key := fmt.Sprintf("%s/%d", port.Protocol, port.Port)
+		if seen[key] {
+			return fmt.Errorf("loadbalancer: service %s has port %s twice", spec.ID, key)
+		}
+		seen[key] = true
+	}
+	if spec.HealthProbePath != "" && !strings.HasPrefix(spec.HealthProbePath, "/") {
+		return fmt.Errorf("loadbalancer: health probe path %q of service %s does not start with /", spec.HealthProbePath, spec.ID)
+	}
+	if spec.LoadBalancerIP != "" && !spec.Internal {
+		return fmt.Errorf("loadbalancer: service %s asks for IP address %s, which only internal services can", spec.ID, spec.LoadBalancerIP)
+	}
+	return nil
+}
+
+// prefix returns the name of the frontend of the service, which starts the
+// names of its rules and probes.
+func (spec ServiceSpec) prefix() string {
+	prefix := "a" + strings.ToLower(strings.Replace(spec.ID, "-", "", -1))
+	if len(prefix) > maxPrefixLength {
+		prefix = prefix[:maxPrefixLength]
+	}
+	return prefix
+}
+
+// owned reports whether name is that of something belonging to the service
+// prefix.
+func owned(name *string, prefix string) bool {
+	if name == nil {
+		return false
+	}
+	n := strings.ToLower(*name)
+	return n == prefix || strings.HasPrefix(n, prefix+"-")
+}
+
+func findFrontend(lb network.LoadBalancer, prefix string) *network.FrontendIPConfiguration {
+	if lb.LoadBalancerPropertiesFormat == nil || lb.FrontendIPConfigurations == nil {
+		return nil
+	}
+	frontends := *lb.FrontendIPConfigurations
+	for i := range frontends {
+		if frontends[i].Name != nil && strings.EqualFold(*frontends[i].Name, prefix) {
+			return &frontends[i]
+		}
+	}
+	return nil
+}
+
+func frontendMatches(have, want network.FrontendIPConfigurationPropertiesFormat) bool {
+	if want.PublicIPAddress != nil {
+		return have.PublicIPAddress != nil && idsEqual(have.PublicIPAddress.ID, want.PublicIPAddress.ID)
+	}
+	if have.PublicIPAddress != nil || have.Subnet == nil || !idsEqual(have.Subnet.ID, want.Subnet.ID) {
+		return false
+	}
+	if want.PrivateIPAllocationMethod == network.Static {
+		return have.PrivateIPAllocationMethod == network.Static && stringsEqual(have.PrivateIPAddress, want.PrivateIPAddress)
+	}
+	return have.PrivateIPAllocationMethod != network.Static
+}
+
+func probeMatches(have, want network.ProbePropertiesFormat) bool {
+	return strings.EqualFold(string(have.Protocol), string(want.Protocol)) &&
+		int32sEqual(have.Port, want.Port) &&
+		int32sEqual(have.IntervalInSeconds, want.IntervalInSeconds) &&
+		int32sEqual(have.NumberOfProbes, want.NumberOfProbes) &&
+		stringsEqual(have.RequestPath, want.RequestPath)
+}
+
+func ruleMatches(have, want network.LoadBalancingRulePropertiesFormat) bool {
+	return subResourcesEqual(have.FrontendIPConfiguration, want.FrontendIPConfiguration) &&
+		subResourcesEqual(have.BackendAddressPool, want.BackendAddressPool) &&
+		subResourcesEqual(have.Probe, want.Probe) &&
+		strings.EqualFold(string(have.Protocol), string(want.Protocol)) &&
+		(have.LoadDistribution == want.LoadDistribution || have.LoadDistribution == "" && want.LoadDistribution == network.Default) &&
+		int32sEqual(have.FrontendPort, want.FrontendPort) &&
+		int32sEqual(have.BackendPort, want.BackendPort) &&
+		(have.EnableFloatingIP == nil || !*have.EnableFloatingIP)
+}
+
+func newProbe(id, name string, protocol network.ProbeProtocol, port int32, path string) network.Probe {
+	probe := network.Probe{
+		Name: stringPtr(name),
+		ID:   stringPtr(id),
+		ProbePropertiesFormat: &network.ProbePropertiesFormat{
+			Protocol:          protocol,
+			Port:              int32Ptr(port),
+			IntervalInSeconds: int32Ptr(probeIntervalSeconds),
+			NumberOfProbes:    int32Ptr(probeCount),
+		},
+	}
+	if path != "" {
+		probe.RequestPath = stringPtr(path)
+	}
+	return probe
+}
+
+func derefFrontends(p *[]network.FrontendIPConfiguration) []network.FrontendIPConfiguration {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+func derefPools(p *[]network.BackendAddressPool) []network.BackendAddressPool {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+func derefProbes(p *[]network.Probe) []network.Probe {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+func derefRules(p *[]network.LoadBalancingRule) []network.LoadBalancingRule {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+func idsEqual(a, b *string) bool {
+	return a != nil && b != nil && strings.EqualFold(*a, *b)
+}
+
+func subResourcesEqual(a, b *network.SubResource) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return idsEqual(a.ID, b.ID)
+}
+
+func stringsEqual(a, b *string) bool {
+	if a == nil || b == nil {
+		return (a == nil || *a == "") && (b == nil || *b == "")
+	}
+	return *a == *b
+}
+
+func int32sEqual(a, b *int32) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func stringPtr(s string) *string { return &s }
+
+func int32Ptr(i int32) *int32 { return &i }
+
+func boolPtr(b bool) *bool { return &b }
@@ -0,0 +1,376 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+const (
+	testSubscription = "00000000-0000-0000-0000-000000000001"
+	testGroup        = "cluster"
+)
+
+// fakeResources stores resources as JSON under ETags that change on every
+// write, and turns down writes whose If-Match no longer matches, or whose
+// If-None-Match: * finds the resource, as ARM does.
+type fakeResources struct {
+	resources map[string][]byte
+	etags     map[string]string
+	etag      int
+	// race, if set, runs before every write, to change the resource
+	// between the read and the write.
+	race func(name string)
+	// ifMatch and ifNoneMatch hold the If-Match and If-None-Match headers
+	// of the writes.
+	ifMatch     []string
+	ifNoneMatch []string
+}
+
+func newFakeResources() *fakeResources {
+	return &fakeResources{resources: map[string][]byte{}, etags: map[string]string{}}
+}
+
+// set stores v under name with a new ETag.
+func (f *fakeResources) set(name string, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	f.etag++
+	f.resources[name] = body
+	f.etags[name] = strconv.Itoa(f.etag)
+}
+
+// get unmarshals the resource name into v along with its ETag.
+func (f *fakeResources) get(name string, v interface{}, etag **string) error {
+	body, ok := f.resources[name]
+	if !ok {
+		return autorest.DetailedError{StatusCode: http.StatusNotFound}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return err
+	}
+	e := f.etags[name]
+	*etag = &e
+	return nil
+}
+
+func (f *fakeResources) prepare(name string, v interface{}) (*http.Request, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return http.NewRequest(http.MethodPut, "https://management.local/"+name, bytes.NewReader(body))
+}
+
+func (f *fakeResources) send(req *http.Request) (*http.Response, error) {
+	name := path.Base(req.URL.Path)
+	if f.race != nil {
+		f.race(name)
+	}
+	ifMatch, ifNoneMatch := req.Header.Get("If-Match"), req.Header.Get("If-None-Match")
+	f.ifMatch = append(f.ifMatch, ifMatch)
+	f.ifNoneMatch = append(f.ifNoneMatch, ifNoneMatch)
+	resp := &http.Response{Request: req, Body: ioutil.NopCloser(strings.NewReader("{}"))}
+	etag, exists := f.etags[name]
+	if exists && ifMatch != "" && ifMatch != etag || exists && ifNoneMatch == "*" {
+		resp.StatusCode = http.StatusPreconditionFailed
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.resources[name] = body
+	f.etag++
+	f.etags[name] = strconv.Itoa(f.etag)
+	resp.StatusCode = http.StatusOK
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (f *fakeResources) respond(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return autorest.DetailedError{StatusCode: resp.StatusCode}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type fakeLoadBalancers struct{ *fakeResources }
+
+func (f fakeLoadBalancers) Get(resourceGroupName string, loadBalancerName string, expand string) (network.LoadBalancer, error) {
+	var lb network.LoadBalancer
+	err := f.get(loadBalancerName, &lb, &lb.Etag)
+	return lb, err
+}
+
+func (f fakeLoadBalancers) CreateOrUpdatePreparer(resourceGroupName string, loadBalancerName string, parameters network.LoadBalancer, cancel <-chan struct{}) (*http.Request, error) {
+	return f.prepare(loadBalancerName, parameters)
+}
+
+func (f fakeLoadBalancers) CreateOrUpdateSender(req *http.Request) (*http.Response, error) {
+	return f.send(req)
+}
+
+func (f fakeLoadBalancers) CreateOrUpdateResponder(resp *http.Response) (network.LoadBalancer, error) {
+	var lb network.LoadBalancer
+	err := f.respond(resp, &lb)
+	return lb, err
+}
+
+type fakeInterfaces struct{ *fakeResources }
+
+func (f fakeInterfaces) Get(resourceGroupName string, networkInterfaceName string, expand string) (network.Interface, error) {
+	var nic network.Interface
+	err := f.get(networkInterfaceName, &nic, &nic.Etag)
+	return nic, err
+}
+
+func (f fakeInterfaces) CreateOrUpdatePreparer(resourceGroupName string, networkInterfaceName string, parameters network.Interface, cancel <-chan struct{}) (*http.Request, error) {
+	return f.prepare(networkInterfaceName, parameters)
+}
+
+func (f fakeInterfaces) CreateOrUpdateSender(req *http.Request) (*http.Response, error) {
+	return f.send(req)
+}
+
+func (f fakeInterfaces) CreateOrUpdateResponder(resp *http.Response) (network.Interface, error) {
+	var nic network.Interface
+	err := f.respond(resp, &nic)
+	return nic, err
+}
+
+// fakePublicIPAddresses hands out 192.0.2.1 to every public IP address.
+type fakePublicIPAddresses map[string]network.PublicIPAddress
+
+func (f fakePublicIPAddresses) Get(resourceGroupName string, publicIPAddressName string, expand string) (network.PublicIPAddress, error) {
+	pip, ok := f[publicIPAddressName]
+	if !ok {
+		return network.PublicIPAddress{}, autorest.DetailedError{StatusCode: http.StatusNotFound}
+	}
+	return pip, nil
+}
+
+func (f fakePublicIPAddresses) CreateOrUpdate(resourceGroupName string, publicIPAddressName string, parameters network.PublicIPAddress, cancel <-chan struct{}) (<-chan network.PublicIPAddress, <-chan error) {
+	resultc, errc := make(chan network.PublicIPAddress, 1), make(chan error, 1)
+	parameters.ID = stringPtr("/subscriptions/" + testSubscription + "/resourceGroups/" + resourceGroupName + "/providers/Microsoft.Network/publicIPAddresses/" + publicIPAddressName)
+	parameters.IPAddress = stringPtr("192.0.2.1")
+	f[publicIPAddressName] = parameters
+	resultc <- parameters
+	errc <- nil
+	return resultc, errc
+}
+
+func (f fakePublicIPAddresses) Delete(resourceGroupName string, publicIPAddressName string, cancel <-chan struct{}) (<-chan autorest.Response, <-chan error) {
+	delete(f, publicIPAddressName)
+	resultc, errc := make(chan autorest.Response, 1), make(chan error, 1)
+	resultc <- autorest.Response{}
+	errc <- nil
+	return resultc, errc
+}
+
+func newTestReconciler(t *testing.T, lbs, nics *fakeResources) *Reconciler {
+	r, err := NewReconciler(Config{
+		SubscriptionID:    testSubscription,
+		ResourceGroup:     testGroup,
+		Location:          "local",
+		LoadBalancerName:  "kubernetes",
+		LoadBalancers:     fakeLoadBalancers{lbs},
+		PublicIPAddresses: fakePublicIPAddresses{},
+		Interfaces:        fakeInterfaces{nics},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func testSpec() ServiceSpec {
+	return ServiceSpec{
+		ID:    "svc1",
+		Ports: []Port{{Protocol: network.TransportProtocolTCP, Port: 80, NodePort: 30080}},
+	}
+}
+
+func newTestInterface(nics *fakeResources, name string) string {
+	id := "/subscriptions/" + testSubscription + "/resourceGroups/" + testGroup + "/providers/Microsoft.Network/networkInterfaces/" + name
+	nics.set(name, network.Interface{
+		ID:   &id,
+		Name: &name,
+		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
+			IPConfigurations: &[]network.InterfaceIPConfiguration{{
+				Name: stringPtr("ipconfig1"),
+				InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+					Primary: boolPtr(true),
+				},
+			}},
+		},
+	})
+	return id
+}
+
+func TestReconcileRetriesOnPreconditionFailed(t *testing.T) {
+	lbs, nics := newFakeResources(), newFakeResources()
+	lbs.set("kubernetes", network.LoadBalancer{
+		Name:                         stringPtr("kubernetes"),
+		Location:                     stringPtr("local"),
+		LoadBalancerPropertiesFormat: &network.LoadBalancerPropertiesFormat{},
+	})
+	nic := newTestInterface(nics, "node1-nic")
+
+	// Another writer changes both the load balancer and the network
+	// interface between the first read and write of each.
+	for _, f := range []*fakeResources{lbs, nics} {
+		f := f
+		raced := false
+		f.race = func(name string) {
+			if raced {
+				return
+			}
+			raced = true
+			f.etag++
+			f.etags[name] = strconv.Itoa(f.etag)
+		}
+	}
+
+	r := newTestReconciler(t, lbs, nics)
+	status, err := r.Reconcile(testSpec(), []string{nic})
+	if err != nil {
+		t.Fatalf("Reconcile() = %v", err)
+	}
+	if status.IP != "192.0.2.1" {
+		t.Errorf("Reconcile() IP = %q", status.IP)
+	}
+
+	// The first write of each carried the ETag it read and lost; the retry
+	// carried the new one.
+	for _, tt := range []struct {
+		what string
+		f    *fakeResources
+		want []string
+	}{
+		{"load balancer", lbs, []string{"1", "2"}},
+		{"network interface", nics, []string{"1", "2"}},
+	} {
+		if strings.Join(tt.f.ifMatch, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s writes had If-Match %q, want %q", tt.what, tt.f.ifMatch, tt.want)
+		}
+	}
+
+	lb, err := fakeLoadBalancers{lbs}.Get(testGroup, "kubernetes", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(derefRules(lb.LoadBalancingRules)) != 1 || len(derefFrontends(lb.FrontendIPConfigurations)) != 1 {
+		t.Errorf("load balancer has %d rules and %d frontends, want 1 and 1", len(derefRules(lb.LoadBalancingRules)), len(derefFrontends(lb.FrontendIPConfigurations)))
+	}
+	n, err := fakeInterfaces{nics}.Get(testGroup, "node1-nic", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pools := (*n.IPConfigurations)[0].LoadBalancerBackendAddressPools
+	if pools == nil || len(*pools) != 1 || !strings.HasSuffix(*(*pools)[0].ID, "/backendAddressPools/kubernetes") {
+		t.Errorf("network interface is not in the backend pool: %v", pools)
+	}
+
+	// Nothing to change, nothing written.
+	lbs.ifMatch, nics.ifMatch = nil, nil
+	if _, err := r.Reconcile(testSpec(), []string{nic}); err != nil {
+		t.Fatalf("second Reconcile() = %v", err)
+	}
+	if len(lbs.ifMatch) != 0 || len(nics.ifMatch) != 0 {
+		t.Errorf("second Reconcile() wrote %d load balancers and %d network interfaces", len(lbs.ifMatch), len(nics.ifMatch))
+	}
+}
+
+func TestReconcileGivesUpOnContention(t *testing.T) {
+	lbs, nics := newFakeResources(), newFakeResources()
+	lbs.set("kubernetes", network.LoadBalancer{
+		Name:                         stringPtr("kubernetes"),
+		Location:                     stringPtr("local"),
+		LoadBalancerPropertiesFormat: &network.LoadBalancerPropertiesFormat{},
+	})
+	lbs.race = func(name string) {
+		lbs.etag++
+		lbs.etags[name] = strconv.Itoa(lbs.etag)
+	}
+
+	r := newTestReconciler(t, lbs, nics)
+	if _, err := r.Reconcile(testSpec(), nil); err == nil || !strings.Contains(err.Error(), "kept changing") {
+		t.Fatalf("Reconcile() = %v, want an error after %d attempts", err, updateAttempts)
+	}
+	if len(lbs.ifMatch) != updateAttempts {
+		t.Errorf("Reconcile() wrote %d times, want %d", len(lbs.ifMatch), updateAttempts)
+	}
+}
+
+func TestReconcileCreatesLoadBalancer(t *testing.T) {
+	lbs, nics := newFakeResources(), newFakeResources()
+	r := newTestReconciler(t, lbs, nics)
+	if _, err := r.Reconcile(testSpec(), nil); err != nil {
+		t.Fatalf("Reconcile() = %v", err)
+	}
+	// A new load balancer has no ETag to match, only the condition that it
+	// does not exist yet.
+	if len(lbs.ifMatch) != 1 || lbs.ifMatch[0] != "" || lbs.ifNoneMatch[0] != "*" {
+		t.Errorf("creating the load balancer sent If-Match %q, If-None-Match %q", lbs.ifMatch, lbs.ifNoneMatch)
+	}
+	if err := r.Delete(testSpec()); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	lb, err := fakeLoadBalancers{lbs}.Get(testGroup, "kubernetes", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(derefRules(lb.LoadBalancingRules)) != 0 || len(derefFrontends(lb.FrontendIPConfigurations)) != 0 {
+		t.Errorf("Delete() left the rules or frontend of the service")
+	}
+	if last := lbs.ifMatch[len(lbs.ifMatch)-1]; last != "1" {
+		t.Errorf("Delete() wrote with If-Match %q, want the ETag of the created load balancer", last)
+	}
+}
+
+func TestReconcileLosesCreateRace(t *testing.T) {
+	lbs, nics := newFakeResources(), newFakeResources()
+	// Another replica creates the load balancer, with a rule of its own,
+	// between the read and the create.
+	raced := false
+	lbs.race = func(name string) {
+		if raced {
+			return
+		}
+		raced = true
+		lbs.set(name, network.LoadBalancer{
+			Name:     stringPtr(name),
+			Location: stringPtr("local"),
+			LoadBalancerPropertiesFormat: &network.LoadBalancerPropertiesFormat{
+				LoadBalancingRules: &[]network.LoadBalancingRule{{Name: stringPtr("other")}},
+			},
+		})
+	}
+
+	r := newTestReconciler(t, lbs, nics)
+	if _, err := r.Reconcile(testSpec(), nil); err != nil {
+		t.Fatalf("Reconcile() = %v", err)
+	}
+	if strings.Join(lbs.ifNoneMatch, ",") != "*," || strings.Join(lbs.ifMatch, ",") != ",1" {
+		t.Errorf("writes had If-None-Match %q and If-Match %q, want a create and then an update of the ETag read", lbs.ifNoneMatch, lbs.ifMatch)
+	}
+	lb, err := fakeLoadBalancers{lbs}.Get(testGroup, "kubernetes", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := derefRules(lb.LoadBalancingRules); len(rules) != 2 {
+		t.Errorf("load balancer has %d rules, want the one of the other replica and the one of the service", len(rules))
+	}
+}
@@ -0,0 +1,553 @@
+// Package nodepool manages an agent pool backed by a VM scale set, as the
+// cluster autoscaler manages a node group: it reads and sets the target
+// size of the pool, which is the capacity of the scale set SKU, deletes
+// the VMs of given nodes and tells which VM backs which node.
+//
+// Scaling a scale set takes minutes. A NodePool runs one scale operation at
+// a time in the background and, while it is in flight, reports the size it
+// scales to and refuses other operations with ErrScaleInProgress, as it does
+// while someone else updates the scale set. The scale set and its VMs are
+// kept in memory for a while and read again after every operation.
+package nodepool
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+	"github.com/honcao/cloudprovider/pkg/instances"
+	"github.com/honcao/cloudprovider/pkg/resourceid"
+)
+
+const (
+	defaultCacheTTL = time.Minute
+
+	scaleSetsType = "virtualMachineScaleSets"
+
+	provisioningDeleting = "Deleting"
+)
+
+// ErrScaleInProgress is returned when the pool is asked to scale while a
+// scale operation is in flight.
+var ErrScaleInProgress = errors.New("nodepool: a scale operation is in progress")
+
+// busyProvisioningStates are the provisioning states of scale sets that
+// are being changed.
+var busyProvisioningStates = map[string]bool{
+	"Creating": true,
+	"Updating": true,
+	"Deleting": true,
+}
+
+// ScaleSetsClient is the subset of compute.VirtualMachineScaleSetsClient a
+// NodePool uses.
+type ScaleSetsClient interface {
+	Get(resourceGroupName string, VMScaleSetName string) (compute.VirtualMachineScaleSet, error)
+	CreateOrUpdate(resourceGroupName string, VMScaleSetName string, parameters compute.VirtualMachineScaleSet, cancel <-chan struct{}) (<-chan compute.VirtualMachineScaleSet, <-chan error)
+	DeleteInstances(resourceGroupName string, VMScaleSetName string, VMInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error)
+}
+
+var _ ScaleSetsClient = compute.VirtualMachineScaleSetsClient{}
+
+// ScaleSetVMsClient is the subset of compute.VirtualMachineScaleSetVMsClient
+// a NodePool uses.
+type ScaleSetVMsClient interface {
+	List(resourceGroupName string, virtualMachineScaleSetName string, filter string, selectParameter string, expand string) (compute.VirtualMachineScaleSetVMListResult, error)
+	ListNextResults(lastResults compute.VirtualMachineScaleSetVMListResult) (compute.VirtualMachineScaleSetVMListResult, error)
+}
+
+var _ ScaleSetVMsClient = compute.VirtualMachineScaleSetVMsClient{}
+
+// Config configures a NodePool.
+type Config struct {
+	ResourceGroup string
+	ScaleSetName  string
+	// MinSize and MaxSize bound the target size of the pool.
+	MinSize     int
+	MaxSize     int
+	ScaleSets   ScaleSetsClient
+	ScaleSetVMs ScaleSetVMsClient
+	// CacheTTL is how long the scale set and its VMs are kept. It defaults
+	// to 1m.
+	CacheTTL time.Duration
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// Instance is a VM of the pool.
+type Instance struct {
+	// ProviderID is the provider ID of the node of the VM.
+	ProviderID string
+	InstanceID string
+	// NodeName is the lower case computer name, which is the name of the
+	// node.
+	NodeName          string
+	ProvisioningState string
+	// LatestModelApplied reports whether the VM runs the current model of
+	// the scale set.
+	LatestModelApplied bool
+}
+
+// NodePool is an agent pool backed by a scale set.
+type NodePool struct {
+	config Config
+
+	mu               sync.Mutex
+	scaleSet         *compute.VirtualMachineScaleSet
+	scaleSetExpires  time.Time
+	instances        []Instance
+	instancesExpires time.Time
+	// op is the latest scale operation, if any.
+	op *operation
+}
+
+// operation is a scale operation of a NodePool.
+type operation struct {
+	// target is the size the pool scales to.
+	target int
+	done   chan struct{}
+	// err is set once done is closed.
+	err error
+}
+
+// running reports whether op is still in flight.
+func (op *operation) running() bool {
+	select {
+	case <-op.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// NewNodePool validates config and returns a NodePool.
+func NewNodePool(config Config) (*NodePool, error) {
+	if config.ResourceGroup == "" || config.ScaleSetName == "" {
+		return nil, fmt.Errorf("nodepool: a resource group and scale set name are required")
+	}
+	if config.ScaleSets == nil || config.ScaleSetVMs == nil {
+		return nil, fmt.Errorf("nodepool: scale set and scale set VM clients are required")
+	}
+	if config.MinSize < 0 || config.MaxSize < config.MinSize {
+		return nil, fmt.Errorf("nodepool: invalid size bounds %d-%d", config.MinSize, config.MaxSize)
+	}
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = defaultCacheTTL
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	return &NodePool{config: config}, nil
+}
+
+// Name returns the name of the scale set.
+func (p *NodePool) Name() string {
+	return p.config.ScaleSetName
+}
+
+// MinSize returns the smallest target size of the pool.
+func (p *NodePool) MinSize() int {
+	return p.config.MinSize
+}
+
+// MaxSize returns the largest target size of the pool.
+func (p *NodePool) MaxSize() int {
+	return p.config.MaxSize
+}
+
+// TargetSize returns the number of VMs the pool has or is scaling to.
+func (p *NodePool) TargetSize() (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.op != nil && p.op.running() {
+		return p.op.target, nil
+	}
+	ss, err := p.getScaleSet()
+	if err != nil {
+		return 0, err
+	}
+	return capacity(ss), nil
+}
+
+// SetTargetSize starts scaling the pool to size VMs. It fails if size is
+// out of the bounds of the pool.
+func (p *NodePool) SetTargetSize(size int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ss, err := p.getIdleScaleSet()
+	if err != nil {
+		return err
+	}
+	return p.scale(ss, size)
+}
+
+// IncreaseSize starts adding delta VMs to the pool.
+func (p *NodePool) IncreaseSize(delta int) error {
+	if delta <= 0 {
+		return fmt.Errorf("nodepool: size increase %d is not positive", delta)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ss, err := p.getIdleScaleSet()
+	if err != nil {
+		return err
+	}
+	return p.scale(ss, capacity(ss)+delta)
+}
+
+// DecreaseTargetSize lowers the target size of the pool by delta without
+// deleting VMs, which gives up on VMs that have not been created yet. It
+// fails if the pool has more VMs than the new target: those are removed
+// with DeleteInstances.
+func (p *NodePool) DecreaseTargetSize(delta int) error {
+	if delta <= 0 {
+		return fmt.Errorf("nodepool: size decrease %d is not positive", delta)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ss, err := p.getIdleScaleSet()
+	if err != nil {
+		return err
+	}
+	instances, err := p.getInstances()
+	if err != nil {
+		return err
+	}
+	target := capacity(ss) - delta
+	if target < len(instances) {
+		return fmt.Errorf("nodepool: cannot decrease the target size of scale set %s to %d, it has %d VMs", p.config.ScaleSetName, target, len(instances))
+	}
+	return p.scale(ss, target)
+}
+
+// DeleteInstances starts deleting the VMs of the nodes with the given
+// provider IDs, which lowers the target size of the pool by as many. The
+// VMs must belong to the pool, and the pool must not shrink below its
+// minimum size.
+func (p *NodePool) DeleteInstances(providerIDs []string) error {
+	if len(providerIDs) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ss, err := p.getIdleScaleSet()
+	if err != nil {
+		return err
+	}
+	instances, err := p.getInstances()
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]Instance, len(instances))
+	for _, instance := range instances {
+		byID[instance.InstanceID] = instance
+	}
+
+	var instanceIDs []string
+	seen := map[string]bool{}
+	for _, providerID := range providerIDs {
+		instanceID, err := p.instanceID(providerID)
+		if err != nil {
+			return err
+		}
+		instance, ok := byID[instanceID]
+		if !ok {
+			return fmt.Errorf("nodepool: scale set %s has no VM %s", p.config.ScaleSetName, instanceID)
+		}
+		if seen[instanceID] {
+			continue
+		}
+		seen[instanceID] = true
+		if instance.ProvisioningState == provisioningDeleting {
+			glog.V(2).Infof("nodepool: VM %s of scale set %s is already being deleted", instanceID, p.config.ScaleSetName)
+			continue
+		}
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+	if len(instanceIDs) == 0 {
+		return nil
+	}
+	target := capacity(ss) - len(instanceIDs)
+	if target < p.config.MinSize {
+		return fmt.Errorf("nodepool: deleting %d VMs would shrink scale set %s below its minimum size %d", len(instanceIDs), p.config.ScaleSetName, p.config.MinSize)
+	}
+
+	sort.Sort(byInstanceID(instanceIDs))
+	glog.V(2).Infof("nodepool: deleting VMs %s of scale set %s", strings.Join(instanceIDs, ", "), p.config.ScaleSetName)
+	_, errc := p.config.ScaleSets.DeleteInstances(p.config.ResourceGroup, p.config.ScaleSetName, compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+		InstanceIds: &instanceIDs,
+	}, nil)
+	p.start(target, errc)
+	return nil
+}
+
+// Instances returns the VMs of the pool, in the order of their instance
+// IDs.
+func (p *NodePool) Instances() ([]Instance, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	instances, err := p.getInstances()
+	if err != nil {
+		return nil, err
+	}
+	return append([]Instance(nil), instances...), nil
+}
+
+// InstanceByNodeName returns the VM of the node nodeName, and false if no
+// VM of the pool backs the node.
+func (p *NodePool) InstanceByNodeName(nodeName string) (Instance, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	instances, err := p.getInstances()
+	if err != nil {
+		return Instance{}, false, err
+	}
+	nodeName = strings.ToLower(nodeName)
+	for _, instance := range instances {
+		if instance.NodeName == nodeName {
+			return instance, true, nil
+		}
+	}
+	return Instance{}, false, nil
+}
+
+// Belongs reports whether the node with the provider ID providerID is
+// backed by a VM of the scale set of the pool. The VM need not exist.
+func (p *NodePool) Belongs(providerID string) (bool, error) {
+	id, err := resourceid.ParseProviderID(providerID)
+	if err != nil {
+		return false, err
+	}
+	scaleSet, ok := id.NameOf(scaleSetsType)
+	return ok && strings.EqualFold(scaleSet, p.config.ScaleSetName) && strings.EqualFold(id.ResourceGroup, p.config.ResourceGroup), nil
+}
+
+// Wait waits for the latest scale operation, if any, and returns its
+// error.
+func (p *NodePool) Wait() error {
+	p.mu.Lock()
+	op := p.op
+	p.mu.Unlock()
+	if op == nil {
+		return nil
+	}
+	<-op.done
+	return op.err
+}
+
+// Refresh drops the scale set and its VMs from memory, so that they are
+// read again.
+func (p *NodePool) Refresh() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.invalidate()
+}
+
+// scale starts scaling the scale set ss to size VMs. p.mu is held.
+func (p *NodePool) scale(ss *compute.VirtualMachineScaleSet, size int) error {
+	if size < p.config.MinSize || size > p.config.MaxSize {
+		return fmt.Errorf("nodepool: target size %d of scale set %s is out of bounds %d-%d", size, p.config.ScaleSetName, p.config.MinSize, p.config.MaxSize)
+	}
+	if size == capacity(ss) {
+		return nil
+	}
+	if ss.Sku == nil {
+		return fmt.Errorf("nodepool: scale set %s has no SKU", p.config.ScaleSetName)
+	}
+
+	// Only the location and SKU are sent, which leaves the rest of the
+	// scale set, and the API versions that lack PATCH, alone.
+	sku := *ss.Sku
+	c := int64(size)
+	sku.Capacity = &c
+	glog.V(2).Infof("nodepool: scaling scale set %s from %d to %d VMs", p.config.ScaleSetName, capacity(ss), size)
+	_, errc := p.config.ScaleSets.CreateOrUpdate(p.config.ResourceGroup, p.config.ScaleSetName, compute.VirtualMachineScaleSet{
+		Location: ss.Location,
+		Sku:      &sku,
+	}, nil)
+	p.start(size, errc)
+	return nil
+}
+
+// start records the scale operation to target whose outcome errc delivers.
+// p.mu is held.
+func (p *NodePool) start(target int, errc <-chan error) {
+	op := &operation{target: target, done: make(chan struct{})}
+	p.op = op
+	p.invalidate()
+	go func() {
+		err := <-errc
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if err != nil {
+			op.err = fmt.Errorf("nodepool: scaling scale set %s to %d VMs: %v", p.config.ScaleSetName, target, err)
+			glog.Warningf("%v", op.err)
+		} else {
+			glog.V(2).Infof("nodepool: scaled scale set %s to %d VMs", p.config.ScaleSetName, target)
+		}
+		p.invalidate()
+		close(op.done)
+	}()
+}
+
+// getIdleScaleSet returns the scale set, unless it is being scaled or
+// otherwise updated. p.mu is held.
+func (p *NodePool) getIdleScaleSet() (*compute.VirtualMachineScaleSet, error) {
+	if p.op != nil && p.op.running() {
+		return nil, ErrScaleInProgress
+	}
+	ss, err := p.getScaleSet()
+	if err != nil {
+		return nil, err
+	}
+	if state := provisioningState(ss); busyProvisioningStates[state] {
+		glog.V(2).Infof("nodepool: scale set %s is %s", p.config.ScaleSetName, state)
+		return nil, ErrScaleInProgress
+	}
+	return ss, nil
+}
+
+// getScaleSet returns the scale set, from memory if it is recent. A scale
+// set that is being updated is not kept, so its settling is seen right
+// away. p.mu is held.
+func (p *NodePool) getScaleSet() (*compute.VirtualMachineScaleSet, error) {
+	now := p.config.Now()
+	if p.scaleSet != nil && now.Before(p.scaleSetExpires) {
+		return p.scaleSet, nil
+	}
+	ss, err := p.config.ScaleSets.Get(p.config.ResourceGroup, p.config.ScaleSetName)
+	if err != nil {
+		if apierror.IsNotFound(err) {
+			return nil, fmt.Errorf("nodepool: scale set %s does not exist in resource group %s", p.config.ScaleSetName, p.config.ResourceGroup)
+		}
+		return nil, fmt.Errorf("nodepool: getting scale set %s: %v", p.config.ScaleSetName, err)
+	}
+	p.scaleSet = nil
+	if !busyProvisioningStates[provisioningState(&ss)] {
+		p.scaleSet = &ss
+		p.scaleSetExpires = now.Add(p.config.CacheTTL)
+	}
+	return &ss, nil
+}
+
+// getInstances returns the VMs of the scale set, from memory if they are
+// recent. p.mu is held.
+func (p *NodePool) getInstances() ([]Instance, error) {
+	now := p.config.Now()
+	if p.instances != nil && now.Before(p.instancesExpires) {
+		return p.instances, nil
+	}
+	var instances []Instance
+	result, err := p.config.ScaleSetVMs.List(p.config.ResourceGroup, p.config.ScaleSetName, "", "", "")
+	for {
+		if err != nil {
+			return nil, fmt.Errorf("nodepool: listing the VMs of scale set %s: %v", p.config.ScaleSetName, err)
+		}
+		if result.Value != nil {
+			for _, vm := range *result.Value {
+				instance, err := p.newInstance(vm)
+				if err != nil {
+					return nil, err
+				}
+				instances = append(instances, instance)
+			}
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			break
+		}
+		result, err = p.config.ScaleSetVMs.ListNextResults(result)
+	}
+	sort.Sort(instancesByID(instances))
+	if instances == nil {
+		instances = []Instance{}
+	}
+	p.instances = instances
+	p.instancesExpires = now.Add(p.config.CacheTTL)
+	return instances, nil
+}
+
+func (p *NodePool) newInstance(vm compute.VirtualMachineScaleSetVM) (Instance, error) {
+	if vm.ID == nil || vm.InstanceID == nil {
+		return Instance{}, fmt.Errorf("nodepool: a VM of scale set %s has no ID", p.config.ScaleSetName)
+	}
+	id, err := resourceid.Parse(*vm.ID)
+	if err != nil {
+		return Instance{}, err
+	}
+	instance := Instance{
+		ProviderID: id.ProviderID(),
+		InstanceID: *vm.InstanceID,
+		NodeName:   strings.ToLower(instances.ScaleSetComputerName(p.config.ScaleSetName, *vm.InstanceID)),
+	}
+	if props := vm.VirtualMachineScaleSetVMProperties; props != nil {
+		if props.OsProfile != nil && props.OsProfile.ComputerName != nil && *props.OsProfile.ComputerName != "" {
+			instance.NodeName = strings.ToLower(*props.OsProfile.ComputerName)
+		}
+		if props.ProvisioningState != nil {
+			instance.ProvisioningState = *props.ProvisioningState
+		}
+		instance.LatestModelApplied = props.LatestModelApplied != nil && *props.LatestModelApplied
+	}
+	return instance, nil
+}
+
+// instanceID returns the instance ID of the VM named by providerID, which
+// must belong to the scale set of the pool.
+func (p *NodePool) instanceID(providerID string) (string, error) {
+	ok, err := p.Belongs(providerID)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("nodepool: %s is not a VM of scale set %s", providerID, p.config.ScaleSetName)
+	}
+	id, _ := resourceid.ParseProviderID(providerID)
+	return id.Name(), nil
+}
+
+// invalidate drops the scale set and its VMs from memory. p.mu is held.
+func (p *NodePool) invalidate() {
+	p.scaleSet = nil
+	p.instances = nil
+}
+
+func capacity(ss *compute.VirtualMachineScaleSet) int {
+	if ss.Sku == nil || ss.Sku.Capacity == nil {
+		return 0
+	}
+	return int(*ss.Sku.Capacity)
+}
+
+func provisioningState(ss *compute.VirtualMachineScaleSet) string {
+	if ss.VirtualMachineScaleSetProperties == nil || ss.ProvisioningState == nil {
+		return ""
+	}
+	return *ss.ProvisioningState
+}
+
+// byInstanceID sorts instance IDs numerically.
+type byInstanceID []string
+
+func (s byInstanceID) Len() int           { return len(s) }
+func (s byInstanceID) Less(i, j int) bool { return lessInstanceID(s[i], s[j]) }
+func (s byInstanceID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// instancesByID sorts instances numerically by instance ID.
+type instancesByID []Instance
+
+func (s instancesByID) Len() int           { return len(s) }
+func (s instancesByID) Less(i, j int) bool { return lessInstanceID(s[i].InstanceID, s[j].InstanceID) }
+func (s instancesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func lessInstanceID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
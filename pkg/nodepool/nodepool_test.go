@@ -0,0 +1,254 @@
+package nodepool
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+const testScaleSetID = "/subscriptions/sub/resourceGroups/cluster/providers/Microsoft.Compute/virtualMachineScaleSets/pool"
+
+func stringPtr(s string) *string { return &s }
+
+// fakeScaleSet is a scale set and its VMs. Its operations finish when
+// release is closed.
+type fakeScaleSet struct {
+	mu       sync.Mutex
+	capacity int64
+	state    string
+	vms      []string
+	release  chan struct{}
+	gets     int
+	lists    int
+	deleted  []string
+}
+
+func newFakeScaleSet(instanceIDs ...string) *fakeScaleSet {
+	return &fakeScaleSet{capacity: int64(len(instanceIDs)), state: "Succeeded", vms: instanceIDs, release: make(chan struct{})}
+}
+
+func (f *fakeScaleSet) Get(resourceGroupName string, VMScaleSetName string) (compute.VirtualMachineScaleSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if VMScaleSetName != "pool" {
+		return compute.VirtualMachineScaleSet{}, autorest.DetailedError{StatusCode: http.StatusNotFound}
+	}
+	f.gets++
+	capacity := f.capacity
+	return compute.VirtualMachineScaleSet{
+		Location: stringPtr("local"),
+		Sku:      &compute.Sku{Name: stringPtr("Standard_D2_v2"), Capacity: &capacity},
+		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+			ProvisioningState: stringPtr(f.state),
+		},
+	}, nil
+}
+
+// operation finishes with apply once released.
+func (f *fakeScaleSet) operation(apply func()) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		<-f.release
+		f.mu.Lock()
+		apply()
+		f.mu.Unlock()
+		close(errc)
+	}()
+	return errc
+}
+
+func (f *fakeScaleSet) CreateOrUpdate(resourceGroupName string, VMScaleSetName string, parameters compute.VirtualMachineScaleSet, cancel <-chan struct{}) (<-chan compute.VirtualMachineScaleSet, <-chan error) {
+	return nil, f.operation(func() { f.capacity = *parameters.Sku.Capacity })
+}
+
+func (f *fakeScaleSet) DeleteInstances(resourceGroupName string, VMScaleSetName string, VMInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	ids := *VMInstanceIDs.InstanceIds
+	return nil, f.operation(func() {
+		f.deleted = append(f.deleted, ids...)
+		f.capacity -= int64(len(ids))
+		var kept []string
+		for _, vm := range f.vms {
+			found := false
+			for _, id := range ids {
+				found = found || id == vm
+			}
+			if !found {
+				kept = append(kept, vm)
+			}
+		}
+		f.vms = kept
+	})
+}
+
+func (f *fakeScaleSet) List(resourceGroupName string, virtualMachineScaleSetName string, filter string, selectParameter string, expand string) (compute.VirtualMachineScaleSetVMListResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists++
+	var vms []compute.VirtualMachineScaleSetVM
+	for _, id := range f.vms {
+		vms = append(vms, compute.VirtualMachineScaleSetVM{
+			ID:         stringPtr(testScaleSetID + "/virtualMachines/" + id),
+			InstanceID: stringPtr(id),
+		})
+	}
+	return compute.VirtualMachineScaleSetVMListResult{Value: &vms}, nil
+}
+
+func (f *fakeScaleSet) ListNextResults(lastResults compute.VirtualMachineScaleSetVMListResult) (compute.VirtualMachineScaleSetVMListResult, error) {
+	return compute.VirtualMachineScaleSetVMListResult{}, nil
+}
+
+func newTestNodePool(t *testing.T, f *fakeScaleSet, min, max int) *NodePool {
+	p, err := NewNodePool(Config{
+		ResourceGroup: "cluster",
+		ScaleSetName:  "pool",
+		MinSize:       min,
+		MaxSize:       max,
+		ScaleSets:     f,
+		ScaleSetVMs:   f,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func providerID(instanceID string) string {
+	return "azure://" + testScaleSetID + "/virtualMachines/" + instanceID
+}
+
+func TestSetTargetSize(t *testing.T) {
+	f := newFakeScaleSet("0", "1")
+	p := newTestNodePool(t, f, 1, 5)
+	for _, size := range []int{0, 6} {
+		if err := p.SetTargetSize(size); err == nil {
+			t.Errorf("SetTargetSize(%d) succeeded, want an out of bounds error", size)
+		}
+	}
+	if err := p.SetTargetSize(2); err != nil || p.op != nil {
+		t.Errorf("SetTargetSize() of the current size = %v, started an operation %v", err, p.op != nil)
+	}
+
+	if err := p.SetTargetSize(4); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := p.TargetSize(); size != 4 || err != nil {
+		t.Errorf("TargetSize() while scaling = %d, %v, want 4", size, err)
+	}
+	if err := p.SetTargetSize(3); err != ErrScaleInProgress {
+		t.Errorf("SetTargetSize() while scaling = %v, want %v", err, ErrScaleInProgress)
+	}
+	if err := p.IncreaseSize(1); err != ErrScaleInProgress {
+		t.Errorf("IncreaseSize() while scaling = %v, want %v", err, ErrScaleInProgress)
+	}
+	if err := p.DeleteInstances([]string{providerID("0")}); err != ErrScaleInProgress {
+		t.Errorf("DeleteInstances() while scaling = %v, want %v", err, ErrScaleInProgress)
+	}
+	close(f.release)
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := p.TargetSize(); size != 4 || err != nil {
+		t.Errorf("TargetSize() after scaling = %d, %v, want 4", size, err)
+	}
+}
+
+func TestScaleSetBeingUpdated(t *testing.T) {
+	f := newFakeScaleSet("0", "1")
+	f.state = "Updating"
+	p := newTestNodePool(t, f, 1, 5)
+	if err := p.SetTargetSize(3); err != ErrScaleInProgress {
+		t.Errorf("SetTargetSize() = %v, want %v", err, ErrScaleInProgress)
+	}
+	// A busy scale set is not kept, so that it is seen settling.
+	f.state = "Succeeded"
+	if err := p.SetTargetSize(3); err != nil {
+		t.Errorf("SetTargetSize() after the update = %v", err)
+	}
+}
+
+func TestDeleteInstances(t *testing.T) {
+	f := newFakeScaleSet("0", "1", "2")
+	p := newTestNodePool(t, f, 2, 5)
+	for _, tt := range []struct {
+		name        string
+		providerIDs []string
+	}{
+		{"below the minimum size", []string{providerID("0"), providerID("2")}},
+		{"unknown VM", []string{providerID("7")}},
+		{"VM of another scale set", []string{strings.Replace(providerID("0"), "/pool/", "/other/", 1)}},
+	} {
+		if err := p.DeleteInstances(tt.providerIDs); err == nil {
+			t.Errorf("%s: DeleteInstances() succeeded", tt.name)
+		}
+	}
+
+	// The same VM twice counts once.
+	if err := p.DeleteInstances([]string{providerID("1"), providerID("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := p.TargetSize(); size != 2 {
+		t.Errorf("TargetSize() while deleting = %d, want 2", size)
+	}
+	close(f.release)
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1"}; !reflect.DeepEqual(f.deleted, want) {
+		t.Errorf("deleted VMs %v, want %v", f.deleted, want)
+	}
+}
+
+func TestCacheReadAgainAfterOperation(t *testing.T) {
+	f := newFakeScaleSet("0", "1", "10")
+	p := newTestNodePool(t, f, 0, 5)
+	for i := 0; i < 2; i++ {
+		if _, err := p.Instances(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.TargetSize(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.lists != 1 || f.gets != 1 {
+		t.Errorf("listed the VMs %d times and got the scale set %d times, want once each", f.lists, f.gets)
+	}
+
+	if err := p.DeleteInstances([]string{providerID("0")}); err != nil {
+		t.Fatal(err)
+	}
+	close(f.release)
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	instances, err := p.Instances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.lists != 2 {
+		t.Errorf("listed the VMs %d times, want again after the operation", f.lists)
+	}
+	var names []string
+	for _, instance := range instances {
+		names = append(names, instance.NodeName)
+	}
+	if want := []string{"pool000001", "pool00000a"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("node names %v, want %v", names, want)
+	}
+
+	// Past the TTL, they are read again too.
+	now := time.Now()
+	p.config.Now = func() time.Time { return now.Add(2 * defaultCacheTTL) }
+	if _, err := p.Instances(); err != nil {
+		t.Fatal(err)
+	}
+	if f.lists != 3 {
+		t.Errorf("listed the VMs %d times, want again past the TTL", f.lists)
+	}
+}
@@ -0,0 +1,318 @@
+// Package queueworker dispatches the messages of a storage queue to a
+// handler, for work such as disk operations that outlives a single request.
+// A message stays invisible to other workers while its handler runs, is
+// deleted once the handler succeeds and reappears after a growing delay when
+// it fails. Messages that keep failing are moved to a poison queue.
+//
+// Everything goes through storage.Queue and storage.Message, so a Worker can
+// be exercised against the storageemulator package.
+package queueworker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+)
+
+const (
+	defaultConcurrency       = 1
+	defaultVisibilityTimeout = 30 * time.Second
+	defaultMaxDequeueCount   = 5
+	defaultPollInterval      = 2 * time.Second
+	defaultMinBackoff        = 5 * time.Second
+	defaultMaxBackoff        = 5 * time.Minute
+
+	// The queue service hands out at most 32 messages per request, and
+	// keeps a message invisible for at most 7 days.
+	maxMessagesPerRequest = 32
+	maxVisibilityTimeout  = 7 * 24 * time.Hour
+)
+
+// Handler processes a message. Returning nil deletes the message; an error
+// makes it visible again after a backoff. ctx is cancelled when the worker
+// loses hold of the message or gives up waiting for the handler on shutdown.
+type Handler func(ctx context.Context, msg *storage.Message) error
+
+// Config configures a Worker.
+type Config struct {
+	// Queue is the queue work is taken from.
+	Queue *storage.Queue
+	// PoisonQueue receives the messages that failed MaxDequeueCount times.
+	PoisonQueue *storage.Queue
+	// Handler processes the messages.
+	Handler Handler
+	// Concurrency bounds the number of handlers running at once. It
+	// defaults to 1.
+	Concurrency int
+	// VisibilityTimeout is how long a message stays invisible after it is
+	// dequeued. It is extended for as long as the handler runs, so it only
+	// bounds how soon a message reappears when a worker dies. It defaults to
+	// 30s.
+	VisibilityTimeout time.Duration
+	// MaxDequeueCount is the number of times a message is handled before it
+	// is moved to PoisonQueue. It defaults to 5.
+	MaxDequeueCount int
+	// PollInterval is the wait before looking at an empty queue again. It
+	// defaults to 2s.
+	PollInterval time.Duration
+	// MinBackoff and MaxBackoff bound the delay before a failed message is
+	// handled again, which doubles with every failure. They default to 5s
+	// and 5m.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// ShutdownTimeout is how long Run waits for running handlers once its
+	// context is done, before cancelling theirs. Zero waits until they
+	// return.
+	ShutdownTimeout time.Duration
+}
+
+// Worker takes messages off a queue and hands them to a Handler.
+type Worker struct {
+	config Config
+}
+
+// NewWorker validates config and returns a Worker.
+func NewWorker(config Config) (*Worker, error) {
+	if config.Queue == nil {
+		return nil, fmt.Errorf("queueworker: a queue is required")
+	}
+	if config.PoisonQueue == nil {
+		return nil, fmt.Errorf("queueworker: a poison queue is required")
+	}
+	if config.Queue.Name == config.PoisonQueue.Name {
+		return nil, fmt.Errorf("queueworker: queue %s cannot be its own poison queue", config.Queue.Name)
+	}
+	if config.Handler == nil {
+		return nil, fmt.Errorf("queueworker: a handler is required")
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = defaultConcurrency
+	}
+	if config.VisibilityTimeout <= 0 {
+		config.VisibilityTimeout = defaultVisibilityTimeout
+	}
+	if config.MaxDequeueCount <= 0 {
+		config.MaxDequeueCount = defaultMaxDequeueCount
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+	if config.VisibilityTimeout < 3*time.Second {
+		return nil, fmt.Errorf("queueworker: visibility timeout %v is too short to be extended in time", config.VisibilityTimeout)
+	}
+	if config.VisibilityTimeout > maxVisibilityTimeout || config.MaxBackoff > maxVisibilityTimeout {
+		return nil, fmt.Errorf("queueworker: visibility timeout and backoff must not exceed %v", maxVisibilityTimeout)
+	}
+	if config.MinBackoff > config.MaxBackoff {
+		return nil, fmt.Errorf("queueworker: min backoff %v is more than max backoff %v", config.MinBackoff, config.MaxBackoff)
+	}
+	return &Worker{config: config}, nil
+}
+
+// Run handles messages until ctx is done, then waits for the handlers that
+// are still running as configured by ShutdownTimeout.
+func (w *Worker) Run(ctx context.Context) {
+	// Handlers outlive ctx, so that shutting down lets them finish.
+	handlerCtx, cancelHandlers := context.WithCancel(context.Background())
+	defer cancelHandlers()
+
+	slots := make(chan struct{}, w.config.Concurrency)
+	var wg sync.WaitGroup
+	for w.acquire(ctx, slots) {
+		// Take every free slot, to fetch as many messages as can be handled.
+		n := 1
+		for n < maxMessagesPerRequest && len(slots) < cap(slots) {
+			slots <- struct{}{}
+			n++
+		}
+
+		msgs, err := w.config.Queue.GetMessages(&storage.GetMessagesOptions{
+			NumOfMessages:     n,
+			VisibilityTimeout: seconds(w.config.VisibilityTimeout),
+		})
+		if err != nil {
+			glog.Warningf("queueworker: dequeuing from %s: %v", w.config.Queue.Name, err)
+		}
+		for i := len(msgs); i < n; i++ {
+			<-slots
+		}
+		for i := range msgs {
+			wg.Add(1)
+			go func(msg *storage.Message) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				w.process(handlerCtx, msg)
+			}(&msgs[i])
+		}
+
+		if len(msgs) == 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(w.config.PollInterval):
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	if w.config.ShutdownTimeout > 0 {
+		select {
+		case <-done:
+			return
+		case <-time.After(w.config.ShutdownTimeout):
+			glog.Warningf("queueworker: cancelling handlers of %s still running after %v", w.config.Queue.Name, w.config.ShutdownTimeout)
+			cancelHandlers()
+		}
+	}
+	<-done
+}
+
+// acquire blocks until a handler slot is free and reports whether it got
+// one before ctx was done.
+func (w *Worker) acquire(ctx context.Context, slots chan struct{}) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// process handles one message and settles it according to the outcome.
+func (w *Worker) process(ctx context.Context, msg *storage.Message) {
+	if msg.DequeueCount > w.config.MaxDequeueCount {
+		w.poison(msg)
+		return
+	}
+
+	handlerCtx, cancel := context.WithCancel(ctx)
+	kept := make(chan bool, 1)
+	go func() {
+		kept <- w.keepInvisible(handlerCtx, cancel, msg)
+	}()
+	// The handler gets a copy, as extending visibility updates the pop
+	// receipt of msg.
+	handled := *msg
+	err := w.handle(handlerCtx, &handled)
+	cancel()
+	if !<-kept {
+		glog.Warningf("queueworker: lost hold of message %s of %s, leaving it to reappear", msg.ID, w.config.Queue.Name)
+		return
+	}
+
+	if err == nil {
+		if err := msg.Delete(nil); err != nil {
+			glog.Warningf("queueworker: deleting handled message %s of %s: %v", msg.ID, w.config.Queue.Name, err)
+		}
+		return
+	}
+	backoff := w.backoff(msg.DequeueCount)
+	if ctx.Err() != nil {
+		// Cut short by shutdown rather than failed; hand it to another
+		// worker right away.
+		backoff = time.Second
+	}
+	glog.V(2).Infof("queueworker: message %s of %s failed on attempt %d, retrying in %v: %v", msg.ID, w.config.Queue.Name, msg.DequeueCount, backoff, err)
+	if err := msg.Update(&storage.UpdateMessageOptions{VisibilityTimeout: seconds(backoff)}); err != nil {
+		glog.Warningf("queueworker: delaying failed message %s of %s: %v", msg.ID, w.config.Queue.Name, err)
+	}
+}
+
+// handle runs the handler, turning a panic into an error so that the
+// message is retried and eventually poisoned rather than taking the worker
+// down.
+func (w *Worker) handle(ctx context.Context, msg *storage.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("queueworker: handler panicked: %v", r)
+		}
+	}()
+	return w.config.Handler(ctx, msg)
+}
+
+// keepInvisible extends the visibility timeout of msg until ctx is done. It
+// reports false, after cancelling the handler, when msg may have become
+// visible to other workers.
+func (w *Worker) keepInvisible(ctx context.Context, cancel context.CancelFunc, msg *storage.Message) bool {
+	timeout := w.config.VisibilityTimeout
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return time.Now().Before(deadline)
+		case <-ticker.C:
+		}
+		err := msg.Update(&storage.UpdateMessageOptions{VisibilityTimeout: seconds(timeout)})
+		switch {
+		case err == nil:
+			deadline = time.Now().Add(timeout)
+			continue
+		case apierror.IsStorageStatus(err, http.StatusNotFound):
+			// The pop receipt no longer matches; someone else has it.
+		case time.Now().Before(deadline):
+			glog.Warningf("queueworker: extending visibility of message %s of %s: %v", msg.ID, w.config.Queue.Name, err)
+			continue
+		}
+		cancel()
+		return false
+	}
+}
+
+// poison moves msg to the poison queue.
+func (w *Worker) poison(msg *storage.Message) {
+	glog.Warningf("queueworker: moving message %s of %s to %s after %d attempts", msg.ID, w.config.Queue.Name, w.config.PoisonQueue.Name, msg.DequeueCount-1)
+	poisoned := w.config.PoisonQueue.GetMessageReference(msg.Text)
+	if err := poisoned.Put(nil); err != nil {
+		glog.Warningf("queueworker: putting message %s to %s: %v", msg.ID, w.config.PoisonQueue.Name, err)
+		return
+	}
+	// A failure here leaves the message to be poisoned again later.
+	if err := msg.Delete(nil); err != nil {
+		glog.Warningf("queueworker: deleting poisoned message %s of %s: %v", msg.ID, w.config.Queue.Name, err)
+	}
+}
+
+// backoff returns the delay before a message that failed on its
+// dequeueCount-th attempt is handled again.
+func (w *Worker) backoff(dequeueCount int) time.Duration {
+	backoff := w.config.MinBackoff
+	for i := 1; i < dequeueCount && backoff < w.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > w.config.MaxBackoff {
+		backoff = w.config.MaxBackoff
+	}
+	return backoff
+}
+
+// seconds rounds d up to whole seconds, of which the queue service takes at
+// least one: the storage package leaves out a zero visibility timeout.
+func seconds(d time.Duration) int {
+	s := int((d + time.Second - 1) / time.Second)
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
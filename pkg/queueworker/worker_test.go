@@ -0,0 +1,359 @@
+package queueworker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/honcao/cloudprovider/pkg/storageemulator"
+)
+
+func newTestQueues(t *testing.T) (*storage.Queue, *storage.Queue) {
+	e := storageemulator.New()
+	t.Cleanup(e.Close)
+	client, err := e.NewClient(storage.StorageEmulatorAccountName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queues := client.GetQueueService()
+	queue, poison := queues.GetQueueReference("work"), queues.GetQueueReference("work-poison")
+	for _, q := range []*storage.Queue{queue, poison} {
+		if err := q.Create(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return queue, poison
+}
+
+func putMessages(t *testing.T, q *storage.Queue, texts ...string) {
+	for _, text := range texts {
+		if err := q.GetMessageReference(text).Put(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func messageCount(t *testing.T, q *storage.Queue) uint64 {
+	if err := q.GetMetadata(nil); err != nil {
+		t.Fatal(err)
+	}
+	return q.AproxMessageCount
+}
+
+// waitForCount waits until q holds n messages.
+func waitForCount(t *testing.T, q *storage.Queue, n uint64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for messageCount(t, q) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s holds %d messages, want %d", q.Name, messageCount(t, q), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startWorker runs a worker for config until the returned function is
+// called, which returns once Run does.
+func startWorker(t *testing.T, config Config) (stop func() <-chan struct{}) {
+	if config.PollInterval == 0 {
+		config.PollInterval = 10 * time.Millisecond
+	}
+	w, err := NewWorker(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return func() <-chan struct{} {
+		cancel()
+		return done
+	}
+}
+
+func TestNewWorkerValidates(t *testing.T) {
+	queue, poison := newTestQueues(t)
+	handler := func(context.Context, *storage.Message) error { return nil }
+	for _, tt := range []struct {
+		name   string
+		config Config
+		ok     bool
+	}{
+		{"defaults", Config{Queue: queue, PoisonQueue: poison, Handler: handler}, true},
+		{"no queue", Config{PoisonQueue: poison, Handler: handler}, false},
+		{"no poison queue", Config{Queue: queue, Handler: handler}, false},
+		{"own poison queue", Config{Queue: queue, PoisonQueue: queue, Handler: handler}, false},
+		{"no handler", Config{Queue: queue, PoisonQueue: poison}, false},
+		{"short visibility", Config{Queue: queue, PoisonQueue: poison, Handler: handler, VisibilityTimeout: time.Second}, false},
+		{"long visibility", Config{Queue: queue, PoisonQueue: poison, Handler: handler, VisibilityTimeout: 8 * 24 * time.Hour}, false},
+		{"backoff bounds", Config{Queue: queue, PoisonQueue: poison, Handler: handler, MinBackoff: time.Minute, MaxBackoff: time.Second}, false},
+	} {
+		_, err := NewWorker(tt.config)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: NewWorker() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	w := &Worker{config: Config{MinBackoff: 5 * time.Second, MaxBackoff: time.Minute}}
+	for _, tt := range []struct {
+		dequeueCount int
+		want         time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{4, 40 * time.Second},
+		{5, time.Minute},
+		{50, time.Minute},
+	} {
+		if got := w.backoff(tt.dequeueCount); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.dequeueCount, got, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		d    time.Duration
+		want int
+	}{
+		{0, 1},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+	} {
+		if got := seconds(tt.d); got != tt.want {
+			t.Errorf("seconds(%v) = %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestVisibilityRenewal(t *testing.T) {
+	t.Parallel()
+	queue, poison := newTestQueues(t)
+	putMessages(t, queue, "resize")
+
+	const timeout = 3 * time.Second
+	started := make(chan struct{})
+	release := make(chan struct{})
+	startWorker(t, Config{
+		Queue:             queue,
+		PoisonQueue:       poison,
+		VisibilityTimeout: timeout,
+		Handler: func(ctx context.Context, msg *storage.Message) error {
+			close(started)
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return fmt.Errorf("handler of %s cancelled: %v", msg.Text, ctx.Err())
+			}
+		},
+	})
+	<-started
+
+	// Well past the visibility timeout the message is still hidden from
+	// other workers, because the worker keeps extending it.
+	time.Sleep(timeout + 1500*time.Millisecond)
+	msgs, err := queue.GetMessages(&storage.GetMessagesOptions{NumOfMessages: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("message became visible while its handler ran")
+	}
+
+	close(release)
+	waitForCount(t, queue, 0)
+	if n := messageCount(t, poison); n != 0 {
+		t.Fatalf("poison queue holds %d messages", n)
+	}
+}
+
+func TestPoison(t *testing.T) {
+	t.Parallel()
+	queue, poison := newTestQueues(t)
+	putMessages(t, queue, "bad")
+
+	attempts := make(chan int, 10)
+	startWorker(t, Config{
+		Queue:           queue,
+		PoisonQueue:     poison,
+		MaxDequeueCount: 2,
+		MinBackoff:      time.Second,
+		MaxBackoff:      time.Second,
+		Handler: func(ctx context.Context, msg *storage.Message) error {
+			attempts <- msg.DequeueCount
+			panic("bad message")
+		},
+	})
+
+	waitForCount(t, poison, 1)
+	waitForCount(t, queue, 0)
+	close(attempts)
+	var got []int
+	for n := range attempts {
+		got = append(got, n)
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("handler saw dequeue counts %v, want [1 2]", got)
+	}
+	msgs, err := poison.PeekMessages(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Text != "bad" {
+		t.Fatalf("poison queue holds %v, want the bad message", msgs)
+	}
+}
+
+func TestBackoffDelaysRetries(t *testing.T) {
+	t.Parallel()
+	queue, poison := newTestQueues(t)
+	putMessages(t, queue, "flaky")
+
+	type attempt struct {
+		dequeueCount int
+		at           time.Time
+	}
+	attempts := make(chan attempt, 3)
+	startWorker(t, Config{
+		Queue:       queue,
+		PoisonQueue: poison,
+		MinBackoff:  2 * time.Second,
+		MaxBackoff:  4 * time.Second,
+		Handler: func(ctx context.Context, msg *storage.Message) error {
+			attempts <- attempt{msg.DequeueCount, time.Now()}
+			if msg.DequeueCount < 3 {
+				return fmt.Errorf("attempt %d failed", msg.DequeueCount)
+			}
+			return nil
+		},
+	})
+
+	waitForCount(t, queue, 0)
+	close(attempts)
+	var got []attempt
+	for a := range attempts {
+		got = append(got, a)
+	}
+	if len(got) != 3 {
+		t.Fatalf("handler ran %d times, want 3", len(got))
+	}
+	// The service keeps time to the second, so a delay of n seconds is
+	// more than n-1 seconds.
+	for i, min := range []time.Duration{time.Second, 3 * time.Second} {
+		if got[i+1].dequeueCount != i+2 {
+			t.Errorf("attempt %d has dequeue count %d", i+2, got[i+1].dequeueCount)
+		}
+		if gap := got[i+1].at.Sub(got[i].at); gap < min {
+			t.Errorf("attempt %d came %v after the previous one, want at least %v", i+2, gap, min)
+		}
+	}
+	if n := messageCount(t, poison); n != 0 {
+		t.Fatalf("poison queue holds %d messages", n)
+	}
+}
+
+func TestShutdownDrainsHandlers(t *testing.T) {
+	queue, poison := newTestQueues(t)
+	putMessages(t, queue, "a", "b", "c", "d")
+
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	cancelled := make(chan error, 4)
+	stop := startWorker(t, Config{
+		Queue:       queue,
+		PoisonQueue: poison,
+		Concurrency: 3,
+		Handler: func(ctx context.Context, msg *storage.Message) error {
+			started <- struct{}{}
+			<-release
+			cancelled <- ctx.Err()
+			return nil
+		},
+	})
+	for i := 0; i < 3; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of 3 handlers started", i)
+		}
+	}
+
+	done := stop()
+	select {
+	case <-done:
+		t.Fatalf("Run returned while handlers were running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after the handlers did")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := <-cancelled; err != nil {
+			t.Errorf("handler context was cancelled on shutdown: %v", err)
+		}
+	}
+	if len(started) != 0 {
+		t.Errorf("a handler started after shutdown")
+	}
+	// The handled messages are deleted; the one never taken is left.
+	if n := messageCount(t, queue); n != 1 {
+		t.Fatalf("queue holds %d messages after shutdown, want 1", n)
+	}
+}
+
+func TestShutdownTimeoutCancelsHandlers(t *testing.T) {
+	t.Parallel()
+	queue, poison := newTestQueues(t)
+	putMessages(t, queue, "slow")
+
+	started := make(chan struct{})
+	stop := startWorker(t, Config{
+		Queue:           queue,
+		PoisonQueue:     poison,
+		ShutdownTimeout: 50 * time.Millisecond,
+		Handler: func(ctx context.Context, msg *storage.Message) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	<-started
+	select {
+	case <-stop():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not cancel the handler after the shutdown timeout")
+	}
+
+	// The interrupted message is handed back promptly, not after a backoff.
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		msgs, err := queue.GetMessages(&storage.GetMessagesOptions{NumOfMessages: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 1 {
+			if msgs[0].Text != "slow" || msgs[0].DequeueCount != 2 {
+				t.Fatalf("got message %q with dequeue count %d", msgs[0].Text, msgs[0].DequeueCount)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("interrupted message did not reappear")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
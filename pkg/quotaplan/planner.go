@@ -0,0 +1,309 @@
+// Package quotaplan checks the quotas of a subscription before anything is
+// provisioned, so that a deployment does not fail halfway when it runs out
+// of cores, public IPs or storage accounts. A Planner sums what a Plan of
+// VMs, network interfaces, public IPs, load balancers and storage accounts
+// needs and compares it with the compute, network and storage usage of the
+// location.
+package quotaplan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/azure-sdk-for-go/arm/storage"
+	"github.com/honcao/cloudprovider/pkg/vmadvisor"
+)
+
+// The providers of quotas.
+const (
+	Compute = "compute"
+	Network = "network"
+	Storage = "storage"
+)
+
+// The names of the quotas a plan needs, besides the core quotas of size
+// families, which are named after the families.
+const (
+	coresQuota                   = "cores"
+	virtualMachinesQuota         = "virtualMachines"
+	networkInterfacesQuota       = "NetworkInterfaces"
+	publicIPAddressesQuota       = "PublicIPAddresses"
+	staticPublicIPAddressesQuota = "StaticPublicIPAddresses"
+	loadBalancersQuota           = "LoadBalancers"
+	storageAccountsQuota         = "StorageAccounts"
+)
+
+// Sizes lists the VM sizes of the location, as vmadvisor.Advisor does.
+type Sizes interface {
+	Sizes() ([]vmadvisor.Size, error)
+}
+
+var _ Sizes = &vmadvisor.Advisor{}
+
+// ComputeUsageClient is the subset of compute.UsageClient the Planner
+// uses.
+type ComputeUsageClient interface {
+	List(location string) (compute.ListUsagesResult, error)
+	ListNextResults(lastResults compute.ListUsagesResult) (compute.ListUsagesResult, error)
+}
+
+var _ ComputeUsageClient = compute.UsageClient{}
+
+// NetworkUsagesClient is the subset of network.UsagesClient the Planner
+// uses.
+type NetworkUsagesClient interface {
+	List(location string) (network.UsagesListResult, error)
+	ListNextResults(lastResults network.UsagesListResult) (network.UsagesListResult, error)
+}
+
+var _ NetworkUsagesClient = network.UsagesClient{}
+
+// StorageUsageClient is the subset of storage.UsageClient the Planner
+// uses.
+type StorageUsageClient interface {
+	List() (storage.UsageListResult, error)
+}
+
+var _ StorageUsageClient = storage.UsageClient{}
+
+// Plan is what a deployment is going to create.
+type Plan struct {
+	// VirtualMachines need their HardwareProfile.VMSize.
+	VirtualMachines   []compute.VirtualMachine
+	NetworkInterfaces []network.Interface
+	// PublicIPAddresses with the Static allocation method count against
+	// the static public IP quota as well.
+	PublicIPAddresses []network.PublicIPAddress
+	LoadBalancers     []network.LoadBalancer
+	StorageAccounts   []storage.AccountCreateParameters
+}
+
+// Config configures a Planner.
+type Config struct {
+	Location string
+	// Sizes tells the cores and families of VM sizes.
+	Sizes   Sizes
+	Compute ComputeUsageClient
+	Network NetworkUsagesClient
+	// Storage reports the storage accounts of the whole subscription,
+	// since storage usage has no location in the storage API of Azure
+	// Stack.
+	Storage StorageUsageClient
+}
+
+// Planner checks plans against the quotas of a location.
+type Planner struct {
+	config Config
+}
+
+// NewPlanner validates config and returns a Planner.
+func NewPlanner(config Config) (*Planner, error) {
+	if config.Location == "" {
+		return nil, fmt.Errorf("quotaplan: a location is required")
+	}
+	if config.Sizes == nil {
+		return nil, fmt.Errorf("quotaplan: a VM size source is required")
+	}
+	if config.Compute == nil || config.Network == nil || config.Storage == nil {
+		return nil, fmt.Errorf("quotaplan: compute, network and storage usage clients are required")
+	}
+	return &Planner{config: config}, nil
+}
+
+// quotaKey identifies a quota.
+type quotaKey struct {
+	provider string
+	// name is the lower case name of the quota, since the providers do
+	// not agree on case.
+	name string
+}
+
+// Check compares a plan with the quotas of the location. It fails only if
+// the plan is invalid or a usage cannot be listed; the report tells the
+// quotas the plan exceeds.
+func (p *Planner) Check(plan Plan) (*Report, error) {
+	required, err := p.requirements(plan)
+	if err != nil {
+		return nil, err
+	}
+	quotas, err := p.quotas(required)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Location: p.config.Location}
+	for key, r := range required {
+		item := Item{
+			Provider: key.provider,
+			Name:     r.name,
+			Required: r.count,
+		}
+		if quota, ok := quotas[key]; ok {
+			item.Name = quota.name
+			item.Current = quota.current
+			item.Limit = quota.limit
+		} else {
+			item.Unreported = true
+		}
+		report.Items = append(report.Items, item)
+	}
+	sort.Sort(itemsByName(report.Items))
+	return report, nil
+}
+
+// requirement is what a plan needs of a quota.
+type requirement struct {
+	name  string
+	count int64
+}
+
+// requirements sums what plan needs of each quota.
+func (p *Planner) requirements(plan Plan) (map[quotaKey]*requirement, error) {
+	required := map[quotaKey]*requirement{}
+	add := func(provider, name string, n int64) {
+		key := quotaKey{provider, strings.ToLower(name)}
+		r, ok := required[key]
+		if !ok {
+			r = &requirement{name: name}
+			required[key] = r
+		}
+		r.count += n
+	}
+
+	if len(plan.VirtualMachines) > 0 {
+		sizes, err := p.config.Sizes.Sizes()
+		if err != nil {
+			return nil, fmt.Errorf("quotaplan: %v", err)
+		}
+		byName := map[string]vmadvisor.Size{}
+		for _, size := range sizes {
+			byName[strings.ToLower(size.Name)] = size
+		}
+		for _, vm := range plan.VirtualMachines {
+			name := "VM"
+			if vm.Name != nil {
+				name = "VM " + *vm.Name
+			}
+			if vm.VirtualMachineProperties == nil || vm.HardwareProfile == nil || vm.HardwareProfile.VMSize == "" {
+				return nil, fmt.Errorf("quotaplan: %s has no size", name)
+			}
+			size, ok := byName[strings.ToLower(string(vm.HardwareProfile.VMSize))]
+			if !ok {
+				return nil, fmt.Errorf("quotaplan: the size %s of %s is not available in location %s", vm.HardwareProfile.VMSize, name, p.config.Location)
+			}
+			add(Compute, coresQuota, int64(size.Cores))
+			add(Compute, virtualMachinesQuota, 1)
+			if size.Family != "" {
+				add(Compute, size.Family, int64(size.Cores))
+			}
+		}
+	}
+	if n := len(plan.NetworkInterfaces); n > 0 {
+		add(Network, networkInterfacesQuota, int64(n))
+	}
+	for _, ip := range plan.PublicIPAddresses {
+		add(Network, publicIPAddressesQuota, 1)
+		if ip.PublicIPAddressPropertiesFormat != nil && ip.PublicIPAllocationMethod == network.Static {
+			add(Network, staticPublicIPAddressesQuota, 1)
+		}
+	}
+	if n := len(plan.LoadBalancers); n > 0 {
+		add(Network, loadBalancersQuota, int64(n))
+	}
+	if n := len(plan.StorageAccounts); n > 0 {
+		add(Storage, storageAccountsQuota, int64(n))
+	}
+	return required, nil
+}
+
+// quota is the usage and limit of a quota.
+type quota struct {
+	name    string
+	current int64
+	limit   int64
+}
+
+// quotas lists the usage of the providers plan needs.
+func (p *Planner) quotas(required map[quotaKey]*requirement) (map[quotaKey]quota, error) {
+	providers := map[string]bool{}
+	for key := range required {
+		providers[key.provider] = true
+	}
+	quotas := map[quotaKey]quota{}
+	add := func(provider string, name *string, current, limit int64) {
+		if name == nil {
+			return
+		}
+		quotas[quotaKey{provider, strings.ToLower(*name)}] = quota{name: *name, current: current, limit: limit}
+	}
+
+	if providers[Compute] {
+		result, err := p.config.Compute.List(p.config.Location)
+		for {
+			if err != nil {
+				return nil, fmt.Errorf("quotaplan: listing the compute usage of location %s: %v", p.config.Location, err)
+			}
+			if result.Value != nil {
+				for _, u := range *result.Value {
+					if u.Name != nil {
+						add(Compute, u.Name.Value, int64Value32(u.CurrentValue), int64Value(u.Limit))
+					}
+				}
+			}
+			if result.NextLink == nil || *result.NextLink == "" {
+				break
+			}
+			result, err = p.config.Compute.ListNextResults(result)
+		}
+	}
+	if providers[Network] {
+		result, err := p.config.Network.List(p.config.Location)
+		for {
+			if err != nil {
+				return nil, fmt.Errorf("quotaplan: listing the network usage of location %s: %v", p.config.Location, err)
+			}
+			if result.Value != nil {
+				for _, u := range *result.Value {
+					if u.Name != nil {
+						add(Network, u.Name.Value, int64Value(u.CurrentValue), int64Value(u.Limit))
+					}
+				}
+			}
+			if result.NextLink == nil || *result.NextLink == "" {
+				break
+			}
+			result, err = p.config.Network.ListNextResults(result)
+		}
+	}
+	if providers[Storage] {
+		result, err := p.config.Storage.List()
+		if err != nil {
+			return nil, fmt.Errorf("quotaplan: listing the storage usage: %v", err)
+		}
+		if result.Value != nil {
+			for _, u := range *result.Value {
+				if u.Name != nil {
+					add(Storage, u.Name.Value, int64Value32(u.CurrentValue), int64Value32(u.Limit))
+				}
+			}
+		}
+	}
+	return quotas, nil
+}
+
+func int64Value(p *int64) int64 {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
+
+func int64Value32(p *int32) int64 {
+	if p == nil {
+		return 0
+	}
+	return int64(*p)
+}
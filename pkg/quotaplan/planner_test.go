@@ -0,0 +1,193 @@
+package quotaplan
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/azure-sdk-for-go/arm/storage"
+	"github.com/honcao/cloudprovider/pkg/vmadvisor"
+)
+
+func unmarshal(t *testing.T, data string, v interface{}) {
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type fakeSizes []vmadvisor.Size
+
+func (f fakeSizes) Sizes() ([]vmadvisor.Size, error) {
+	return f, nil
+}
+
+var testSizes = fakeSizes{
+	{Name: "Standard_A1", Cores: 1},
+	{Name: "Standard_DS2_v2", Cores: 2, Family: "standardDSv2Family"},
+	{Name: "Standard_DS3_v2", Cores: 4, Family: "standardDSv2Family"},
+}
+
+// fakeComputeUsage returns its usage in two pages.
+type fakeComputeUsage struct {
+	pages []compute.ListUsagesResult
+}
+
+func (f *fakeComputeUsage) List(location string) (compute.ListUsagesResult, error) {
+	return f.pages[0], nil
+}
+
+func (f *fakeComputeUsage) ListNextResults(lastResults compute.ListUsagesResult) (compute.ListUsagesResult, error) {
+	return f.pages[1], nil
+}
+
+type fakeNetworkUsages struct {
+	result network.UsagesListResult
+}
+
+func (f *fakeNetworkUsages) List(location string) (network.UsagesListResult, error) {
+	return f.result, nil
+}
+
+func (f *fakeNetworkUsages) ListNextResults(lastResults network.UsagesListResult) (network.UsagesListResult, error) {
+	return network.UsagesListResult{}, nil
+}
+
+type fakeStorageUsage struct {
+	result storage.UsageListResult
+}
+
+func (f *fakeStorageUsage) List() (storage.UsageListResult, error) {
+	return f.result, nil
+}
+
+func newTestPlanner(t *testing.T) *Planner {
+	c := &fakeComputeUsage{pages: make([]compute.ListUsagesResult, 2)}
+	unmarshal(t, `{"value":[
+		{"unit":"Count","name":{"value":"cores","localizedValue":"Total Regional vCPUs"},"currentValue":90,"limit":100},
+		{"unit":"Count","name":{"value":"virtualMachines","localizedValue":"Virtual Machines"},"currentValue":10,"limit":50}],
+	 "nextLink":"page2"}`, &c.pages[0])
+	unmarshal(t, `{"value":[
+		{"unit":"Count","name":{"value":"standardDSv2Family","localizedValue":"Standard DSv2 Family vCPUs"},"currentValue":4,"limit":10}]}`, &c.pages[1])
+	n := &fakeNetworkUsages{}
+	// This stamp does not report static public IPs.
+	unmarshal(t, `{"value":[
+		{"unit":"Count","name":{"value":"PublicIPAddresses","localizedValue":"Public IP Addresses"},"currentValue":9,"limit":10},
+		{"unit":"Count","name":{"value":"NetworkInterfaces","localizedValue":"Network Interfaces"},"currentValue":0,"limit":100},
+		{"unit":"Count","name":{"value":"LoadBalancers","localizedValue":"Load Balancers"},"currentValue":0,"limit":10}]}`, &n.result)
+	s := &fakeStorageUsage{}
+	unmarshal(t, `{"value":[
+		{"unit":"Count","name":{"value":"StorageAccounts","localizedValue":"Storage Accounts"},"currentValue":99,"limit":100}]}`, &s.result)
+	p, err := NewPlanner(Config{Location: "local", Sizes: testSizes, Compute: c, Network: n, Storage: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func vm(t *testing.T, size string) compute.VirtualMachine {
+	var vm compute.VirtualMachine
+	unmarshal(t, `{"name":"vm","properties":{"hardwareProfile":{"vmSize":"`+size+`"}}}`, &vm)
+	return vm
+}
+
+func publicIP(t *testing.T, method string) network.PublicIPAddress {
+	var ip network.PublicIPAddress
+	unmarshal(t, `{"properties":{"publicIPAllocationMethod":"`+method+`"}}`, &ip)
+	return ip
+}
+
+func TestRequirements(t *testing.T) {
+	p := newTestPlanner(t)
+	plan := Plan{
+		VirtualMachines:   []compute.VirtualMachine{vm(t, "Standard_DS2_v2"), vm(t, "standard_ds3_v2"), vm(t, "Standard_A1")},
+		NetworkInterfaces: make([]network.Interface, 3),
+		PublicIPAddresses: []network.PublicIPAddress{publicIP(t, "Static"), publicIP(t, "Dynamic"), publicIP(t, "Static"), {}},
+		LoadBalancers:     make([]network.LoadBalancer, 1),
+	}
+	required, err := p.requirements(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	for key, r := range required {
+		got[key.provider+" "+r.name] = r.count
+	}
+	want := map[string]int64{
+		"compute cores":              7,
+		"compute virtualMachines":    3,
+		"compute standardDSv2Family": 6,
+		"network NetworkInterfaces":  3,
+		// Static public IPs count against both quotas.
+		"network PublicIPAddresses":       4,
+		"network StaticPublicIPAddresses": 2,
+		"network LoadBalancers":           1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requirements() = %v, want %v", got, want)
+	}
+
+	for _, tt := range []struct {
+		name string
+		vm   compute.VirtualMachine
+	}{
+		{"no size", compute.VirtualMachine{}},
+		{"unknown size", vm(t, "Standard_G5")},
+	} {
+		if _, err := p.requirements(Plan{VirtualMachines: []compute.VirtualMachine{tt.vm}}); err == nil {
+			t.Errorf("%s: requirements() succeeded", tt.name)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p := newTestPlanner(t)
+	plan := Plan{
+		VirtualMachines:   []compute.VirtualMachine{vm(t, "Standard_DS3_v2"), vm(t, "Standard_DS3_v2")},
+		NetworkInterfaces: make([]network.Interface, 2),
+		PublicIPAddresses: []network.PublicIPAddress{publicIP(t, "Static")},
+		StorageAccounts:   make([]storage.AccountCreateParameters, 2),
+	}
+	report, err := p.Check(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Item{
+		{Provider: Compute, Name: "cores", Required: 8, Current: 90, Limit: 100},
+		{Provider: Compute, Name: "standardDSv2Family", Required: 8, Current: 4, Limit: 10},
+		{Provider: Compute, Name: "virtualMachines", Required: 2, Current: 10, Limit: 50},
+		{Provider: Network, Name: "NetworkInterfaces", Required: 2, Limit: 100},
+		{Provider: Network, Name: "PublicIPAddresses", Required: 1, Current: 9, Limit: 10},
+		{Provider: Network, Name: "StaticPublicIPAddresses", Required: 1, Unreported: true},
+		{Provider: Storage, Name: "StorageAccounts", Required: 2, Current: 99, Limit: 100},
+	}
+	if !reflect.DeepEqual(report.Items, want) {
+		t.Errorf("Check() items\n%+v\nwant\n%+v", report.Items, want)
+	}
+
+	if report.OK() {
+		t.Errorf("OK() = true for a plan that exceeds quotas")
+	}
+	var short []string
+	for _, item := range report.Shortfalls() {
+		short = append(short, item.Name)
+		if item.Name == "standardDSv2Family" && item.Shortfall() != 2 {
+			t.Errorf("family cores short by %d, want 2", item.Shortfall())
+		}
+	}
+	if want := []string{"standardDSv2Family", "StorageAccounts"}; !reflect.DeepEqual(short, want) {
+		t.Errorf("Shortfalls() = %v, want %v", short, want)
+	}
+	for _, line := range []string{
+		"the plan exceeds 2 quotas of location local",
+		"compute standardDSv2Family: needs 8, 6 of 10 left, short by 2",
+		"network StaticPublicIPAddresses: needs 1, not reported",
+		"storage StorageAccounts: needs 2, 1 of 100 left, short by 1",
+	} {
+		if !strings.Contains(report.String(), line) {
+			t.Errorf("report\n%s\nlacks %q", report, line)
+		}
+	}
+}
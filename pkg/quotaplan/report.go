@@ -0,0 +1,90 @@
+package quotaplan
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Item is what a plan needs of a quota.
+type Item struct {
+	// Provider is Compute, Network or Storage.
+	Provider string
+	// Name is the name of the quota, e.g. "cores" or "PublicIPAddresses".
+	Name     string
+	Required int64
+	Current  int64
+	Limit    int64
+	// Unreported is set if the stamp does not report the quota, which is
+	// then taken to have room.
+	Unreported bool
+}
+
+// Remaining returns what is left of the quota.
+func (i Item) Remaining() int64 {
+	return i.Limit - i.Current
+}
+
+// Shortfall returns how much the plan exceeds the quota by, or zero.
+func (i Item) Shortfall() int64 {
+	if i.Unreported || i.Required <= i.Remaining() {
+		return 0
+	}
+	return i.Required - i.Remaining()
+}
+
+// Report compares what a plan needs with the quotas of the location.
+type Report struct {
+	Location string
+	// Items has an Item for each quota the plan needs, by provider and
+	// name.
+	Items []Item
+}
+
+// OK reports whether the plan fits in the quotas.
+func (r *Report) OK() bool {
+	return len(r.Shortfalls()) == 0
+}
+
+// Shortfalls returns the items of the quotas the plan exceeds.
+func (r *Report) Shortfalls() []Item {
+	var short []Item
+	for _, item := range r.Items {
+		if item.Shortfall() > 0 {
+			short = append(short, item)
+		}
+	}
+	return short
+}
+
+// String summarizes the report, with a line for each quota.
+func (r *Report) String() string {
+	var b bytes.Buffer
+	if r.OK() {
+		fmt.Fprintf(&b, "the plan fits in the quotas of location %s\n", r.Location)
+	} else {
+		fmt.Fprintf(&b, "the plan exceeds %d quotas of location %s\n", len(r.Shortfalls()), r.Location)
+	}
+	for _, item := range r.Items {
+		switch {
+		case item.Unreported:
+			fmt.Fprintf(&b, "  %s %s: needs %d, not reported\n", item.Provider, item.Name, item.Required)
+		case item.Shortfall() > 0:
+			fmt.Fprintf(&b, "  %s %s: needs %d, %d of %d left, short by %d\n", item.Provider, item.Name, item.Required, item.Remaining(), item.Limit, item.Shortfall())
+		default:
+			fmt.Fprintf(&b, "  %s %s: needs %d, %d of %d left\n", item.Provider, item.Name, item.Required, item.Remaining(), item.Limit)
+		}
+	}
+	return b.String()
+}
+
+// itemsByName sorts items by provider, then name.
+type itemsByName []Item
+
+func (s itemsByName) Len() int { return len(s) }
+func (s itemsByName) Less(i, j int) bool {
+	if s[i].Provider != s[j].Provider {
+		return s[i].Provider < s[j].Provider
+	}
+	return s[i].Name < s[j].Name
+}
+func (s itemsByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
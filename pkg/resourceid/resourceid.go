@@ -0,0 +1,287 @@
+// Package resourceid parses and builds ARM resource IDs such as
+// /subscriptions/<id>/resourceGroups/<group>/providers/Microsoft.Compute/virtualMachines/<name>,
+// so that resource groups and names can be read back from the references
+// in NICs, disks and load balancers instead of splitting them by hand.
+// Keywords are matched without regard to case, as ARM does, and names are
+// kept as given. The package also converts to and from the provider IDs the
+// Kubernetes Azure cloud provider gives nodes, azure:///subscriptions/....
+package resourceid
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	subscriptionsKeyword  = "subscriptions"
+	resourceGroupsKeyword = "resourceGroups"
+	providersKeyword      = "providers"
+
+	computeProvider     = "Microsoft.Compute"
+	virtualMachinesType = "virtualMachines"
+
+	// ProviderIDPrefix starts the Kubernetes provider IDs of Azure nodes,
+	// followed by the resource ID of the VM.
+	ProviderIDPrefix = "azure://"
+)
+
+// Resource is one step of the type chain of an ID, e.g. virtualMachines/vm1
+// or extensions/ext1 under it.
+type Resource struct {
+	// Provider is the resource provider namespace preceding the resource in
+	// the ID, e.g. Microsoft.Compute. It is set on the first resource and on
+	// extension resources, such as locks, that start a namespace of their
+	// own; it is empty for child resources, which share that of their
+	// parent.
+	Provider string
+	Type     string
+	Name     string
+}
+
+// ID is a parsed resource ID. The zero value is the empty ID.
+type ID struct {
+	// SubscriptionID is empty for tenant level resources.
+	SubscriptionID string
+	// ResourceGroup is empty for subscription and tenant level resources.
+	ResourceGroup string
+	// Resources is the type chain from the top level resource down, empty
+	// for the IDs of subscriptions and resource groups.
+	Resources []Resource
+}
+
+// Parse parses a resource ID. It accepts the IDs of subscriptions, resource
+// groups and resources nested to any depth, including extension resources,
+// but not those of resource collections, which lack a final name.
+func Parse(id string) (ID, error) {
+	var parsed ID
+	if !strings.HasPrefix(id, "/") {
+		return parsed, fmt.Errorf("resourceid: %q does not start with /", id)
+	}
+	segments := strings.Split(strings.TrimSuffix(id[1:], "/"), "/")
+	for _, s := range segments {
+		if s == "" {
+			return parsed, fmt.Errorf("resourceid: %q has an empty segment", id)
+		}
+	}
+
+	i := 0
+	// next returns the value following the keyword at i.
+	next := func(keyword string) (string, error) {
+		if i+1 >= len(segments) {
+			return "", fmt.Errorf("resourceid: %q ends with %s but no value", id, keyword)
+		}
+		i += 2
+		return segments[i-1], nil
+	}
+	var err error
+	if strings.EqualFold(segments[i], subscriptionsKeyword) {
+		if parsed.SubscriptionID, err = next(subscriptionsKeyword); err != nil {
+			return ID{}, err
+		}
+		if i < len(segments) && strings.EqualFold(segments[i], resourceGroupsKeyword) {
+			if parsed.ResourceGroup, err = next(resourceGroupsKeyword); err != nil {
+				return ID{}, err
+			}
+		}
+	}
+	if i < len(segments) && !strings.EqualFold(segments[i], providersKeyword) {
+		return ID{}, fmt.Errorf("resourceid: %q has %q where %s was expected", id, segments[i], providersKeyword)
+	}
+
+	provider := ""
+	for i < len(segments) {
+		if strings.EqualFold(segments[i], providersKeyword) {
+			if provider, err = next(providersKeyword); err != nil {
+				return ID{}, err
+			}
+			if i == len(segments) {
+				return ID{}, fmt.Errorf("resourceid: %q ends with provider %s but no resource", id, provider)
+			}
+			continue
+		}
+		if i+1 >= len(segments) {
+			return ID{}, fmt.Errorf("resourceid: %q ends with type %s but no name", id, segments[i])
+		}
+		parsed.Resources = append(parsed.Resources, Resource{
+			Provider: provider,
+			Type:     segments[i],
+			Name:     segments[i+1],
+		})
+		provider = ""
+		i += 2
+	}
+	return parsed, nil
+}
+
+// New returns the ID of a top level resource, e.g.
+// New(subscriptionID, group, "Microsoft.Network", "loadBalancers", "lb").
+func New(subscriptionID, resourceGroup, provider, resourceType, name string) ID {
+	return ID{
+		SubscriptionID: subscriptionID,
+		ResourceGroup:  resourceGroup,
+		Resources:      []Resource{{Provider: provider, Type: resourceType, Name: name}},
+	}
+}
+
+// ResourceGroupID returns the ID of a resource group.
+func ResourceGroupID(subscriptionID, resourceGroup string) ID {
+	return ID{SubscriptionID: subscriptionID, ResourceGroup: resourceGroup}
+}
+
+// String returns the canonical form of id, with keywords cased as ARM
+// returns them.
+func (id ID) String() string {
+	var segments []string
+	if id.SubscriptionID != "" {
+		segments = append(segments, subscriptionsKeyword, id.SubscriptionID)
+		if id.ResourceGroup != "" {
+			segments = append(segments, resourceGroupsKeyword, id.ResourceGroup)
+		}
+	}
+	for _, r := range id.Resources {
+		if r.Provider != "" {
+			segments = append(segments, providersKeyword, r.Provider)
+		}
+		segments = append(segments, r.Type, r.Name)
+	}
+	if len(segments) == 0 {
+		return ""
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// Key returns the canonical form of id in lower case, under which IDs that
+// only differ in case, and so name the same resource, are stored once.
+func (id ID) Key() string {
+	return strings.ToLower(id.String())
+}
+
+// Equal reports whether id and other name the same resource.
+func (id ID) Equal(other ID) bool {
+	return strings.EqualFold(id.String(), other.String())
+}
+
+// IsZero reports whether id is the empty ID.
+func (id ID) IsZero() bool {
+	return id.SubscriptionID == "" && id.ResourceGroup == "" && len(id.Resources) == 0
+}
+
+// Provider returns the provider namespace of the top level resource, e.g.
+// Microsoft.Compute.
+func (id ID) Provider() string {
+	if len(id.Resources) == 0 {
+		return ""
+	}
+	return id.Resources[0].Provider
+}
+
+// Type returns the full type of the resource, e.g.
+// Microsoft.Compute/virtualMachines/extensions. The type of an extension
+// resource starts at its own namespace, e.g. Microsoft.Authorization/locks.
+// It is empty for subscriptions and resource groups.
+func (id ID) Type() string {
+	start := 0
+	for i, r := range id.Resources {
+		if r.Provider != "" {
+			start = i
+		}
+	}
+	var parts []string
+	for _, r := range id.Resources[start:] {
+		if r.Provider != "" {
+			parts = append(parts, r.Provider)
+		}
+		parts = append(parts, r.Type)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Name returns the name of the resource, that of the resource group or
+// subscription for their IDs.
+func (id ID) Name() string {
+	switch {
+	case len(id.Resources) > 0:
+		return id.Resources[len(id.Resources)-1].Name
+	case id.ResourceGroup != "":
+		return id.ResourceGroup
+	default:
+		return id.SubscriptionID
+	}
+}
+
+// NameOf returns the name of the first resource of type resourceType in the
+// type chain, e.g. NameOf("virtualMachineScaleSets") for the scale set of a
+// scale set VM. The type is matched without regard to case.
+func (id ID) NameOf(resourceType string) (string, bool) {
+	for _, r := range id.Resources {
+		if strings.EqualFold(r.Type, resourceType) {
+			return r.Name, true
+		}
+	}
+	return "", false
+}
+
+// Parent returns the ID of the resource id is nested in: its parent
+// resource, the resource group or the subscription. It returns false for
+// subscriptions, tenant level resources and the empty ID.
+func (id ID) Parent() (ID, bool) {
+	switch {
+	case len(id.Resources) > 0:
+		parent := id
+		last := len(id.Resources) - 1
+		parent.Resources = id.Resources[:last:last]
+		return parent, !parent.IsZero()
+	case id.ResourceGroup != "":
+		return ID{SubscriptionID: id.SubscriptionID}, true
+	default:
+		return ID{}, false
+	}
+}
+
+// Child returns the ID of the child resource of type resourceType named
+// name, e.g. Child("extensions", "ext1") of a VM.
+func (id ID) Child(resourceType, name string) ID {
+	return id.nest(Resource{Type: resourceType, Name: name})
+}
+
+// Extension returns the ID of an extension resource of id, which lives in
+// another namespace, e.g. Extension("Microsoft.Authorization", "locks",
+// "lock1").
+func (id ID) Extension(provider, resourceType, name string) ID {
+	return id.nest(Resource{Provider: provider, Type: resourceType, Name: name})
+}
+
+func (id ID) nest(r Resource) ID {
+	child := id
+	child.Resources = make([]Resource, len(id.Resources), len(id.Resources)+1)
+	copy(child.Resources, id.Resources)
+	child.Resources = append(child.Resources, r)
+	return child
+}
+
+// ResourceGroupID returns the ID of the resource group of id.
+func (id ID) ResourceGroupID() ID {
+	return ResourceGroupID(id.SubscriptionID, id.ResourceGroup)
+}
+
+// ProviderID returns the Kubernetes provider ID of the node backed by the
+// VM id.
+func (id ID) ProviderID() string {
+	return ProviderIDPrefix + id.String()
+}
+
+// ParseProviderID parses the Kubernetes provider ID of an Azure node into
+// the resource ID of its VM, a virtual machine or a scale set VM.
+func ParseProviderID(providerID string) (ID, error) {
+	if len(providerID) < len(ProviderIDPrefix) || !strings.EqualFold(providerID[:len(ProviderIDPrefix)], ProviderIDPrefix) {
+		return ID{}, fmt.Errorf("resourceid: provider ID %q does not start with %s", providerID, ProviderIDPrefix)
+	}
+	id, err := Parse(providerID[len(ProviderIDPrefix):])
+	if err != nil {
+		return ID{}, err
+	}
+	if id.SubscriptionID == "" || id.ResourceGroup == "" || !strings.EqualFold(id.Provider(), computeProvider) || !strings.EqualFold(id.Resources[len(id.Resources)-1].Type, virtualMachinesType) {
+		return ID{}, fmt.Errorf("resourceid: provider ID %q does not name a VM", providerID)
+	}
+	return id, nil
+}
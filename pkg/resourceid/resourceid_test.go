@@ -0,0 +1,290 @@
+package resourceid
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	sub   = "00000000-0000-0000-0000-000000000001"
+	group = "Group1"
+)
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		id       string
+		want     ID
+		typ      string
+		name     string
+		provider string
+	}{
+		{
+			id:   "/subscriptions/" + sub,
+			want: ID{SubscriptionID: sub},
+			name: sub,
+		},
+		{
+			id:   "/subscriptions/" + sub + "/resourceGroups/" + group,
+			want: ID{SubscriptionID: sub, ResourceGroup: group},
+			name: group,
+		},
+		{
+			id: "/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1",
+			want: ID{SubscriptionID: sub, ResourceGroup: group, Resources: []Resource{
+				{Provider: "Microsoft.Compute", Type: "virtualMachines", Name: "vm1"},
+			}},
+			typ:      "Microsoft.Compute/virtualMachines",
+			name:     "vm1",
+			provider: "Microsoft.Compute",
+		},
+		{
+			id: "/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachineScaleSets/ss/virtualMachines/3/networkInterfaces/nic/ipConfigurations/ipconfig1",
+			want: ID{SubscriptionID: sub, ResourceGroup: group, Resources: []Resource{
+				{Provider: "Microsoft.Compute", Type: "virtualMachineScaleSets", Name: "ss"},
+				{Type: "virtualMachines", Name: "3"},
+				{Type: "networkInterfaces", Name: "nic"},
+				{Type: "ipConfigurations", Name: "ipconfig1"},
+			}},
+			typ:      "Microsoft.Compute/virtualMachineScaleSets/virtualMachines/networkInterfaces/ipConfigurations",
+			name:     "ipconfig1",
+			provider: "Microsoft.Compute",
+		},
+		{
+			id: "/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1/providers/Microsoft.Authorization/locks/lock1",
+			want: ID{SubscriptionID: sub, ResourceGroup: group, Resources: []Resource{
+				{Provider: "Microsoft.Compute", Type: "virtualMachines", Name: "vm1"},
+				{Provider: "Microsoft.Authorization", Type: "locks", Name: "lock1"},
+			}},
+			typ:      "Microsoft.Authorization/locks",
+			name:     "lock1",
+			provider: "Microsoft.Compute",
+		},
+		{
+			id: "/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Authorization/locks/lock1",
+			want: ID{SubscriptionID: sub, ResourceGroup: group, Resources: []Resource{
+				{Provider: "Microsoft.Authorization", Type: "locks", Name: "lock1"},
+			}},
+			typ:      "Microsoft.Authorization/locks",
+			name:     "lock1",
+			provider: "Microsoft.Authorization",
+		},
+		{
+			id: "/subscriptions/" + sub + "/providers/Microsoft.Authorization/roleAssignments/ra1",
+			want: ID{SubscriptionID: sub, Resources: []Resource{
+				{Provider: "Microsoft.Authorization", Type: "roleAssignments", Name: "ra1"},
+			}},
+			typ:      "Microsoft.Authorization/roleAssignments",
+			name:     "ra1",
+			provider: "Microsoft.Authorization",
+		},
+		{
+			id: "/providers/Microsoft.Management/managementGroups/mg1",
+			want: ID{Resources: []Resource{
+				{Provider: "Microsoft.Management", Type: "managementGroups", Name: "mg1"},
+			}},
+			typ:      "Microsoft.Management/managementGroups",
+			name:     "mg1",
+			provider: "Microsoft.Management",
+		},
+	} {
+		got, err := Parse(tt.id)
+		if err != nil {
+			t.Errorf("Parse(%q) = %v", tt.id, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %#v, want %#v", tt.id, got, tt.want)
+		}
+		if s := got.String(); s != tt.id {
+			t.Errorf("Parse(%q).String() = %q", tt.id, s)
+		}
+		if got.Type() != tt.typ || got.Name() != tt.name || got.Provider() != tt.provider {
+			t.Errorf("Parse(%q): Type(), Name(), Provider() = %q, %q, %q, want %q, %q, %q", tt.id, got.Type(), got.Name(), got.Provider(), tt.typ, tt.name, tt.provider)
+		}
+		if got.IsZero() {
+			t.Errorf("Parse(%q).IsZero() = true", tt.id)
+		}
+	}
+}
+
+func TestParseCanonicalizes(t *testing.T) {
+	for _, tt := range []struct {
+		id, want string
+	}{
+		// Keywords take the casing ARM returns; names are kept.
+		{"/SUBSCRIPTIONS/" + sub + "/RESOURCEGROUPS/" + group + "/PROVIDERS/Microsoft.Network/loadBalancers/LB", "/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Network/loadBalancers/LB"},
+		{"/subscriptions/" + sub + "/resourcegroups/" + group + "/providers/Microsoft.Compute/disks/d1/", "/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/disks/d1"},
+	} {
+		got, err := Parse(tt.id)
+		if err != nil {
+			t.Errorf("Parse(%q) = %v", tt.id, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("Parse(%q).String() = %q, want %q", tt.id, got.String(), tt.want)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, id := range []string{
+		"",
+		"/",
+		"subscriptions/" + sub,
+		"/subscriptions",
+		"/subscriptions/" + sub + "/resourceGroups",
+		"/subscriptions/" + sub + "//resourceGroups/" + group,
+		"/subscriptions/" + sub + "/resourceGroups/" + group + "/virtualMachines/vm1",
+		"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers",
+		"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute",
+		"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines",
+		"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1/extensions",
+		"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1/providers/Microsoft.Authorization",
+	} {
+		if got, err := Parse(id); err == nil {
+			t.Errorf("Parse(%q) = %#v, want an error", id, got)
+		}
+	}
+}
+
+func TestEqualAndKey(t *testing.T) {
+	a := New(sub, group, "Microsoft.Network", "loadBalancers", "lb")
+	for _, tt := range []struct {
+		id    string
+		equal bool
+	}{
+		{"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Network/loadBalancers/lb", true},
+		{"/SUBSCRIPTIONS/" + sub + "/RESOURCEGROUPS/GROUP1/PROVIDERS/MICROSOFT.NETWORK/LOADBALANCERS/LB", true},
+		{"/subscriptions/" + sub + "/resourceGroups/group1/providers/microsoft.network/loadbalancers/Lb/", true},
+		{"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Network/loadBalancers/lb2", false},
+		{"/subscriptions/" + sub + "/resourceGroups/Group2/providers/Microsoft.Network/loadBalancers/lb", false},
+		{"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Network/publicIPAddresses/lb", false},
+		{"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Network/loadBalancers/lb/frontendIPConfigurations/fe", false},
+	} {
+		b, err := Parse(tt.id)
+		if err != nil {
+			t.Fatalf("Parse(%q) = %v", tt.id, err)
+		}
+		if got := a.Equal(b); got != tt.equal {
+			t.Errorf("Equal(%q) = %v, want %v", tt.id, got, tt.equal)
+		}
+		if got := b.Equal(a); got != tt.equal {
+			t.Errorf("Equal of %q is not symmetric", tt.id)
+		}
+		if got := a.Key() == b.Key(); got != tt.equal {
+			t.Errorf("keys %q and %q: equal %v, want %v", a.Key(), b.Key(), got, tt.equal)
+		}
+	}
+}
+
+func TestParentAndChild(t *testing.T) {
+	vm := New(sub, group, "Microsoft.Compute", "virtualMachines", "vm1")
+	ext := vm.Child("extensions", "ext1")
+	lock := vm.Extension("Microsoft.Authorization", "locks", "lock1")
+
+	for _, tt := range []struct {
+		id   ID
+		want string
+	}{
+		{ext, "/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1/extensions/ext1"},
+		{lock, "/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1/providers/Microsoft.Authorization/locks/lock1"},
+		{ext.ResourceGroupID(), "/subscriptions/" + sub + "/resourceGroups/" + group},
+		{ResourceGroupID(sub, group), "/subscriptions/" + sub + "/resourceGroups/" + group},
+	} {
+		if got := tt.id.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+	if ext.Type() != "Microsoft.Compute/virtualMachines/extensions" {
+		t.Errorf("Type() of a child = %q", ext.Type())
+	}
+	if name, ok := ext.NameOf("VIRTUALMACHINES"); !ok || name != "vm1" {
+		t.Errorf("NameOf(VIRTUALMACHINES) = %q, %v, want vm1", name, ok)
+	}
+	if _, ok := ext.NameOf("virtualMachineScaleSets"); ok {
+		t.Errorf("NameOf(virtualMachineScaleSets) of a VM extension succeeded")
+	}
+
+	// Nesting copies, so siblings do not share the type chain.
+	a, b := vm.Child("extensions", "a"), vm.Child("extensions", "b")
+	if a.Name() != "a" || b.Name() != "b" || len(vm.Resources) != 1 {
+		t.Errorf("Child() changed its receiver or siblings: %v, %v, %v", vm, a, b)
+	}
+
+	// Parent walks back up the chain to the subscription.
+	var chain []string
+	for id, ok := lock.Child("notes", "n1"), true; ok; id, ok = id.Parent() {
+		chain = append(chain, id.String())
+	}
+	want := []string{
+		"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1/providers/Microsoft.Authorization/locks/lock1/notes/n1",
+		"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1/providers/Microsoft.Authorization/locks/lock1",
+		"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1",
+		"/subscriptions/" + sub + "/resourceGroups/" + group,
+		"/subscriptions/" + sub,
+	}
+	if !reflect.DeepEqual(chain, want) {
+		t.Errorf("parents = %q, want %q", chain, want)
+	}
+
+	parent, _ := ext.Parent()
+	if parent.Child("extensions", "ext2"); ext.Name() != "ext1" {
+		t.Errorf("Child() of a parent changed the original ID to %v", ext)
+	}
+	tenant, err := Parse("/providers/Microsoft.Management/managementGroups/mg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []ID{{}, tenant} {
+		if parent, ok := id.Parent(); ok {
+			t.Errorf("Parent() of %q = %q, want none", id, parent)
+		}
+	}
+	if !(ID{}).IsZero() || (ID{}).String() != "" {
+		t.Errorf("the zero ID is not empty")
+	}
+}
+
+func TestProviderID(t *testing.T) {
+	vm := New(sub, group, "Microsoft.Compute", "virtualMachines", "vm1")
+	scaleSetVM := New(sub, group, "Microsoft.Compute", "virtualMachineScaleSets", "ss").Child("virtualMachines", "3")
+	for _, id := range []ID{vm, scaleSetVM} {
+		providerID := id.ProviderID()
+		if providerID != "azure://"+id.String() {
+			t.Errorf("ProviderID() = %q", providerID)
+		}
+		got, err := ParseProviderID(providerID)
+		if err != nil {
+			t.Errorf("ParseProviderID(%q) = %v", providerID, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, id) {
+			t.Errorf("ParseProviderID(%q) = %#v, want %#v", providerID, got, id)
+		}
+	}
+
+	got, err := ParseProviderID("AZURE:///SUBSCRIPTIONS/" + sub + "/resourcegroups/" + group + "/providers/microsoft.compute/VIRTUALMACHINES/vm1")
+	if err != nil || !got.Equal(vm) {
+		t.Errorf("ParseProviderID() of an upper case ID = %v, %v, want %v", got, err, vm)
+	}
+
+	for _, providerID := range []string{
+		"",
+		"azure:/",
+		"azure://",
+		"aws:///subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1",
+		"/subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1",
+		"azure://subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1",
+		"azure:///subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines",
+		"azure:///subscriptions/" + sub + "/resourceGroups/" + group,
+		"azure:///subscriptions/" + sub + "/providers/Microsoft.Compute/virtualMachines/vm1",
+		"azure:///subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Network/virtualMachines/vm1",
+		"azure:///subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/disks/d1",
+		"azure:///subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachineScaleSets/ss",
+		"azure:///subscriptions/" + sub + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/vm1/extensions/ext1",
+	} {
+		if got, err := ParseProviderID(providerID); err == nil {
+			t.Errorf("ParseProviderID(%q) = %v, want an error", providerID, got)
+		}
+	}
+}
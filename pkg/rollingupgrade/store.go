@@ -0,0 +1,99 @@
+package rollingupgrade
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// State is the progress of an upgrade.
+type State struct {
+	// Batch is the instance IDs of the VMs of the batch in flight.
+	Batch []string `json:"batch,omitempty"`
+	// Upgraded is the number of VMs updated whose nodes passed the health
+	// check.
+	Upgraded int `json:"upgraded"`
+	// Failed is the instance IDs of the VMs whose nodes failed the health
+	// check.
+	Failed []string `json:"failed,omitempty"`
+	// Paused is set once too many nodes failed the health check.
+	Paused bool `json:"paused,omitempty"`
+	// Reason tells why the upgrade is paused.
+	Reason string `json:"reason,omitempty"`
+}
+
+// StateStore keeps the State of an upgrade across restarts.
+type StateStore interface {
+	// Load returns the saved state, or the zero State if there is none.
+	Load() (State, error)
+	Save(state State) error
+}
+
+// FileStore keeps the State of an upgrade in a JSON file.
+type FileStore struct {
+	Path string
+}
+
+var _ StateStore = &FileStore{}
+
+// Load implements StateStore.
+func (s *FileStore) Load() (State, error) {
+	var state State
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// Save implements StateStore. The file is replaced at once, so a crash
+// leaves either the old or the new state.
+func (s *FileStore) Save(state State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.Path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// memoryStore keeps the State of an upgrade in memory.
+type memoryStore struct {
+	mu    sync.Mutex
+	state State
+}
+
+func (s *memoryStore) Load() (State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, nil
+}
+
+func (s *memoryStore) Save(state State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	return nil
+}
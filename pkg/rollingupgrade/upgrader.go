@@ -0,0 +1,306 @@
+// Package rollingupgrade rolls the model of a VM scale set out to its VMs
+// batch by batch, for the API versions of Azure Stack that lack rolling
+// upgrades. The VMs that do not run the latest model are updated with
+// UpdateInstances a batch at a time, and the next batch only starts once
+// the nodes of the last one pass a health check, such as being Ready. An
+// upgrade pauses when too many nodes fail the check, and it carries on
+// where it stopped when it runs again, since its progress is saved to a
+// StateStore.
+package rollingupgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/nodepool"
+)
+
+const (
+	defaultBatchPercent  = 20
+	defaultPollInterval  = 15 * time.Second
+	defaultHealthTimeout = 10 * time.Minute
+
+	provisioningDeleting = "Deleting"
+)
+
+// ErrPaused is returned by Run when the upgrade is paused, until Resume is
+// called.
+var ErrPaused = errors.New("rollingupgrade: the upgrade is paused")
+
+// Pool is the part of nodepool.NodePool the Upgrader uses.
+type Pool interface {
+	Instances() ([]nodepool.Instance, error)
+	Refresh()
+}
+
+var _ Pool = &nodepool.NodePool{}
+
+// ScaleSetsClient is the subset of compute.VirtualMachineScaleSetsClient
+// the Upgrader uses.
+type ScaleSetsClient interface {
+	UpdateInstances(resourceGroupName string, VMScaleSetName string, VMInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error)
+}
+
+var _ ScaleSetsClient = compute.VirtualMachineScaleSetsClient{}
+
+// HealthFunc reports whether the node of an updated VM is healthy, e.g.
+// whether it is Ready. Errors are logged and the check is tried again.
+type HealthFunc func(ctx context.Context, instance nodepool.Instance) (bool, error)
+
+// Config configures an Upgrader.
+type Config struct {
+	ResourceGroup string
+	ScaleSetName  string
+	// Pool lists the VMs of the scale set.
+	Pool      Pool
+	ScaleSets ScaleSetsClient
+	// Health checks the nodes of updated VMs.
+	Health HealthFunc
+	// BatchPercent is the part of the VMs of the scale set updated at
+	// once, rounded up to at least one VM. It defaults to 20.
+	BatchPercent int
+	// MaxUnhealthy is the number of nodes that may fail the health check
+	// before the upgrade pauses. Zero pauses it on the first one.
+	MaxUnhealthy int
+	// PollInterval is the delay between health checks. It defaults to
+	// 15s.
+	PollInterval time.Duration
+	// HealthTimeout is how long the nodes of a batch have to become
+	// healthy. It defaults to 10m.
+	HealthTimeout time.Duration
+	// Store keeps the progress of the upgrade. It defaults to memory,
+	// which does not survive a restart.
+	Store StateStore
+}
+
+// Upgrader upgrades the VMs of a scale set to its latest model.
+type Upgrader struct {
+	config Config
+}
+
+// NewUpgrader validates config and returns an Upgrader.
+func NewUpgrader(config Config) (*Upgrader, error) {
+	if config.ResourceGroup == "" || config.ScaleSetName == "" {
+		return nil, fmt.Errorf("rollingupgrade: a resource group and scale set name are required")
+	}
+	if config.Pool == nil || config.ScaleSets == nil {
+		return nil, fmt.Errorf("rollingupgrade: a pool and a scale set client are required")
+	}
+	if config.Health == nil {
+		return nil, fmt.Errorf("rollingupgrade: a health check is required")
+	}
+	if config.BatchPercent <= 0 || config.BatchPercent > 100 {
+		config.BatchPercent = defaultBatchPercent
+	}
+	if config.MaxUnhealthy < 0 {
+		return nil, fmt.Errorf("rollingupgrade: max unhealthy %d is negative", config.MaxUnhealthy)
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	if config.HealthTimeout <= 0 {
+		config.HealthTimeout = defaultHealthTimeout
+	}
+	if config.Store == nil {
+		config.Store = &memoryStore{}
+	}
+	return &Upgrader{config: config}, nil
+}
+
+// Run upgrades the VMs that do not run the latest model, batch by batch,
+// until none is left, the upgrade pauses or ctx is done. It returns the
+// state of the upgrade, and ErrPaused if it is paused. A batch that was in
+// flight when the Upgrader last stopped is finished first.
+func (u *Upgrader) Run(ctx context.Context) (State, error) {
+	state, err := u.config.Store.Load()
+	if err != nil {
+		return State{}, fmt.Errorf("rollingupgrade: loading the state of scale set %s: %v", u.config.ScaleSetName, err)
+	}
+	if state.Paused {
+		return state, ErrPaused
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return state, err
+		}
+		u.config.Pool.Refresh()
+		instances, err := u.config.Pool.Instances()
+		if err != nil {
+			return state, err
+		}
+
+		var batch []nodepool.Instance
+		if len(state.Batch) > 0 {
+			batch = selectInstances(instances, state.Batch)
+			glog.V(2).Infof("rollingupgrade: resuming batch %s of scale set %s", strings.Join(state.Batch, ", "), u.config.ScaleSetName)
+		} else {
+			batch = u.nextBatch(instances, state.Failed)
+			if len(batch) == 0 {
+				glog.V(2).Infof("rollingupgrade: all VMs of scale set %s run the latest model", u.config.ScaleSetName)
+				return state, nil
+			}
+			state.Batch = instanceIDs(batch)
+			if err := u.save(state); err != nil {
+				return state, err
+			}
+		}
+
+		// After a restart, some VMs of the batch may be updated already.
+		var outdated []string
+		for _, instance := range batch {
+			if !instance.LatestModelApplied {
+				outdated = append(outdated, instance.InstanceID)
+			}
+		}
+		if len(outdated) > 0 {
+			glog.V(2).Infof("rollingupgrade: updating VMs %s of scale set %s", strings.Join(outdated, ", "), u.config.ScaleSetName)
+			_, errc := u.config.ScaleSets.UpdateInstances(u.config.ResourceGroup, u.config.ScaleSetName, compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+				InstanceIds: &outdated,
+			}, ctx.Done())
+			if err := <-errc; err != nil {
+				return state, fmt.Errorf("rollingupgrade: updating VMs %s of scale set %s: %v", strings.Join(outdated, ", "), u.config.ScaleSetName, err)
+			}
+		}
+
+		unhealthy := u.waitHealthy(ctx, batch)
+		if err := ctx.Err(); err != nil {
+			return state, err
+		}
+		state.Upgraded += len(batch) - len(unhealthy)
+		state.Failed = append(state.Failed, unhealthy...)
+		state.Batch = nil
+		if len(state.Failed) > u.config.MaxUnhealthy {
+			state.Paused = true
+			state.Reason = fmt.Sprintf("the nodes of VMs %s did not become healthy within %v", strings.Join(state.Failed, ", "), u.config.HealthTimeout)
+			glog.Warningf("rollingupgrade: pausing the upgrade of scale set %s: %s", u.config.ScaleSetName, state.Reason)
+			if err := u.save(state); err != nil {
+				return state, err
+			}
+			return state, ErrPaused
+		}
+		if err := u.save(state); err != nil {
+			return state, err
+		}
+	}
+}
+
+// Resume clears the pause and the failed VMs of the upgrade, so that Run
+// carries on. The failed VMs are not tried again, since they run the latest
+// model already.
+func (u *Upgrader) Resume() error {
+	state, err := u.config.Store.Load()
+	if err != nil {
+		return fmt.Errorf("rollingupgrade: loading the state of scale set %s: %v", u.config.ScaleSetName, err)
+	}
+	state.Paused = false
+	state.Reason = ""
+	state.Failed = nil
+	glog.V(2).Infof("rollingupgrade: resuming the upgrade of scale set %s", u.config.ScaleSetName)
+	return u.save(state)
+}
+
+// State returns the saved state of the upgrade.
+func (u *Upgrader) State() (State, error) {
+	state, err := u.config.Store.Load()
+	if err != nil {
+		return State{}, fmt.Errorf("rollingupgrade: loading the state of scale set %s: %v", u.config.ScaleSetName, err)
+	}
+	return state, nil
+}
+
+// nextBatch returns the next VMs to update: those that do not run the
+// latest model, are not being deleted and have not failed before, up to
+// BatchPercent of all the VMs.
+func (u *Upgrader) nextBatch(instances []nodepool.Instance, failed []string) []nodepool.Instance {
+	skip := map[string]bool{}
+	for _, id := range failed {
+		skip[id] = true
+	}
+	size := (len(instances)*u.config.BatchPercent + 99) / 100
+	if size < 1 {
+		size = 1
+	}
+	var batch []nodepool.Instance
+	for _, instance := range instances {
+		if len(batch) == size {
+			break
+		}
+		if instance.LatestModelApplied || instance.ProvisioningState == provisioningDeleting || skip[instance.InstanceID] {
+			continue
+		}
+		batch = append(batch, instance)
+	}
+	return batch
+}
+
+// waitHealthy waits for the nodes of batch to pass the health check and
+// returns the instance IDs of those that did not in time.
+func (u *Upgrader) waitHealthy(ctx context.Context, batch []nodepool.Instance) []string {
+	deadline := time.Now().Add(u.config.HealthTimeout)
+	pending := batch
+	for {
+		var unhealthy []nodepool.Instance
+		for _, instance := range pending {
+			ok, err := u.config.Health(ctx, instance)
+			if err != nil {
+				glog.Warningf("rollingupgrade: checking the health of node %s: %v", instance.NodeName, err)
+			}
+			if !ok {
+				unhealthy = append(unhealthy, instance)
+			}
+		}
+		pending = unhealthy
+		if len(pending) == 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		select {
+		case <-time.After(u.config.PollInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	for _, instance := range pending {
+		glog.Warningf("rollingupgrade: node %s of VM %s of scale set %s is not healthy after %v", instance.NodeName, instance.InstanceID, u.config.ScaleSetName, u.config.HealthTimeout)
+	}
+	return instanceIDs(pending)
+}
+
+func (u *Upgrader) save(state State) error {
+	if err := u.config.Store.Save(state); err != nil {
+		return fmt.Errorf("rollingupgrade: saving the state of scale set %s: %v", u.config.ScaleSetName, err)
+	}
+	return nil
+}
+
+// selectInstances returns the instances with the given instance IDs that
+// still exist.
+func selectInstances(instances []nodepool.Instance, ids []string) []nodepool.Instance {
+	want := map[string]bool{}
+	for _, id := range ids {
+		want[id] = true
+	}
+	var out []nodepool.Instance
+	for _, instance := range instances {
+		if want[instance.InstanceID] {
+			out = append(out, instance)
+		}
+	}
+	return out
+}
+
+func instanceIDs(instances []nodepool.Instance) []string {
+	ids := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		ids = append(ids, instance.InstanceID)
+	}
+	return ids
+}
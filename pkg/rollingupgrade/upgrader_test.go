@@ -0,0 +1,178 @@
+package rollingupgrade
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/honcao/cloudprovider/pkg/nodepool"
+)
+
+// fakeScaleSet is the VMs of a scale set. UpdateInstances brings VMs to
+// the latest model and records the instance IDs of every call.
+type fakeScaleSet struct {
+	mu        sync.Mutex
+	instances []nodepool.Instance
+	updates   [][]string
+}
+
+func newFakeScaleSet(n int) *fakeScaleSet {
+	f := &fakeScaleSet{}
+	for i := 0; i < n; i++ {
+		id := strconv.Itoa(i)
+		f.instances = append(f.instances, nodepool.Instance{InstanceID: id, NodeName: "node" + id})
+	}
+	return f
+}
+
+func (f *fakeScaleSet) Instances() ([]nodepool.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]nodepool.Instance(nil), f.instances...), nil
+}
+
+func (f *fakeScaleSet) Refresh() {}
+
+func (f *fakeScaleSet) UpdateInstances(resourceGroupName string, VMScaleSetName string, VMInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, cancel <-chan struct{}) (<-chan compute.OperationStatusResponse, <-chan error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := append([]string(nil), *VMInstanceIDs.InstanceIds...)
+	f.updates = append(f.updates, ids)
+	for _, id := range ids {
+		for i := range f.instances {
+			if f.instances[i].InstanceID == id {
+				f.instances[i].LatestModelApplied = true
+			}
+		}
+	}
+	resultc, errc := make(chan compute.OperationStatusResponse, 1), make(chan error, 1)
+	resultc <- compute.OperationStatusResponse{}
+	close(errc)
+	return resultc, errc
+}
+
+// healthyExcept is a health check that fails the nodes of the given VMs.
+func healthyExcept(ids ...string) HealthFunc {
+	return func(ctx context.Context, instance nodepool.Instance) (bool, error) {
+		for _, id := range ids {
+			if instance.InstanceID == id {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+func newTestUpgrader(t *testing.T, f *fakeScaleSet, store StateStore, batchPercent int, health HealthFunc) *Upgrader {
+	u, err := NewUpgrader(Config{
+		ResourceGroup: "cluster",
+		ScaleSetName:  "pool",
+		Pool:          f,
+		ScaleSets:     f,
+		Health:        health,
+		BatchPercent:  batchPercent,
+		PollInterval:  time.Millisecond,
+		HealthTimeout: 10 * time.Millisecond,
+		Store:         store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestNextBatch(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		vms      int
+		percent  int
+		latest   []int
+		deleting []int
+		failed   []string
+		want     []string
+	}{
+		{"20% of 10", 10, 20, nil, nil, nil, []string{"0", "1"}},
+		{"20% of 7 rounds up", 7, 20, nil, nil, nil, []string{"0", "1"}},
+		{"at least one", 3, 20, nil, nil, nil, []string{"0"}},
+		{"all at once", 3, 100, nil, nil, nil, []string{"0", "1", "2"}},
+		{"the default", 6, 0, nil, nil, nil, []string{"0", "1"}},
+		{"skips updated, deleting and failed VMs", 10, 30, []int{0, 2}, []int{3}, []string{"1"}, []string{"4", "5", "6"}},
+		{"none left", 2, 50, []int{0, 1}, nil, nil, nil},
+	} {
+		f := newFakeScaleSet(tt.vms)
+		for _, i := range tt.latest {
+			f.instances[i].LatestModelApplied = true
+		}
+		for _, i := range tt.deleting {
+			f.instances[i].ProvisioningState = "Deleting"
+		}
+		u := newTestUpgrader(t, f, nil, tt.percent, healthyExcept())
+		got := u.nextBatch(f.instances, tt.failed)
+		if ids := instanceIDs(got); len(ids) != len(tt.want) || len(ids) > 0 && !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("%s: nextBatch() = %v, want %v", tt.name, ids, tt.want)
+		}
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	f := newFakeScaleSet(4)
+	store := &memoryStore{}
+	u := newTestUpgrader(t, f, store, 50, healthyExcept("2"))
+
+	state, err := u.Run(context.Background())
+	if err != ErrPaused {
+		t.Fatalf("Run() = %v, want %v", err, ErrPaused)
+	}
+	if state.Upgraded != 3 || !reflect.DeepEqual(state.Failed, []string{"2"}) || !state.Paused || state.Reason == "" {
+		t.Errorf("state %+v, want 3 upgraded and VM 2 failed, paused", state)
+	}
+	if saved, _ := store.Load(); !reflect.DeepEqual(saved, state) {
+		t.Errorf("saved state %+v, want %+v", saved, state)
+	}
+
+	// Paused, it does nothing until resumed.
+	if _, err := u.Run(context.Background()); err != ErrPaused {
+		t.Errorf("Run() while paused = %v, want %v", err, ErrPaused)
+	}
+	if len(f.updates) != 2 {
+		t.Errorf("%d updates, want the 2 batches", len(f.updates))
+	}
+
+	if err := u.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	state, err = u.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() after Resume() = %v", err)
+	}
+	// VM 2 runs the latest model already and is not tried again.
+	if state.Upgraded != 3 || len(state.Failed) != 0 || state.Paused || len(state.Batch) != 0 {
+		t.Errorf("state %+v, want 3 upgraded and nothing failed or in flight", state)
+	}
+	if want := [][]string{{"0", "1"}, {"2", "3"}}; !reflect.DeepEqual(f.updates, want) {
+		t.Errorf("updates %v, want %v", f.updates, want)
+	}
+}
+
+func TestResumeSavedBatch(t *testing.T) {
+	f := newFakeScaleSet(4)
+	// The upgrader stopped after VM 1 of its batch was updated.
+	f.instances[1].LatestModelApplied = true
+	store := &memoryStore{state: State{Batch: []string{"1", "2"}}}
+	u := newTestUpgrader(t, f, store, 50, healthyExcept())
+
+	state, err := u.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"2"}, {"0", "3"}}; !reflect.DeepEqual(f.updates, want) {
+		t.Errorf("updates %v, want %v", f.updates, want)
+	}
+	if state.Upgraded != 4 || len(state.Batch) != 0 {
+		t.Errorf("state %+v, want 4 upgraded and nothing in flight", state)
+	}
+}
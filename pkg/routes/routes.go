@@ -0,0 +1,515 @@
+// Package routes is the route half of a Kubernetes cloud provider for Azure
+// and Azure Stack: it routes the pod CIDR of every node to the private IP
+// address of the node, through the route table of the cluster, the
+// routeTableName of azure.json. The route table is created if missing and
+// associated with the subnet of the nodes.
+//
+// The route controller creates the routes of all nodes at once when a
+// cluster starts, which would take an ARM write per node and soon run into
+// throttling. Changes are therefore held for a short while and applied
+// together, in a single write of the route table when there are several.
+// That write is conditional on the route table not having changed since it
+// was read, and is retried against the new route table if it did; when it
+// keeps failing, the routes are written one by one instead.
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+	"github.com/honcao/cloudprovider/pkg/instances"
+)
+
+const (
+	defaultBatchInterval = time.Second
+
+	// updateAttempts bounds how often a write that lost a race is retried.
+	updateAttempts = 5
+)
+
+// errPreconditionFailed is returned by writes whose ETag no longer matches.
+var errPreconditionFailed = errors.New("routes: changed since it was read")
+
+// Route routes the pod CIDR of a node to it, as in the Kubernetes cloud
+// provider interface.
+type Route struct {
+	// Name is the name of the route in the route table, that of the node.
+	Name string
+	// TargetNode is the name of the node.
+	TargetNode string
+	// DestinationCIDR is the pod CIDR of the node, e.g. 10.244.1.0/24.
+	DestinationCIDR string
+}
+
+// NodeAddresser tells the addresses of nodes, as instances.Instances does.
+type NodeAddresser interface {
+	NodeAddresses(nodeName string) ([]instances.NodeAddress, error)
+}
+
+var _ NodeAddresser = &instances.Instances{}
+
+// RouteTablesClient is the subset of network.RouteTablesClient Routes uses.
+type RouteTablesClient interface {
+	Get(resourceGroupName string, routeTableName string, expand string) (network.RouteTable, error)
+	CreateOrUpdatePreparer(resourceGroupName string, routeTableName string, parameters network.RouteTable, cancel <-chan struct{}) (*http.Request, error)
+	CreateOrUpdateSender(req *http.Request) (*http.Response, error)
+	CreateOrUpdateResponder(resp *http.Response) (network.RouteTable, error)
+}
+
+var _ RouteTablesClient = network.RouteTablesClient{}
+
+// RoutesClient is the subset of network.RoutesClient Routes uses.
+type RoutesClient interface {
+	CreateOrUpdate(resourceGroupName string, routeTableName string, routeName string, routeParameters network.Route, cancel <-chan struct{}) (<-chan network.Route, <-chan error)
+	Delete(resourceGroupName string, routeTableName string, routeName string, cancel <-chan struct{}) (<-chan autorest.Response, <-chan error)
+}
+
+var _ RoutesClient = network.RoutesClient{}
+
+// SubnetsClient is the subset of network.SubnetsClient Routes uses.
+type SubnetsClient interface {
+	Get(resourceGroupName string, virtualNetworkName string, subnetName string, expand string) (network.Subnet, error)
+	CreateOrUpdatePreparer(resourceGroupName string, virtualNetworkName string, subnetName string, subnetParameters network.Subnet, cancel <-chan struct{}) (*http.Request, error)
+	CreateOrUpdateSender(req *http.Request) (*http.Response, error)
+	CreateOrUpdateResponder(resp *http.Response) (network.Subnet, error)
+}
+
+var _ SubnetsClient = network.SubnetsClient{}
+
+// Config configures Routes. Apart from the clients and BatchInterval, its
+// settings are those of azure.json.
+type Config struct {
+	// ResourceGroup holds the route table.
+	ResourceGroup  string
+	Location       string
+	RouteTableName string
+	// VnetResourceGroup holds the virtual network. It defaults to
+	// ResourceGroup.
+	VnetResourceGroup string
+	VnetName          string
+	// SubnetName is the name of the subnet of the nodes, which the route
+	// table is associated with.
+	SubnetName string
+	// BatchInterval is how long changes wait for others to be applied with.
+	// It defaults to 1s.
+	BatchInterval time.Duration
+
+	// Nodes tells the private IP addresses of nodes.
+	Nodes       NodeAddresser
+	RouteTables RouteTablesClient
+	Routes      RoutesClient
+	Subnets     SubnetsClient
+}
+
+// change is a route to write, or to delete if route is nil, and where to
+// report the outcome.
+type change struct {
+	name  string
+	route *network.Route
+	done  chan error
+}
+
+// Routes manages the routes of the pod CIDRs of nodes.
+type Routes struct {
+	config Config
+
+	// mu guards the changes waiting for the next batch.
+	mu        sync.Mutex
+	pending   []*change
+	scheduled bool
+
+	// applyMu serializes batches, and guards associated.
+	applyMu sync.Mutex
+	// associated is set once the route table is known to be associated with
+	// the subnet.
+	associated bool
+}
+
+// NewRoutes validates config and returns Routes.
+func NewRoutes(config Config) (*Routes, error) {
+	if config.ResourceGroup == "" || config.Location == "" || config.RouteTableName == "" {
+		return nil, fmt.Errorf("routes: a resource group, location and route table name are required")
+	}
+	if config.VnetName == "" || config.SubnetName == "" {
+		return nil, fmt.Errorf("routes: a virtual network and subnet name are required")
+	}
+	if config.Nodes == nil || config.RouteTables == nil || config.Routes == nil || config.Subnets == nil {
+		return nil, fmt.Errorf("routes: node, route table, route and subnet clients are required")
+	}
+	if config.VnetResourceGroup == "" {
+		config.VnetResourceGroup = config.ResourceGroup
+	}
+	if config.BatchInterval == 0 {
+		config.BatchInterval = defaultBatchInterval
+	}
+	return &Routes{config: config}, nil
+}
+
+// ListRoutes returns the routes of the route table. clusterName is ignored:
+// the route table belongs to a single cluster.
+func (r *Routes) ListRoutes(clusterName string) ([]*Route, error) {
+	table, err := r.config.RouteTables.Get(r.config.ResourceGroup, r.config.RouteTableName, "")
+	if apierror.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("routes: getting route table %s: %v", r.config.RouteTableName, err)
+	}
+	var routes []*Route
+	for _, route := range derefRoutes(table.RouteTablePropertiesFormat) {
+		if route.Name == nil || route.RoutePropertiesFormat == nil || route.AddressPrefix == nil {
+			continue
+		}
+		routes = append(routes, &Route{
+			Name:            *route.Name,
+			TargetNode:      *route.Name,
+			DestinationCIDR: *route.AddressPrefix,
+		})
+	}
+	return routes, nil
+}
+
+// CreateRoute routes the pod CIDR of route to the private IP address of its
+// target node. nameHint is ignored: routes are named after their nodes.
+func (r *Routes) CreateRoute(clusterName string, nameHint string, route *Route) error {
+	if _, _, err := net.ParseCIDR(route.DestinationCIDR); err != nil {
+		return fmt.Errorf("routes: destination of the route of node %s: %v", route.TargetNode, err)
+	}
+	ip, err := r.nodeIP(route.TargetNode)
+	if err != nil {
+		return err
+	}
+	name, cidr := route.TargetNode, route.DestinationCIDR
+	return r.submit(name, &network.Route{
+		Name: &name,
+		RoutePropertiesFormat: &network.RoutePropertiesFormat{
+			AddressPrefix:    &cidr,
+			NextHopType:      network.RouteNextHopTypeVirtualAppliance,
+			NextHopIPAddress: &ip,
+		},
+	})
+}
+
+// DeleteRoute deletes the route of the target node of route.
+func (r *Routes) DeleteRoute(clusterName string, route *Route) error {
+	name := route.TargetNode
+	if name == "" {
+		name = route.Name
+	}
+	if name == "" {
+		return fmt.Errorf("routes: route to %s has no node", route.DestinationCIDR)
+	}
+	return r.submit(name, nil)
+}
+
+// nodeIP returns the private IP address of the node nodeName.
+func (r *Routes) nodeIP(nodeName string) (string, error) {
+	addresses, err := r.config.Nodes.NodeAddresses(nodeName)
+	if err != nil {
+		return "", fmt.Errorf("routes: getting addresses of node %s: %v", nodeName, err)
+	}
+	for _, address := range addresses {
+		if address.Type == instances.NodeInternalIP {
+			return address.Address, nil
+		}
+	}
+	return "", fmt.Errorf("routes: node %s has no private IP address", nodeName)
+}
+
+// submit queues the change of the route name for the next batch and waits
+// for its outcome.
+func (r *Routes) submit(name string, route *network.Route) error {
+	c := &change{name: name, route: route, done: make(chan error, 1)}
+	r.mu.Lock()
+	r.pending = append(r.pending, c)
+	if !r.scheduled {
+		r.scheduled = true
+		time.AfterFunc(r.config.BatchInterval, r.flush)
+	}
+	r.mu.Unlock()
+	return <-c.done
+}
+
+// flush applies the changes waiting and reports the outcome to each.
+func (r *Routes) flush() {
+	r.mu.Lock()
+	batch := r.pending
+	r.pending = nil
+	r.scheduled = false
+	r.mu.Unlock()
+
+	r.applyMu.Lock()
+	errs, err := r.apply(batch)
+	r.applyMu.Unlock()
+	for _, c := range batch {
+		if err != nil {
+			c.done <- err
+		} else {
+			c.done <- errs[strings.ToLower(c.name)]
+		}
+	}
+}
+
+// apply makes the changes of batch to the route table, the later of two
+// changes of a route winning. A single change is written as a route, more
+// as the whole route table, on condition that it did not change since it
+// was read. It returns the errors of the routes that could not be written,
+// by lower case name, or an error that applies to all of them.
+func (r *Routes) apply(batch []*change) (map[string]error, error) {
+	for attempt := 1; ; attempt++ {
+		table, err := r.ensureRouteTable()
+		if err != nil {
+			return nil, err
+		}
+		routes, changed := merge(table, batch)
+		switch len(changed) {
+		case 0:
+			glog.V(2).Infof("routes: route table %s is up to date", r.config.RouteTableName)
+			return nil, nil
+		case 1:
+			return map[string]error{strings.ToLower(changed[0].name): r.writeRoute(changed[0])}, nil
+		}
+
+		glog.V(2).Infof("routes: updating %d routes of route table %s", len(changed), r.config.RouteTableName)
+		table.Routes = &routes
+		_, err = r.putRouteTable(table)
+		if err == nil {
+			return nil, nil
+		}
+		if err == errPreconditionFailed && attempt < updateAttempts {
+			glog.V(2).Infof("routes: route table %s changed while being updated, retrying", r.config.RouteTableName)
+			continue
+		}
+		if err == errPreconditionFailed {
+			err = fmt.Errorf("routes: route table %s kept changing while being updated", r.config.RouteTableName)
+		}
+		glog.Warningf("%v; writing the %d routes one by one", err, len(changed))
+		errs := map[string]error{}
+		for _, c := range changed {
+			errs[strings.ToLower(c.name)] = r.writeRoute(c)
+		}
+		return errs, nil
+	}
+}
+
+// merge returns the routes of table with the changes of batch made, and
+// the changes that make a difference.
+func merge(table network.RouteTable, batch []*change) ([]network.Route, []*change) {
+	latest := map[string]*change{}
+	var order []string
+	for _, c := range batch {
+		key := strings.ToLower(c.name)
+		if _, ok := latest[key]; !ok {
+			order = append(order, key)
+		}
+		latest[key] = c
+	}
+
+	routes := []network.Route{}
+	var changed []*change
+	for _, route := range derefRoutes(table.RouteTablePropertiesFormat) {
+		key := ""
+		if route.Name != nil {
+			key = strings.ToLower(*route.Name)
+		}
+		c, ok := latest[key]
+		if !ok {
+			routes = append(routes, route)
+			continue
+		}
+		delete(latest, key)
+		switch {
+		case c.route == nil:
+			changed = append(changed, c)
+		case route.RoutePropertiesFormat != nil && routeMatches(*route.RoutePropertiesFormat, *c.route.RoutePropertiesFormat):
+			routes = append(routes, route)
+		default:
+			route.RoutePropertiesFormat = c.route.RoutePropertiesFormat
+			routes = append(routes, route)
+			changed = append(changed, c)
+		}
+	}
+	// Routes to delete that do not exist are left out.
+	for _, key := range order {
+		if c, ok := latest[key]; ok && c.route != nil {
+			routes = append(routes, *c.route)
+			changed = append(changed, c)
+		}
+	}
+	return routes, changed
+}
+
+// writeRoute makes the single change c.
+func (r *Routes) writeRoute(c *change) error {
+	if c.route == nil {
+		glog.V(2).Infof("routes: deleting route %s of route table %s", c.name, r.config.RouteTableName)
+		_, errc := r.config.Routes.Delete(r.config.ResourceGroup, r.config.RouteTableName, c.name, nil)
+		if err := <-errc; err != nil && !apierror.IsNotFound(err) {
+			return fmt.Errorf("routes: deleting route %s: %v", c.name, err)
+		}
+		return nil
+	}
+	glog.V(2).Infof("routes: routing %s to node %s", *c.route.AddressPrefix, c.name)
+	_, errc := r.config.Routes.CreateOrUpdate(r.config.ResourceGroup, r.config.RouteTableName, c.name, *c.route, nil)
+	if err := <-errc; err != nil {
+		return fmt.Errorf("routes: creating route %s: %v", c.name, err)
+	}
+	return nil
+}
+
+// ensureRouteTable returns the route table, creating it if it does not
+// exist, and associates it with the subnet of the nodes the first time.
+func (r *Routes) ensureRouteTable() (network.RouteTable, error) {
+	name := r.config.RouteTableName
+	table, err := r.config.RouteTables.Get(r.config.ResourceGroup, name, "")
+	if apierror.IsNotFound(err) {
+		glog.V(2).Infof("routes: creating route table %s", name)
+		location := r.config.Location
+		table, err = r.putRouteTable(network.RouteTable{
+			Location:                   &location,
+			RouteTablePropertiesFormat: &network.RouteTablePropertiesFormat{},
+		})
+		if err == errPreconditionFailed {
+			// Another writer created it in between.
+			table, err = r.config.RouteTables.Get(r.config.ResourceGroup, name, "")
+		} else if err != nil {
+			return network.RouteTable{}, err
+		}
+	}
+	if err != nil {
+		return network.RouteTable{}, fmt.Errorf("routes: getting route table %s: %v", name, err)
+	}
+	if table.RouteTablePropertiesFormat == nil {
+		table.RouteTablePropertiesFormat = &network.RouteTablePropertiesFormat{}
+	}
+
+	if !r.associated {
+		if err := r.associate(table); err != nil {
+			return network.RouteTable{}, err
+		}
+		r.associated = true
+	}
+	return table, nil
+}
+
+// putRouteTable writes table on condition that the route table still has
+// the ETag table was read with, or, for a new route table without one, that
+// it still does not exist.
+func (r *Routes) putRouteTable(table network.RouteTable) (network.RouteTable, error) {
+	name := r.config.RouteTableName
+	etag := table.Etag
+	// Leave out what the service computes.
+	table.Etag = nil
+	table.ProvisioningState = nil
+	req, err := r.config.RouteTables.CreateOrUpdatePreparer(r.config.ResourceGroup, name, table, nil)
+	if err != nil {
+		return network.RouteTable{}, fmt.Errorf("routes: preparing update of route table %s: %v", name, err)
+	}
+	if etag != nil {
+		req.Header.Set("If-Match", *etag)
+	} else {
+		req.Header.Set("If-None-Match", "*")
+	}
+	resp, err := r.config.RouteTables.CreateOrUpdateSender(req)
+	var result network.RouteTable
+	if err == nil {
+		result, err = r.config.RouteTables.CreateOrUpdateResponder(resp)
+	}
+	if resp != nil && resp.StatusCode == http.StatusPreconditionFailed {
+		return network.RouteTable{}, errPreconditionFailed
+	}
+	if err != nil {
+		return network.RouteTable{}, fmt.Errorf("routes: updating route table %s: %v", name, err)
+	}
+	return result, nil
+}
+
+// associate makes table the route table of the subnet of the nodes,
+// starting over when the subnet changed in between. A subnet that already
+// has another route table is left alone.
+func (r *Routes) associate(table network.RouteTable) error {
+	if table.ID == nil {
+		return fmt.Errorf("routes: route table %s has no ID", r.config.RouteTableName)
+	}
+	for attempt := 1; ; attempt++ {
+		subnet, err := r.config.Subnets.Get(r.config.VnetResourceGroup, r.config.VnetName, r.config.SubnetName, "")
+		if err != nil {
+			return fmt.Errorf("routes: getting subnet %s of virtual network %s: %v", r.config.SubnetName, r.config.VnetName, err)
+		}
+		if subnet.SubnetPropertiesFormat == nil {
+			subnet.SubnetPropertiesFormat = &network.SubnetPropertiesFormat{}
+		}
+		if subnet.RouteTable != nil && subnet.RouteTable.ID != nil {
+			if strings.EqualFold(*subnet.RouteTable.ID, *table.ID) {
+				return nil
+			}
+			return fmt.Errorf("routes: subnet %s already has route table %s", r.config.SubnetName, *subnet.RouteTable.ID)
+		}
+
+		glog.V(2).Infof("routes: associating route table %s with subnet %s", r.config.RouteTableName, r.config.SubnetName)
+		subnet.RouteTable = &network.RouteTable{ID: table.ID}
+		err = r.putSubnet(subnet)
+		if err != errPreconditionFailed {
+			return err
+		}
+		if attempt == updateAttempts {
+			return fmt.Errorf("routes: subnet %s kept changing while being associated with route table %s", r.config.SubnetName, r.config.RouteTableName)
+		}
+		glog.V(2).Infof("routes: subnet %s changed while being associated, retrying", r.config.SubnetName)
+	}
+}
+
+// putSubnet writes subnet on condition that the subnet still has the ETag
+// it was read with.
+func (r *Routes) putSubnet(subnet network.Subnet) error {
+	etag := subnet.Etag
+	subnet.Etag = nil
+	subnet.ProvisioningState = nil
+	req, err := r.config.Subnets.CreateOrUpdatePreparer(r.config.VnetResourceGroup, r.config.VnetName, r.config.SubnetName, subnet, nil)
+	if err != nil {
+		return fmt.Errorf("routes: preparing update of subnet %s: %v", r.config.SubnetName, err)
+	}
+	if etag != nil {
+		req.Header.Set("If-Match", *etag)
+	}
+	resp, err := r.config.Subnets.CreateOrUpdateSender(req)
+	if err == nil {
+		_, err = r.config.Subnets.CreateOrUpdateResponder(resp)
+	}
+	if resp != nil && resp.StatusCode == http.StatusPreconditionFailed {
+		return errPreconditionFailed
+	}
+	if err != nil {
+		return fmt.Errorf("routes: associating route table %s with subnet %s: %v", r.config.RouteTableName, r.config.SubnetName, err)
+	}
+	return nil
+}
+
+func routeMatches(have, want network.RoutePropertiesFormat) bool {
+	return stringsEqual(have.AddressPrefix, want.AddressPrefix) &&
+		strings.EqualFold(string(have.NextHopType), string(want.NextHopType)) &&
+		stringsEqual(have.NextHopIPAddress, want.NextHopIPAddress)
+}
+
+func derefRoutes(props *network.RouteTablePropertiesFormat) []network.Route {
+	if props == nil || props.Routes == nil {
+		return nil
+	}
+	return *props.Routes
+}
+
+func stringsEqual(a, b *string) bool {
+	if a == nil || b == nil {
+		return (a == nil || *a == "") && (b == nil || *b == "")
+	}
+	return *a == *b
+}
@@ -0,0 +1,367 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/honcao/cloudprovider/pkg/instances"
+)
+
+const testRouteTableID = "/subscriptions/sub/resourceGroups/cluster/providers/Microsoft.Network/routeTables/k8s-routes"
+
+// fakeResources stores resources as JSON under ETags that change on every
+// write, and turns down writes whose If-Match no longer matches, or whose
+// If-None-Match: * finds the resource, as ARM does.
+type fakeResources struct {
+	resources map[string][]byte
+	etags     map[string]string
+	etag      int
+	// race, if set, runs before every write, to change the resource
+	// between the read and the write.
+	race func(name string)
+	// status, if set, is the status of every write instead of the outcome.
+	status int
+	// ifMatch holds the If-Match headers of the writes.
+	ifMatch []string
+}
+
+func newFakeResources() *fakeResources {
+	return &fakeResources{resources: map[string][]byte{}, etags: map[string]string{}}
+}
+
+// set stores v under name with a new ETag.
+func (f *fakeResources) set(name string, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	f.etag++
+	f.resources[name] = body
+	f.etags[name] = strconv.Itoa(f.etag)
+}
+
+// get unmarshals the resource name into v along with its ETag.
+func (f *fakeResources) get(name string, v interface{}, etag **string) error {
+	body, ok := f.resources[name]
+	if !ok {
+		return autorest.DetailedError{StatusCode: http.StatusNotFound}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return err
+	}
+	e := f.etags[name]
+	*etag = &e
+	return nil
+}
+
+func (f *fakeResources) prepare(name string, v interface{}) (*http.Request, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return http.NewRequest(http.MethodPut, "https://management.local/"+name, bytes.NewReader(body))
+}
+
+func (f *fakeResources) send(req *http.Request) (*http.Response, error) {
+	name := path.Base(req.URL.Path)
+	if f.race != nil {
+		f.race(name)
+	}
+	ifMatch, ifNoneMatch := req.Header.Get("If-Match"), req.Header.Get("If-None-Match")
+	f.ifMatch = append(f.ifMatch, ifMatch)
+	resp := &http.Response{Request: req, Body: ioutil.NopCloser(strings.NewReader("{}"))}
+	if f.status != 0 {
+		resp.StatusCode = f.status
+		return resp, nil
+	}
+	etag, exists := f.etags[name]
+	if exists && ifMatch != "" && ifMatch != etag || exists && ifNoneMatch == "*" {
+		resp.StatusCode = http.StatusPreconditionFailed
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.resources[name] = body
+	f.etag++
+	f.etags[name] = strconv.Itoa(f.etag)
+	resp.StatusCode = http.StatusOK
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (f *fakeResources) respond(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return autorest.DetailedError{StatusCode: resp.StatusCode}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type fakeRouteTables struct{ *fakeResources }
+
+func (f fakeRouteTables) Get(resourceGroupName string, routeTableName string, expand string) (network.RouteTable, error) {
+	var table network.RouteTable
+	err := f.get(routeTableName, &table, &table.Etag)
+	table.ID = stringPtr(testRouteTableID)
+	return table, err
+}
+
+func (f fakeRouteTables) CreateOrUpdatePreparer(resourceGroupName string, routeTableName string, parameters network.RouteTable, cancel <-chan struct{}) (*http.Request, error) {
+	return f.prepare(routeTableName, parameters)
+}
+
+func (f fakeRouteTables) CreateOrUpdateSender(req *http.Request) (*http.Response, error) {
+	return f.send(req)
+}
+
+func (f fakeRouteTables) CreateOrUpdateResponder(resp *http.Response) (network.RouteTable, error) {
+	var table network.RouteTable
+	err := f.respond(resp, &table)
+	table.ID = stringPtr(testRouteTableID)
+	return table, err
+}
+
+// fakeRoutes writes single routes into the route table of a
+// fakeRouteTables, failing those named in fail.
+type fakeRoutes struct {
+	tables  fakeRouteTables
+	fail    map[string]bool
+	written []string
+}
+
+func (f *fakeRoutes) update(routeTableName, routeName string, route *network.Route) error {
+	f.written = append(f.written, routeName)
+	if f.fail[routeName] {
+		return autorest.DetailedError{StatusCode: http.StatusInternalServerError}
+	}
+	table, err := f.tables.Get("", routeTableName, "")
+	if err != nil {
+		return err
+	}
+	routes := []network.Route{}
+	for _, r := range derefRoutes(table.RouteTablePropertiesFormat) {
+		if *r.Name != routeName {
+			routes = append(routes, r)
+		}
+	}
+	if route != nil {
+		routes = append(routes, *route)
+	}
+	table.Routes = &routes
+	f.tables.set(routeTableName, table)
+	return nil
+}
+
+func (f *fakeRoutes) CreateOrUpdate(resourceGroupName string, routeTableName string, routeName string, routeParameters network.Route, cancel <-chan struct{}) (<-chan network.Route, <-chan error) {
+	resultc, errc := make(chan network.Route, 1), make(chan error, 1)
+	if err := f.update(routeTableName, routeName, &routeParameters); err != nil {
+		errc <- err
+	} else {
+		resultc <- routeParameters
+	}
+	close(errc)
+	return resultc, errc
+}
+
+func (f *fakeRoutes) Delete(resourceGroupName string, routeTableName string, routeName string, cancel <-chan struct{}) (<-chan autorest.Response, <-chan error) {
+	resultc, errc := make(chan autorest.Response, 1), make(chan error, 1)
+	if err := f.update(routeTableName, routeName, nil); err != nil {
+		errc <- err
+	}
+	resultc <- autorest.Response{}
+	close(errc)
+	return resultc, errc
+}
+
+type fakeSubnets struct{ *fakeResources }
+
+func (f fakeSubnets) Get(resourceGroupName string, virtualNetworkName string, subnetName string, expand string) (network.Subnet, error) {
+	var subnet network.Subnet
+	err := f.get(subnetName, &subnet, &subnet.Etag)
+	return subnet, err
+}
+
+func (f fakeSubnets) CreateOrUpdatePreparer(resourceGroupName string, virtualNetworkName string, subnetName string, subnetParameters network.Subnet, cancel <-chan struct{}) (*http.Request, error) {
+	return f.prepare(subnetName, subnetParameters)
+}
+
+func (f fakeSubnets) CreateOrUpdateSender(req *http.Request) (*http.Response, error) {
+	return f.send(req)
+}
+
+func (f fakeSubnets) CreateOrUpdateResponder(resp *http.Response) (network.Subnet, error) {
+	var subnet network.Subnet
+	err := f.respond(resp, &subnet)
+	return subnet, err
+}
+
+// fakeNodes gives node<n> the private IP address 10.240.0.<n>.
+type fakeNodes struct{}
+
+func (fakeNodes) NodeAddresses(nodeName string) ([]instances.NodeAddress, error) {
+	return []instances.NodeAddress{
+		{Type: instances.NodeInternalIP, Address: "10.240.0." + strings.TrimPrefix(nodeName, "node")},
+	}, nil
+}
+
+func stringPtr(s string) *string { return &s }
+
+type testClients struct {
+	tables  fakeRouteTables
+	routes  *fakeRoutes
+	subnets fakeSubnets
+}
+
+func newTestRoutes(t *testing.T) (*Routes, testClients) {
+	c := testClients{tables: fakeRouteTables{newFakeResources()}, subnets: fakeSubnets{newFakeResources()}}
+	c.routes = &fakeRoutes{tables: c.tables, fail: map[string]bool{}}
+	c.subnets.set("nodes", network.Subnet{SubnetPropertiesFormat: &network.SubnetPropertiesFormat{AddressPrefix: stringPtr("10.240.0.0/16")}})
+	r, err := NewRoutes(Config{
+		ResourceGroup:  "cluster",
+		Location:       "local",
+		RouteTableName: "k8s-routes",
+		VnetName:       "k8s-vnet",
+		SubnetName:     "nodes",
+		BatchInterval:  20 * time.Millisecond,
+		Nodes:          fakeNodes{},
+		RouteTables:    c.tables,
+		Routes:         c.routes,
+		Subnets:        c.subnets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, c
+}
+
+// createRoutes creates the routes of the nodes together and returns the
+// error of each.
+func createRoutes(r *Routes, nodes ...string) map[string]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := map[string]error{}
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(node, cidr string) {
+			defer wg.Done()
+			err := r.CreateRoute("", "", &Route{TargetNode: node, DestinationCIDR: cidr})
+			mu.Lock()
+			errs[node] = err
+			mu.Unlock()
+		}(node, fmt.Sprintf("10.244.%d.0/24", i))
+	}
+	wg.Wait()
+	return errs
+}
+
+func routeNames(t *testing.T, r *Routes) []string {
+	routes, err := r.ListRoutes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, route := range routes {
+		names = append(names, route.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestBatchRetriesOnPreconditionFailed(t *testing.T) {
+	r, c := newTestRoutes(t)
+	c.tables.set("k8s-routes", network.RouteTable{RouteTablePropertiesFormat: &network.RouteTablePropertiesFormat{}})
+	// Another writer adds a route between the first read and write of the
+	// route table.
+	raced := false
+	c.tables.race = func(name string) {
+		if !raced {
+			raced = true
+			c.tables.set(name, network.RouteTable{RouteTablePropertiesFormat: &network.RouteTablePropertiesFormat{
+				Routes: &[]network.Route{{Name: stringPtr("manual"), RoutePropertiesFormat: &network.RoutePropertiesFormat{AddressPrefix: stringPtr("10.0.0.0/8")}}},
+			}})
+		}
+	}
+
+	for node, err := range createRoutes(r, "node1", "node2", "node3") {
+		if err != nil {
+			t.Errorf("CreateRoute(%s) = %v", node, err)
+		}
+	}
+	if !raced {
+		t.Fatal("the route table was not changed between read and write")
+	}
+	if want := []string{"manual", "node1", "node2", "node3"}; !reflect.DeepEqual(routeNames(t, r), want) {
+		t.Errorf("routes %v, want %v", routeNames(t, r), want)
+	}
+	// The lost write and its retry.
+	if want := []string{"1", "2"}; !reflect.DeepEqual(c.tables.ifMatch, want) {
+		t.Errorf("route table writes had If-Match %q, want %q", c.tables.ifMatch, want)
+	}
+	if len(c.routes.written) != 0 {
+		t.Errorf("routes %v were written one by one", c.routes.written)
+	}
+	if want := []string{"1"}; !reflect.DeepEqual(c.subnets.ifMatch, want) {
+		t.Errorf("subnet writes had If-Match %q, want %q", c.subnets.ifMatch, want)
+	}
+}
+
+func TestBatchFallsBackToRouteWrites(t *testing.T) {
+	r, c := newTestRoutes(t)
+	if err := r.CreateRoute("", "", &Route{TargetNode: "node0", DestinationCIDR: "10.244.9.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.tables.status = http.StatusInternalServerError
+	c.routes.fail["node2"] = true
+	errs := createRoutes(r, "node1", "node2", "node3")
+	for _, node := range []string{"node1", "node3"} {
+		if errs[node] != nil {
+			t.Errorf("CreateRoute(%s) = %v", node, errs[node])
+		}
+	}
+	if errs["node2"] == nil {
+		t.Errorf("CreateRoute(node2) succeeded, want the error of its write")
+	}
+	if want := []string{"node0", "node1", "node3"}; !reflect.DeepEqual(routeNames(t, r), want) {
+		t.Errorf("routes %v, want %v", routeNames(t, r), want)
+	}
+}
+
+func TestAssociateRetriesOnPreconditionFailed(t *testing.T) {
+	r, c := newTestRoutes(t)
+	raced := false
+	c.subnets.race = func(name string) {
+		if !raced {
+			raced = true
+			c.subnets.set(name, network.Subnet{SubnetPropertiesFormat: &network.SubnetPropertiesFormat{AddressPrefix: stringPtr("10.240.0.0/16")}})
+		}
+	}
+	if err := r.CreateRoute("", "", &Route{TargetNode: "node1", DestinationCIDR: "10.244.1.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	subnet, err := c.subnets.Get("", "", "nodes", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subnet.RouteTable == nil || *subnet.RouteTable.ID != testRouteTableID {
+		t.Errorf("subnet route table %v, want %s", subnet.RouteTable, testRouteTableID)
+	}
+	if want := []string{"1", "2"}; !reflect.DeepEqual(c.subnets.ifMatch, want) {
+		t.Errorf("subnet writes had If-Match %q, want %q", c.subnets.ifMatch, want)
+	}
+}
@@ -0,0 +1,129 @@
+package runcommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+)
+
+const (
+	// The markers the Linux agent puts before the output streams in the
+	// message of its status.
+	stdoutMarker = "[stdout]\n"
+	stderrMarker = "[stderr]\n"
+
+	failedSuffix = "/failed"
+)
+
+// exitStatusRE finds the exit status in the message of a failed script,
+// e.g. "command terminated with exit status=2".
+var exitStatusRE = regexp.MustCompile(`exit (?:status|code)[=: ]+(\d+)`)
+
+// Output is the output of a script.
+type Output struct {
+	Stdout string
+	Stderr string
+	// Succeeded reports whether the script seems to have succeeded, and
+	// ExitStatus is its exit status as far as it can be told. runCommand
+	// reports no exit status: it is read from the message of a Linux
+	// agent, and a Windows script that wrote to stderr is taken to have
+	// failed with exit status 1.
+	Succeeded  bool
+	ExitStatus int
+	// Message is the message of the status runCommand reported, without
+	// the output.
+	Message string
+}
+
+// status is a status in the output of runCommand.
+type status struct {
+	Code    string                   `json:"code"`
+	Level   compute.StatusLevelTypes `json:"level"`
+	Message string                   `json:"message"`
+}
+
+// parseResult digs the output of a script out of the result of runCommand,
+// whose output is an array of statuses: one with both streams from Linux,
+// and one for each stream from Windows.
+func parseResult(result compute.RunCommandResult) (*Output, error) {
+	output := &Output{Succeeded: true}
+	if result.Error != nil {
+		output.Succeeded = false
+		if result.Error.Message != nil {
+			output.Message = *result.Error.Message
+		}
+	}
+	if result.Status != nil && strings.EqualFold(*result.Status, "Failed") {
+		output.Succeeded = false
+	}
+
+	var statuses []status
+	if result.RunCommandResultProperties != nil && result.Output != nil {
+		data, err := json.Marshal(*result.Output)
+		if err != nil {
+			return nil, err
+		}
+		var value struct {
+			Value []status `json:"value"`
+		}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, fmt.Errorf("unexpected output %s: %v", data, err)
+		}
+		statuses = value.Value
+	}
+
+	windows := false
+	for _, s := range statuses {
+		code := strings.ToLower(s.Code)
+		if strings.HasSuffix(code, failedSuffix) || s.Level == compute.Error {
+			output.Succeeded = false
+		}
+		switch {
+		case strings.Contains(code, "/stdout/"):
+			windows = true
+			output.Stdout += s.Message
+		case strings.Contains(code, "/stderr/"):
+			windows = true
+			output.Stderr += s.Message
+		default:
+			message, stdout, stderr := splitStreams(s.Message)
+			output.Stdout += stdout
+			output.Stderr += stderr
+			if output.Message == "" {
+				output.Message = message
+			}
+		}
+	}
+	if windows && strings.TrimSpace(output.Stderr) != "" {
+		output.Succeeded = false
+	}
+
+	if !output.Succeeded {
+		output.ExitStatus = 1
+		if m := exitStatusRE.FindStringSubmatch(output.Message); m != nil {
+			if n, err := strconv.Atoi(m[1]); err == nil && n != 0 {
+				output.ExitStatus = n
+			}
+		}
+	}
+	return output, nil
+}
+
+// splitStreams splits the message of a Linux agent into the message proper
+// and the output streams that follow it.
+func splitStreams(message string) (string, string, string) {
+	var stdout, stderr string
+	if i := strings.Index(message, stderrMarker); i >= 0 {
+		stderr = message[i+len(stderrMarker):]
+		message = message[:i]
+	}
+	if i := strings.Index(message, stdoutMarker); i >= 0 {
+		stdout = message[i+len(stdoutMarker):]
+		message = message[:i]
+	}
+	return strings.TrimSuffix(strings.TrimSpace(message), ":"), stdout, stderr
+}
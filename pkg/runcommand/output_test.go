@@ -0,0 +1,90 @@
+package runcommand
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+)
+
+func TestParseResult(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// result is the body of the runCommand operation.
+		result string
+		want   Output
+	}{
+		{
+			name: "Linux",
+			result: `{"name":"1","status":"Succeeded","properties":{"output":{"value":[
+				{"code":"ProvisioningState/succeeded","level":"Info","displayStatus":"Provisioning succeeded",
+				 "message":"Enable succeeded: \n[stdout]\nhello\nworld\n\n[stderr]\n"}]}}}`,
+			want: Output{Stdout: "hello\nworld\n\n", Succeeded: true, Message: "Enable succeeded"},
+		},
+		{
+			name: "Linux with stderr",
+			result: `{"name":"1","status":"Succeeded","properties":{"output":{"value":[
+				{"code":"ProvisioningState/succeeded","level":"Info",
+				 "message":"Enable succeeded: \n[stdout]\nok\n\n[stderr]\nwarning: deprecated\n"}]}}}`,
+			want: Output{Stdout: "ok\n\n", Stderr: "warning: deprecated\n", Succeeded: true, Message: "Enable succeeded"},
+		},
+		{
+			name: "Linux exit status",
+			result: `{"name":"1","status":"Succeeded","properties":{"output":{"value":[
+				{"code":"ProvisioningState/failed/0","level":"Error","displayStatus":"Provisioning failed",
+				 "message":"Enable failed: failed to execute command: command terminated with exit status=2\n[stdout]\n\n[stderr]\nno such file\n"}]}}}`,
+			want: Output{Stdout: "\n", Stderr: "no such file\n", ExitStatus: 2, Message: "Enable failed: failed to execute command: command terminated with exit status=2"},
+		},
+		{
+			name: "Windows",
+			result: `{"name":"1","status":"Succeeded","properties":{"output":{"value":[
+				{"code":"ComponentStatus/StdOut/succeeded","level":"Info","displayStatus":"Provisioning succeeded","message":"hello\r\n"},
+				{"code":"ComponentStatus/StdErr/succeeded","level":"Info","displayStatus":"Provisioning succeeded","message":""}]}}}`,
+			want: Output{Stdout: "hello\r\n", Succeeded: true},
+		},
+		{
+			name: "Windows with stderr",
+			result: `{"name":"1","status":"Succeeded","properties":{"output":{"value":[
+				{"code":"ComponentStatus/StdOut/succeeded","level":"Info","message":""},
+				{"code":"ComponentStatus/StdErr/succeeded","level":"Info","message":"Get-Foo : The term 'Get-Foo' is not recognized"}]}}}`,
+			want: Output{Stderr: "Get-Foo : The term 'Get-Foo' is not recognized", ExitStatus: 1},
+		},
+		{
+			name:   "failed operation",
+			result: `{"name":"1","status":"Failed","error":{"code":"VMAgentStatusCommunicationError","message":"VM has reported a failure when processing extension"}}`,
+			want:   Output{ExitStatus: 1, Message: "VM has reported a failure when processing extension"},
+		},
+	} {
+		var result compute.RunCommandResult
+		if err := json.Unmarshal([]byte(tt.result), &result); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := parseResult(result)
+		if err != nil {
+			t.Errorf("%s: parseResult() = %v", tt.name, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("%s: parseResult() = %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestSplitStreams(t *testing.T) {
+	for _, tt := range []struct {
+		message                string
+		wantMessage, out, errs string
+	}{
+		{"Enable succeeded: \n[stdout]\nout\n\n[stderr]\nerr\n", "Enable succeeded", "out\n\n", "err\n"},
+		{"Enable succeeded: \n[stdout]\nout\n", "Enable succeeded", "out\n", ""},
+		{"Enable succeeded: \n[stderr]\nerr\n", "Enable succeeded", "", "err\n"},
+		{"Enable succeeded", "Enable succeeded", "", ""},
+		// The markers only count at the start of a line.
+		{"Enable succeeded: \n[stdout]\nprinted [stderr] inline\n", "Enable succeeded", "printed [stderr] inline\n", ""},
+	} {
+		message, stdout, stderr := splitStreams(tt.message)
+		if message != tt.wantMessage || stdout != tt.out || stderr != tt.errs {
+			t.Errorf("splitStreams(%q) = %q, %q, %q, want %q, %q, %q", tt.message, message, stdout, stderr, tt.wantMessage, tt.out, tt.errs)
+		}
+	}
+}
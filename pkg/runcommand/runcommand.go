@@ -0,0 +1,231 @@
+// Package runcommand runs shell and PowerShell scripts on VMs through the
+// runCommand action of the compute API, which needs no extension or network
+// access to the VMs. It waits for the scripts under a timeout and digs their
+// output, which the API buries in an array of statuses, out into stdout,
+// stderr and an exit status.
+//
+// runCommand came with the 2017-03-30 compute API, which not all Azure
+// Stack stamps have. Run returns ErrUnsupported on those.
+package runcommand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+)
+
+// CommandID identifies the kind of script to run.
+type CommandID string
+
+const (
+	// ShellScript runs a shell script on a Linux VM.
+	ShellScript CommandID = "RunShellScript"
+	// PowerShellScript runs a PowerShell script on a Windows VM.
+	PowerShellScript CommandID = "RunPowerShellScript"
+)
+
+const (
+	defaultTimeout     = 10 * time.Minute
+	defaultConcurrency = 5
+
+	// minAPIVersion is the first compute API version with runCommand.
+	minAPIVersion = "2017-03-30"
+)
+
+// ErrUnsupported is returned when the compute API version of the stamp
+// lacks runCommand.
+var ErrUnsupported = errors.New("runcommand: the compute API version of the stamp lacks runCommand, which needs " + minAPIVersion + " or later")
+
+// VirtualMachinesClient is the subset of compute.VirtualMachinesClient the
+// Runner uses.
+type VirtualMachinesClient interface {
+	RunCommand(resourceGroupName string, VMName string, parameters compute.RunCommandInput, cancel <-chan struct{}) (<-chan compute.RunCommandResult, <-chan error)
+}
+
+var _ VirtualMachinesClient = compute.VirtualMachinesClient{}
+
+// Script is a script to run.
+type Script struct {
+	CommandID CommandID
+	// Lines are the lines of the script.
+	Lines []string
+	// Parameters are passed to the script: as environment variables to a
+	// shell script, and as named parameters to a PowerShell one.
+	Parameters map[string]string
+}
+
+// Config configures a Runner.
+type Config struct {
+	VirtualMachines VirtualMachinesClient
+	// APIVersion is the compute API version of the stamp. It defaults to
+	// compute.APIVersion.
+	APIVersion string
+	// Timeout bounds the wait for a script on a VM. It defaults to 10m.
+	Timeout time.Duration
+	// Concurrency is the number of VMs RunAll runs a script on at once. It
+	// defaults to 5.
+	Concurrency int
+}
+
+// Runner runs scripts on VMs.
+type Runner struct {
+	config Config
+}
+
+// NewRunner validates config and returns a Runner.
+func NewRunner(config Config) (*Runner, error) {
+	if config.VirtualMachines == nil {
+		return nil, fmt.Errorf("runcommand: a virtual machine client is required")
+	}
+	if config.APIVersion == "" {
+		config.APIVersion = compute.APIVersion
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = defaultConcurrency
+	}
+	return &Runner{config: config}, nil
+}
+
+// Run runs script on a VM and returns its output. It fails if the script
+// could not be run or did not finish within the timeout or before ctx is
+// done; a script that ran and failed is reported by Output.Succeeded.
+func (r *Runner) Run(ctx context.Context, resourceGroup, vmName string, script Script) (*Output, error) {
+	if err := r.check(script); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	glog.V(2).Infof("runcommand: running %s on VM %s", script.CommandID, vmName)
+	resultc, errc := r.config.VirtualMachines.RunCommand(resourceGroup, vmName, script.input(), ctx.Done())
+	select {
+	case err := <-errc:
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("runcommand: running %s on VM %s: %v", script.CommandID, vmName, ctx.Err())
+			}
+			if apierror.IsUnsupported(err) {
+				return nil, ErrUnsupported
+			}
+			return nil, fmt.Errorf("runcommand: running %s on VM %s: %v", script.CommandID, vmName, err)
+		}
+	case <-ctx.Done():
+		// The client gives up polling once ctx is done, and its channels
+		// are buffered, so nothing is left blocked.
+		return nil, fmt.Errorf("runcommand: running %s on VM %s: %v", script.CommandID, vmName, ctx.Err())
+	}
+	output, err := parseResult(<-resultc)
+	if err != nil {
+		return nil, fmt.Errorf("runcommand: the output of %s on VM %s: %v", script.CommandID, vmName, err)
+	}
+	if !output.Succeeded {
+		glog.Warningf("runcommand: %s failed on VM %s with exit status %d", script.CommandID, vmName, output.ExitStatus)
+	}
+	return output, nil
+}
+
+// Result is the outcome of a script on one of the VMs of RunAll.
+type Result struct {
+	VM     string
+	Output *Output
+	Err    error
+}
+
+// RunAll runs script on the given VMs of a resource group, a few at a
+// time, and returns a result for each VM in the order of their names. It
+// stops early with ErrUnsupported if the stamp lacks runCommand.
+func (r *Runner) RunAll(ctx context.Context, resourceGroup string, vmNames []string, script Script) ([]Result, error) {
+	if err := r.check(script); err != nil {
+		return nil, err
+	}
+	names := append([]string(nil), vmNames...)
+	sort.Strings(names)
+	results := make([]Result, len(names))
+
+	// Every VM would fail the same way on a stamp without runCommand, so
+	// the first VM runs alone to find out.
+	for i, name := range names {
+		results[i].VM = name
+	}
+	if len(names) == 0 {
+		return results, nil
+	}
+	results[0].Output, results[0].Err = r.Run(ctx, resourceGroup, names[0], script)
+	if results[0].Err == ErrUnsupported {
+		return nil, ErrUnsupported
+	}
+
+	sem := make(chan struct{}, r.config.Concurrency)
+	var wg sync.WaitGroup
+	for i := 1; i < len(results); i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(result *Result) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			result.Output, result.Err = r.Run(ctx, resourceGroup, result.VM, script)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// check validates script and that the stamp has runCommand.
+func (r *Runner) check(script Script) error {
+	if script.CommandID == "" || len(script.Lines) == 0 {
+		return fmt.Errorf("runcommand: a command ID and a script are required")
+	}
+	// API versions are dates, which compare as strings.
+	if r.config.APIVersion < minAPIVersion {
+		return ErrUnsupported
+	}
+	return nil
+}
+
+// input returns the input of runCommand for script, with the parameters
+// in the order of their names.
+func (script Script) input() compute.RunCommandInput {
+	commandID := string(script.CommandID)
+	lines := script.Lines
+	input := compute.RunCommandInput{
+		CommandID: &commandID,
+		Script:    &lines,
+	}
+	if len(script.Parameters) > 0 {
+		names := make([]string, 0, len(script.Parameters))
+		for name := range script.Parameters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		params := make([]compute.RunCommandInputParameter, 0, len(names))
+		for _, name := range names {
+			params = append(params, compute.RunCommandInputParameter{
+				Name:  stringPtr(name),
+				Value: stringPtr(script.Parameters[name]),
+			})
+		}
+		input.Parameters = &params
+	}
+	return input
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,69 @@
+package runcommand
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+)
+
+// newTestRunner returns a Runner whose client talks to a server that
+// answers runCommand with status and body.
+func newTestRunner(t *testing.T, apiVersion string, status int, body string) *Runner {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	client := compute.NewVirtualMachinesClientWithBaseURI(server.URL, "sub")
+	client.PollingDelay = 0
+	r, err := NewRunner(Config{VirtualMachines: client, APIVersion: apiVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRunUnsupported(t *testing.T) {
+	script := Script{CommandID: ShellScript, Lines: []string{"hostname"}}
+	for _, tt := range []struct {
+		name       string
+		apiVersion string
+		status     int
+		body       string
+		want       bool
+	}{
+		{"old API version", "2016-04-30-preview", http.StatusOK, `{}`, true},
+		// A stamp without the runCommand route answers 404 with no error
+		// code.
+		{"no route", "", http.StatusNotFound, ``, true},
+		{"no route, JSON body", "", http.StatusNotFound, `{"message":"No HTTP resource was found"}`, true},
+		{"unknown API version", "", http.StatusBadRequest, `{"error":{"code":"InvalidApiVersionParameter","message":"The api-version is invalid."}}`, true},
+		{"missing VM", "", http.StatusNotFound, `{"error":{"code":"ResourceNotFound","message":"The Resource 'vm0' was not found."}}`, false},
+	} {
+		r := newTestRunner(t, tt.apiVersion, tt.status, tt.body)
+		_, err := r.Run(context.Background(), "cluster", "vm0", script)
+		if err == nil {
+			t.Errorf("%s: Run() succeeded", tt.name)
+			continue
+		}
+		if got := err == ErrUnsupported; got != tt.want {
+			t.Errorf("%s: Run() = %v, want ErrUnsupported %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	r := newTestRunner(t, "", http.StatusOK, `{"name":"1","status":"Succeeded","properties":{"output":{"value":[
+		{"code":"ProvisioningState/succeeded","level":"Info","message":"Enable succeeded: \n[stdout]\nvm0\n\n[stderr]\n"}]}}}`)
+	output, err := r.Run(context.Background(), "cluster", "vm0", Script{CommandID: ShellScript, Lines: []string{"hostname"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !output.Succeeded || output.Stdout != "vm0\n\n" {
+		t.Errorf("Run() = %+v, want success with the stdout of the script", *output)
+	}
+}
@@ -0,0 +1,655 @@
+// Package securitygroup opens the ports of exposed services in the network
+// security group of the cluster, the securityGroupName of azure.json. A
+// Reconciler gives every service one inbound rule per protocol, merging its
+// ports and source ranges into that rule, and places the rules at free
+// priorities within a band set aside for it. Network API versions before
+// 2017-10-01, such as the 2015-06-15 of Azure Stack, lack rules with several
+// source prefixes or port ranges; there a service gets one rule per
+// protocol, port range and source instead.
+//
+// The security group is shared with rules written by hand or by other
+// tools, so the reconciler only touches rules whose names start with its
+// rule prefix. Priorities are unique within the whole security group, so
+// rules are added and changed by writing the security group under an ETag
+// precondition, which fails if anyone else wrote it since it was read; the
+// reconciler then reads it again and retries. Rules are deleted one by one,
+// each under a precondition on its own ETag.
+package securitygroup
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/golang/glog"
+)
+
+const (
+	defaultRulePrefix  = "k8s-"
+	defaultPriorityMin = 500
+	defaultPriorityMax = 4096
+
+	// The priorities Azure accepts for security rules.
+	minPriority = 100
+	maxPriority = 4096
+
+	// defaultSource is the source of the rules of services without source
+	// ranges.
+	defaultSource = "Internet"
+	anyAddress    = "*"
+	anyPort       = "*"
+
+	// maxServicePrefixLength keeps rule names, which add the rule prefix and
+	// protocol to the service prefix, under the 80 character limit.
+	maxServicePrefixLength = 33
+
+	// updateAttempts bounds how often a write that lost a race is retried.
+	updateAttempts = 5
+
+	// augmentedRulesAPIVersion is the first network API version with
+	// sourceAddressPrefixes and destinationPortRanges.
+	augmentedRulesAPIVersion = "2017-10-01"
+)
+
+// validServiceID matches the service IDs rule names can be derived from.
+var validServiceID = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// validRulePrefix matches the rule prefixes that keep rule names valid.
+var validRulePrefix = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ownedRuleName matches, in lower case and after the rule prefix, the names
+// of the rules the reconciler creates: the rest of the service prefix, the
+// protocol and, for split rules, a number.
+var ownedRuleName = regexp.MustCompile(`^(a[0-9a-z]{0,32})-(tcp|udp)(-[0-9]+)?$`)
+
+// errPreconditionFailed is returned by writes whose ETag no longer matches.
+var errPreconditionFailed = errors.New("securitygroup: changed since it was read")
+
+// Port is a port a service exposes.
+type Port struct {
+	Protocol network.SecurityRuleProtocol
+	Port     int32
+}
+
+// ServiceSpec is what a service asks of the security group.
+type ServiceSpec struct {
+	// ID uniquely and durably identifies the service, e.g. its Kubernetes
+	// UID. The names of its rules derive from it.
+	ID    string
+	Ports []Port
+	// SourceRanges are the CIDRs, addresses or service tags allowed to
+	// reach the service. They default to Internet.
+	SourceRanges []string
+	// DestinationAddress is the frontend IP address of the service. It
+	// defaults to any address.
+	DestinationAddress string
+}
+
+// SecurityGroupsClient is the subset of network.SecurityGroupsClient the
+// reconciler uses. Writes go through the preparer, sender and responder so
+// that they can carry an If-Match header.
+type SecurityGroupsClient interface {
+	Get(resourceGroupName string, networkSecurityGroupName string, expand string) (network.SecurityGroup, error)
+	CreateOrUpdatePreparer(resourceGroupName string, networkSecurityGroupName string, parameters network.SecurityGroup, cancel <-chan struct{}) (*http.Request, error)
+	CreateOrUpdateSender(req *http.Request) (*http.Response, error)
+	CreateOrUpdateResponder(resp *http.Response) (network.SecurityGroup, error)
+}
+
+var _ SecurityGroupsClient = network.SecurityGroupsClient{}
+
+// SecurityRulesClient is the subset of network.SecurityRulesClient the
+// reconciler uses.
+type SecurityRulesClient interface {
+	DeletePreparer(resourceGroupName string, networkSecurityGroupName string, securityRuleName string, cancel <-chan struct{}) (*http.Request, error)
+	DeleteSender(req *http.Request) (*http.Response, error)
+	DeleteResponder(resp *http.Response) (autorest.Response, error)
+}
+
+var _ SecurityRulesClient = network.SecurityRulesClient{}
+
+// Config configures a Reconciler.
+type Config struct {
+	// ResourceGroup holds the security group.
+	ResourceGroup string
+	// SecurityGroupName is the name of the security group of the cluster,
+	// securityGroupName in azure.json.
+	SecurityGroupName string
+	// RulePrefix starts the names of the rules the reconciler owns. It
+	// defaults to "k8s-". Rules named otherwise are never changed.
+	RulePrefix string
+	// PriorityMin and PriorityMax bound the priorities of new rules. They
+	// default to 500 and 4096, leaving the priorities below 500 to rules
+	// that must take precedence over those of services.
+	PriorityMin int32
+	PriorityMax int32
+	// APIVersion is the network API version of the stamp. It defaults to
+	// network.APIVersion.
+	APIVersion string
+
+	SecurityGroups SecurityGroupsClient
+	SecurityRules  SecurityRulesClient
+}
+
+// Reconciler brings the rules of a security group in line with services.
+type Reconciler struct {
+	config Config
+	// mu serializes the updates of the reconciler; ETags guard against
+	// other writers.
+	mu sync.Mutex
+}
+
+// NewReconciler validates config and returns a Reconciler.
+func NewReconciler(config Config) (*Reconciler, error) {
+	if config.ResourceGroup == "" || config.SecurityGroupName == "" {
+		return nil, fmt.Errorf("securitygroup: a resource group and security group name are required")
+	}
+	if config.SecurityGroups == nil || config.SecurityRules == nil {
+		return nil, fmt.Errorf("securitygroup: security group and security rule clients are required")
+	}
+	if config.RulePrefix == "" {
+		config.RulePrefix = defaultRulePrefix
+	}
+	if !validRulePrefix.MatchString(config.RulePrefix) {
+		return nil, fmt.Errorf("securitygroup: rule prefix %q must start with a letter or digit and hold only letters, digits, underscores, periods and hyphens", config.RulePrefix)
+	}
+	if config.PriorityMin == 0 {
+		config.PriorityMin = defaultPriorityMin
+	}
+	if config.PriorityMax == 0 {
+		config.PriorityMax = defaultPriorityMax
+	}
+	if config.APIVersion == "" {
+		config.APIVersion = network.APIVersion
+	}
+	if config.PriorityMin < minPriority || config.PriorityMax > maxPriority || config.PriorityMin > config.PriorityMax {
+		return nil, fmt.Errorf("securitygroup: priority band %d-%d is not within %d-%d", config.PriorityMin, config.PriorityMax, minPriority, maxPriority)
+	}
+	return &Reconciler{config: config}, nil
+}
+
+// Reconcile makes the rules of the service those of spec, adding, changing
+// and removing its rules in a single write of the security group.
+func (r *Reconciler) Reconcile(spec ServiceSpec) error {
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := r.servicePrefix(spec.ID)
+	for attempt := 1; ; attempt++ {
+		nsg, err := r.getSecurityGroup()
+		if err != nil {
+			return err
+		}
+		changed, err := r.ensureRules(&nsg, spec, prefix)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			glog.V(2).Infof("securitygroup: security group %s is up to date for service %s", r.config.SecurityGroupName, spec.ID)
+			return nil
+		}
+		err = r.putSecurityGroup(nsg)
+		if err != errPreconditionFailed || attempt == updateAttempts {
+			return err
+		}
+		glog.V(2).Infof("securitygroup: security group %s changed while reconciling service %s, retrying", r.config.SecurityGroupName, spec.ID)
+	}
+}
+
+// Delete removes the rules of the service serviceID.
+func (r *Reconciler) Delete(serviceID string) error {
+	if !validServiceID.MatchString(serviceID) {
+		return fmt.Errorf("securitygroup: service ID %q must be letters, digits and hyphens", serviceID)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := r.servicePrefix(serviceID)
+	return r.deleteRules(func(name string) bool {
+		return owned(name, prefix)
+	})
+}
+
+// Cleanup removes the rules the reconciler owns that belong to none of the
+// services serviceIDs, such as those of services deleted while it was not
+// running.
+func (r *Reconciler) Cleanup(serviceIDs []string) error {
+	live := map[string]bool{}
+	for _, id := range serviceIDs {
+		if !validServiceID.MatchString(id) {
+			return fmt.Errorf("securitygroup: service ID %q must be letters, digits and hyphens", id)
+		}
+		live[r.servicePrefix(id)] = true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.deleteRules(func(name string) bool {
+		prefix, ok := r.ownerOf(name)
+		return ok && !live[prefix]
+	})
+}
+
+// servicePrefix returns the prefix of the names of the rules of the service
+// id.
+func (r *Reconciler) servicePrefix(id string) string {
+	prefix := "a" + strings.ToLower(strings.Replace(id, "-", "", -1))
+	if len(prefix) > maxServicePrefixLength {
+		prefix = prefix[:maxServicePrefixLength]
+	}
+	return strings.ToLower(r.config.RulePrefix) + prefix
+}
+
+// ownerOf returns the service prefix of the rule name, if the reconciler
+// owns it. Only names of the exact form the reconciler gives its rules are
+// owned, so that rules added by hand with the same rule prefix, such as
+// k8s-allow-ssh, are left alone.
+func (r *Reconciler) ownerOf(name string) (string, bool) {
+	n, rulePrefix := strings.ToLower(name), strings.ToLower(r.config.RulePrefix)
+	if !strings.HasPrefix(n, rulePrefix) {
+		return "", false
+	}
+	m := ownedRuleName.FindStringSubmatch(n[len(rulePrefix):])
+	if m == nil {
+		return "", false
+	}
+	return rulePrefix + m[1], true
+}
+
+func (r *Reconciler) getSecurityGroup() (network.SecurityGroup, error) {
+	nsg, err := r.config.SecurityGroups.Get(r.config.ResourceGroup, r.config.SecurityGroupName, "")
+	if err != nil {
+		return network.SecurityGroup{}, fmt.Errorf("securitygroup: getting security group %s: %v", r.config.SecurityGroupName, err)
+	}
+	if nsg.SecurityGroupPropertiesFormat == nil {
+		nsg.SecurityGroupPropertiesFormat = &network.SecurityGroupPropertiesFormat{}
+	}
+	return nsg, nil
+}
+
+// putSecurityGroup writes nsg on condition that the security group still
+// has the ETag nsg was read with.
+func (r *Reconciler) putSecurityGroup(nsg network.SecurityGroup) error {
+	name := r.config.SecurityGroupName
+	glog.V(2).Infof("securitygroup: updating security group %s", name)
+	etag := nsg.Etag
+	// Leave out what the service computes.
+	nsg.Etag = nil
+	nsg.ProvisioningState = nil
+	req, err := r.config.SecurityGroups.CreateOrUpdatePreparer(r.config.ResourceGroup, name, nsg, nil)
+	if err != nil {
+		return fmt.Errorf("securitygroup: preparing update of security group %s: %v", name, err)
+	}
+	if etag != nil {
+		req.Header.Set("If-Match", *etag)
+	}
+	resp, err := r.config.SecurityGroups.CreateOrUpdateSender(req)
+	if err == nil {
+		_, err = r.config.SecurityGroups.CreateOrUpdateResponder(resp)
+	}
+	if resp != nil && resp.StatusCode == http.StatusPreconditionFailed {
+		return errPreconditionFailed
+	}
+	if err != nil {
+		return fmt.Errorf("securitygroup: updating security group %s: %v", name, err)
+	}
+	return nil
+}
+
+// deleteRules deletes the rules of the security group whose names match,
+// starting over when one changed since the security group was read.
+func (r *Reconciler) deleteRules(match func(name string) bool) error {
+	for attempt := 1; ; attempt++ {
+		nsg, err := r.getSecurityGroup()
+		if err != nil {
+			return err
+		}
+		raced := false
+		for _, rule := range derefRules(nsg.SecurityRules) {
+			if rule.Name == nil || !match(*rule.Name) {
+				continue
+			}
+			err := r.deleteRule(*rule.Name, rule.Etag)
+			if err == errPreconditionFailed {
+				raced = true
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if !raced {
+			return nil
+		}
+		if attempt == updateAttempts {
+			return fmt.Errorf("securitygroup: rules of security group %s kept changing while being deleted", r.config.SecurityGroupName)
+		}
+		glog.V(2).Infof("securitygroup: rules of security group %s changed while being deleted, retrying", r.config.SecurityGroupName)
+	}
+}
+
+// deleteRule deletes the rule name on condition that it still has the ETag
+// etag.
+func (r *Reconciler) deleteRule(name string, etag *string) error {
+	glog.V(2).Infof("securitygroup: deleting rule %s of security group %s", name, r.config.SecurityGroupName)
+	req, err := r.config.SecurityRules.DeletePreparer(r.config.ResourceGroup, r.config.SecurityGroupName, name, nil)
+	if err != nil {
+		return fmt.Errorf("securitygroup: preparing deletion of rule %s: %v", name, err)
+	}
+	if etag != nil {
+		req.Header.Set("If-Match", *etag)
+	}
+	resp, err := r.config.SecurityRules.DeleteSender(req)
+	if err == nil {
+		_, err = r.config.SecurityRules.DeleteResponder(resp)
+	}
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusPreconditionFailed:
+			return errPreconditionFailed
+		case http.StatusNotFound:
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("securitygroup: deleting rule %s of security group %s: %v", name, r.config.SecurityGroupName, err)
+	}
+	return nil
+}
+
+// ensureRules makes the rules of the service prefix in nsg those of spec
+// and reports whether it changed nsg. Rules that stay keep their
+// priorities; new ones get the lowest free priorities of the band.
+func (r *Reconciler) ensureRules(nsg *network.SecurityGroup, spec ServiceSpec, prefix string) (bool, error) {
+	want := r.desiredRules(spec, prefix)
+	pending := map[string]network.SecurityRule{}
+	for _, rule := range want {
+		pending[strings.ToLower(*rule.Name)] = rule
+	}
+
+	// Priorities are unique per direction among all rules, including those
+	// of other services and rules the reconciler does not own.
+	used := map[int32]bool{}
+	have := map[string]network.SecurityRule{}
+	rules := []network.SecurityRule{}
+	changed := false
+	for _, rule := range derefRules(nsg.SecurityRules) {
+		if rule.Name == nil || !owned(*rule.Name, prefix) {
+			if rule.SecurityRulePropertiesFormat != nil && rule.Priority != nil && rule.Direction == network.SecurityRuleDirectionInbound {
+				used[*rule.Priority] = true
+			}
+			rules = append(rules, rule)
+			continue
+		}
+		key := strings.ToLower(*rule.Name)
+		if _, ok := pending[key]; !ok {
+			changed = true
+			continue
+		}
+		have[key] = rule
+	}
+
+	for _, w := range want {
+		key := strings.ToLower(*w.Name)
+		rule, exists := have[key]
+		if exists && rule.SecurityRulePropertiesFormat != nil && rule.Priority != nil {
+			p := *rule.Priority
+			if p >= r.config.PriorityMin && p <= r.config.PriorityMax && !used[p] && ruleMatches(*rule.SecurityRulePropertiesFormat, *w.SecurityRulePropertiesFormat) {
+				used[p] = true
+				rules = append(rules, rule)
+				continue
+			}
+			if p >= r.config.PriorityMin && p <= r.config.PriorityMax && !used[p] {
+				w.Priority = int32Ptr(p)
+			}
+		}
+		if w.Priority == nil {
+			p, ok := r.freePriority(used)
+			if !ok {
+				return false, fmt.Errorf("securitygroup: no free priority left in %d-%d of security group %s for rule %s", r.config.PriorityMin, r.config.PriorityMax, r.config.SecurityGroupName, *w.Name)
+			}
+			w.Priority = int32Ptr(p)
+		}
+		used[*w.Priority] = true
+		if exists {
+			rule.SecurityRulePropertiesFormat = w.SecurityRulePropertiesFormat
+			w = rule
+		}
+		rules = append(rules, w)
+		changed = true
+	}
+
+	nsg.SecurityRules = &rules
+	return changed, nil
+}
+
+// freePriority returns the lowest priority of the band that is not used.
+func (r *Reconciler) freePriority(used map[int32]bool) (int32, bool) {
+	for p := r.config.PriorityMin; p <= r.config.PriorityMax; p++ {
+		if !used[p] {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+// desiredRules returns the rules of the service, without priorities: one
+// inbound rule named <prefix>-<protocol> per protocol, allowing all its
+// ports from all its source ranges. Consecutive ports are merged into
+// ranges. On network API versions without rules for several sources or
+// port ranges, a protocol with more than one of either gets a rule per
+// port range and source instead, named <prefix>-<protocol>-<n>.
+func (r *Reconciler) desiredRules(spec ServiceSpec, prefix string) []network.SecurityRule {
+	sources := normalize(spec.SourceRanges)
+	if len(sources) == 0 {
+		sources = []string{defaultSource}
+	}
+	destination := spec.DestinationAddress
+	if destination == "" {
+		destination = anyAddress
+	}
+
+	ports := map[network.SecurityRuleProtocol][]int{}
+	for _, port := range spec.Ports {
+		ports[port.Protocol] = append(ports[port.Protocol], int(port.Port))
+	}
+	var rules []network.SecurityRule
+	for _, protocol := range []network.SecurityRuleProtocol{network.SecurityRuleProtocolTCP, network.SecurityRuleProtocolUDP} {
+		if len(ports[protocol]) == 0 {
+			continue
+		}
+		name := prefix + "-" + string(protocol)
+		ranges := portRanges(ports[protocol])
+		if r.augmentedRules() || len(sources) == 1 && len(ranges) == 1 {
+			props := newRuleProperties(spec, protocol, destination)
+			setSources(props, sources)
+			setPortRanges(props, ranges)
+			rules = append(rules, network.SecurityRule{
+				Name:                         stringPtr(name),
+				SecurityRulePropertiesFormat: props,
+			})
+			continue
+		}
+		n := 0
+		for _, portRange := range ranges {
+			for _, source := range sources {
+				props := newRuleProperties(spec, protocol, destination)
+				props.SourceAddressPrefix = stringPtr(source)
+				props.DestinationPortRange = stringPtr(portRange)
+				n++
+				rules = append(rules, network.SecurityRule{
+					Name:                         stringPtr(name + "-" + strconv.Itoa(n)),
+					SecurityRulePropertiesFormat: props,
+				})
+			}
+		}
+	}
+	return rules
+}
+
+// augmentedRules reports whether the network API version has rules with
+// several source prefixes and port ranges.
+func (r *Reconciler) augmentedRules() bool {
+	return r.config.APIVersion >= augmentedRulesAPIVersion
+}
+
+// newRuleProperties returns the properties the rules of the service share.
+func newRuleProperties(spec ServiceSpec, protocol network.SecurityRuleProtocol, destination string) *network.SecurityRulePropertiesFormat {
+	return &network.SecurityRulePropertiesFormat{
+		Description:              stringPtr("Service " + spec.ID),
+		Protocol:                 protocol,
+		SourcePortRange:          stringPtr(anyPort),
+		DestinationAddressPrefix: stringPtr(destination),
+		Access:                   network.SecurityRuleAccessAllow,
+		Direction:                network.SecurityRuleDirectionInbound,
+	}
+}
+
+// setSources sets the source of a rule. Azure takes a single prefix or a
+// list of them, but not both.
+func setSources(props *network.SecurityRulePropertiesFormat, sources []string) {
+	if len(sources) == 1 {
+		props.SourceAddressPrefix = stringPtr(sources[0])
+		return
+	}
+	props.SourceAddressPrefixes = &sources
+}
+
+// setPortRanges sets the destination ports of a rule, as a single range or
+// a list of them.
+func setPortRanges(props *network.SecurityRulePropertiesFormat, ranges []string) {
+	if len(ranges) == 1 {
+		props.DestinationPortRange = stringPtr(ranges[0])
+		return
+	}
+	props.DestinationPortRanges = &ranges
+}
+
+// portRanges returns ports as ranges, e.g. 80-82 for 80, 81 and 82.
+func portRanges(ports []int) []string {
+	sort.Ints(ports)
+	var ranges []string
+	for i := 0; i < len(ports); {
+		j := i
+		for j+1 < len(ports) && ports[j+1] <= ports[j]+1 {
+			j++
+		}
+		if ports[i] == ports[j] {
+			ranges = append(ranges, strconv.Itoa(ports[i]))
+		} else {
+			ranges = append(ranges, strconv.Itoa(ports[i])+"-"+strconv.Itoa(ports[j]))
+		}
+		i = j + 1
+	}
+	return ranges
+}
+
+// ruleMatches reports whether the rule have does what want does, whether
+// its sources and ports are given singly or as lists.
+func ruleMatches(have, want network.SecurityRulePropertiesFormat) bool {
+	return strings.EqualFold(string(have.Protocol), string(want.Protocol)) &&
+		strings.EqualFold(string(have.Access), string(want.Access)) &&
+		strings.EqualFold(string(have.Direction), string(want.Direction)) &&
+		stringsEqual(have.Description, want.Description) &&
+		setsEqual(values(have.SourcePortRange, have.SourcePortRanges), values(want.SourcePortRange, want.SourcePortRanges)) &&
+		setsEqual(values(have.SourceAddressPrefix, have.SourceAddressPrefixes), values(want.SourceAddressPrefix, want.SourceAddressPrefixes)) &&
+		setsEqual(values(have.DestinationAddressPrefix, have.DestinationAddressPrefixes), values(want.DestinationAddressPrefix, want.DestinationAddressPrefixes)) &&
+		setsEqual(values(have.DestinationPortRange, have.DestinationPortRanges), values(want.DestinationPortRange, want.DestinationPortRanges))
+}
+
+// values returns the values of a field that Azure splits into a single
+// value and a list.
+func values(single *string, list *[]string) []string {
+	var v []string
+	if single != nil && *single != "" {
+		v = append(v, *single)
+	}
+	if list != nil {
+		v = append(v, *list...)
+	}
+	return normalize(v)
+}
+
+// normalize returns the distinct values of v in order, compared without
+// regard to case.
+func normalize(v []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, s := range v {
+		key := strings.ToLower(s)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func setsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (spec ServiceSpec) validate() error {
+	if !validServiceID.MatchString(spec.ID) {
+		return fmt.Errorf("securitygroup: service ID %q must be letters, digits and hyphens", spec.ID)
+	}
+	if len(spec.Ports) == 0 {
+		return fmt.Errorf("securitygroup: service %s has no ports", spec.ID)
+	}
+	for _, port := range spec.Ports {
+		if port.Protocol != network.SecurityRuleProtocolTCP && port.Protocol != network.SecurityRuleProtocolUDP {
+			return fmt.Errorf("securitygroup: service %s has port %d with unsupported protocol %q", spec.ID, port.Port, port.Protocol)
+		}
+		if port.Port < 1 || port.Port > 65535 {
+			return fmt.Errorf("securitygroup: service %s has port %d out of range", spec.ID, port.Port)
+		}
+	}
+	for _, source := range spec.SourceRanges {
+		if strings.TrimSpace(source) == "" {
+			return fmt.Errorf("securitygroup: service %s has an empty source range", spec.ID)
+		}
+	}
+	return nil
+}
+
+// owned reports whether name is that of a rule of the service prefix.
+func owned(name, prefix string) bool {
+	return strings.HasPrefix(strings.ToLower(name), prefix+"-")
+}
+
+func derefRules(p *[]network.SecurityRule) []network.SecurityRule {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+func stringsEqual(a, b *string) bool {
+	if a == nil || b == nil {
+		return (a == nil || *a == "") && (b == nil || *b == "")
+	}
+	return *a == *b
+}
+
+func stringPtr(s string) *string { return &s }
+
+func int32Ptr(i int32) *int32 { return &i }
@@ -0,0 +1,252 @@
+package securitygroup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// fakeSecurityGroup holds one security group, stored as JSON so that
+// writes cannot share memory with what the reconciler keeps.
+type fakeSecurityGroup struct {
+	body []byte
+	// deleted holds the names of the deleted rules.
+	deleted []string
+}
+
+func newFakeSecurityGroup(rules ...network.SecurityRule) *fakeSecurityGroup {
+	f := &fakeSecurityGroup{}
+	f.set(network.SecurityGroup{SecurityGroupPropertiesFormat: &network.SecurityGroupPropertiesFormat{SecurityRules: &rules}})
+	return f
+}
+
+func (f *fakeSecurityGroup) set(nsg network.SecurityGroup) {
+	body, err := json.Marshal(nsg)
+	if err != nil {
+		panic(err)
+	}
+	f.body = body
+}
+
+func (f *fakeSecurityGroup) Get(resourceGroupName string, networkSecurityGroupName string, expand string) (network.SecurityGroup, error) {
+	var nsg network.SecurityGroup
+	err := json.Unmarshal(f.body, &nsg)
+	return nsg, err
+}
+
+func (f *fakeSecurityGroup) CreateOrUpdatePreparer(resourceGroupName string, networkSecurityGroupName string, parameters network.SecurityGroup, cancel <-chan struct{}) (*http.Request, error) {
+	body, err := json.Marshal(parameters)
+	if err != nil {
+		return nil, err
+	}
+	return http.NewRequest(http.MethodPut, "https://management.local/"+networkSecurityGroupName, bytes.NewReader(body))
+}
+
+func (f *fakeSecurityGroup) CreateOrUpdateSender(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.body = body
+	return &http.Response{Request: req, StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func (f *fakeSecurityGroup) CreateOrUpdateResponder(resp *http.Response) (network.SecurityGroup, error) {
+	defer resp.Body.Close()
+	var nsg network.SecurityGroup
+	err := json.NewDecoder(resp.Body).Decode(&nsg)
+	return nsg, err
+}
+
+func (f *fakeSecurityGroup) DeletePreparer(resourceGroupName string, networkSecurityGroupName string, securityRuleName string, cancel <-chan struct{}) (*http.Request, error) {
+	return http.NewRequest(http.MethodDelete, "https://management.local/"+networkSecurityGroupName+"/securityRules/"+securityRuleName, nil)
+}
+
+func (f *fakeSecurityGroup) DeleteSender(req *http.Request) (*http.Response, error) {
+	name := path.Base(req.URL.Path)
+	nsg, err := f.Get("", "", "")
+	if err != nil {
+		return nil, err
+	}
+	var rules []network.SecurityRule
+	for _, rule := range derefRules(nsg.SecurityRules) {
+		if *rule.Name != name {
+			rules = append(rules, rule)
+		}
+	}
+	nsg.SecurityRules = &rules
+	f.set(nsg)
+	f.deleted = append(f.deleted, name)
+	return &http.Response{Request: req, StatusCode: http.StatusOK}, nil
+}
+
+func (f *fakeSecurityGroup) DeleteResponder(resp *http.Response) (autorest.Response, error) {
+	return autorest.Response{Response: resp}, nil
+}
+
+func newTestReconciler(t *testing.T, f *fakeSecurityGroup, apiVersion string) *Reconciler {
+	r, err := NewReconciler(Config{
+		ResourceGroup:     "cluster",
+		SecurityGroupName: "k8s-nsg",
+		APIVersion:        apiVersion,
+		SecurityGroups:    f,
+		SecurityRules:     f,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+var testSpec = ServiceSpec{
+	ID: "svc-1",
+	Ports: []Port{
+		{network.SecurityRuleProtocolTCP, 80},
+		{network.SecurityRuleProtocolTCP, 443},
+		{network.SecurityRuleProtocolUDP, 53},
+	},
+	SourceRanges: []string{"10.0.0.0/8", "192.168.0.0/16"},
+}
+
+// ruleString describes rule by its name and the fields a split or merged
+// rule sets.
+func ruleString(rule network.SecurityRule) string {
+	return strings.Join([]string{
+		*rule.Name,
+		string(rule.Protocol),
+		strings.Join(values(rule.SourceAddressPrefix, rule.SourceAddressPrefixes), ","),
+		strings.Join(values(rule.DestinationPortRange, rule.DestinationPortRanges), ","),
+	}, " ")
+}
+
+func TestReconcileRuleForm(t *testing.T) {
+	for _, tt := range []struct {
+		apiVersion string
+		want       []string
+	}{
+		{"2015-06-15", []string{
+			"k8s-asvc1-Tcp-1 Tcp 10.0.0.0/8 80",
+			"k8s-asvc1-Tcp-2 Tcp 192.168.0.0/16 80",
+			"k8s-asvc1-Tcp-3 Tcp 10.0.0.0/8 443",
+			"k8s-asvc1-Tcp-4 Tcp 192.168.0.0/16 443",
+			"k8s-asvc1-Udp-1 Udp 10.0.0.0/8 53",
+			"k8s-asvc1-Udp-2 Udp 192.168.0.0/16 53",
+		}},
+		{"2017-10-01", []string{
+			"k8s-asvc1-Tcp Tcp 10.0.0.0/8,192.168.0.0/16 443,80",
+			"k8s-asvc1-Udp Udp 10.0.0.0/8,192.168.0.0/16 53",
+		}},
+	} {
+		f := newFakeSecurityGroup()
+		r := newTestReconciler(t, f, tt.apiVersion)
+		if err := r.Reconcile(testSpec); err != nil {
+			t.Fatalf("%s: Reconcile() = %v", tt.apiVersion, err)
+		}
+		nsg, _ := f.Get("", "", "")
+		var got []string
+		priorities := map[int32]bool{}
+		for _, rule := range derefRules(nsg.SecurityRules) {
+			got = append(got, ruleString(rule))
+			if rule.SourceAddressPrefixes != nil && rule.SourceAddressPrefix != nil || rule.DestinationPortRanges != nil && rule.DestinationPortRange != nil {
+				t.Errorf("%s: rule %s sets both a single value and a list", tt.apiVersion, *rule.Name)
+			}
+			if priorities[*rule.Priority] {
+				t.Errorf("%s: priority %d is used twice", tt.apiVersion, *rule.Priority)
+			}
+			priorities[*rule.Priority] = true
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: rules\n%s\nwant\n%s", tt.apiVersion, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+
+		// A second pass finds the rules up to date.
+		before := string(f.body)
+		if err := r.Reconcile(testSpec); err != nil {
+			t.Fatalf("%s: second Reconcile() = %v", tt.apiVersion, err)
+		}
+		if string(f.body) != before {
+			t.Errorf("%s: second Reconcile() rewrote the security group", tt.apiVersion)
+		}
+	}
+}
+
+func TestReconcileSingleRuleOnOldAPIVersion(t *testing.T) {
+	f := newFakeSecurityGroup()
+	r := newTestReconciler(t, f, "2015-06-15")
+	spec := ServiceSpec{ID: "svc-1", Ports: []Port{{network.SecurityRuleProtocolTCP, 80}}}
+	if err := r.Reconcile(spec); err != nil {
+		t.Fatal(err)
+	}
+	nsg, _ := f.Get("", "", "")
+	rules := derefRules(nsg.SecurityRules)
+	if len(rules) != 1 || ruleString(rules[0]) != "k8s-asvc1-Tcp Tcp Internet 80" {
+		t.Errorf("rules %v, want the single rule k8s-asvc1-Tcp", rules)
+	}
+}
+
+func TestCleanupKeepsSplitRules(t *testing.T) {
+	hand := network.SecurityRule{
+		Name: stringPtr("k8s-allow-ssh"),
+		SecurityRulePropertiesFormat: &network.SecurityRulePropertiesFormat{
+			Protocol:  network.SecurityRuleProtocolTCP,
+			Priority:  int32Ptr(100),
+			Direction: network.SecurityRuleDirectionInbound,
+		},
+	}
+	f := newFakeSecurityGroup(hand)
+	r := newTestReconciler(t, f, "2015-06-15")
+	if err := r.Reconcile(testSpec); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reconcile(ServiceSpec{ID: "svc-10", Ports: []Port{{network.SecurityRuleProtocolTCP, 8080}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Cleanup([]string{"svc-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"k8s-asvc10-Tcp"}; !reflect.DeepEqual(f.deleted, want) {
+		t.Errorf("Cleanup() deleted %v, want %v", f.deleted, want)
+	}
+	nsg, _ := f.Get("", "", "")
+	if n := len(derefRules(nsg.SecurityRules)); n != 7 {
+		t.Errorf("%d rules are left, want the 6 of svc-1 and k8s-allow-ssh", n)
+	}
+}
+
+func TestOwnerOf(t *testing.T) {
+	r := newTestReconciler(t, newFakeSecurityGroup(), "")
+	for _, tt := range []struct {
+		name  string
+		owner string
+		ok    bool
+	}{
+		{"k8s-asvc1-Tcp", "k8s-asvc1", true},
+		{"k8s-asvc1-Tcp-12", "k8s-asvc1", true},
+		{"K8S-ASVC1-TCP-3", "k8s-asvc1", true},
+		{"k8s-asvc1-Udp-2", "k8s-asvc1", true},
+		{"k8s-asvc1", "", false},
+		{"k8s--Tcp", "", false},
+		{"allow-ssh", "", false},
+		{"k8s-allow-ssh", "", false},
+		{"k8s-asvc1-Icmp", "", false},
+		{"k8s-asvc1-Tcp-x", "", false},
+		{"k8s-asvc1-Tcp-1-2", "", false},
+		{"k8s-bsvc1-Tcp", "", false},
+	} {
+		owner, ok := r.ownerOf(tt.name)
+		if owner != tt.owner || ok != tt.ok {
+			t.Errorf("ownerOf(%q) = %q, %v, want %q, %v", tt.name, owner, ok, tt.owner, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package snapshots
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/disk"
+	"github.com/honcao/cloudprovider/pkg/internal/tags"
+)
+
+const (
+	// maxPolicyNameLength leaves room for the disk name in snapshot names.
+	maxPolicyNameLength = 40
+)
+
+// validPolicyName matches the policy names snapshot names can be derived
+// from.
+var validPolicyName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+// Policy is a declarative snapshot policy: which disks to snapshot, when,
+// and how long to keep the snapshots. Policies are read from JSON by
+// ReadPolicies, e.g.
+//
+//	{"policies": [{
+//	  "name": "nightly",
+//	  "resourceGroups": ["k8s"],
+//	  "tags": {"backup": "*"},
+//	  "schedule": "30 2 * * *",
+//	  "maxCount": 7,
+//	  "maxAge": "14d",
+//	  "copyResourceGroup": "k8s-backup"
+//	}]}
+type Policy struct {
+	// Name identifies the policy. It is part of the names of its snapshots
+	// and tags them, so it must not change.
+	Name string `json:"name"`
+	// ResourceGroups restricts the policy to the disks of these resource
+	// groups.
+	ResourceGroups []string `json:"resourceGroups,omitempty"`
+	// Tags restricts the policy to the disks with all of these tags. A
+	// value of "*" matches any value.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Schedule is when disks are snapshotted, as a cron expression in UTC,
+	// e.g. "0 */6 * * *", or one of @hourly, @daily, @weekly and @monthly.
+	Schedule string `json:"schedule"`
+	// MaxCount is the number of snapshots of each disk to keep. Zero means
+	// unlimited.
+	MaxCount int `json:"maxCount,omitempty"`
+	// MaxAge removes the snapshots older than this. Zero means unlimited.
+	// The newest snapshot of a disk is always kept.
+	MaxAge Duration `json:"maxAge,omitempty"`
+	// CopyResourceGroup, if set, gets a copy of every snapshot, e.g. to
+	// survive the deletion of the resource group of the disk. Copies are
+	// pruned like the snapshots.
+	CopyResourceGroup string `json:"copyResourceGroup,omitempty"`
+	// AccountType is the storage of the snapshots. It defaults to
+	// Standard_LRS.
+	AccountType disk.StorageAccountTypes `json:"accountType,omitempty"`
+
+	schedule *Schedule
+}
+
+// Duration is a time.Duration read from JSON strings such as "12h" or,
+// in days, "7d".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("snapshots: duration %s is not a string", b)
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return fmt.Errorf("snapshots: invalid duration %q", s)
+		}
+		*d = Duration(time.Duration(days) * 24 * time.Hour)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("snapshots: invalid duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ReadPolicies reads and validates a JSON document of the form
+// {"policies": [...]}.
+func ReadPolicies(r io.Reader) ([]Policy, error) {
+	var doc struct {
+		Policies []Policy `json:"policies"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("snapshots: reading policies: %v", err)
+	}
+	seen := map[string]bool{}
+	for i := range doc.Policies {
+		p := &doc.Policies[i]
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(p.Name)
+		if seen[key] {
+			return nil, fmt.Errorf("snapshots: policy %s is defined twice", p.Name)
+		}
+		seen[key] = true
+	}
+	return doc.Policies, nil
+}
+
+// validate checks p and parses its schedule.
+func (p *Policy) validate() error {
+	if !validPolicyName.MatchString(p.Name) || len(p.Name) > maxPolicyNameLength {
+		return fmt.Errorf("snapshots: policy name %q must be up to %d letters, digits and hyphens", p.Name, maxPolicyNameLength)
+	}
+	if len(p.ResourceGroups) == 0 && len(p.Tags) == 0 {
+		return fmt.Errorf("snapshots: policy %s selects no disks; give resource groups or tags", p.Name)
+	}
+	schedule, err := ParseSchedule(p.Schedule)
+	if err != nil {
+		return fmt.Errorf("snapshots: policy %s: %v", p.Name, err)
+	}
+	p.schedule = schedule
+	if p.MaxCount < 0 || p.MaxAge < 0 {
+		return fmt.Errorf("snapshots: policy %s has a negative retention", p.Name)
+	}
+	return nil
+}
+
+// selects reports whether the policy applies to the disk d in the resource
+// group resourceGroup.
+func (p *Policy) selects(d disk.Model, resourceGroup string) bool {
+	if len(p.ResourceGroups) > 0 {
+		found := false
+		for _, group := range p.ResourceGroups {
+			if strings.EqualFold(group, resourceGroup) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return tags.Match(d.Tags, p.Tags)
+}
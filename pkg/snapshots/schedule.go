@@ -0,0 +1,140 @@
+package snapshots
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxScheduleSearch bounds the search for the next time of a schedule, which
+// never comes for expressions such as "0 0 30 2 *".
+const maxScheduleSearch = 5 * 366 * 24 * time.Hour
+
+// scheduleDescriptors are the shorthands accepted for common schedules.
+var scheduleDescriptors = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// Schedule is a cron schedule of minute, hour, day of month, month and day
+// of week fields, evaluated in UTC. Fields are *, numbers, ranges such as
+// 1-5, steps such as */15 or 0-30/10, and lists of these. As in cron, a day
+// matches if either day field does when both are restricted.
+type Schedule struct {
+	minute, hour, dom, month, dow bits
+	// domAny and dowAny are set for the day fields starting with *.
+	domAny, dowAny bool
+}
+
+// bits is a set of the values of a field.
+type bits uint64
+
+func (b bits) has(v int) bool { return b&(1<<uint(v)) != 0 }
+
+// ParseSchedule parses a cron expression.
+func ParseSchedule(expr string) (*Schedule, error) {
+	if d, ok := scheduleDescriptors[strings.TrimSpace(expr)]; ok {
+		expr = d
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q does not have 5 fields", expr)
+	}
+	s := &Schedule{
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}
+	var err error
+	for _, f := range []struct {
+		value    string
+		min, max int
+		out      *bits
+	}{
+		{fields[0], 0, 59, &s.minute},
+		{fields[1], 0, 23, &s.hour},
+		{fields[2], 1, 31, &s.dom},
+		{fields[3], 1, 12, &s.month},
+		// 7 is Sunday as well as 0.
+		{fields[4], 0, 7, &s.dow},
+	} {
+		if *f.out, err = parseField(f.value, f.min, f.max); err != nil {
+			return nil, fmt.Errorf("schedule %q: %v", expr, err)
+		}
+	}
+	if s.dow.has(7) {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parseField parses a field whose values range from min to max.
+func parseField(field string, min, max int) (bits, error) {
+	var b bits
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng = part[:i]
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if step > 1 {
+				// 5/10 means from 5 on, every 10.
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			b |= 1 << uint(v)
+		}
+	}
+	return b, nil
+}
+
+// Next returns the first time of the schedule after t, or the zero time if
+// there is none within five years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxScheduleSearch)
+	for t.Before(limit) {
+		switch {
+		case !s.month.has(int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !s.hour.has(t.Hour()):
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case !s.minute.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom.has(t.Day()), s.dow.has(int(t.Weekday()))
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
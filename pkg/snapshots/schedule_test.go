@@ -0,0 +1,63 @@
+package snapshots
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@yearly",
+	} {
+		if _, err := ParseSchedule(expr); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	for _, tt := range []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"*/15 * * * *", at(10, 18, 10, 7), at(10, 18, 10, 15)},
+		{"*/15 * * * *", at(10, 18, 10, 15), at(10, 18, 10, 30)},
+		// 5/10 is 5, 15, ..., 55.
+		{"5/10 * * * *", at(10, 18, 10, 7), at(10, 18, 10, 15)},
+		{"5/10 * * * *", at(10, 18, 10, 56), at(10, 18, 11, 5)},
+		{"0-30/10 * * * *", at(10, 18, 10, 31), at(10, 18, 11, 0)},
+		{"30 2 * * *", at(10, 18, 2, 30), at(10, 19, 2, 30)},
+		{"@daily", at(10, 18, 10, 0), at(10, 19, 0, 0)},
+		{"0 0 1,15 * *", at(10, 2, 0, 0), at(10, 15, 0, 0)},
+		// With both day fields restricted, either matches: the 13th or
+		// a Friday. 2026-10-13 is a Tuesday, 2026-10-16 a Friday.
+		{"0 0 13 * 5", at(10, 10, 12, 0), at(10, 13, 0, 0)},
+		{"0 0 13 * 5", at(10, 13, 1, 0), at(10, 16, 0, 0)},
+		// With one of them *, only the other counts.
+		{"0 0 * * 5", at(10, 13, 1, 0), at(10, 16, 0, 0)},
+		{"0 0 13 * *", at(10, 14, 0, 0), at(11, 13, 0, 0)},
+		// 7 is Sunday, as is 0; 2026-10-18 is a Sunday.
+		{"0 12 * * 7", at(10, 17, 0, 0), at(10, 18, 12, 0)},
+		{"0 0 30 2 *", at(10, 18, 0, 0), time.Time{}},
+	} {
+		s, err := ParseSchedule(tt.expr)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q) = %v", tt.expr, err)
+			continue
+		}
+		if got := s.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q: Next(%s) = %s, want %s", tt.expr, tt.from.Format(time.RFC3339), got.Format(time.RFC3339), tt.want.Format(time.RFC3339))
+		}
+	}
+}
@@ -0,0 +1,537 @@
+// Package snapshots takes snapshots of managed disks by policy. A policy
+// selects disks by resource group and tags, snapshots them on a cron
+// schedule and prunes their snapshots by count and age, optionally keeping
+// a copy of every snapshot in another resource group. Snapshots are named
+// after their disk, a hash of its resource ID, their policy and a sequence
+// number that grows with every snapshot, and tagged so that they are found
+// again whatever their names.
+//
+// A Scheduler plans what the policies call for at the time it runs, which
+// can be listed without acting on it for a dry run, and takes the actions
+// of the plan when run. It also restores disks from snapshots.
+package snapshots
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/disk"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+	"github.com/honcao/cloudprovider/pkg/internal/tags"
+	"github.com/honcao/cloudprovider/pkg/resourceid"
+)
+
+const (
+	tagPolicy   = "snapshot-policy"
+	tagSource   = "snapshot-source"
+	tagTime     = "snapshot-time"
+	tagSequence = "snapshot-sequence"
+
+	computeProvider = "Microsoft.Compute"
+	snapshotsType   = "snapshots"
+
+	// maxNameLength is the longest name of a snapshot.
+	maxNameLength = 80
+)
+
+// ActionType is what an Action does.
+type ActionType string
+
+const (
+	// ActionSnapshot snapshots a disk.
+	ActionSnapshot ActionType = "snapshot"
+	// ActionCopy copies a new snapshot to the copy resource group.
+	ActionCopy ActionType = "copy"
+	// ActionDelete deletes a snapshot past retention.
+	ActionDelete ActionType = "delete"
+)
+
+// Action is a step of a plan.
+type Action struct {
+	Type   ActionType
+	Policy string
+	// Disk is the resource ID of the disk the snapshot is of.
+	Disk string
+	// ResourceGroup and Snapshot name the snapshot created or deleted.
+	ResourceGroup string
+	Snapshot      string
+	// Source is the resource ID of the disk or snapshot a snapshot is taken
+	// from. It is empty for deletions.
+	Source string
+	// Reason tells why the policy calls for the action.
+	Reason string
+
+	location    string
+	sequence    int
+	accountType disk.StorageAccountTypes
+}
+
+// String describes the action, e.g. for a dry run listing.
+func (a Action) String() string {
+	return fmt.Sprintf("%s %s/%s (policy %s, disk %s): %s", a.Type, a.ResourceGroup, a.Snapshot, a.Policy, a.Disk, a.Reason)
+}
+
+// DisksClient is the subset of disk.DisksClient the Scheduler uses.
+type DisksClient interface {
+	Get(resourceGroupName string, diskName string) (disk.Model, error)
+	CreateOrUpdate(resourceGroupName string, diskName string, diskParameter disk.Model, cancel <-chan struct{}) (<-chan disk.Model, <-chan error)
+	List() (disk.ListType, error)
+	ListNextResults(lastResults disk.ListType) (disk.ListType, error)
+	ListByResourceGroup(resourceGroupName string) (disk.ListType, error)
+	ListByResourceGroupNextResults(lastResults disk.ListType) (disk.ListType, error)
+}
+
+var _ DisksClient = disk.DisksClient{}
+
+// SnapshotsClient is the subset of disk.SnapshotsClient the Scheduler uses.
+type SnapshotsClient interface {
+	Get(resourceGroupName string, snapshotName string) (disk.Snapshot, error)
+	CreateOrUpdate(resourceGroupName string, snapshotName string, snapshot disk.Snapshot, cancel <-chan struct{}) (<-chan disk.Snapshot, <-chan error)
+	Delete(resourceGroupName string, snapshotName string, cancel <-chan struct{}) (<-chan disk.OperationStatusResponse, <-chan error)
+	List() (disk.SnapshotList, error)
+	ListNextResults(lastResults disk.SnapshotList) (disk.SnapshotList, error)
+}
+
+var _ SnapshotsClient = disk.SnapshotsClient{}
+
+// Config configures a Scheduler.
+type Config struct {
+	Disks     DisksClient
+	Snapshots SnapshotsClient
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// Scheduler plans and takes the actions of snapshot policies.
+type Scheduler struct {
+	config Config
+}
+
+// NewScheduler validates config and returns a Scheduler.
+func NewScheduler(config Config) (*Scheduler, error) {
+	if config.Disks == nil || config.Snapshots == nil {
+		return nil, fmt.Errorf("snapshots: disk and snapshot clients are required")
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	return &Scheduler{config: config}, nil
+}
+
+// snapshot is a snapshot taken by a policy.
+type snapshot struct {
+	resourceGroup string
+	name          string
+	sequence      int
+	taken         time.Time
+}
+
+// Plan returns the actions the policies call for now, without taking them:
+// for every disk, a snapshot and its copy if one is due, followed by the
+// deletions of the snapshots past retention.
+func (s *Scheduler) Plan(policies []Policy) ([]Action, error) {
+	now := s.config.Now().UTC()
+	existing, err := s.listSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	var actions []Action
+	for i := range policies {
+		p := &policies[i]
+		if p.schedule == nil {
+			if err := p.validate(); err != nil {
+				return nil, err
+			}
+		}
+		disks, err := s.listDisks(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range disks {
+			actions = append(actions, s.planDisk(p, d, existing[snapshotKey(p.Name, *d.ID)], now)...)
+		}
+	}
+	return actions, nil
+}
+
+// Run takes the actions Plan returns and returns those taken. The copy and
+// deletions planned for a disk are skipped if its snapshot fails. Errors do
+// not stop the other disks; they are returned together at the end.
+func (s *Scheduler) Run(policies []Policy) ([]Action, error) {
+	actions, err := s.Plan(policies)
+	if err != nil {
+		return nil, err
+	}
+	var done []Action
+	var errs []string
+	failed := map[string]bool{}
+	for _, a := range actions {
+		key := snapshotKey(a.Policy, a.Disk)
+		if failed[key] {
+			continue
+		}
+		if err := s.take(a); err != nil {
+			glog.Warningf("snapshots: %v", err)
+			errs = append(errs, err.Error())
+			if a.Type != ActionDelete {
+				failed[key] = true
+			}
+			continue
+		}
+		done = append(done, a)
+	}
+	if len(errs) > 0 {
+		return done, fmt.Errorf("snapshots: %d of %d actions failed: %s", len(errs), len(actions), strings.Join(errs, "; "))
+	}
+	return done, nil
+}
+
+// Loop runs the policies every interval until stop is closed. The interval
+// should be shorter than that of the most frequent schedule.
+func (s *Scheduler) Loop(policies []Policy, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if done, err := s.Run(policies); err != nil {
+			glog.Warningf("snapshots: %v", err)
+		} else {
+			glog.V(2).Infof("snapshots: took %d actions", len(done))
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Restore creates the managed disk name in resourceGroup from the snapshot
+// snapshotID, in the location of the snapshot. accountType defaults to that
+// of the snapshot. An existing disk is not overwritten.
+func (s *Scheduler) Restore(snapshotID, resourceGroup, name string, accountType disk.StorageAccountTypes) (disk.Model, error) {
+	id, err := resourceid.Parse(snapshotID)
+	if err != nil {
+		return disk.Model{}, err
+	}
+	if !strings.EqualFold(id.Type(), computeProvider+"/"+snapshotsType) {
+		return disk.Model{}, fmt.Errorf("snapshots: %s is not the ID of a snapshot", snapshotID)
+	}
+	snap, err := s.config.Snapshots.Get(id.ResourceGroup, id.Name())
+	if err != nil {
+		return disk.Model{}, fmt.Errorf("snapshots: getting snapshot %s: %v", id.Name(), err)
+	}
+	_, err = s.config.Disks.Get(resourceGroup, name)
+	if err == nil {
+		return disk.Model{}, fmt.Errorf("snapshots: disk %s already exists in resource group %s", name, resourceGroup)
+	}
+	if !apierror.IsNotFound(err) {
+		return disk.Model{}, fmt.Errorf("snapshots: getting disk %s: %v", name, err)
+	}
+
+	if accountType == "" && snap.Properties != nil {
+		accountType = snap.AccountType
+	}
+	if accountType == "" {
+		accountType = disk.StandardLRS
+	}
+	source := snapshotID
+	glog.V(2).Infof("snapshots: restoring disk %s from snapshot %s", name, id.Name())
+	resultc, errc := s.config.Disks.CreateOrUpdate(resourceGroup, name, disk.Model{
+		Location: snap.Location,
+		Properties: &disk.Properties{
+			AccountType: accountType,
+			CreationData: &disk.CreationData{
+				CreateOption:     disk.Copy,
+				SourceResourceID: &source,
+			},
+		},
+	}, nil)
+	if err := <-errc; err != nil {
+		return disk.Model{}, fmt.Errorf("snapshots: restoring disk %s from snapshot %s: %v", name, id.Name(), err)
+	}
+	return <-resultc, nil
+}
+
+// planDisk returns the actions the policy p calls for on the disk d, which
+// has the snapshots snaps.
+func (s *Scheduler) planDisk(p *Policy, d disk.Model, snaps []snapshot, now time.Time) []Action {
+	id, _ := resourceid.Parse(*d.ID)
+	accountType := p.AccountType
+	if accountType == "" {
+		accountType = disk.StandardLRS
+	}
+
+	sequence := 0
+	var last time.Time
+	for _, snap := range snaps {
+		if snap.sequence > sequence {
+			sequence = snap.sequence
+		}
+		if snap.taken.After(last) {
+			last = snap.taken
+		}
+	}
+	due, reason := true, "the disk has no snapshot"
+	if !last.IsZero() {
+		next := p.schedule.Next(last)
+		due = !next.IsZero() && !next.After(now)
+		reason = "due since " + next.Format(time.RFC3339)
+	}
+
+	copyGroup := p.CopyResourceGroup
+	if strings.EqualFold(copyGroup, id.ResourceGroup) {
+		copyGroup = ""
+	}
+	var actions []Action
+	if due {
+		sequence++
+		name := snapshotName(*d.ID, id.Name(), p.Name, sequence)
+		actions = append(actions, Action{
+			Type:          ActionSnapshot,
+			Policy:        p.Name,
+			Disk:          *d.ID,
+			ResourceGroup: id.ResourceGroup,
+			Snapshot:      name,
+			Source:        *d.ID,
+			Reason:        reason,
+			location:      *d.Location,
+			sequence:      sequence,
+			accountType:   accountType,
+		})
+		if copyGroup != "" {
+			actions = append(actions, Action{
+				Type:          ActionCopy,
+				Policy:        p.Name,
+				Disk:          *d.ID,
+				ResourceGroup: copyGroup,
+				Snapshot:      name,
+				Source:        resourceid.New(id.SubscriptionID, id.ResourceGroup, computeProvider, snapshotsType, name).String(),
+				Reason:        "copy of snapshot " + name,
+				location:      *d.Location,
+				sequence:      sequence,
+				accountType:   accountType,
+			})
+		}
+	}
+
+	// Snapshots are pruned in each resource group on their own, counting
+	// the one about to be taken.
+	byGroup := map[string][]snapshot{}
+	var groups []string
+	for _, snap := range snaps {
+		key := strings.ToLower(snap.resourceGroup)
+		if _, ok := byGroup[key]; !ok {
+			groups = append(groups, key)
+		}
+		byGroup[key] = append(byGroup[key], snap)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		list := byGroup[group]
+		sort.Sort(bySequenceDesc(list))
+		taking := 0
+		if due && (strings.EqualFold(group, id.ResourceGroup) || strings.EqualFold(group, copyGroup)) {
+			taking = 1
+		}
+		for i, snap := range list {
+			var reason string
+			switch {
+			case i == 0 && taking == 0:
+				// The newest snapshot is always kept.
+				continue
+			case p.MaxCount > 0 && i+taking >= p.MaxCount:
+				reason = fmt.Sprintf("beyond the newest %d snapshots", p.MaxCount)
+			case p.MaxAge > 0 && now.Sub(snap.taken) > time.Duration(p.MaxAge):
+				reason = fmt.Sprintf("older than %v", time.Duration(p.MaxAge))
+			default:
+				continue
+			}
+			actions = append(actions, Action{
+				Type:          ActionDelete,
+				Policy:        p.Name,
+				Disk:          *d.ID,
+				ResourceGroup: snap.resourceGroup,
+				Snapshot:      snap.name,
+				Reason:        reason,
+			})
+		}
+	}
+	return actions
+}
+
+// take takes the action a.
+func (s *Scheduler) take(a Action) error {
+	if a.Type == ActionDelete {
+		glog.V(2).Infof("snapshots: deleting snapshot %s/%s: %s", a.ResourceGroup, a.Snapshot, a.Reason)
+		_, errc := s.config.Snapshots.Delete(a.ResourceGroup, a.Snapshot, nil)
+		if err := <-errc; err != nil && !apierror.IsNotFound(err) {
+			return fmt.Errorf("deleting snapshot %s/%s: %v", a.ResourceGroup, a.Snapshot, err)
+		}
+		return nil
+	}
+
+	// Names are unique to a disk, but a snapshot by the same name may have
+	// been created by hand or by another tool.
+	existing, err := s.config.Snapshots.Get(a.ResourceGroup, a.Snapshot)
+	switch {
+	case apierror.IsNotFound(err):
+	case err != nil:
+		return fmt.Errorf("getting snapshot %s/%s: %v", a.ResourceGroup, a.Snapshot, err)
+	default:
+		if source, _ := tags.Get(existing.Tags, tagSource); !strings.EqualFold(source, a.Disk) {
+			return fmt.Errorf("snapshot %s/%s exists and is not a snapshot of %s", a.ResourceGroup, a.Snapshot, a.Disk)
+		}
+	}
+
+	glog.V(2).Infof("snapshots: taking snapshot %s/%s of %s: %s", a.ResourceGroup, a.Snapshot, a.Source, a.Reason)
+	location, source, policy, diskID := a.location, a.Source, a.Policy, a.Disk
+	taken := s.config.Now().UTC().Format(time.RFC3339)
+	sequence := strconv.Itoa(a.sequence)
+	_, errc := s.config.Snapshots.CreateOrUpdate(a.ResourceGroup, a.Snapshot, disk.Snapshot{
+		Location: &location,
+		Tags: &map[string]*string{
+			tagPolicy:   &policy,
+			tagSource:   &diskID,
+			tagTime:     &taken,
+			tagSequence: &sequence,
+		},
+		Properties: &disk.Properties{
+			AccountType: a.accountType,
+			CreationData: &disk.CreationData{
+				CreateOption:     disk.Copy,
+				SourceResourceID: &source,
+			},
+		},
+	}, nil)
+	if err := <-errc; err != nil {
+		return fmt.Errorf("taking snapshot %s/%s of %s: %v", a.ResourceGroup, a.Snapshot, a.Source, err)
+	}
+	return nil
+}
+
+// listDisks returns the disks the policy p selects.
+func (s *Scheduler) listDisks(p *Policy) ([]disk.Model, error) {
+	var all []disk.Model
+	if len(p.ResourceGroups) > 0 {
+		for _, group := range p.ResourceGroups {
+			result, err := s.config.Disks.ListByResourceGroup(group)
+			for {
+				if err != nil {
+					return nil, fmt.Errorf("snapshots: listing disks of resource group %s: %v", group, err)
+				}
+				all = append(all, derefDisks(result.Value)...)
+				if result.NextLink == nil || *result.NextLink == "" {
+					break
+				}
+				result, err = s.config.Disks.ListByResourceGroupNextResults(result)
+			}
+		}
+	} else {
+		result, err := s.config.Disks.List()
+		for {
+			if err != nil {
+				return nil, fmt.Errorf("snapshots: listing disks: %v", err)
+			}
+			all = append(all, derefDisks(result.Value)...)
+			if result.NextLink == nil || *result.NextLink == "" {
+				break
+			}
+			result, err = s.config.Disks.ListNextResults(result)
+		}
+	}
+
+	var selected []disk.Model
+	for _, d := range all {
+		if d.ID == nil || d.Location == nil {
+			continue
+		}
+		id, err := resourceid.Parse(*d.ID)
+		if err != nil {
+			glog.Warningf("snapshots: skipping disk: %v", err)
+			continue
+		}
+		if p.selects(d, id.ResourceGroup) {
+			selected = append(selected, d)
+		}
+	}
+	return selected, nil
+}
+
+// listSnapshots returns the snapshots taken by policies, by policy and
+// disk.
+func (s *Scheduler) listSnapshots() (map[string][]snapshot, error) {
+	snaps := map[string][]snapshot{}
+	result, err := s.config.Snapshots.List()
+	for {
+		if err != nil {
+			return nil, fmt.Errorf("snapshots: listing snapshots: %v", err)
+		}
+		if result.Value != nil {
+			for _, snap := range *result.Value {
+				policy, ok := tags.Get(snap.Tags, tagPolicy)
+				source, ok2 := tags.Get(snap.Tags, tagSource)
+				if !ok || !ok2 || snap.ID == nil || snap.Name == nil {
+					continue
+				}
+				id, err := resourceid.Parse(*snap.ID)
+				if err != nil {
+					continue
+				}
+				entry := snapshot{resourceGroup: id.ResourceGroup, name: *snap.Name}
+				if v, ok := tags.Get(snap.Tags, tagSequence); ok {
+					entry.sequence, _ = strconv.Atoi(v)
+				}
+				if v, ok := tags.Get(snap.Tags, tagTime); ok {
+					entry.taken, _ = time.Parse(time.RFC3339, v)
+				}
+				if entry.taken.IsZero() && snap.Properties != nil && snap.TimeCreated != nil {
+					entry.taken = snap.TimeCreated.Time
+				}
+				key := snapshotKey(policy, source)
+				snaps[key] = append(snaps[key], entry)
+			}
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			break
+		}
+		result, err = s.config.Snapshots.ListNextResults(result)
+	}
+	return snaps, nil
+}
+
+// snapshotName returns the name of the snapshot sequence of the disk
+// diskName, whose resource ID is diskID, by policy, e.g.
+// data1-5c2ad3f0-nightly-00042, shortening the disk name if needed. The
+// hash of the ID tells apart disks of the same name in other resource
+// groups, and disks whose names only differ past the shortening.
+func snapshotName(diskID, diskName, policy string, sequence int) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(diskID)))
+	suffix := fmt.Sprintf("-%08x-%s-%05d", h.Sum32(), policy, sequence)
+	if len(diskName)+len(suffix) > maxNameLength {
+		diskName = diskName[:maxNameLength-len(suffix)]
+	}
+	return diskName + suffix
+}
+
+func snapshotKey(policy, diskID string) string {
+	return strings.ToLower(policy + "|" + diskID)
+}
+
+type bySequenceDesc []snapshot
+
+func (s bySequenceDesc) Len() int           { return len(s) }
+func (s bySequenceDesc) Less(i, j int) bool { return s[i].sequence > s[j].sequence }
+func (s bySequenceDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func derefDisks(p *[]disk.Model) []disk.Model {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
@@ -0,0 +1,201 @@
+package snapshots
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/disk"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+const testDiskID = "/subscriptions/sub/resourceGroups/k8s/providers/Microsoft.Compute/disks/data1"
+
+func stringPtr(s string) *string { return &s }
+
+// fakeSnapshots holds snapshots by resource group and name, and records
+// those written.
+type fakeSnapshots struct {
+	snapshots map[string]disk.Snapshot
+	written   []string
+}
+
+func (f *fakeSnapshots) Get(resourceGroupName string, snapshotName string) (disk.Snapshot, error) {
+	snap, ok := f.snapshots[resourceGroupName+"/"+snapshotName]
+	if !ok {
+		return disk.Snapshot{}, autorest.DetailedError{StatusCode: http.StatusNotFound}
+	}
+	return snap, nil
+}
+
+func (f *fakeSnapshots) CreateOrUpdate(resourceGroupName string, snapshotName string, snapshot disk.Snapshot, cancel <-chan struct{}) (<-chan disk.Snapshot, <-chan error) {
+	f.written = append(f.written, resourceGroupName+"/"+snapshotName)
+	f.snapshots[resourceGroupName+"/"+snapshotName] = snapshot
+	resultc, errc := make(chan disk.Snapshot, 1), make(chan error, 1)
+	resultc <- snapshot
+	close(errc)
+	return resultc, errc
+}
+
+func (f *fakeSnapshots) Delete(resourceGroupName string, snapshotName string, cancel <-chan struct{}) (<-chan disk.OperationStatusResponse, <-chan error) {
+	delete(f.snapshots, resourceGroupName+"/"+snapshotName)
+	resultc, errc := make(chan disk.OperationStatusResponse, 1), make(chan error, 1)
+	resultc <- disk.OperationStatusResponse{}
+	close(errc)
+	return resultc, errc
+}
+
+func (f *fakeSnapshots) List() (disk.SnapshotList, error) {
+	return disk.SnapshotList{}, nil
+}
+
+func (f *fakeSnapshots) ListNextResults(lastResults disk.SnapshotList) (disk.SnapshotList, error) {
+	return disk.SnapshotList{}, nil
+}
+
+func newTestPolicy(t *testing.T, p Policy) *Policy {
+	p.Name = "nightly"
+	p.ResourceGroups = []string{"k8s"}
+	p.Schedule = "30 2 * * *"
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &p
+}
+
+// actionStrings describes actions by type, resource group and snapshot.
+func actionStrings(actions []Action) []string {
+	var out []string
+	for _, a := range actions {
+		out = append(out, fmt.Sprintf("%s %s/%s", a.Type, a.ResourceGroup, a.Snapshot))
+	}
+	return out
+}
+
+func TestPlanDiskRetention(t *testing.T) {
+	now := time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC)
+	d := disk.Model{ID: stringPtr(testDiskID), Location: stringPtr("local")}
+	name := func(sequence int) string { return snapshotName(testDiskID, "data1", "nightly", sequence) }
+	// snaps returns the snapshots of the given sequences in group, taken
+	// at 02:30 sequence days before the newest.
+	snaps := func(group string, newest int, sequences ...int) []snapshot {
+		var out []snapshot
+		for _, seq := range sequences {
+			taken := time.Date(2026, 10, 17, 2, 30, 0, 0, time.UTC).AddDate(0, 0, seq-newest)
+			out = append(out, snapshot{resourceGroup: group, name: name(seq), sequence: seq, taken: taken})
+		}
+		return out
+	}
+
+	for _, tt := range []struct {
+		name   string
+		policy Policy
+		snaps  []snapshot
+		now    time.Time
+		want   []string
+	}{
+		{
+			name:   "first snapshot and its copy",
+			policy: Policy{MaxCount: 3, CopyResourceGroup: "k8s-backup"},
+			now:    now,
+			want: []string{
+				"snapshot k8s/" + name(1),
+				"copy k8s-backup/" + name(1),
+			},
+		},
+		{
+			name:   "by count, with a copy group",
+			policy: Policy{MaxCount: 3, CopyResourceGroup: "k8s-backup"},
+			snaps:  append(snaps("k8s", 4, 1, 2, 3, 4), snaps("k8s-backup", 4, 3, 4)...),
+			now:    now,
+			want: []string{
+				"snapshot k8s/" + name(5),
+				"copy k8s-backup/" + name(5),
+				"delete k8s/" + name(2),
+				"delete k8s/" + name(1),
+			},
+		},
+		{
+			name:   "by count, not due",
+			policy: Policy{MaxCount: 2},
+			snaps:  snaps("k8s", 4, 1, 2, 3, 4),
+			now:    now.Add(-2 * time.Hour),
+			want: []string{
+				"delete k8s/" + name(2),
+				"delete k8s/" + name(1),
+			},
+		},
+		{
+			name:   "by age",
+			policy: Policy{MaxAge: Duration(3 * 24 * time.Hour), CopyResourceGroup: "k8s-backup"},
+			snaps:  append(snaps("k8s", 5, 1, 2, 4, 5), snaps("k8s-backup", 5, 1, 5)...),
+			now:    now.Add(-2 * time.Hour),
+			want: []string{
+				"delete k8s/" + name(2),
+				"delete k8s/" + name(1),
+				"delete k8s-backup/" + name(1),
+			},
+		},
+		{
+			name:   "the newest snapshot is kept whatever its age",
+			policy: Policy{MaxAge: Duration(time.Hour)},
+			snaps:  snaps("k8s", 2, 1, 2),
+			now:    now.Add(-2 * time.Hour),
+			want:   []string{"delete k8s/" + name(1)},
+		},
+		{
+			name:   "a copy group that is the disk's own is ignored",
+			policy: Policy{CopyResourceGroup: "K8S"},
+			now:    now,
+			want:   []string{"snapshot k8s/" + name(1)},
+		},
+	} {
+		s := &Scheduler{}
+		got := actionStrings(s.planDisk(newTestPolicy(t, tt.policy), d, tt.snaps, tt.now))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: actions\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestSnapshotName(t *testing.T) {
+	other := strings.Replace(testDiskID, "/k8s/", "/other/", 1)
+	if a, b := snapshotName(testDiskID, "data1", "nightly", 1), snapshotName(other, "data1", "nightly", 1); a == b {
+		t.Errorf("disks data1 of two resource groups both get snapshot name %s", a)
+	}
+	long := strings.Repeat("d", 70)
+	a := snapshotName(testDiskID+"/"+long+"a", long+"a", "nightly", 42)
+	b := snapshotName(testDiskID+"/"+long+"b", long+"b", "nightly", 42)
+	if a == b || len(a) > maxNameLength || !strings.HasSuffix(a, "-nightly-00042") {
+		t.Errorf("names %s and %s of disks that differ past the shortening", a, b)
+	}
+}
+
+func TestTakeRefusesSnapshotOfAnotherDisk(t *testing.T) {
+	other := "/subscriptions/sub/resourceGroups/other/providers/Microsoft.Compute/disks/data1"
+	name := snapshotName(testDiskID, "data1", "nightly", 1)
+	f := &fakeSnapshots{snapshots: map[string]disk.Snapshot{
+		"k8s-backup/" + name: {Tags: &map[string]*string{tagSource: stringPtr(other)}},
+	}}
+	s := &Scheduler{config: Config{Snapshots: f, Now: time.Now}}
+	for _, tt := range []struct {
+		group string
+		ok    bool
+	}{
+		{"k8s", true},
+		// Taking it again, e.g. after a failed run, is fine.
+		{"k8s", true},
+		{"k8s-backup", false},
+	} {
+		err := s.take(Action{Type: ActionSnapshot, Policy: "nightly", Disk: testDiskID, ResourceGroup: tt.group, Snapshot: name, Source: testDiskID, location: "local", sequence: 1})
+		if (err == nil) != tt.ok {
+			t.Errorf("take(%s/%s) = %v, want success %v", tt.group, name, err, tt.ok)
+		}
+	}
+	if want := []string{"k8s/" + name, "k8s/" + name}; !reflect.DeepEqual(f.written, want) {
+		t.Errorf("wrote %v, want %v", f.written, want)
+	}
+}
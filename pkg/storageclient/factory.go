@@ -0,0 +1,339 @@
+// Package storageclient builds data-plane storage clients from the ARM
+// metadata of a storage account. The endpoint suffix and scheme come from
+// the primary endpoints the resource provider reports, rather than from a
+// cloud environment, so the clients reach the account wherever it lives,
+// Azure Stack included. The clients authenticate with an account key or
+// with an account SAS minted by the resource provider, where its API
+// version has them.
+package storageclient
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	armstorage "github.com/Azure/azure-sdk-for-go/arm/storage"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+)
+
+const (
+	// Service names as they appear in the endpoint host names.
+	blobService  = "blob"
+	queueService = "queue"
+	tableService = "table"
+	fileService  = "file"
+
+	defaultSASPermissions = armstorage.Permissions("rwdlacup")
+	defaultSASLifetime    = time.Hour
+	// sasClockSkew backdates the start of account SAS tokens, so that they
+	// are valid right away on servers whose clock is a little behind.
+	sasClockSkew = 5 * time.Minute
+)
+
+// errSASUnsupported is returned by sasClient when the storage API version
+// of the stamp lacks listAccountSas, which came with 2016-12-01.
+var errSASUnsupported = errors.New("storageclient: the storage API version of the stamp lacks account SAS")
+
+// AccountsClient is the subset of armstorage.AccountsClient the factory
+// uses.
+type AccountsClient interface {
+	GetProperties(resourceGroupName, accountName string) (armstorage.Account, error)
+	ListKeys(resourceGroupName, accountName string) (armstorage.AccountListKeysResult, error)
+	ListAccountSAS(resourceGroupName, accountName string, parameters armstorage.AccountSasParameters) (armstorage.ListAccountSasResponse, error)
+}
+
+var _ AccountsClient = armstorage.AccountsClient{}
+
+// Factory builds clients for the storage accounts of a subscription.
+type Factory struct {
+	Accounts AccountsClient
+	// APIVersion is the service version of clients using an account key.
+	// Empty means storage.DefaultAPIVersion. Clients using an account SAS
+	// take the version the resource provider signed the token for.
+	APIVersion string
+	// UseSAS makes clients authenticate with an account SAS instead of an
+	// account key, so the key never leaves the resource provider. Stamps
+	// whose storage API version predates account SAS (2016-12-01) get a
+	// client using the key instead; see RequireSAS.
+	UseSAS bool
+	// RequireSAS makes NewAccount fail rather than fall back to the account
+	// key when UseSAS is set and the stamp lacks account SAS.
+	RequireSAS bool
+	// SASPermissions are granted by the account SAS. Empty means
+	// "rwdlacup", everything.
+	SASPermissions armstorage.Permissions
+	// SASLifetime is how long the account SAS is valid. Zero means 1h.
+	SASLifetime time.Duration
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewFactory returns a factory using account keys.
+func NewFactory(accounts AccountsClient) *Factory {
+	return &Factory{
+		Accounts: accounts,
+		Now:      time.Now,
+	}
+}
+
+// Account is a storage account along with a client for it.
+type Account struct {
+	Name          string
+	ResourceGroup string
+	// Client reaches the services of the account.
+	Client storage.Client
+	// EndpointSuffix and UseHTTPS are those of the primary endpoints, e.g.
+	// "core.windows.net" and true.
+	EndpointSuffix string
+	UseHTTPS       bool
+	// Expires is when the account SAS of Client expires. It is zero when
+	// Client uses an account key.
+	Expires time.Time
+
+	// services holds the services the account has endpoints for.
+	services map[string]bool
+}
+
+// NewAccount reads the properties of the account accountName of
+// resourceGroup and returns a client for it.
+func (f *Factory) NewAccount(resourceGroup, accountName string) (*Account, error) {
+	props, err := f.Accounts.GetProperties(resourceGroup, accountName)
+	if err != nil {
+		return nil, fmt.Errorf("storageclient: getting storage account %s: %v", accountName, err)
+	}
+	if props.AccountProperties == nil || props.AccountProperties.PrimaryEndpoints == nil {
+		return nil, fmt.Errorf("storageclient: storage account %s has no endpoints, its provisioning state is %q", accountName, provisioningState(props))
+	}
+	account, err := parseEndpoints(accountName, props.AccountProperties.PrimaryEndpoints)
+	if err != nil {
+		return nil, err
+	}
+	account.ResourceGroup = resourceGroup
+	if httpsOnly := props.AccountProperties.EnableHTTPSTrafficOnly; httpsOnly != nil && *httpsOnly && !account.UseHTTPS {
+		return nil, fmt.Errorf("storageclient: storage account %s only accepts HTTPS but its endpoints use HTTP", accountName)
+	}
+
+	if f.UseSAS {
+		err = f.sasClient(account)
+		if err == errSASUnsupported && !f.RequireSAS {
+			glog.Warningf("storageclient: the storage API version of the stamp lacks account SAS, using the key of storage account %s", accountName)
+			err = f.keyClient(account)
+		}
+	} else {
+		err = f.keyClient(account)
+	}
+	if err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("storageclient: storage account %s uses endpoint suffix %s, HTTPS %v, service version %s", accountName, account.EndpointSuffix, account.UseHTTPS, account.Client.APIVersion())
+	return account, nil
+}
+
+// keyClient sets the client of account to one using its first full-access
+// key.
+func (f *Factory) keyClient(account *Account) error {
+	result, err := f.Accounts.ListKeys(account.ResourceGroup, account.Name)
+	if err != nil {
+		return fmt.Errorf("storageclient: listing keys of storage account %s: %v", account.Name, err)
+	}
+	key := ""
+	if result.Keys != nil {
+		for _, k := range *result.Keys {
+			if k.Value != nil && *k.Value != "" && (k.Permissions == "" || strings.EqualFold(string(k.Permissions), string(armstorage.Full))) {
+				key = *k.Value
+				break
+			}
+		}
+	}
+	if key == "" {
+		return fmt.Errorf("storageclient: storage account %s has no full access key", account.Name)
+	}
+
+	apiVersion := f.APIVersion
+	if apiVersion == "" {
+		apiVersion = storage.DefaultAPIVersion
+	}
+	client, err := storage.NewClient(account.Name, key, account.EndpointSuffix, apiVersion, account.UseHTTPS)
+	if err != nil {
+		return fmt.Errorf("storageclient: creating client for storage account %s: %v", account.Name, err)
+	}
+	account.Client = client
+	return nil
+}
+
+// sasClient sets the client of account to one using an account SAS, for
+// the services and over the protocols of its endpoints.
+func (f *Factory) sasClient(account *Account) error {
+	now := time.Now
+	if f.Now != nil {
+		now = f.Now
+	}
+	permissions := f.SASPermissions
+	if permissions == "" {
+		permissions = defaultSASPermissions
+	}
+	lifetime := f.SASLifetime
+	if lifetime <= 0 {
+		lifetime = defaultSASLifetime
+	}
+	protocols := armstorage.HTTPS
+	if !account.UseHTTPS {
+		protocols = armstorage.Httpshttp
+	}
+	services := ""
+	for _, s := range []struct {
+		name   string
+		signed armstorage.Services
+	}{
+		{blobService, armstorage.B},
+		{queueService, armstorage.Q},
+		{tableService, armstorage.T},
+		{fileService, armstorage.F},
+	} {
+		if account.services[s.name] {
+			services += string(s.signed)
+		}
+	}
+
+	start := now()
+	expires := start.Add(lifetime)
+	result, err := f.Accounts.ListAccountSAS(account.ResourceGroup, account.Name, armstorage.AccountSasParameters{
+		Services:               armstorage.Services(services),
+		ResourceTypes:          armstorage.SignedResourceTypes("sco"),
+		Permissions:            permissions,
+		Protocols:              protocols,
+		SharedAccessStartTime:  &date.Time{Time: start.Add(-sasClockSkew).UTC()},
+		SharedAccessExpiryTime: &date.Time{Time: expires.UTC()},
+	})
+	if apierror.IsUnsupported(err) {
+		return errSASUnsupported
+	}
+	if err != nil {
+		return fmt.Errorf("storageclient: getting account SAS of storage account %s: %v", account.Name, err)
+	}
+	if result.AccountSasToken == nil || *result.AccountSasToken == "" {
+		return fmt.Errorf("storageclient: storage account %s returned no account SAS", account.Name)
+	}
+	token, err := url.ParseQuery(strings.TrimPrefix(*result.AccountSasToken, "?"))
+	if err != nil {
+		return fmt.Errorf("storageclient: parsing account SAS of storage account %s: %v", account.Name, err)
+	}
+	if token.Get("sv") == "" || token.Get("sig") == "" {
+		return fmt.Errorf("storageclient: account SAS of storage account %s lacks a service version or signature", account.Name)
+	}
+	// The client goes over HTTPS only if the token is restricted to it.
+	if account.UseHTTPS && token.Get("spr") != string(armstorage.HTTPS) {
+		return fmt.Errorf("storageclient: account SAS of storage account %s is not restricted to HTTPS", account.Name)
+	}
+
+	account.Client = storage.NewAccountSASClient(account.Name, token, azure.Environment{StorageEndpointSuffix: account.EndpointSuffix})
+	account.Expires = expires
+	return nil
+}
+
+// BlobService returns a client for the blob service of the account.
+func (a *Account) BlobService() (*storage.BlobStorageClient, error) {
+	if err := a.checkService(blobService); err != nil {
+		return nil, err
+	}
+	s := a.Client.GetBlobService()
+	return &s, nil
+}
+
+// QueueService returns a client for the queue service of the account.
+func (a *Account) QueueService() (*storage.QueueServiceClient, error) {
+	if err := a.checkService(queueService); err != nil {
+		return nil, err
+	}
+	s := a.Client.GetQueueService()
+	return &s, nil
+}
+
+// TableService returns a client for the table service of the account.
+func (a *Account) TableService() (*storage.TableServiceClient, error) {
+	if err := a.checkService(tableService); err != nil {
+		return nil, err
+	}
+	s := a.Client.GetTableService()
+	return &s, nil
+}
+
+// FileService returns a client for the file service of the account.
+func (a *Account) FileService() (*storage.FileServiceClient, error) {
+	if err := a.checkService(fileService); err != nil {
+		return nil, err
+	}
+	s := a.Client.GetFileService()
+	return &s, nil
+}
+
+func (a *Account) checkService(service string) error {
+	if !a.services[service] {
+		return fmt.Errorf("storageclient: storage account %s has no %s endpoint", a.Name, service)
+	}
+	return nil
+}
+
+// parseEndpoints returns an account with the suffix and scheme shared by
+// endpoints, which all have the form <scheme>://<account>.<service>.<suffix>/.
+func parseEndpoints(accountName string, endpoints *armstorage.Endpoints) (*Account, error) {
+	account := &Account{
+		Name:     accountName,
+		services: map[string]bool{},
+	}
+	scheme := ""
+	for _, e := range []struct {
+		service  string
+		endpoint *string
+	}{
+		{blobService, endpoints.Blob},
+		{queueService, endpoints.Queue},
+		{tableService, endpoints.Table},
+		{fileService, endpoints.File},
+	} {
+		if e.endpoint == nil || *e.endpoint == "" {
+			continue
+		}
+		u, err := url.Parse(*e.endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("storageclient: parsing %s endpoint of storage account %s: %v", e.service, accountName, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("storageclient: %s endpoint %s of storage account %s is not an HTTP URL", e.service, *e.endpoint, accountName)
+		}
+		if u.Path != "" && u.Path != "/" {
+			return nil, fmt.Errorf("storageclient: %s endpoint %s of storage account %s has a path", e.service, *e.endpoint, accountName)
+		}
+		prefix := accountName + "." + e.service + "."
+		host := strings.ToLower(u.Host)
+		if !strings.HasPrefix(host, prefix) || len(host) == len(prefix) {
+			return nil, fmt.Errorf("storageclient: %s endpoint %s of storage account %s does not start with %s", e.service, *e.endpoint, accountName, prefix)
+		}
+		suffix := strings.TrimSuffix(host[len(prefix):], ".")
+		if account.EndpointSuffix == "" {
+			account.EndpointSuffix = suffix
+			scheme = u.Scheme
+		} else if suffix != account.EndpointSuffix || u.Scheme != scheme {
+			return nil, fmt.Errorf("storageclient: endpoints of storage account %s differ in suffix or scheme: %s://%s and %s", accountName, scheme, account.EndpointSuffix, *e.endpoint)
+		}
+		account.services[e.service] = true
+	}
+	if len(account.services) == 0 {
+		return nil, fmt.Errorf("storageclient: storage account %s has no endpoints", accountName)
+	}
+	account.UseHTTPS = scheme == "https"
+	return account, nil
+}
+
+func provisioningState(account armstorage.Account) armstorage.ProvisioningState {
+	if account.AccountProperties == nil {
+		return ""
+	}
+	return account.AccountProperties.ProvisioningState
+}
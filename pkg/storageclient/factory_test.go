@@ -0,0 +1,102 @@
+package storageclient
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	armstorage "github.com/Azure/azure-sdk-for-go/arm/storage"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// fakeAccounts serves one storage account on https://<name>.<service>.local.azurestack.external/.
+type fakeAccounts struct {
+	sasToken string
+	sasErr   error
+	listKeys int
+}
+
+func (f *fakeAccounts) GetProperties(resourceGroupName, accountName string) (armstorage.Account, error) {
+	endpoint := func(service string) *string {
+		e := "https://" + accountName + "." + service + ".local.azurestack.external/"
+		return &e
+	}
+	return armstorage.Account{AccountProperties: &armstorage.AccountProperties{
+		PrimaryEndpoints: &armstorage.Endpoints{
+			Blob:  endpoint(blobService),
+			Queue: endpoint(queueService),
+			Table: endpoint(tableService),
+		},
+	}}, nil
+}
+
+func (f *fakeAccounts) ListKeys(resourceGroupName, accountName string) (armstorage.AccountListKeysResult, error) {
+	f.listKeys++
+	name, value := "key1", storage.StorageEmulatorAccountKey
+	return armstorage.AccountListKeysResult{Keys: &[]armstorage.AccountKey{
+		{KeyName: &name, Value: &value, Permissions: armstorage.Full},
+	}}, nil
+}
+
+func (f *fakeAccounts) ListAccountSAS(resourceGroupName, accountName string, parameters armstorage.AccountSasParameters) (armstorage.ListAccountSasResponse, error) {
+	if f.sasErr != nil {
+		return armstorage.ListAccountSasResponse{}, f.sasErr
+	}
+	return armstorage.ListAccountSasResponse{AccountSasToken: &f.sasToken}, nil
+}
+
+func armError(status int, code string) error {
+	return autorest.DetailedError{
+		StatusCode: status,
+		Original:   &azure.RequestError{ServiceError: &azure.ServiceError{Code: code}},
+	}
+}
+
+func TestNewAccountSAS(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		sasErr     error
+		requireSAS bool
+		ok         bool
+		sas        bool
+	}{
+		{"account SAS", nil, false, true, true},
+		{"unsupported API version", armError(http.StatusBadRequest, "InvalidResourceType"), false, true, false},
+		{"unknown route", autorest.DetailedError{StatusCode: http.StatusNotFound}, false, true, false},
+		{"unsupported and required", armError(http.StatusBadRequest, "NoRegisteredProviderFound"), true, false, false},
+		{"forbidden", armError(http.StatusForbidden, "AuthorizationFailed"), false, false, false},
+		{"no response", errors.New("dial tcp: i/o timeout"), false, false, false},
+	} {
+		accounts := &fakeAccounts{
+			sasToken: "sv=2016-05-31&ss=bqt&srt=sco&sp=rwdlacup&se=2026-10-18T13%3A00%3A00Z&spr=https&sig=c2ln",
+			sasErr:   tt.sasErr,
+		}
+		now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+		f := &Factory{
+			Accounts:   accounts,
+			UseSAS:     true,
+			RequireSAS: tt.requireSAS,
+			Now:        func() time.Time { return now },
+		}
+		account, err := f.NewAccount("group", "data")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: NewAccount() = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if sas := !account.Expires.IsZero(); sas != tt.sas {
+			t.Errorf("%s: client uses account SAS %v, want %v", tt.name, sas, tt.sas)
+		}
+		if keys := accounts.listKeys > 0; keys == tt.sas {
+			t.Errorf("%s: listed keys %d times with account SAS %v", tt.name, accounts.listKeys, tt.sas)
+		}
+		if account.EndpointSuffix != "local.azurestack.external" || !account.UseHTTPS {
+			t.Errorf("%s: endpoint suffix %s, HTTPS %v", tt.name, account.EndpointSuffix, account.UseHTTPS)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package storageemulator
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sasGrant is what a verified shared access signature allows.
+type sasGrant struct {
+	// account is set for account SAS tokens, which are scoped by services
+	// and resource types instead of a single resource.
+	account       bool
+	services      string
+	resourceTypes string
+
+	// resource is the signed resource of service SAS tokens: "c" for a
+	// container, "b" for a blob, "q" for a queue and "t" for a table.
+	resource  string
+	container string
+	blob      string
+
+	permissions string
+}
+
+// access describes what an operation needs from the credentials of a
+// request.
+type access struct {
+	// resourceType is 's' for service, 'c' for container (or queue and
+	// table) and 'o' for object level operations, as in account SAS tokens.
+	resourceType byte
+	// permission is the SAS permission letter the operation requires.
+	permission byte
+	container  string
+	blob       string
+}
+
+// authenticate verifies the credentials of a request. Requests without
+// credentials are marked anonymous and left to authorize.
+func (e *Emulator) authenticate(req *request) *serviceError {
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		return e.checkSharedKey(req, auth)
+	}
+	if req.URL.Query().Get("sig") != "" {
+		return e.checkSAS(req)
+	}
+	req.anonymous = true
+	return nil
+}
+
+// authorize checks that the credentials of a request allow an operation.
+func (e *Emulator) authorize(req *request, a access) *serviceError {
+	switch {
+	case req.sas != nil:
+		return req.sas.allows(req.service, a)
+	case req.anonymous:
+		if req.service == blobService {
+			if c, ok := req.account.containers[a.container]; ok && c.allowsAnonymous(a) {
+				return nil
+			}
+			return newError(http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+		}
+		return newError(http.StatusForbidden, "AuthenticationFailed", "Server failed to authenticate the request. The Authorization header is missing.")
+	}
+	return nil
+}
+
+func (g *sasGrant) allows(service string, a access) *serviceError {
+	if strings.IndexByte(g.permissions, a.permission) < 0 {
+		return newError(http.StatusForbidden, "AuthorizationPermissionMismatch", "This request is not authorized to perform this operation using this permission.")
+	}
+	if g.account {
+		if strings.IndexByte(g.services, service[0]) < 0 {
+			return newError(http.StatusForbidden, "AuthorizationServiceMismatch", "This request is not authorized to perform this operation using this service.")
+		}
+		if strings.IndexByte(g.resourceTypes, a.resourceType) < 0 {
+			return newError(http.StatusForbidden, "AuthorizationResourceTypeMismatch", "This request is not authorized to perform this operation using this resource type.")
+		}
+		return nil
+	}
+
+	mismatch := newError(http.StatusForbidden, "AuthorizationFailure", "This request is not authorized to perform this operation.")
+	if g.resource == "t" {
+		// Table names are case-insensitive, and a table SAS covers only
+		// the entities in it.
+		if a.resourceType != 'o' || !strings.EqualFold(a.container, g.container) {
+			return mismatch
+		}
+		return nil
+	}
+	if a.container != g.container {
+		return mismatch
+	}
+	switch g.resource {
+	case "b":
+		if a.resourceType != 'o' || a.blob != g.blob {
+			return mismatch
+		}
+	case "c":
+		// A container SAS covers the blobs in it and listing them.
+		if a.resourceType == 's' || (a.resourceType == 'c' && a.permission != 'l') {
+			return mismatch
+		}
+	case "q":
+		if a.resourceType == 's' {
+			return mismatch
+		}
+	}
+	return nil
+}
+
+// checkSharedKey verifies a SharedKey or SharedKeyLite Authorization header.
+func (e *Emulator) checkSharedKey(req *request, auth string) *serviceError {
+	fail := func(format string, args ...interface{}) *serviceError {
+		return newError(http.StatusForbidden, "AuthenticationFailed", "Server failed to authenticate the request. "+format, args...)
+	}
+
+	parts := strings.SplitN(auth, " ", 2)
+	if len(parts) != 2 || (parts[0] != "SharedKey" && parts[0] != "SharedKeyLite") {
+		return fail("Unsupported authorization scheme in %q.", auth)
+	}
+	lite := parts[0] == "SharedKeyLite"
+	cred := strings.SplitN(parts[1], ":", 2)
+	if len(cred) != 2 || strings.TrimSuffix(cred[0], "-secondary") != req.account.name {
+		return fail("The account in the Authorization header does not match the request.")
+	}
+
+	stringToSign := sharedKeyStringToSign(req, lite)
+	if !hmac.Equal([]byte(computeHmac256(req.account.key, stringToSign)), []byte(cred[1])) {
+		return fail("The MAC signature found in the HTTP request '%s' is not the same as any computed signature. Server used following string to sign: '%s'.", cred[1], stringToSign)
+	}
+	return nil
+}
+
+// sharedKeyStringToSign builds the string a client signs for a request,
+// mirroring buildCanonicalizedString in the storage package.
+func sharedKeyStringToSign(req *request, lite bool) string {
+	h := req.Header
+	table := req.service == tableService
+
+	date := h.Get("Date")
+	if v := h.Get("x-ms-date"); v != "" {
+		if table {
+			date = v
+		} else {
+			date = ""
+		}
+	}
+	resource := canonicalizedResource(req, !table && !lite)
+
+	switch {
+	case table && lite:
+		return strings.Join([]string{date, resource}, "\n")
+	case table:
+		return strings.Join([]string{req.Method, h.Get("Content-MD5"), h.Get("Content-Type"), date, resource}, "\n")
+	case lite:
+		return strings.Join([]string{req.Method, h.Get("Content-MD5"), h.Get("Content-Type"), date, canonicalizedHeaders(h), resource}, "\n")
+	}
+
+	contentLength := h.Get("Content-Length")
+	if contentLength == "" && len(req.body) > 0 {
+		contentLength = strconv.Itoa(len(req.body))
+	}
+	if contentLength == "0" {
+		contentLength = ""
+	}
+	return strings.Join([]string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		contentLength,
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		date,
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+		canonicalizedHeaders(h),
+		resource,
+	}, "\n")
+}
+
+func canonicalizedHeaders(h http.Header) string {
+	values := map[string]string{}
+	for k, v := range h {
+		name := strings.TrimSpace(strings.ToLower(k))
+		if strings.HasPrefix(name, "x-ms-") && len(v) > 0 {
+			values[name] = v[0]
+		}
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = k + ":" + values[k]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// canonicalizedResource returns the canonicalized resource of a request.
+// full selects the SharedKey format, which lists every query parameter;
+// the other schemes only include comp.
+func canonicalizedResource(req *request, full bool) string {
+	resource := "/" + req.account.name + req.URL.EscapedPath()
+	params, _ := url.ParseQuery(req.URL.RawQuery)
+	if !full {
+		if v, ok := params["comp"]; ok {
+			resource += "?comp=" + v[0]
+		}
+		return resource
+	}
+	if len(params) == 0 {
+		return resource
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := params[k]
+		sort.Strings(values)
+		resource += "\n" + k + ":" + strings.Join(values, ",")
+	}
+	return resource
+}
+
+func computeHmac256(key []byte, message string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(message))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// checkSAS verifies the shared access signature in the query of a request
+// and records what it grants.
+func (e *Emulator) checkSAS(req *request) *serviceError {
+	q := req.URL.Query()
+	fail := newError(http.StatusForbidden, "AuthenticationFailed", "Server failed to authenticate the request. Make sure the value of the signature is formed correctly.")
+
+	var (
+		grant      *sasGrant
+		candidates []string
+		start      = q.Get("st")
+		expiry     = q.Get("se")
+		version    = q.Get("sv")
+	)
+	if q.Get("ss") != "" {
+		grant = &sasGrant{
+			account:       true,
+			services:      q.Get("ss"),
+			resourceTypes: q.Get("srt"),
+			permissions:   q.Get("sp"),
+		}
+		candidates = []string{strings.Join([]string{
+			req.account.name, q.Get("sp"), q.Get("ss"), q.Get("srt"), start, expiry, q.Get("sip"), q.Get("spr"), version, "",
+		}, "\n")}
+	} else {
+		var resources []string
+		segs := req.segments(2)
+		grant = &sasGrant{resource: q.Get("sr")}
+		if len(segs) > 0 {
+			grant.container = segs[0]
+		}
+		switch req.service {
+		case blobService:
+			switch grant.resource {
+			case "c":
+				resources = []string{"/" + req.account.name + "/" + grant.container}
+			case "b":
+				if len(segs) < 2 {
+					return fail
+				}
+				grant.blob = segs[1]
+				resources = []string{"/" + req.account.name + "/" + grant.container + "/" + grant.blob}
+			default:
+				return fail
+			}
+		case queueService:
+			// The storage package leaves the account out of the resource
+			// for the development account.
+			grant.resource = "q"
+			resources = []string{"/" + req.account.name + "/" + grant.container, "/" + grant.container}
+		case tableService:
+			if q.Get("spk") != "" || q.Get("srk") != "" || q.Get("epk") != "" || q.Get("erk") != "" {
+				return newError(http.StatusForbidden, "AuthenticationFailed", "Table SAS tokens limited to key ranges are not supported by the emulator.")
+			}
+			grant.resource = "t"
+			grant.container = q.Get("tn")
+			if grant.container == "" {
+				return fail
+			}
+			resources = []string{"/" + req.account.name + "/" + strings.ToLower(grant.container)}
+		default:
+			return newError(http.StatusForbidden, "AuthenticationFailed", "Service SAS tokens are not supported by the %s service of the emulator.", req.service)
+		}
+
+		permissions := q.Get("sp")
+		if id := q.Get("si"); id != "" {
+			policy, ok := req.account.storedPolicy(req.service, grant.container, id)
+			if !ok {
+				return newError(http.StatusForbidden, "AuthenticationFailed", "Signed identifier %s does not exist.", id)
+			}
+			if start == "" {
+				start = policy.Start
+			}
+			if expiry == "" {
+				expiry = policy.Expiry
+			}
+			if permissions == "" {
+				permissions = policy.Permission
+			}
+		}
+		grant.permissions = permissions
+
+		for _, resource := range resources {
+			candidates = append(candidates, serviceSASStringToSign(req.service, q, resource))
+		}
+	}
+
+	sig := q.Get("sig")
+	valid := false
+	for _, s := range candidates {
+		if hmac.Equal([]byte(computeHmac256(req.account.key, s)), []byte(sig)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fail
+	}
+
+	now := e.now()
+	notAfter, err := parseSASTime(expiry)
+	if err != nil || now.After(notAfter) {
+		return newError(http.StatusForbidden, "AuthenticationFailed", "Signed expiry time [%s] has to be after the current time.", expiry)
+	}
+	if start != "" {
+		notBefore, err := parseSASTime(start)
+		if err != nil || now.Before(notBefore) {
+			return newError(http.StatusForbidden, "AuthenticationFailed", "Signed start time [%s] has to be before the current time.", start)
+		}
+	}
+	if q.Get("spr") == "https" && req.scheme() != "https" {
+		return newError(http.StatusForbidden, "AuthorizationProtocolMismatch", "This request is not authorized to perform this operation using this protocol.")
+	}
+	if sip := q.Get("sip"); sip != "" && !ipAllowed(sip, req.RemoteAddr) {
+		return newError(http.StatusForbidden, "AuthorizationSourceIPMismatch", "This request is not authorized to perform this operation using this source IP %s.", req.RemoteAddr)
+	}
+
+	req.sas = grant
+	return nil
+}
+
+func serviceSASStringToSign(service string, q url.Values, resource string) string {
+	version := q.Get("sv")
+	if version >= "2015-02-21" {
+		resource = "/" + service + resource
+	}
+	fields := []string{q.Get("sp"), q.Get("st"), q.Get("se"), resource, q.Get("si")}
+	if version >= "2015-04-05" {
+		fields = append(fields, q.Get("sip"), q.Get("spr"))
+	}
+	fields = append(fields, version)
+	switch service {
+	case blobService:
+		fields = append(fields, q.Get("rscc"), q.Get("rscd"), q.Get("rsce"), q.Get("rscl"), q.Get("rsct"))
+	case tableService:
+		fields = append(fields, q.Get("spk"), q.Get("srk"), q.Get("epk"), q.Get("erk"))
+	}
+	return strings.Join(fields, "\n")
+}
+
+// parseSASTime parses the start and expiry of a SAS, which are either ISO
+// 8601 timestamps or plain dates.
+func parseSASTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// ipAllowed reports whether the address of the client is within sip, a
+// single address or a range.
+func ipAllowed(sip, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host).To4()
+	bounds := strings.SplitN(sip, "-", 2)
+	low := net.ParseIP(bounds[0]).To4()
+	high := low
+	if len(bounds) == 2 {
+		high = net.ParseIP(bounds[1]).To4()
+	}
+	if ip == nil || low == nil || high == nil {
+		return false
+	}
+	return string(ip) >= string(low) && string(ip) <= string(high)
+}
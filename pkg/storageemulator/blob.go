@@ -0,0 +1,639 @@
+package storageemulator
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// snapshotFormat is the format of snapshot timestamps on the wire.
+const snapshotFormat = "2006-01-02T15:04:05.0000000Z"
+
+type blobProps struct {
+	contentType        string
+	contentEncoding    string
+	contentLanguage    string
+	contentMD5         string
+	cacheControl       string
+	contentDisposition string
+}
+
+// blob is a blob or, when snapshot is set, one of its snapshots.
+type blob struct {
+	name         string
+	blobType     storage.BlobType
+	snapshot     time.Time
+	props        blobProps
+	metadata     map[string]string
+	lastModified time.Time
+	etag         string
+
+	// data is the content of block and append blobs.
+	data []byte
+	// committed is the committed block list of a block blob.
+	committed []block
+	// appendCount is the number of blocks appended to an append blob.
+	appendCount int
+
+	// size, pages and sequenceNumber describe page blobs. Every page
+	// write is stamped with the next writeSeq so snapshots can be diffed.
+	size           int64
+	pages          map[int64]page
+	sequenceNumber int64
+	writeSeq       int64
+
+	copy            *copyState
+	incrementalCopy bool
+
+	// lease and snapshots are only used on base blobs.
+	lease     lease
+	snapshots []*blob
+}
+
+type block struct {
+	id   string
+	data []byte
+}
+
+func (b *blob) length() int64 {
+	if b.blobType == storage.BlobTypePage {
+		return b.size
+	}
+	return int64(len(b.data))
+}
+
+// content returns the bytes of the blob.
+func (b *blob) content() []byte {
+	if b.blobType != storage.BlobTypePage {
+		return b.data
+	}
+	out := make([]byte, b.size)
+	for i, p := range b.pages {
+		copy(out[i*pageSize:], p.data)
+	}
+	return out
+}
+
+// clone returns a copy of the content, properties and metadata of the blob.
+func (b *blob) clone() *blob {
+	c := *b
+	c.metadata = copyMetadata(b.metadata)
+	c.committed = append([]block(nil), b.committed...)
+	c.data = append([]byte(nil), b.data...)
+	if b.pages != nil {
+		c.pages = make(map[int64]page, len(b.pages))
+		for i, p := range b.pages {
+			c.pages[i] = p
+		}
+	}
+	c.lease = lease{}
+	c.snapshots = nil
+	if b.copy != nil {
+		cs := *b.copy
+		c.copy = &cs
+	}
+	return &c
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func propsFromHeaders(h http.Header) blobProps {
+	return blobProps{
+		contentType:        h.Get("x-ms-blob-content-type"),
+		contentEncoding:    h.Get("x-ms-blob-content-encoding"),
+		contentLanguage:    h.Get("x-ms-blob-content-language"),
+		contentMD5:         h.Get("x-ms-blob-content-md5"),
+		cacheControl:       h.Get("x-ms-blob-cache-control"),
+		contentDisposition: h.Get("x-ms-blob-content-disposition"),
+	}
+}
+
+func (e *Emulator) touch(b *blob) {
+	b.lastModified = e.timeNow()
+	b.etag = e.newETag()
+}
+
+func (e *Emulator) serveBlobObject(w http.ResponseWriter, req *request, cname, name string, q url.Values) *serviceError {
+	c, ok := req.account.containers[cname]
+	if !ok {
+		if req.anonymous {
+			return newError(http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+		}
+		return newError(http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+	}
+
+	comp := q.Get("comp")
+	switch req.Method {
+	case http.MethodPut:
+		switch comp {
+		case "":
+			if req.Header.Get("x-ms-copy-source") != "" {
+				return e.copyBlob(w, req, c, name)
+			}
+			return e.putBlob(w, req, c, name)
+		case "block":
+			return e.putBlock(w, req, c, name, q)
+		case "blocklist":
+			return e.putBlockList(w, req, c, name)
+		case "appendblock":
+			return e.appendBlock(w, req, c, name)
+		case "page":
+			return e.putPage(w, req, c, name)
+		case "properties":
+			return e.setBlobProperties(w, req, c, name)
+		case "metadata":
+			return e.setBlobMetadata(w, req, c, name)
+		case "snapshot":
+			return e.snapshotBlob(w, req, c, name)
+		case "lease":
+			return e.leaseBlob(w, req, c, name)
+		case "copy":
+			return e.abortCopy(w, req, c, name, q)
+		case "incrementalcopy":
+			return e.incrementalCopyBlob(w, req, c, name)
+		}
+	case http.MethodGet, http.MethodHead:
+		switch comp {
+		case "":
+			return e.getBlob(w, req, c, name, q)
+		case "metadata":
+			return e.getBlobMetadata(w, req, c, name, q)
+		case "blocklist":
+			return e.getBlockList(w, req, c, name, q)
+		case "pagelist":
+			return e.getPageRanges(w, req, c, name, q)
+		}
+	case http.MethodDelete:
+		if comp == "" {
+			return e.deleteBlob(w, req, c, name, q)
+		}
+	}
+	return unsupported(req)
+}
+
+// findBlob returns a blob and the version of it addressed by the snapshot
+// parameter of the request, which is the blob itself if there is none.
+func (e *Emulator) findBlob(c *container, name string, q url.Values) (*blob, *blob, *serviceError) {
+	b, ok := c.blobs[name]
+	if !ok {
+		return nil, nil, newError(http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+	}
+	e.refresh(b)
+	v := q.Get("snapshot")
+	if v == "" {
+		return b, b, nil
+	}
+	t, err := parseSnapshot(v)
+	if err != nil {
+		return nil, nil, newError(http.StatusBadRequest, "InvalidQueryParameterValue", "Value for one of the query parameters specified in the request URI is invalid: snapshot=%s.", v)
+	}
+	if s := b.findSnapshot(t); s != nil {
+		return b, s, nil
+	}
+	return nil, nil, newError(http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+}
+
+func (b *blob) findSnapshot(t time.Time) *blob {
+	for _, s := range b.snapshots {
+		if s.snapshot.Equal(t) {
+			return s
+		}
+	}
+	return nil
+}
+
+func parseSnapshot(v string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, http.TimeFormat} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Parse(snapshotFormat, v)
+}
+
+func formatSnapshot(t time.Time) string {
+	return t.UTC().Format(snapshotFormat)
+}
+
+// authorizeWrite authorizes writing a blob, which needs the create
+// permission for new blobs and the write permission otherwise.
+func (e *Emulator) authorizeWrite(req *request, c *container, name string, exists bool) *serviceError {
+	err := e.authorize(req, access{resourceType: 'o', permission: 'w', container: c.name, blob: name})
+	if err != nil && !exists {
+		if e.authorize(req, access{resourceType: 'o', permission: 'c', container: c.name, blob: name}) == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// checkWrite checks the conditional and lease headers of a write to an
+// existing blob.
+func checkWrite(req *request, b *blob) *serviceError {
+	if err := checkConditions(req.Request, b.etag, b.lastModified, false); err != nil {
+		return err
+	}
+	return b.lease.checkWrite(req.Header.Get("x-ms-lease-id"))
+}
+
+// checkWriteNew checks the conditional headers of a write that creates a
+// blob.
+func checkWriteNew(req *request) *serviceError {
+	if req.Header.Get("If-Match") != "" {
+		return newError(http.StatusPreconditionFailed, "ConditionNotMet", "The condition specified using HTTP conditional header(s) is not met.")
+	}
+	if req.Header.Get("x-ms-lease-id") != "" {
+		return newError(http.StatusPreconditionFailed, "LeaseNotPresentWithBlobOperation", "There is currently no lease on the blob.")
+	}
+	return nil
+}
+
+func (e *Emulator) putBlob(w http.ResponseWriter, req *request, c *container, name string) *serviceError {
+	old, exists := c.blobs[name]
+	if err := e.authorizeWrite(req, c, name, exists); err != nil {
+		return err
+	}
+	if exists {
+		e.refresh(old)
+		if err := checkWrite(req, old); err != nil {
+			return err
+		}
+	} else if err := checkWriteNew(req); err != nil {
+		return err
+	}
+
+	b := &blob{
+		name:     name,
+		blobType: storage.BlobType(req.Header.Get("x-ms-blob-type")),
+		props:    propsFromHeaders(req.Header),
+		metadata: metadataFromHeaders(req.Header),
+	}
+	switch b.blobType {
+	case storage.BlobTypeBlock:
+		if err := checkContentMD5(req); err != nil {
+			return err
+		}
+		b.data = req.body
+		if b.props.contentMD5 == "" {
+			sum := md5.Sum(req.body)
+			b.props.contentMD5 = base64.StdEncoding.EncodeToString(sum[:])
+		}
+	case storage.BlobTypePage:
+		size, err := parsePageBlobSize(req.Header.Get("x-ms-blob-content-length"))
+		if err != nil {
+			return err
+		}
+		if len(req.body) > 0 {
+			return newError(http.StatusBadRequest, "InvalidHeaderValue", "The request body of Put Blob must be empty for page blobs.")
+		}
+		b.size = size
+		b.pages = map[int64]page{}
+		if v := req.Header.Get("x-ms-blob-sequence-number"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for x-ms-blob-sequence-number is invalid.")
+			}
+			b.sequenceNumber = n
+		}
+	case storage.BlobTypeAppend:
+		if len(req.body) > 0 {
+			return newError(http.StatusBadRequest, "InvalidHeaderValue", "The request body of Put Blob must be empty for append blobs.")
+		}
+	default:
+		return newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for x-ms-blob-type is invalid: %q.", b.blobType)
+	}
+
+	if exists {
+		b.lease = old.lease
+		b.snapshots = old.snapshots
+	}
+	e.touch(b)
+	c.blobs[name] = b
+	delete(c.blocks, name)
+
+	writeBlobWriteHeaders(w, b)
+	if b.blobType == storage.BlobTypeBlock {
+		w.Header().Set("Content-MD5", b.props.contentMD5)
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// checkContentMD5 verifies the transactional MD5 of a request body.
+func checkContentMD5(req *request) *serviceError {
+	v := req.Header.Get("Content-MD5")
+	if v == "" {
+		return nil
+	}
+	sum := md5.Sum(req.body)
+	if base64.StdEncoding.EncodeToString(sum[:]) != v {
+		return newError(http.StatusBadRequest, "Md5Mismatch", "The MD5 value specified in the request did not match with the MD5 value calculated by the server.")
+	}
+	return nil
+}
+
+func writeBlobWriteHeaders(w http.ResponseWriter, b *blob) {
+	w.Header().Set("ETag", b.etag)
+	w.Header().Set("Last-Modified", b.lastModified.Format(http.TimeFormat))
+	if b.blobType == storage.BlobTypePage {
+		w.Header().Set("x-ms-blob-sequence-number", strconv.FormatInt(b.sequenceNumber, 10))
+	}
+}
+
+// writeBlobHeaders writes the properties of version v of blob b.
+func writeBlobHeaders(w http.ResponseWriter, b, v *blob) {
+	h := w.Header()
+	h.Set("ETag", v.etag)
+	h.Set("Last-Modified", v.lastModified.Format(http.TimeFormat))
+	h.Set("x-ms-blob-type", string(v.blobType))
+	h.Set("Accept-Ranges", "bytes")
+	contentType := v.props.contentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h.Set("Content-Type", contentType)
+	for k, value := range map[string]string{
+		"Content-Encoding":    v.props.contentEncoding,
+		"Content-Language":    v.props.contentLanguage,
+		"Content-MD5":         v.props.contentMD5,
+		"Cache-Control":       v.props.cacheControl,
+		"Content-Disposition": v.props.contentDisposition,
+	} {
+		if value != "" {
+			h.Set(k, value)
+		}
+	}
+	switch v.blobType {
+	case storage.BlobTypePage:
+		h.Set("x-ms-blob-sequence-number", strconv.FormatInt(v.sequenceNumber, 10))
+	case storage.BlobTypeAppend:
+		h.Set("x-ms-blob-committed-block-count", strconv.Itoa(v.appendCount))
+	}
+	if v.incrementalCopy {
+		h.Set("x-ms-incremental-copy", "true")
+	}
+	if v == b {
+		status, state, duration := b.lease.describe()
+		h.Set("x-ms-lease-status", status)
+		h.Set("x-ms-lease-state", state)
+		if duration != "" {
+			h.Set("x-ms-lease-duration", duration)
+		}
+	}
+	if cs := v.copy; cs != nil {
+		h.Set("x-ms-copy-id", cs.id)
+		h.Set("x-ms-copy-status", cs.status)
+		h.Set("x-ms-copy-source", cs.source)
+		h.Set("x-ms-copy-progress", cs.progress())
+		if cs.description != "" {
+			h.Set("x-ms-copy-status-description", cs.description)
+		}
+		if !cs.completed.IsZero() {
+			h.Set("x-ms-copy-completion-time", cs.completed.Format(http.TimeFormat))
+		}
+	}
+	writeMetadataHeaders(w, v.metadata)
+}
+
+func (e *Emulator) getBlob(w http.ResponseWriter, req *request, c *container, name string, q url.Values) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'r', container: c.name, blob: name}); err != nil {
+		return err
+	}
+	b, v, err := e.findBlob(c, name, q)
+	if err != nil {
+		return err
+	}
+	if err := checkConditions(req.Request, v.etag, v.lastModified, true); err != nil {
+		return err
+	}
+	if err := b.lease.checkRead(req.Header.Get("x-ms-lease-id")); err != nil {
+		return err
+	}
+
+	writeBlobHeaders(w, b, v)
+	size := v.length()
+	if req.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	content := v.content()
+	rangeHeader := req.Header.Get("x-ms-range")
+	if rangeHeader == "" {
+		rangeHeader = req.Header.Get("Range")
+	}
+	if rangeHeader == "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		w.Write(content)
+		return nil
+	}
+
+	start, end, rerr := parseRange(rangeHeader, size)
+	if rerr != nil {
+		return rerr
+	}
+	part := content[start : end+1]
+	if req.Header.Get("x-ms-range-get-content-md5") == "true" {
+		sum := md5.Sum(part)
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	} else {
+		w.Header().Del("Content-MD5")
+		if v.props.contentMD5 != "" {
+			w.Header().Set("x-ms-blob-content-md5", v.props.contentMD5)
+		}
+	}
+	w.Header().Set("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+"/"+strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Length", strconv.Itoa(len(part)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(part)
+	return nil
+}
+
+func (e *Emulator) getBlobMetadata(w http.ResponseWriter, req *request, c *container, name string, q url.Values) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'r', container: c.name, blob: name}); err != nil {
+		return err
+	}
+	b, v, err := e.findBlob(c, name, q)
+	if err != nil {
+		return err
+	}
+	if err := checkConditions(req.Request, v.etag, v.lastModified, true); err != nil {
+		return err
+	}
+	if err := b.lease.checkRead(req.Header.Get("x-ms-lease-id")); err != nil {
+		return err
+	}
+	w.Header().Set("ETag", v.etag)
+	w.Header().Set("Last-Modified", v.lastModified.Format(http.TimeFormat))
+	writeMetadataHeaders(w, v.metadata)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (e *Emulator) setBlobMetadata(w http.ResponseWriter, req *request, c *container, name string) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'w', container: c.name, blob: name}); err != nil {
+		return err
+	}
+	b, _, err := e.findBlob(c, name, nil)
+	if err != nil {
+		return err
+	}
+	if err := checkWrite(req, b); err != nil {
+		return err
+	}
+	b.metadata = metadataFromHeaders(req.Header)
+	e.touch(b)
+	writeBlobWriteHeaders(w, b)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (e *Emulator) setBlobProperties(w http.ResponseWriter, req *request, c *container, name string) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'w', container: c.name, blob: name}); err != nil {
+		return err
+	}
+	b, _, err := e.findBlob(c, name, nil)
+	if err != nil {
+		return err
+	}
+	if err := checkWrite(req, b); err != nil {
+		return err
+	}
+
+	if b.blobType == storage.BlobTypePage {
+		if v := req.Header.Get("x-ms-blob-content-length"); v != "" {
+			size, err := parsePageBlobSize(v)
+			if err != nil {
+				return err
+			}
+			b.resize(size)
+		}
+		if action := req.Header.Get("x-ms-sequence-number-action"); action != "" {
+			if err := b.updateSequenceNumber(action, req.Header.Get("x-ms-blob-sequence-number")); err != nil {
+				return err
+			}
+		}
+	}
+	b.props = propsFromHeaders(req.Header)
+	e.touch(b)
+	writeBlobWriteHeaders(w, b)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (e *Emulator) snapshotBlob(w http.ResponseWriter, req *request, c *container, name string) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'w', container: c.name, blob: name}); err != nil {
+		return err
+	}
+	b, _, err := e.findBlob(c, name, nil)
+	if err != nil {
+		return err
+	}
+	if err := checkConditions(req.Request, b.etag, b.lastModified, false); err != nil {
+		return err
+	}
+	if err := b.lease.checkRead(req.Header.Get("x-ms-lease-id")); err != nil {
+		return err
+	}
+
+	s := e.takeSnapshot(b)
+	if hasMetadataHeaders(req.Header) {
+		s.metadata = metadataFromHeaders(req.Header)
+	}
+	w.Header().Set("x-ms-snapshot", formatSnapshot(s.snapshot))
+	w.Header().Set("ETag", s.etag)
+	w.Header().Set("Last-Modified", s.lastModified.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// takeSnapshot adds a snapshot of the current state of b. Snapshot times
+// have the one second precision the storage package formats them with, and
+// are kept unique by moving a snapshot taken within the same second as the
+// previous one to the next second.
+func (e *Emulator) takeSnapshot(b *blob) *blob {
+	t := e.timeNow()
+	if n := len(b.snapshots); n > 0 && !t.After(b.snapshots[n-1].snapshot) {
+		t = b.snapshots[n-1].snapshot.Add(time.Second)
+	}
+	s := b.clone()
+	s.snapshot = t
+	b.snapshots = append(b.snapshots, s)
+	return s
+}
+
+func (e *Emulator) deleteBlob(w http.ResponseWriter, req *request, c *container, name string, q url.Values) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'd', container: c.name, blob: name}); err != nil {
+		return err
+	}
+	b, v, err := e.findBlob(c, name, q)
+	if err != nil {
+		return err
+	}
+
+	if v != b {
+		for i, s := range b.snapshots {
+			if s == v {
+				b.snapshots = append(b.snapshots[:i], b.snapshots[i+1:]...)
+				break
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+
+	if err := checkWrite(req, b); err != nil {
+		return err
+	}
+	switch req.Header.Get("x-ms-delete-snapshots") {
+	case "only":
+		b.snapshots = nil
+	case "include":
+		delete(c.blobs, name)
+	case "":
+		if len(b.snapshots) > 0 {
+			return newError(http.StatusConflict, "SnapshotsPresent", "This operation is not permitted because the blob has snapshots.")
+		}
+		delete(c.blobs, name)
+	default:
+		return newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for x-ms-delete-snapshots is invalid.")
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// parseRange parses a bytes=start-end range of a blob of the given size.
+func parseRange(v string, size int64) (int64, int64, *serviceError) {
+	invalid := newError(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The range specified is invalid for the current size of the resource.")
+	var start, end int64
+	if n, _ := fmt.Sscanf(v, "bytes=%d-%d", &start, &end); n == 2 {
+		if start > end || start >= size {
+			return 0, 0, invalid
+		}
+		if end >= size {
+			end = size - 1
+		}
+		return start, end, nil
+	}
+	if n, _ := fmt.Sscanf(v, "bytes=%d-", &start); n == 1 {
+		if start >= size {
+			return 0, 0, invalid
+		}
+		return start, size - 1, nil
+	}
+	return 0, 0, newError(http.StatusBadRequest, "InvalidHeaderValue", "The range %q is invalid.", v)
+}
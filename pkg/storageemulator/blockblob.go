@@ -0,0 +1,243 @@
+package storageemulator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+const (
+	maxBlockIDLength      = 64
+	maxUncommittedBlocks  = 100000
+	maxAppendBlocks       = 50000
+	maxCommittedBlockList = 50000
+)
+
+func (e *Emulator) putBlock(w http.ResponseWriter, req *request, c *container, name string, q url.Values) *serviceError {
+	b, exists := c.blobs[name]
+	if err := e.authorizeWrite(req, c, name, exists); err != nil {
+		return err
+	}
+	if exists {
+		e.refresh(b)
+		if b.blobType != storage.BlobTypeBlock {
+			return newError(http.StatusConflict, "InvalidBlobType", "The blob type is invalid for this operation.")
+		}
+		if err := b.lease.checkWrite(req.Header.Get("x-ms-lease-id")); err != nil {
+			return err
+		}
+	}
+
+	id := q.Get("blockid")
+	if raw, err := base64.StdEncoding.DecodeString(id); err != nil || len(raw) == 0 || len(raw) > maxBlockIDLength {
+		return newError(http.StatusBadRequest, "InvalidQueryParameterValue", "Value for one of the query parameters specified in the request URI is invalid: blockid=%s.", id)
+	}
+	if err := checkContentMD5(req); err != nil {
+		return err
+	}
+
+	blocks := c.blocks[name]
+	if blocks == nil {
+		blocks = map[string][]byte{}
+		c.blocks[name] = blocks
+	}
+	if _, ok := blocks[id]; !ok && len(blocks) >= maxUncommittedBlocks {
+		return newError(http.StatusConflict, "BlockCountExceedsLimit", "The uncommitted block count cannot exceed the maximum limit of %d blocks.", maxUncommittedBlocks)
+	}
+	blocks[id] = req.body
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (e *Emulator) putBlockList(w http.ResponseWriter, req *request, c *container, name string) *serviceError {
+	old, exists := c.blobs[name]
+	if err := e.authorizeWrite(req, c, name, exists); err != nil {
+		return err
+	}
+	if exists {
+		e.refresh(old)
+		if old.blobType != storage.BlobTypeBlock {
+			return newError(http.StatusConflict, "InvalidBlobType", "The blob type is invalid for this operation.")
+		}
+		if err := checkWrite(req, old); err != nil {
+			return err
+		}
+	} else if err := checkWriteNew(req); err != nil {
+		return err
+	}
+
+	committed := map[string][]byte{}
+	if exists {
+		for _, blk := range old.committed {
+			committed[blk.id] = blk.data
+		}
+	}
+	pending := c.blocks[name]
+
+	invalid := newError(http.StatusBadRequest, "InvalidBlockList", "The specified block list is invalid.")
+	var list []block
+	var data []byte
+	dec := xml.NewDecoder(bytes.NewReader(req.body))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return newError(http.StatusBadRequest, "InvalidXmlDocument", "XML specified is not syntactically valid: %v", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local == "BlockList" {
+			continue
+		}
+		var id string
+		if err := dec.DecodeElement(&id, &start); err != nil {
+			return newError(http.StatusBadRequest, "InvalidXmlDocument", "XML specified is not syntactically valid: %v", err)
+		}
+
+		var content []byte
+		var found bool
+		switch start.Name.Local {
+		case string(storage.BlockStatusCommitted):
+			content, found = committed[id]
+		case string(storage.BlockStatusUncommitted):
+			content, found = pending[id]
+		case string(storage.BlockStatusLatest):
+			if content, found = pending[id]; !found {
+				content, found = committed[id]
+			}
+		}
+		if !found {
+			return invalid
+		}
+		list = append(list, block{id: id, data: content})
+		data = append(data, content...)
+	}
+	if len(list) > maxCommittedBlockList {
+		return invalid
+	}
+
+	b := &blob{
+		name:      name,
+		blobType:  storage.BlobTypeBlock,
+		props:     propsFromHeaders(req.Header),
+		metadata:  metadataFromHeaders(req.Header),
+		data:      data,
+		committed: list,
+	}
+	if exists {
+		b.lease = old.lease
+		b.snapshots = old.snapshots
+	}
+	e.touch(b)
+	c.blobs[name] = b
+	delete(c.blocks, name)
+
+	writeBlobWriteHeaders(w, b)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+type blockListXML struct {
+	XMLName           xml.Name   `xml:"BlockList"`
+	CommittedBlocks   []blockXML `xml:"CommittedBlocks>Block"`
+	UncommittedBlocks []blockXML `xml:"UncommittedBlocks>Block"`
+}
+
+type blockXML struct {
+	Name string `xml:"Name"`
+	Size int64  `xml:"Size"`
+}
+
+func (e *Emulator) getBlockList(w http.ResponseWriter, req *request, c *container, name string, q url.Values) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'r', container: c.name, blob: name}); err != nil {
+		return err
+	}
+	listType := storage.BlockListType(q.Get("blocklisttype"))
+	if listType == "" {
+		listType = storage.BlockListTypeCommitted
+	}
+
+	var out blockListXML
+	b, v, err := e.findBlob(c, name, q)
+	switch {
+	case err == nil:
+		if b.blobType != storage.BlobTypeBlock {
+			return newError(http.StatusConflict, "InvalidBlobType", "The blob type is invalid for this operation.")
+		}
+		if lerr := b.lease.checkRead(req.Header.Get("x-ms-lease-id")); lerr != nil {
+			return lerr
+		}
+		w.Header().Set("ETag", v.etag)
+		w.Header().Set("Last-Modified", v.lastModified.Format(http.TimeFormat))
+		w.Header().Set("x-ms-blob-content-length", strconv.FormatInt(v.length(), 10))
+		if listType != storage.BlockListTypeUncommitted {
+			for _, blk := range v.committed {
+				out.CommittedBlocks = append(out.CommittedBlocks, blockXML{Name: blk.id, Size: int64(len(blk.data))})
+			}
+		}
+	case c.blocks[name] == nil || q.Get("snapshot") != "":
+		return err
+	}
+
+	if listType != storage.BlockListTypeCommitted && q.Get("snapshot") == "" {
+		for id, data := range c.blocks[name] {
+			out.UncommittedBlocks = append(out.UncommittedBlocks, blockXML{Name: id, Size: int64(len(data))})
+		}
+	}
+	writeXML(w, http.StatusOK, out)
+	return nil
+}
+
+func (e *Emulator) appendBlock(w http.ResponseWriter, req *request, c *container, name string) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'w', container: c.name, blob: name}); err != nil {
+		if e.authorize(req, access{resourceType: 'o', permission: 'a', container: c.name, blob: name}) != nil {
+			return err
+		}
+	}
+	b, _, err := e.findBlob(c, name, nil)
+	if err != nil {
+		return err
+	}
+	if b.blobType != storage.BlobTypeAppend {
+		return newError(http.StatusConflict, "InvalidBlobType", "The blob type is invalid for this operation.")
+	}
+	if err := checkWrite(req, b); err != nil {
+		return err
+	}
+	if err := checkContentMD5(req); err != nil {
+		return err
+	}
+
+	length := int64(len(b.data))
+	if v := req.Header.Get("x-ms-blob-condition-maxsize"); v != "" {
+		max, perr := strconv.ParseInt(v, 10, 64)
+		if perr != nil || length+int64(len(req.body)) > max {
+			return newError(http.StatusPreconditionFailed, "MaxBlobSizeConditionNotMet", "The max blob size condition specified was not met.")
+		}
+	}
+	if v := req.Header.Get("x-ms-blob-condition-appendpos"); v != "" {
+		pos, perr := strconv.ParseInt(v, 10, 64)
+		if perr != nil || pos != length {
+			return newError(http.StatusPreconditionFailed, "AppendPositionConditionNotMet", "The append position condition specified was not met.")
+		}
+	}
+	if b.appendCount >= maxAppendBlocks {
+		return newError(http.StatusConflict, "BlockCountExceedsLimit", "The committed block count cannot exceed the maximum limit of %d blocks.", maxAppendBlocks)
+	}
+
+	b.data = append(b.data, req.body...)
+	b.appendCount++
+	e.touch(b)
+	writeBlobWriteHeaders(w, b)
+	w.Header().Set("x-ms-blob-append-offset", strconv.FormatInt(length, 10))
+	w.Header().Set("x-ms-blob-committed-block-count", strconv.Itoa(b.appendCount))
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
@@ -0,0 +1,655 @@
+package storageemulator
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// maxResults is the default and maximum page size of list operations.
+const maxResults = 5000
+
+type container struct {
+	name         string
+	metadata     map[string]string
+	lastModified time.Time
+	etag         string
+	publicAccess storage.ContainerAccessType
+	policies     []signedIdentifier
+
+	blobs map[string]*blob
+	// blocks holds the uncommitted blocks of each blob.
+	blocks map[string]map[string][]byte
+}
+
+// signedIdentifier is a stored access policy of a container or queue.
+type signedIdentifier struct {
+	ID           string       `xml:"Id"`
+	AccessPolicy accessPolicy `xml:"AccessPolicy"`
+}
+
+type accessPolicy struct {
+	Start      string `xml:"Start,omitempty"`
+	Expiry     string `xml:"Expiry,omitempty"`
+	Permission string `xml:"Permission,omitempty"`
+}
+
+type signedIdentifiers struct {
+	XMLName           xml.Name           `xml:"SignedIdentifiers"`
+	SignedIdentifiers []signedIdentifier `xml:"SignedIdentifier"`
+}
+
+// maxSignedIdentifiers is the number of stored access policies a container
+// or queue can have.
+const maxSignedIdentifiers = 5
+
+// allowsAnonymous reports whether the public access level of the container
+// allows an operation without credentials.
+func (c *container) allowsAnonymous(a access) bool {
+	switch c.publicAccess {
+	case storage.ContainerAccessTypeContainer:
+		return a.permission == 'r' || a.permission == 'l'
+	case storage.ContainerAccessTypeBlob:
+		return a.resourceType == 'o' && a.permission == 'r'
+	}
+	return false
+}
+
+// storedPolicy returns the stored access policy id of a container, queue or
+// table.
+func (acct *account) storedPolicy(service, name, id string) (accessPolicy, bool) {
+	var policies []signedIdentifier
+	switch service {
+	case blobService:
+		if c, ok := acct.containers[name]; ok {
+			policies = c.policies
+		}
+	case queueService:
+		if q, ok := acct.queues[name]; ok {
+			policies = q.policies
+		}
+	case tableService:
+		if t, ok := acct.findTable(name); ok {
+			policies = t.policies
+		}
+	}
+	for _, p := range policies {
+		if p.ID == id {
+			return p.AccessPolicy, true
+		}
+	}
+	return accessPolicy{}, false
+}
+
+func (e *Emulator) serveBlob(w http.ResponseWriter, req *request) *serviceError {
+	q := req.URL.Query()
+	segs := req.segments(2)
+	switch len(segs) {
+	case 0:
+		return e.serveBlobService(w, req, q)
+	case 1:
+		return e.serveContainer(w, req, segs[0], q)
+	}
+	return e.serveBlobObject(w, req, segs[0], segs[1], q)
+}
+
+func (e *Emulator) serveBlobService(w http.ResponseWriter, req *request, q url.Values) *serviceError {
+	switch {
+	case q.Get("comp") == "list" && req.Method == http.MethodGet:
+		if err := e.authorize(req, access{resourceType: 's', permission: 'l'}); err != nil {
+			return err
+		}
+		return e.listContainers(w, req, q)
+	case q.Get("restype") == "service" && q.Get("comp") == "properties":
+		return e.serveServiceProperties(w, req, &req.account.blobProperties)
+	}
+	return unsupported(req)
+}
+
+// serveServiceProperties gets or sets the properties of a service, which the
+// emulator stores without interpreting them.
+func (e *Emulator) serveServiceProperties(w http.ResponseWriter, req *request, props *[]byte) *serviceError {
+	switch req.Method {
+	case http.MethodGet:
+		if err := e.authorize(req, access{resourceType: 's', permission: 'r'}); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusOK)
+		if *props == nil {
+			w.Write([]byte(xml.Header + "<StorageServiceProperties></StorageServiceProperties>"))
+			return nil
+		}
+		w.Write(*props)
+		return nil
+	case http.MethodPut:
+		if err := e.authorize(req, access{resourceType: 's', permission: 'w'}); err != nil {
+			return err
+		}
+		var check struct {
+			XMLName xml.Name `xml:"StorageServiceProperties"`
+		}
+		if err := xml.Unmarshal(req.body, &check); err != nil {
+			return newError(http.StatusBadRequest, "InvalidXmlDocument", "XML specified is not syntactically valid: %v", err)
+		}
+		*props = req.body
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+	return unsupported(req)
+}
+
+type containerListXML struct {
+	XMLName         xml.Name       `xml:"EnumerationResults"`
+	ServiceEndpoint string         `xml:"ServiceEndpoint,attr"`
+	Prefix          string         `xml:"Prefix,omitempty"`
+	Marker          string         `xml:"Marker,omitempty"`
+	MaxResults      int            `xml:"MaxResults,omitempty"`
+	Containers      []containerXML `xml:"Containers>Container"`
+	NextMarker      string         `xml:"NextMarker"`
+}
+
+type containerXML struct {
+	Name       string                 `xml:"Name"`
+	Properties containerPropertiesXML `xml:"Properties"`
+}
+
+type containerPropertiesXML struct {
+	LastModified string `xml:"Last-Modified"`
+	Etag         string `xml:"Etag"`
+	LeaseStatus  string `xml:"LeaseStatus"`
+	LeaseState   string `xml:"LeaseState"`
+	PublicAccess string `xml:"PublicAccess,omitempty"`
+}
+
+func (e *Emulator) listContainers(w http.ResponseWriter, req *request, q url.Values) *serviceError {
+	prefix, marker := q.Get("prefix"), q.Get("marker")
+	limit, err := parseMaxResults(q)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(req.account.containers))
+	for name := range req.account.containers {
+		if strings.HasPrefix(name, prefix) && name >= marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := containerListXML{
+		ServiceEndpoint: req.scheme() + "://" + req.Host + "/",
+		Prefix:          prefix,
+		Marker:          marker,
+		MaxResults:      limit,
+	}
+	if len(names) > limit {
+		out.NextMarker = names[limit]
+		names = names[:limit]
+	}
+	for _, name := range names {
+		c := req.account.containers[name]
+		out.Containers = append(out.Containers, containerXML{
+			Name: name,
+			Properties: containerPropertiesXML{
+				LastModified: c.lastModified.Format(http.TimeFormat),
+				Etag:         c.etag,
+				LeaseStatus:  "unlocked",
+				LeaseState:   "available",
+				PublicAccess: string(c.publicAccess),
+			},
+		})
+	}
+	writeXML(w, http.StatusOK, out)
+	return nil
+}
+
+func (e *Emulator) serveContainer(w http.ResponseWriter, req *request, name string, q url.Values) *serviceError {
+	if q.Get("restype") != "container" {
+		return unsupported(req)
+	}
+	comp := q.Get("comp")
+	c, exists := req.account.containers[name]
+
+	if req.Method == http.MethodPut && comp == "" {
+		if err := e.authorize(req, access{resourceType: 'c', permission: 'c', container: name}); err != nil {
+			return err
+		}
+		if exists {
+			return newError(http.StatusConflict, "ContainerAlreadyExists", "The specified container already exists.")
+		}
+		if !validContainerName(name) {
+			return newError(http.StatusBadRequest, "InvalidResourceName", "The specified resource name contains invalid characters.")
+		}
+		c = &container{
+			name:         name,
+			metadata:     metadataFromHeaders(req.Header),
+			lastModified: e.timeNow(),
+			etag:         e.newETag(),
+			publicAccess: storage.ContainerAccessType(req.Header.Get("x-ms-blob-public-access")),
+			blobs:        map[string]*blob{},
+			blocks:       map[string]map[string][]byte{},
+		}
+		req.account.containers[name] = c
+		writeContainerHeaders(w, c)
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+
+	if !exists {
+		// Anonymous requests cannot tell missing containers from private ones.
+		if req.anonymous {
+			return newError(http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+		}
+		return newError(http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+	}
+
+	switch {
+	case comp == "list" && req.Method == http.MethodGet:
+		if err := e.authorize(req, access{resourceType: 'c', permission: 'l', container: name}); err != nil {
+			return err
+		}
+		return e.listBlobs(w, req, c, q)
+
+	case comp == "" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		if err := e.authorize(req, access{resourceType: 'c', permission: 'r', container: name}); err != nil {
+			return err
+		}
+		writeContainerHeaders(w, c)
+		writeMetadataHeaders(w, c.metadata)
+		w.WriteHeader(http.StatusOK)
+		return nil
+
+	case comp == "" && req.Method == http.MethodDelete:
+		if err := e.authorize(req, access{resourceType: 'c', permission: 'd', container: name}); err != nil {
+			return err
+		}
+		if err := checkConditions(req.Request, c.etag, c.lastModified, false); err != nil {
+			return err
+		}
+		delete(req.account.containers, name)
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+
+	case comp == "metadata":
+		return e.serveContainerMetadata(w, req, c)
+
+	case comp == "acl":
+		return e.serveContainerACL(w, req, c)
+	}
+	return unsupported(req)
+}
+
+func (e *Emulator) serveContainerMetadata(w http.ResponseWriter, req *request, c *container) *serviceError {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		if err := e.authorize(req, access{resourceType: 'c', permission: 'r', container: c.name}); err != nil {
+			return err
+		}
+		writeContainerHeaders(w, c)
+		writeMetadataHeaders(w, c.metadata)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case http.MethodPut:
+		if err := e.authorize(req, access{resourceType: 'c', permission: 'w', container: c.name}); err != nil {
+			return err
+		}
+		if err := checkConditions(req.Request, c.etag, c.lastModified, false); err != nil {
+			return err
+		}
+		c.metadata = metadataFromHeaders(req.Header)
+		e.touchContainer(c)
+		writeContainerHeaders(w, c)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	return unsupported(req)
+}
+
+func (e *Emulator) serveContainerACL(w http.ResponseWriter, req *request, c *container) *serviceError {
+	// Access policies can only be read and changed with the account key.
+	if req.sas != nil || req.anonymous {
+		return newError(http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		writeContainerHeaders(w, c)
+		if c.publicAccess != "" {
+			w.Header().Set("x-ms-blob-public-access", string(c.publicAccess))
+		}
+		writeXML(w, http.StatusOK, signedIdentifiers{SignedIdentifiers: c.policies})
+		return nil
+	case http.MethodPut:
+		policies, err := parseSignedIdentifiers(req.body)
+		if err != nil {
+			return err
+		}
+		c.policies = policies
+		c.publicAccess = storage.ContainerAccessType(req.Header.Get("x-ms-blob-public-access"))
+		e.touchContainer(c)
+		writeContainerHeaders(w, c)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	return unsupported(req)
+}
+
+func parseSignedIdentifiers(body []byte) ([]signedIdentifier, *serviceError) {
+	if len(body) == 0 {
+		return nil, nil
+	}
+	var in signedIdentifiers
+	if err := xml.Unmarshal(body, &in); err != nil {
+		return nil, newError(http.StatusBadRequest, "InvalidXmlDocument", "XML specified is not syntactically valid: %v", err)
+	}
+	if len(in.SignedIdentifiers) > maxSignedIdentifiers {
+		return nil, newError(http.StatusBadRequest, "InvalidXmlDocument", "At most %d signed identifiers are allowed.", maxSignedIdentifiers)
+	}
+	return in.SignedIdentifiers, nil
+}
+
+func (e *Emulator) touchContainer(c *container) {
+	c.lastModified = e.timeNow()
+	c.etag = e.newETag()
+}
+
+func writeContainerHeaders(w http.ResponseWriter, c *container) {
+	h := w.Header()
+	h.Set("ETag", c.etag)
+	h.Set("Last-Modified", c.lastModified.Format(http.TimeFormat))
+	h.Set("x-ms-lease-status", "unlocked")
+	h.Set("x-ms-lease-state", "available")
+	if c.publicAccess != "" {
+		h.Set("x-ms-blob-public-access", string(c.publicAccess))
+	}
+}
+
+type blobListXML struct {
+	XMLName         xml.Name `xml:"EnumerationResults"`
+	ServiceEndpoint string   `xml:"ServiceEndpoint,attr"`
+	ContainerName   string   `xml:"ContainerName,attr"`
+	Prefix          string   `xml:"Prefix,omitempty"`
+	Marker          string   `xml:"Marker,omitempty"`
+	MaxResults      int      `xml:"MaxResults,omitempty"`
+	Delimiter       string   `xml:"Delimiter,omitempty"`
+	Blobs           blobsXML `xml:"Blobs"`
+	NextMarker      string   `xml:"NextMarker"`
+}
+
+type blobsXML struct {
+	Blob       []blobXML       `xml:"Blob"`
+	BlobPrefix []blobPrefixXML `xml:"BlobPrefix"`
+}
+
+type blobPrefixXML struct {
+	Name string `xml:"Name"`
+}
+
+type blobXML struct {
+	Name       string               `xml:"Name"`
+	Snapshot   string               `xml:"Snapshot,omitempty"`
+	Properties blobPropertiesXML    `xml:"Properties"`
+	Metadata   storage.BlobMetadata `xml:"Metadata,omitempty"`
+}
+
+type blobPropertiesXML struct {
+	LastModified          string `xml:"Last-Modified"`
+	Etag                  string `xml:"Etag"`
+	ContentLength         int64  `xml:"Content-Length"`
+	ContentType           string `xml:"Content-Type"`
+	ContentEncoding       string `xml:"Content-Encoding"`
+	ContentLanguage       string `xml:"Content-Language"`
+	ContentMD5            string `xml:"Content-MD5"`
+	CacheControl          string `xml:"Cache-Control"`
+	ContentDisposition    string `xml:"Content-Disposition"`
+	SequenceNumber        *int64 `xml:"x-ms-blob-sequence-number,omitempty"`
+	BlobType              string `xml:"BlobType"`
+	LeaseStatus           string `xml:"LeaseStatus,omitempty"`
+	LeaseState            string `xml:"LeaseState,omitempty"`
+	LeaseDuration         string `xml:"LeaseDuration,omitempty"`
+	CopyID                string `xml:"CopyId,omitempty"`
+	CopyStatus            string `xml:"CopyStatus,omitempty"`
+	CopySource            string `xml:"CopySource,omitempty"`
+	CopyProgress          string `xml:"CopyProgress,omitempty"`
+	CopyCompletionTime    string `xml:"CopyCompletionTime,omitempty"`
+	CopyStatusDescription string `xml:"CopyStatusDescription,omitempty"`
+	IncrementalCopy       bool   `xml:"IncrementalCopy,omitempty"`
+}
+
+func (e *Emulator) listBlobs(w http.ResponseWriter, req *request, c *container, q url.Values) *serviceError {
+	prefix, delimiter, marker := q.Get("prefix"), q.Get("delimiter"), q.Get("marker")
+	limit, err := parseMaxResults(q)
+	if err != nil {
+		return err
+	}
+	include := map[string]bool{}
+	for _, v := range strings.Split(q.Get("include"), ",") {
+		include[v] = true
+	}
+
+	names := make([]string, 0, len(c.blobs))
+	for name := range c.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	if include["uncommittedblobs"] {
+		for name := range c.blocks {
+			if _, ok := c.blobs[name]; !ok && strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	out := blobListXML{
+		ServiceEndpoint: req.scheme() + "://" + req.Host + "/",
+		ContainerName:   c.name,
+		Prefix:          prefix,
+		Marker:          marker,
+		MaxResults:      limit,
+		Delimiter:       delimiter,
+	}
+	count := 0
+	lastPrefix := ""
+	for _, name := range names {
+		// Blobs under a common prefix are reported once, as that prefix.
+		entry := name
+		isPrefix := false
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				entry = name[:len(prefix)+i+len(delimiter)]
+				isPrefix = true
+			}
+		}
+		if entry < marker || (isPrefix && entry == lastPrefix) {
+			continue
+		}
+		if count == limit {
+			out.NextMarker = entry
+			break
+		}
+		count++
+		if isPrefix {
+			lastPrefix = entry
+			out.Blobs.BlobPrefix = append(out.Blobs.BlobPrefix, blobPrefixXML{Name: entry})
+			continue
+		}
+
+		b, ok := c.blobs[name]
+		if !ok {
+			out.Blobs.Blob = append(out.Blobs.Blob, blobXML{
+				Name:       name,
+				Properties: blobPropertiesXML{BlobType: string(storage.BlobTypeBlock)},
+			})
+			continue
+		}
+		e.refresh(b)
+		if include["snapshots"] {
+			for _, s := range b.snapshots {
+				out.Blobs.Blob = append(out.Blobs.Blob, b.listEntry(s, include))
+			}
+		}
+		out.Blobs.Blob = append(out.Blobs.Blob, b.listEntry(b, include))
+	}
+	writeXML(w, http.StatusOK, out)
+	return nil
+}
+
+// listEntry describes version v of the blob, either the blob itself or one
+// of its snapshots, in a List Blobs response.
+func (b *blob) listEntry(v *blob, include map[string]bool) blobXML {
+	entry := blobXML{
+		Name: b.name,
+		Properties: blobPropertiesXML{
+			LastModified:       v.lastModified.Format(http.TimeFormat),
+			Etag:               v.etag,
+			ContentLength:      v.length(),
+			ContentType:        v.props.contentType,
+			ContentEncoding:    v.props.contentEncoding,
+			ContentLanguage:    v.props.contentLanguage,
+			ContentMD5:         v.props.contentMD5,
+			CacheControl:       v.props.cacheControl,
+			ContentDisposition: v.props.contentDisposition,
+			BlobType:           string(v.blobType),
+			IncrementalCopy:    v.incrementalCopy,
+		},
+	}
+	if !v.snapshot.IsZero() {
+		entry.Snapshot = formatSnapshot(v.snapshot)
+	} else {
+		entry.Properties.LeaseStatus, entry.Properties.LeaseState, entry.Properties.LeaseDuration = b.lease.describe()
+	}
+	if v.blobType == storage.BlobTypePage {
+		seq := v.sequenceNumber
+		entry.Properties.SequenceNumber = &seq
+	}
+	if include["copy"] && v.copy != nil {
+		entry.Properties.CopyID = v.copy.id
+		entry.Properties.CopyStatus = v.copy.status
+		entry.Properties.CopySource = v.copy.source
+		entry.Properties.CopyProgress = v.copy.progress()
+		entry.Properties.CopyStatusDescription = v.copy.description
+		if !v.copy.completed.IsZero() {
+			entry.Properties.CopyCompletionTime = v.copy.completed.Format(http.TimeFormat)
+		}
+	}
+	if include["metadata"] && len(v.metadata) > 0 {
+		entry.Metadata = storage.BlobMetadata(v.metadata)
+	}
+	return entry
+}
+
+func parseMaxResults(q url.Values) (int, *serviceError) {
+	v := q.Get("maxresults")
+	if v == "" {
+		return maxResults, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, newError(http.StatusBadRequest, "OutOfRangeQueryParameterValue", "maxresults must be a positive integer, got %q.", v)
+	}
+	if n > maxResults {
+		n = maxResults
+	}
+	return n, nil
+}
+
+// validContainerName reports whether name follows the container naming
+// rules: 3-63 lowercase letters, digits and single dashes, or $root.
+func validContainerName(name string) bool {
+	if name == "$root" || name == "$logs" {
+		return true
+	}
+	if len(name) < 3 || len(name) > 63 || strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") || strings.Contains(name, "--") {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func metadataFromHeaders(h http.Header) map[string]string {
+	metadata := map[string]string{}
+	for k, v := range h {
+		k = strings.ToLower(k)
+		if len(v) > 0 && strings.HasPrefix(k, "x-ms-meta-") {
+			metadata[strings.TrimPrefix(k, "x-ms-meta-")] = v[len(v)-1]
+		}
+	}
+	return metadata
+}
+
+func hasMetadataHeaders(h http.Header) bool {
+	for k := range h {
+		if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+			return true
+		}
+	}
+	return false
+}
+
+func writeMetadataHeaders(w http.ResponseWriter, metadata map[string]string) {
+	for k, v := range metadata {
+		// Keep the case of the name; metadata names may contain
+		// underscores, which header canonicalization would leave alone
+		// anyway.
+		w.Header()["x-ms-meta-"+k] = []string{v}
+	}
+}
+
+// checkConditions evaluates the conditional headers of a request against a
+// resource. For reads an If-None-Match or If-Modified-Since failure is
+// reported as 304 Not Modified, as the service does.
+func checkConditions(r *http.Request, etag string, lastModified time.Time, read bool) *serviceError {
+	failed := newError(http.StatusPreconditionFailed, "ConditionNotMet", "The condition specified using HTTP conditional header(s) is not met.")
+	notModified := failed
+	if read {
+		notModified = &serviceError{status: http.StatusNotModified, code: "ConditionNotMet"}
+	}
+
+	if v := r.Header.Get("If-Match"); v != "" && v != "*" && !etagListContains(v, etag) {
+		return failed
+	}
+	if v := r.Header.Get("If-None-Match"); v != "" {
+		if v == "*" && etag != "" {
+			return failed
+		}
+		if etagListContains(v, etag) {
+			return notModified
+		}
+	}
+	if v := r.Header.Get("If-Modified-Since"); v != "" {
+		if t, err := http.ParseTime(v); err == nil && !lastModified.After(t) {
+			return notModified
+		}
+	}
+	if v := r.Header.Get("If-Unmodified-Since"); v != "" {
+		if t, err := http.ParseTime(v); err == nil && lastModified.After(t) {
+			return failed
+		}
+	}
+	return nil
+}
+
+func etagListContains(list, etag string) bool {
+	for _, v := range strings.Split(list, ",") {
+		if strings.TrimSpace(v) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func unsupported(req *request) *serviceError {
+	return newError(http.StatusBadRequest, "UnsupportedHttpVerb", "The emulator does not support %s %s?%s.", req.Method, req.path, req.URL.RawQuery)
+}
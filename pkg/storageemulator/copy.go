@@ -0,0 +1,322 @@
+package storageemulator
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// Copy states of a blob.
+const (
+	copyPending = "pending"
+	copySuccess = "success"
+	copyAborted = "aborted"
+)
+
+// copyState is the state of the last copy into a blob.
+type copyState struct {
+	id          string
+	source      string
+	status      string
+	description string
+	copied      int64
+	total       int64
+	started     time.Time
+	completes   time.Time
+	completed   time.Time
+
+	// pending is the content the destination gets when a pending copy
+	// completes.
+	pending *blob
+}
+
+func (cs *copyState) progress() string {
+	return strconv.FormatInt(cs.copied, 10) + "/" + strconv.FormatInt(cs.total, 10)
+}
+
+// refresh applies the changes that happened to b with time: lease expiry
+// and completion of pending copies.
+func (e *Emulator) refresh(b *blob) {
+	now := e.now()
+	b.lease.update(now)
+
+	cs := b.copy
+	if cs == nil || cs.status != copyPending {
+		return
+	}
+	if now.Before(cs.completes) {
+		elapsed := now.Sub(cs.started)
+		cs.copied = int64(float64(cs.total) * float64(elapsed) / float64(cs.completes.Sub(cs.started)))
+		return
+	}
+	b.setContent(cs.pending)
+	cs.status = copySuccess
+	cs.copied = cs.total
+	cs.completed = cs.completes.UTC().Truncate(time.Second)
+	cs.pending = nil
+	e.touch(b)
+}
+
+// setContent replaces the content of b with the content of src.
+func (b *blob) setContent(src *blob) {
+	b.blobType = src.blobType
+	b.data = src.data
+	b.committed = src.committed
+	b.appendCount = src.appendCount
+	b.size = src.size
+	b.pages = src.pages
+	b.sequenceNumber = src.sequenceNumber
+	b.writeSeq = src.writeSeq
+}
+
+// clearContent empties b, which is what an aborted copy leaves behind.
+func (b *blob) clearContent() {
+	b.data = nil
+	b.committed = nil
+	b.appendCount = 0
+	b.size = 0
+	if b.blobType == storage.BlobTypePage {
+		b.pages = map[int64]page{}
+	}
+}
+
+// conditionsWithPrefix returns a request carrying the conditional headers
+// that have the given prefix, e.g. x-ms-source-, under their plain names.
+func conditionsWithPrefix(h http.Header, prefixes ...string) *http.Request {
+	out := http.Header{}
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		for _, prefix := range prefixes {
+			if v := h.Get(prefix + name); v != "" {
+				out.Set(name, v)
+			}
+		}
+	}
+	return &http.Request{Header: out}
+}
+
+func (e *Emulator) copyBlob(w http.ResponseWriter, req *request, c *container, name string) *serviceError {
+	old, exists := c.blobs[name]
+	if err := e.authorizeWrite(req, c, name, exists); err != nil {
+		return err
+	}
+	if exists {
+		e.refresh(old)
+		if err := checkConditions(conditionsWithPrefix(req.Header, "", "x-ms-"), old.etag, old.lastModified, false); err != nil {
+			return err
+		}
+		if err := old.lease.checkWrite(req.Header.Get("x-ms-lease-id")); err != nil {
+			return err
+		}
+		if old.copy != nil && old.copy.status == copyPending {
+			return newError(http.StatusConflict, "PendingCopyOperation", "There is currently a pending copy operation.")
+		}
+	} else if err := checkWriteNew(req); err != nil {
+		return err
+	}
+
+	sourceURL := req.Header.Get("x-ms-copy-source")
+	src, serr := e.copySource(req, sourceURL)
+	if serr != nil {
+		return serr
+	}
+
+	b := src.clone()
+	b.name = name
+	b.snapshot = time.Time{}
+	b.incrementalCopy = false
+	if hasMetadataHeaders(req.Header) {
+		b.metadata = metadataFromHeaders(req.Header)
+	}
+	if exists {
+		b.lease = old.lease
+		b.snapshots = old.snapshots
+	}
+
+	now := e.now()
+	cs := &copyState{
+		id:      newLeaseID(),
+		source:  sourceURL,
+		status:  copySuccess,
+		total:   src.length(),
+		copied:  src.length(),
+		started: now,
+	}
+	if e.CopyDuration > 0 {
+		cs.status = copyPending
+		cs.copied = 0
+		cs.completes = now.Add(e.CopyDuration)
+		cs.pending = src.clone()
+		b.clearContent()
+	} else {
+		cs.completed = now.UTC().Truncate(time.Second)
+	}
+	b.copy = cs
+	e.touch(b)
+	c.blobs[name] = b
+	delete(c.blocks, name)
+
+	w.Header().Set("ETag", b.etag)
+	w.Header().Set("Last-Modified", b.lastModified.Format(http.TimeFormat))
+	w.Header().Set("x-ms-copy-id", cs.id)
+	w.Header().Set("x-ms-copy-status", cs.status)
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// copySource resolves the source URL of a copy to the blob version it
+// names, checking that the request may read it: sources in the same account
+// are readable with the account key, others need a SAS or public access.
+func (e *Emulator) copySource(req *request, sourceURL string) (*blob, *serviceError) {
+	cannotVerify := newError(http.StatusForbidden, "CannotVerifyCopySource", "Server failed to authenticate the copy source %s.", sourceURL)
+	notFound := newError(http.StatusNotFound, "CannotVerifyCopySource", "The specified copy source %s does not exist.", sourceURL)
+
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for x-ms-copy-source is invalid: %v", err)
+	}
+	src, serr := e.locate(u.Host, u.Path)
+	if serr != nil || src.service != blobService {
+		return nil, notFound
+	}
+	src.Request = &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Header:     http.Header{forwardedProtoHeader: {u.Scheme}},
+		RemoteAddr: req.RemoteAddr,
+	}
+	segs := src.segments(2)
+	if len(segs) != 2 {
+		return nil, notFound
+	}
+	a := access{resourceType: 'o', permission: 'r', container: segs[0], blob: segs[1]}
+
+	q := u.Query()
+	switch {
+	case q.Get("sig") != "":
+		if err := e.checkSAS(src); err != nil {
+			return nil, cannotVerify
+		}
+	case src.account == req.account && req.sas == nil && !req.anonymous:
+	default:
+		src.anonymous = true
+	}
+	if err := e.authorize(src, a); err != nil {
+		if err.status == http.StatusNotFound {
+			return nil, notFound
+		}
+		return nil, cannotVerify
+	}
+
+	c, ok := src.account.containers[segs[0]]
+	if !ok {
+		return nil, notFound
+	}
+	b, v, ferr := e.findBlob(c, segs[1], q)
+	if ferr != nil {
+		return nil, notFound
+	}
+	if err := checkConditions(conditionsWithPrefix(req.Header, "x-ms-source-"), v.etag, v.lastModified, false); err != nil {
+		err.code = "SourceConditionNotMet"
+		return nil, err
+	}
+	if id := req.Header.Get("x-ms-source-lease-id"); id != "" && (!b.lease.active() || b.lease.id != id) {
+		return nil, newError(http.StatusPreconditionFailed, "SourceLeaseIdMismatch", "The source lease ID specified did not match the lease ID for the source blob.")
+	}
+	return v, nil
+}
+
+func (e *Emulator) abortCopy(w http.ResponseWriter, req *request, c *container, name string, q url.Values) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'w', container: c.name, blob: name}); err != nil {
+		return err
+	}
+	if req.Header.Get("x-ms-copy-action") != "abort" {
+		return newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for x-ms-copy-action is invalid.")
+	}
+	b, _, err := e.findBlob(c, name, nil)
+	if err != nil {
+		return err
+	}
+	if err := b.lease.checkWrite(req.Header.Get("x-ms-lease-id")); err != nil {
+		return err
+	}
+	if b.copy == nil || b.copy.status != copyPending {
+		return newError(http.StatusConflict, "NoPendingCopyOperation", "There is currently no pending copy operation.")
+	}
+	if b.copy.id != q.Get("copyid") {
+		return newError(http.StatusConflict, "CopyIdMismatch", "The specified copy ID did not match the copy ID for the pending copy operation.")
+	}
+
+	b.copy.status = copyAborted
+	b.copy.description = "Copy aborted"
+	b.copy.completed = e.timeNow()
+	b.copy.pending = nil
+	b.clearContent()
+	e.touch(b)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (e *Emulator) incrementalCopyBlob(w http.ResponseWriter, req *request, c *container, name string) *serviceError {
+	old, exists := c.blobs[name]
+	if err := e.authorizeWrite(req, c, name, exists); err != nil {
+		return err
+	}
+	if exists {
+		e.refresh(old)
+		if !old.incrementalCopy {
+			return newError(http.StatusConflict, "InvalidBlobType", "The destination of an incremental copy must be an incremental copy blob.")
+		}
+		if err := checkConditions(conditionsWithPrefix(req.Header, "x-ms-"), old.etag, old.lastModified, false); err != nil {
+			return err
+		}
+	}
+
+	sourceURL := req.Header.Get("x-ms-copy-source")
+	u, perr := url.Parse(sourceURL)
+	if perr != nil || u.Query().Get("snapshot") == "" {
+		return newError(http.StatusBadRequest, "InvalidSourceBlobUrl", "The source of an incremental copy must be a snapshot URL.")
+	}
+	// Incremental copies always need a SAS or a public source.
+	probe := *req
+	probe.sas, probe.anonymous = nil, true
+	src, serr := e.copySource(&probe, sourceURL)
+	if serr != nil {
+		return serr
+	}
+	if src.blobType != storage.BlobTypePage {
+		return newError(http.StatusConflict, "InvalidBlobType", "The source of an incremental copy must be a page blob.")
+	}
+
+	b := src.clone()
+	b.name = name
+	b.snapshot = time.Time{}
+	b.incrementalCopy = true
+	now := e.now()
+	b.copy = &copyState{
+		id:        newLeaseID(),
+		source:    sourceURL,
+		status:    copySuccess,
+		total:     src.length(),
+		copied:    src.length(),
+		started:   now,
+		completed: now.UTC().Truncate(time.Second),
+	}
+	if exists {
+		b.lease = old.lease
+		b.snapshots = old.snapshots
+	}
+	e.touch(b)
+	c.blobs[name] = b
+	s := e.takeSnapshot(b)
+
+	w.Header().Set("ETag", b.etag)
+	w.Header().Set("Last-Modified", b.lastModified.Format(http.TimeFormat))
+	w.Header().Set("x-ms-copy-id", b.copy.id)
+	w.Header().Set("x-ms-copy-status", b.copy.status)
+	w.Header().Set("x-ms-copy-destination-snapshot", formatSnapshot(s.snapshot))
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
@@ -0,0 +1,415 @@
+// Package storageemulator runs an in-process emulator of the blob, queue and
+// table services, so code built on the vendored storage package can be
+// tested without a network or an external emulator.
+//
+// The emulator implements the subset of the REST APIs that the storage
+// package calls: containers, block, page and append blobs, leases, snapshots
+// and copies on the blob service; queues and messages on the queue service;
+// tables, entities and entity group transactions on the table service.
+// Requests are checked against SharedKey, SharedKeyLite and SAS signatures
+// the same way the real services check them, so a wrong key or an expired
+// SAS fails the way it would in Azure.
+//
+// Clients reach the emulator through its Transport, which redirects the
+// requests the storage package sends to the usual endpoints
+// (127.0.0.1:10000-10002 for the development account and
+// <account>.<service>.<EndpointSuffix> for others) to the test server:
+//
+//	e := storageemulator.New()
+//	defer e.Close()
+//	client, err := e.NewClient(storage.StorageEmulatorAccountName)
+//	blobs := client.GetBlobService()
+package storageemulator
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+const (
+	// EndpointSuffix is the endpoint suffix of clients returned by NewClient
+	// for accounts other than the development account.
+	EndpointSuffix = "storage.emulator"
+
+	// EmulatorAccountKey is the well known key of the development account.
+	EmulatorAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+	blobService  = "blob"
+	queueService = "queue"
+	tableService = "table"
+
+	// Ports the storage package uses for the development account.
+	emulatorBlobPort  = "10000"
+	emulatorQueuePort = "10001"
+	emulatorTablePort = "10002"
+)
+
+// Emulator is an in-process storage emulator backed by an httptest.Server.
+// It is safe for concurrent use.
+type Emulator struct {
+	// CopyDuration is how long copies started with Copy Blob stay pending
+	// before they complete. Zero completes them synchronously. It must be
+	// set before the copies it applies to are started.
+	CopyDuration time.Duration
+
+	server *httptest.Server
+
+	mu       sync.Mutex
+	accounts map[string]*account
+	now      func() time.Time
+	// lastEntityTime is the timestamp of the latest entity change.
+	lastEntityTime time.Time
+
+	requestID int64
+	etag      int64
+}
+
+type account struct {
+	name string
+	key  []byte
+
+	containers     map[string]*container
+	queues         map[string]*queue
+	tables         map[string]*table
+	blobProperties []byte
+	queueProps     []byte
+	tableProps     []byte
+}
+
+// New starts an emulator with the development account already registered.
+func New() *Emulator {
+	e := &Emulator{
+		accounts: map[string]*account{},
+		now:      time.Now,
+	}
+	if _, err := e.addAccount(storage.StorageEmulatorAccountName, EmulatorAccountKey); err != nil {
+		panic(err)
+	}
+	e.server = httptest.NewServer(http.HandlerFunc(e.serveHTTP))
+	return e
+}
+
+// Close shuts the emulator down.
+func (e *Emulator) Close() {
+	e.server.Close()
+}
+
+// URL returns the base URL of the underlying test server.
+func (e *Emulator) URL() string {
+	return e.server.URL
+}
+
+// AddAccount registers a storage account with a random key and returns the
+// base64 encoded key.
+func (e *Emulator) AddAccount(name string) (string, error) {
+	raw := make([]byte, 64)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return e.addAccount(name, base64.StdEncoding.EncodeToString(raw))
+}
+
+func (e *Emulator) addAccount(name, key string) (string, error) {
+	if name != storage.StorageEmulatorAccountName && !storage.IsValidStorageAccount(name) {
+		return "", fmt.Errorf("storageemulator: invalid account name %q", name)
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("storageemulator: malformed account key: %v", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.accounts[name]; ok {
+		return "", fmt.Errorf("storageemulator: account %s already exists", name)
+	}
+	e.accounts[name] = &account{
+		name:       name,
+		key:        raw,
+		containers: map[string]*container{},
+		queues:     map[string]*queue{},
+		tables:     map[string]*table{},
+	}
+	return key, nil
+}
+
+// AccountKey returns the base64 encoded key of a registered account.
+func (e *Emulator) AccountKey(name string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	acct, ok := e.accounts[name]
+	if !ok {
+		return "", fmt.Errorf("storageemulator: account %s does not exist", name)
+	}
+	return base64.StdEncoding.EncodeToString(acct.key), nil
+}
+
+// NewClient returns a storage client for a registered account that sends its
+// requests to the emulator.
+func (e *Emulator) NewClient(name string) (storage.Client, error) {
+	key, err := e.AccountKey(name)
+	if err != nil {
+		return storage.Client{}, err
+	}
+	client, err := storage.NewClient(name, key, EndpointSuffix, storage.DefaultAPIVersion, false)
+	if err != nil {
+		return storage.Client{}, err
+	}
+	client.HTTPClient = e.HTTPClient()
+	return client, nil
+}
+
+// HTTPClient returns an http.Client using Transport. It can be assigned to
+// storage.Client.HTTPClient of clients built by other means, such as
+// storage.NewAccountSASClient.
+func (e *Emulator) HTTPClient() *http.Client {
+	return &http.Client{Transport: e.Transport()}
+}
+
+// Transport returns a RoundTripper that sends every request to the emulator,
+// keeping the original host so the emulator can tell accounts and services
+// apart.
+func (e *Emulator) Transport() http.RoundTripper {
+	return roundTripper{emulator: e}
+}
+
+type roundTripper struct {
+	emulator *Emulator
+}
+
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	target := rt.emulator.server.Listener.Addr().String()
+	out := new(http.Request)
+	*out = *req
+	u := *req.URL
+	u.Scheme = "http"
+	u.Host = target
+	out.URL = &u
+	out.Host = req.URL.Host
+	out.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		out.Header[k] = v
+	}
+	out.Header.Set(forwardedProtoHeader, req.URL.Scheme)
+	return http.DefaultTransport.RoundTrip(out)
+}
+
+// forwardedProtoHeader carries the scheme the client used, so SAS tokens
+// restricted to https can be checked even though the test server is http.
+const forwardedProtoHeader = "X-Forwarded-Proto"
+
+// request is an incoming request resolved to an account and service.
+type request struct {
+	*http.Request
+
+	account *account
+	service string
+	// path is the resource path with the account name removed, e.g.
+	// /container/blob.
+	path string
+	body []byte
+
+	// sas is the verified shared access signature of the request, if any.
+	sas *sasGrant
+	// anonymous is set for requests without any credentials.
+	anonymous bool
+}
+
+// serviceError is an error response of the storage services.
+type serviceError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (err *serviceError) Error() string {
+	return fmt.Sprintf("%d %s: %s", err.status, err.code, err.message)
+}
+
+func newError(status int, code, format string, args ...interface{}) *serviceError {
+	return &serviceError{status: status, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Emulator) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("x-ms-request-id", fmt.Sprintf("emulator-%d", atomic.AddInt64(&e.requestID, 1)))
+	if v := r.Header.Get("x-ms-version"); v != "" {
+		w.Header().Set("x-ms-version", v)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, blobService, newError(http.StatusBadRequest, "InvalidInput", "reading body: %v", err))
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	req, serr := e.resolve(r)
+	if serr != nil {
+		writeError(w, r, blobService, serr)
+		return
+	}
+	req.body = body
+	if serr := e.authenticate(req); serr != nil {
+		writeError(w, r, req.service, serr)
+		return
+	}
+
+	switch req.service {
+	case blobService:
+		serr = e.serveBlob(w, req)
+	case queueService:
+		serr = e.serveQueue(w, req)
+	case tableService:
+		serr = e.serveTable(w, req)
+	}
+	if serr != nil {
+		writeError(w, r, req.service, serr)
+	}
+}
+
+// resolve finds the account and service a request is addressed to.
+func (e *Emulator) resolve(r *http.Request) (*request, *serviceError) {
+	req, err := e.locate(r.Host, r.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	req.Request = r
+	return req, nil
+}
+
+// locate resolves a host and path to an account, a service and the path of
+// a resource within the service.
+func (e *Emulator) locate(host, urlPath string) (*request, *serviceError) {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, port = host, ""
+	}
+
+	var name, service, path string
+	switch {
+	case port == emulatorBlobPort || port == emulatorQueuePort || port == emulatorTablePort:
+		// Path style addressing used for the development account.
+		service = map[string]string{
+			emulatorBlobPort:  blobService,
+			emulatorQueuePort: queueService,
+			emulatorTablePort: tableService,
+		}[port]
+		parts := strings.SplitN(strings.TrimPrefix(urlPath, "/"), "/", 2)
+		name = parts[0]
+		path = "/"
+		if len(parts) == 2 {
+			path += parts[1]
+		}
+	default:
+		labels := strings.SplitN(hostname, ".", 3)
+		if len(labels) < 3 {
+			return nil, newError(http.StatusBadRequest, "InvalidUri", "cannot resolve an account from host %q", host)
+		}
+		name, service, path = labels[0], labels[1], urlPath
+		if path == "" {
+			path = "/"
+		}
+	}
+
+	if service != blobService && service != queueService && service != tableService {
+		return nil, newError(http.StatusBadRequest, "InvalidUri", "unsupported service %q", service)
+	}
+	acct, ok := e.accounts[strings.TrimSuffix(name, "-secondary")]
+	if !ok {
+		return nil, newError(http.StatusNotFound, "ResourceNotFound", "account %s does not exist", name)
+	}
+	return &request{account: acct, service: service, path: path}, nil
+}
+
+// segments splits the resource path into at most n parts.
+func (req *request) segments(n int) []string {
+	p := strings.TrimPrefix(req.path, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.SplitN(p, "/", n)
+}
+
+// scheme returns the scheme the client used to send the request.
+func (req *request) scheme() string {
+	if proto := req.Header.Get(forwardedProtoHeader); proto != "" {
+		return proto
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (e *Emulator) newETag() string {
+	return fmt.Sprintf("\"0x%X\"", atomic.AddInt64(&e.etag, 1)+0x8D4A0F2C2A5F000)
+}
+
+// timeNow returns the current time at the one second precision of
+// Last-Modified headers.
+func (e *Emulator) timeNow() time.Time {
+	return e.now().UTC().Truncate(time.Second)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, service string, err *serviceError) {
+	if service == tableService {
+		w.Header().Set("Content-Type", "application/json;odata=minimalmetadata;charset=utf-8")
+		w.WriteHeader(err.status)
+		if r.Method != http.MethodHead {
+			json.NewEncoder(w).Encode(tableErrorBody(err))
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-ms-error-code", err.code)
+	w.WriteHeader(err.status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	writeXMLBody(w, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: err.code, Message: err.message})
+}
+
+func tableErrorBody(err *serviceError) interface{} {
+	type message struct {
+		Lang  string `json:"lang"`
+		Value string `json:"value"`
+	}
+	type odataError struct {
+		Code    string  `json:"code"`
+		Message message `json:"message"`
+	}
+	return map[string]odataError{
+		"odata.error": {Code: err.code, Message: message{Lang: "en-US", Value: err.message}},
+	}
+}
+
+// writeXML writes v as the XML body of a response with the given status.
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	writeXMLBody(w, v)
+}
+
+func writeXMLBody(w http.ResponseWriter, v interface{}) {
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
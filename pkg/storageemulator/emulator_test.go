@@ -0,0 +1,312 @@
+package storageemulator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+func newTestEmulator(t *testing.T) (*Emulator, storage.Client) {
+	e := New()
+	t.Cleanup(e.Close)
+	client, err := e.NewClient(storage.StorageEmulatorAccountName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, client
+}
+
+func newTestContainer(t *testing.T, client storage.Client, name string) *storage.Container {
+	blobs := client.GetBlobService()
+	c := blobs.GetContainerReference(name)
+	if err := c.Create(nil); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// checkServiceError checks that err is a service error with the given
+// status and code.
+func checkServiceError(t *testing.T, what string, err error, status int, code string) {
+	serr, ok := err.(storage.AzureStorageServiceError)
+	if !ok {
+		t.Errorf("%s: got %v (%T), want a %d %s service error", what, err, err, status, code)
+		return
+	}
+	if serr.StatusCode != status || serr.Code != code {
+		t.Errorf("%s: got %d %s, want %d %s", what, serr.StatusCode, serr.Code, status, code)
+	}
+}
+
+func TestSharedKeyRejectsWrongKey(t *testing.T) {
+	e, _ := newTestEmulator(t)
+	key, err := e.AddAccount("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddAccount("other"); err == nil {
+		t.Errorf("adding account other twice succeeded")
+	}
+
+	for _, tt := range []struct {
+		name, account, key string
+	}{
+		{"key of another account", storage.StorageEmulatorAccountName, key},
+		{"key of the development account", "other", EmulatorAccountKey},
+	} {
+		client, err := storage.NewClient(tt.account, tt.key, EndpointSuffix, storage.DefaultAPIVersion, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.HTTPClient = e.HTTPClient()
+
+		blobs := client.GetBlobService()
+		err = blobs.GetContainerReference("data").Create(nil)
+		checkServiceError(t, tt.name+": blob", err, http.StatusForbidden, "AuthenticationFailed")
+
+		queues := client.GetQueueService()
+		err = queues.GetQueueReference("work").Create(nil)
+		checkServiceError(t, tt.name+": queue", err, http.StatusForbidden, "AuthenticationFailed")
+
+		tables := client.GetTableService()
+		err = tables.GetTableReference("state").Create(30, storage.EmptyPayload, nil)
+		checkServiceError(t, tt.name+": table", err, http.StatusForbidden, "AuthenticationFailed")
+	}
+}
+
+func TestSASAuthorization(t *testing.T) {
+	e, client := newTestEmulator(t)
+	c := newTestContainer(t, client, "data")
+	blob := c.GetBlobReference("file")
+	if err := blob.CreateBlockBlobFromReader(strings.NewReader("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sas := func(b *storage.Blob, perms storage.BlobServiceSASPermissions, expiry time.Time) string {
+		uri, err := b.GetSASURI(storage.BlobSASOptions{
+			BlobServiceSASPermissions: perms,
+			SASOptions:                storage.SASOptions{Expiry: expiry},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uri
+	}
+	read := storage.BlobServiceSASPermissions{Read: true}
+	later := time.Now().Add(time.Hour)
+	tampered, _ := url.Parse(sas(blob, read, later))
+	q := tampered.Query()
+	q.Set("sp", "rw")
+	tampered.RawQuery = q.Encode()
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		uri    string
+		status int
+	}{
+		{"read", http.MethodGet, sas(blob, read, later), http.StatusOK},
+		{"write with read permission", http.MethodPut, sas(blob, read, later), http.StatusForbidden},
+		{"expired", http.MethodGet, sas(blob, read, time.Now().Add(-time.Hour)), http.StatusForbidden},
+		{"tampered permissions", http.MethodGet, tampered.String(), http.StatusForbidden},
+		{"other blob", http.MethodGet, strings.Replace(sas(blob, read, later), "/file?", "/other?", 1), http.StatusForbidden},
+		{"anonymous", http.MethodGet, blob.GetURL(), http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(tt.method, tt.uri, bytes.NewReader([]byte("x")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+		resp, err := e.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestTableSASAuthorization(t *testing.T) {
+	e, _ := newTestEmulator(t)
+	key, err := e.AddAccount("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := e.NewClient("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := client.GetTableService()
+	for _, name := range []string{"State", "Other"} {
+		if err := tables.GetTableReference(name).Create(30, storage.EmptyPayload, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ent := tables.GetTableReference("State").GetEntityReference("p", "r")
+	if err := ent.Insert(storage.EmptyPayload, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	accountKey, _ := base64.StdEncoding.DecodeString(key)
+	// sas signs a table service SAS for the State table by hand; the
+	// storage package cannot create one.
+	sas := func(tableName, permissions string, expiry time.Time, extra url.Values) url.Values {
+		q := url.Values{
+			"sv": {storage.DefaultAPIVersion},
+			"tn": {tableName},
+			"sp": {permissions},
+			"se": {expiry.UTC().Format(time.RFC3339)},
+		}
+		for k, v := range extra {
+			q[k] = v
+		}
+		q.Set("sig", computeHmac256(accountKey, serviceSASStringToSign(tableService, q, "/other/"+strings.ToLower(tableName))))
+		return q
+	}
+	later := time.Now().Add(time.Hour)
+	tampered := sas("State", "r", later, nil)
+	tampered.Set("sp", "raud")
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		query  url.Values
+		status int
+	}{
+		{"query", http.MethodGet, "/State()", sas("State", "r", later, nil), http.StatusOK},
+		{"get entity", http.MethodGet, "/State(PartitionKey='p',RowKey='r')", sas("state", "r", later, nil), http.StatusOK},
+		{"delete with read permission", http.MethodDelete, "/State(PartitionKey='p',RowKey='r')", sas("State", "r", later, nil), http.StatusForbidden},
+		{"expired", http.MethodGet, "/State()", sas("State", "r", time.Now().Add(-time.Hour), nil), http.StatusForbidden},
+		{"tampered permissions", http.MethodGet, "/State()", tampered, http.StatusForbidden},
+		{"other table", http.MethodGet, "/Other()", sas("State", "r", later, nil), http.StatusForbidden},
+		{"list tables", http.MethodGet, "/Tables", sas("State", "r", later, nil), http.StatusForbidden},
+		{"key range", http.MethodGet, "/State()", sas("State", "r", later, url.Values{"spk": {"p"}}), http.StatusForbidden},
+	} {
+		req, err := http.NewRequest(tt.method, "http://other.table."+EndpointSuffix+tt.path+"?"+tt.query.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json;odata=nometadata")
+		req.Header.Set("If-Match", "*")
+		resp, err := e.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestPageRanges(t *testing.T) {
+	_, client := newTestEmulator(t)
+	c := newTestContainer(t, client, "disks")
+	blob := c.GetBlobReference("disk.vhd")
+	blob.Properties.ContentLength = 16 * pageSize
+	if err := blob.PutPageBlob(nil); err != nil {
+		t.Fatal(err)
+	}
+	write := func(start, end uint64) error {
+		data := bytes.Repeat([]byte{1}, int(end-start+1))
+		return blob.WriteRange(storage.BlobRange{Start: start, End: end}, bytes.NewReader(data), nil)
+	}
+	ranges := func() []storage.PageRange {
+		resp, err := blob.GetPageRanges(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.PageList
+	}
+
+	if got := ranges(); len(got) != 0 {
+		t.Fatalf("new page blob has ranges %v", got)
+	}
+	for _, r := range [][2]uint64{{0, 511}, {512, 1023}, {4096, 5119}, {4608, 6143}} {
+		if err := write(r[0], r[1]); err != nil {
+			t.Fatalf("writing %v: %v", r, err)
+		}
+	}
+	// Adjacent and overlapping writes merge.
+	want := []storage.PageRange{{Start: 0, End: 1023}, {Start: 4096, End: 6143}}
+	if got := ranges(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ranges %v, want %v", got, want)
+	}
+
+	if err := blob.ClearRange(storage.BlobRange{Start: 4608, End: 5119}, nil); err != nil {
+		t.Fatal(err)
+	}
+	want = []storage.PageRange{{Start: 0, End: 1023}, {Start: 4096, End: 4607}, {Start: 5120, End: 6143}}
+	if got := ranges(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ranges after clearing %v, want %v", got, want)
+	}
+
+	err := write(16*pageSize, 17*pageSize-1)
+	checkServiceError(t, "write past the end", err, http.StatusRequestedRangeNotSatisfiable, "InvalidPageRange")
+}
+
+func TestTableBatchErrorIndex(t *testing.T) {
+	_, client := newTestEmulator(t)
+	tables := client.GetTableService()
+	table := tables.GetTableReference("state")
+	if err := table.Create(30, storage.EmptyPayload, nil); err != nil {
+		t.Fatal(err)
+	}
+	existing := table.GetEntityReference("p", "existing")
+	if err := existing.Insert(storage.EmptyPayload, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		keys  [][2]string
+		index string
+		code  string
+	}{
+		{"conflict", [][2]string{{"p", "a"}, {"p", "b"}, {"p", "existing"}}, "2", "EntityAlreadyExists"},
+		{"partitions", [][2]string{{"p", "a"}, {"q", "b"}}, "1", "CommandsInBatchActOnDifferentPartitions"},
+		{"duplicate row", [][2]string{{"p", "a"}, {"p", "b"}, {"p", "c"}, {"p", "b"}}, "3", "InvalidDuplicateRow"},
+	} {
+		batch := table.NewBatch()
+		for _, key := range tt.keys {
+			batch.InsertEntity(table.GetEntityReference(key[0], key[1]))
+		}
+		err := batch.ExecuteBatch()
+		serr, ok := err.(storage.AzureStorageServiceError)
+		if !ok {
+			t.Errorf("%s: ExecuteBatch() = %v, want a service error", tt.name, err)
+			continue
+		}
+		if serr.Code != tt.code || !strings.HasPrefix(serr.Message, "Element "+tt.index+" ") {
+			t.Errorf("%s: error %s %q, want %s for element %s", tt.name, serr.Code, serr.Message, tt.code, tt.index)
+		}
+
+		// A failed batch leaves no trace.
+		err = table.GetEntityReference("p", "a").Get(30, storage.NoMetadata, nil)
+		checkServiceError(t, tt.name+": entity of the failed batch", err, http.StatusNotFound, "ResourceNotFound")
+	}
+
+	batch := table.NewBatch()
+	batch.InsertEntity(table.GetEntityReference("p", "a"))
+	batch.DeleteEntity(existing, true)
+	if err := batch.ExecuteBatch(); err != nil {
+		t.Fatalf("ExecuteBatch() = %v", err)
+	}
+	result, err := table.QueryEntities(30, storage.NoMetadata, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Entities) != 1 || result.Entities[0].RowKey != "a" {
+		t.Fatalf("table holds %d entities after the batch, want only a", len(result.Entities))
+	}
+}
@@ -0,0 +1,235 @@
+package storageemulator
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Lease states of a blob.
+const (
+	leaseAvailable = "available"
+	leaseLeased    = "leased"
+	leaseExpired   = "expired"
+	leaseBreaking  = "breaking"
+	leaseBroken    = "broken"
+)
+
+// lease is the lease of a blob. The zero value is an available lease.
+type lease struct {
+	id    string
+	state string
+	// duration is the lease duration in seconds, -1 for infinite leases.
+	duration  int
+	expires   time.Time
+	breakEnds time.Time
+}
+
+// update moves the lease along the transitions that happen with time.
+func (l *lease) update(now time.Time) {
+	switch l.state {
+	case leaseLeased:
+		if l.duration > 0 && !now.Before(l.expires) {
+			l.state = leaseExpired
+		}
+	case leaseBreaking:
+		if !now.Before(l.breakEnds) {
+			l.state = leaseBroken
+		}
+	}
+}
+
+// active reports whether the lease locks the blob.
+func (l *lease) active() bool {
+	return l.state == leaseLeased || l.state == leaseBreaking
+}
+
+// describe returns the lease status, state and duration headers of the blob.
+func (l *lease) describe() (string, string, string) {
+	state := l.state
+	if state == "" {
+		state = leaseAvailable
+	}
+	if !l.active() {
+		return "unlocked", state, ""
+	}
+	duration := ""
+	if l.state == leaseLeased {
+		duration = "fixed"
+		if l.duration < 0 {
+			duration = "infinite"
+		}
+	}
+	return "locked", state, duration
+}
+
+// checkWrite checks the lease ID of a request that modifies the blob.
+func (l *lease) checkWrite(id string) *serviceError {
+	if l.active() {
+		if id == "" {
+			return newError(http.StatusPreconditionFailed, "LeaseIdMissing", "There is currently a lease on the blob and no lease ID was specified in the request.")
+		}
+		if id != l.id {
+			return newError(http.StatusPreconditionFailed, "LeaseIdMismatchWithBlobOperation", "The lease ID specified did not match the lease ID for the blob.")
+		}
+		return nil
+	}
+	if id != "" {
+		return newError(http.StatusPreconditionFailed, "LeaseNotPresentWithBlobOperation", "There is currently no lease on the blob.")
+	}
+	return nil
+}
+
+// checkRead checks the lease ID of a request that reads the blob. Reads do
+// not need the lease, but a lease ID that is given must match.
+func (l *lease) checkRead(id string) *serviceError {
+	if id == "" {
+		return nil
+	}
+	return l.checkWrite(id)
+}
+
+func (e *Emulator) leaseBlob(w http.ResponseWriter, req *request, c *container, name string) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'w', container: c.name, blob: name}); err != nil {
+		return err
+	}
+	b, _, err := e.findBlob(c, name, nil)
+	if err != nil {
+		return err
+	}
+	if err := checkConditions(req.Request, b.etag, b.lastModified, false); err != nil {
+		return err
+	}
+
+	l := &b.lease
+	now := e.now()
+	id := req.Header.Get("x-ms-lease-id")
+	proposed := req.Header.Get("x-ms-proposed-lease-id")
+	mismatch := newError(http.StatusConflict, "LeaseIdMismatchWithLeaseOperation", "The lease ID specified did not match the lease ID for the blob.")
+
+	switch action := req.Header.Get("x-ms-lease-action"); action {
+	case "acquire":
+		duration, err := strconv.Atoi(req.Header.Get("x-ms-lease-duration"))
+		if err != nil || (duration != -1 && (duration < 15 || duration > 60)) {
+			return newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for x-ms-lease-duration must be -1 or between 15 and 60.")
+		}
+		if proposed == "" {
+			proposed = newLeaseID()
+		}
+		switch l.state {
+		case leaseBreaking:
+			return newError(http.StatusConflict, "LeaseIsBreakingAndCannotBeAcquired", "There is already a lease present.")
+		case leaseLeased:
+			if l.id != proposed {
+				return newError(http.StatusConflict, "LeaseAlreadyPresent", "There is already a lease present.")
+			}
+		}
+		*l = lease{id: proposed, state: leaseLeased, duration: duration}
+		if duration > 0 {
+			l.expires = now.Add(time.Duration(duration) * time.Second)
+		}
+		w.Header().Set("x-ms-lease-id", l.id)
+		w.WriteHeader(http.StatusCreated)
+		return nil
+
+	case "renew":
+		switch {
+		case l.id != id:
+			return mismatch
+		case l.state == leaseBreaking || l.state == leaseBroken:
+			return newError(http.StatusConflict, "LeaseIsBrokenAndCannotBeRenewed", "The lease ID matched, but the lease has been broken explicitly and cannot be renewed.")
+		case l.state != leaseLeased && l.state != leaseExpired:
+			return mismatch
+		}
+		l.state = leaseLeased
+		if l.duration > 0 {
+			l.expires = now.Add(time.Duration(l.duration) * time.Second)
+		}
+		w.Header().Set("x-ms-lease-id", l.id)
+		w.WriteHeader(http.StatusOK)
+		return nil
+
+	case "change":
+		if proposed == "" {
+			return newError(http.StatusBadRequest, "MissingRequiredHeader", "An HTTP header that's mandatory for this request is not specified: x-ms-proposed-lease-id.")
+		}
+		switch {
+		case l.state == leaseBreaking:
+			return newError(http.StatusConflict, "LeaseIsBreakingAndCannotBeChanged", "The lease ID matched, but the lease is currently in breaking state and cannot be changed.")
+		case l.state != leaseLeased:
+			return newError(http.StatusConflict, "LeaseNotPresentWithLeaseOperation", "There is currently no lease on the blob.")
+		case id != l.id && proposed != l.id:
+			return mismatch
+		}
+		l.id = proposed
+		w.Header().Set("x-ms-lease-id", l.id)
+		w.WriteHeader(http.StatusOK)
+		return nil
+
+	case "release":
+		if l.state == "" || l.state == leaseAvailable {
+			return newError(http.StatusConflict, "LeaseNotPresentWithLeaseOperation", "There is currently no lease on the blob.")
+		}
+		if l.id != id {
+			return mismatch
+		}
+		*l = lease{state: leaseAvailable}
+		w.WriteHeader(http.StatusOK)
+		return nil
+
+	case "break":
+		if l.state == "" || l.state == leaseAvailable {
+			return newError(http.StatusConflict, "LeaseNotPresentWithLeaseOperation", "There is currently no lease on the blob.")
+		}
+		period := -1
+		if v := req.Header.Get("x-ms-lease-break-period"); v != "" {
+			var err error
+			if period, err = strconv.Atoi(v); err != nil || period < 0 || period > 60 {
+				return newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for x-ms-lease-break-period must be between 0 and 60.")
+			}
+		}
+		remaining := 0
+		switch l.state {
+		case leaseLeased:
+			// Without a break period fixed leases run out and infinite
+			// ones break immediately; a period never extends a fixed lease.
+			if l.duration > 0 {
+				remaining = ceilSeconds(l.expires.Sub(now))
+			}
+			if period >= 0 && (l.duration < 0 || period < remaining) {
+				remaining = period
+			}
+		case leaseBreaking:
+			remaining = ceilSeconds(l.breakEnds.Sub(now))
+			if period >= 0 && period < remaining {
+				remaining = period
+			}
+		}
+		if remaining > 0 {
+			l.state = leaseBreaking
+			l.breakEnds = now.Add(time.Duration(remaining) * time.Second)
+		} else {
+			l.state = leaseBroken
+		}
+		w.Header().Set("x-ms-lease-time", strconv.Itoa(remaining))
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+
+	default:
+		return newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for x-ms-lease-action is invalid: %q.", action)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+func newLeaseID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
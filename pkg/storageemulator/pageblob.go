@@ -0,0 +1,264 @@
+package storageemulator
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// pageSize is the alignment of page blob sizes and writes.
+const pageSize = 512
+
+// page is a written page of a page blob. seq identifies the write that
+// last changed it.
+type page struct {
+	data []byte
+	seq  int64
+}
+
+func parsePageBlobSize(v string) (int64, *serviceError) {
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size < 0 || size%pageSize != 0 {
+		return 0, newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for x-ms-blob-content-length must be a multiple of %d, got %q.", pageSize, v)
+	}
+	return size, nil
+}
+
+// resize changes the size of a page blob, dropping the pages beyond it.
+func (b *blob) resize(size int64) {
+	for i := range b.pages {
+		if i*pageSize >= size {
+			delete(b.pages, i)
+		}
+	}
+	b.size = size
+}
+
+func (b *blob) updateSequenceNumber(action, value string) *serviceError {
+	invalid := newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for x-ms-blob-sequence-number is invalid.")
+	if action == string(storage.SequenceNumberActionIncrement) {
+		if value != "" {
+			return invalid
+		}
+		b.sequenceNumber++
+		return nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return invalid
+	}
+	switch storage.SequenceNumberAction(action) {
+	case storage.SequenceNumberActionMax:
+		if n > b.sequenceNumber {
+			b.sequenceNumber = n
+		}
+	case storage.SequenceNumberActionUpdate:
+		b.sequenceNumber = n
+	default:
+		return newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for x-ms-sequence-number-action is invalid: %q.", action)
+	}
+	return nil
+}
+
+// checkSequenceNumber evaluates the sequence number conditions of a page
+// write.
+func checkSequenceNumber(req *request, b *blob) *serviceError {
+	failed := newError(http.StatusPreconditionFailed, "SequenceNumberConditionNotMet", "The sequence number condition specified was not met.")
+	for header, ok := range map[string]func(int64) bool{
+		"x-ms-if-sequence-number-le": func(n int64) bool { return b.sequenceNumber <= n },
+		"x-ms-if-sequence-number-lt": func(n int64) bool { return b.sequenceNumber < n },
+		"x-ms-if-sequence-number-eq": func(n int64) bool { return b.sequenceNumber == n },
+	} {
+		v := req.Header.Get(header)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for %s is invalid.", header)
+		}
+		if !ok(n) {
+			return failed
+		}
+	}
+	return nil
+}
+
+func pageBlobOnly(b *blob) *serviceError {
+	if b.blobType != storage.BlobTypePage {
+		return newError(http.StatusConflict, "InvalidBlobType", "The blob type is invalid for this operation.")
+	}
+	return nil
+}
+
+func (e *Emulator) putPage(w http.ResponseWriter, req *request, c *container, name string) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'w', container: c.name, blob: name}); err != nil {
+		return err
+	}
+	b, _, err := e.findBlob(c, name, nil)
+	if err != nil {
+		return err
+	}
+	if err := pageBlobOnly(b); err != nil {
+		return err
+	}
+	if err := checkWrite(req, b); err != nil {
+		return err
+	}
+	if err := checkSequenceNumber(req, b); err != nil {
+		return err
+	}
+
+	start, end, err := pageRange(req)
+	if err != nil {
+		return err
+	}
+	if end >= b.size {
+		return newError(http.StatusRequestedRangeNotSatisfiable, "InvalidPageRange", "The page range specified is invalid.")
+	}
+
+	switch req.Header.Get("x-ms-page-write") {
+	case "update":
+		if int64(len(req.body)) != end-start+1 {
+			return newError(http.StatusBadRequest, "InvalidHeaderValue", "The length of the body does not match the page range.")
+		}
+		if err := checkContentMD5(req); err != nil {
+			return err
+		}
+		b.writeSeq++
+		for i := start / pageSize; i <= end/pageSize; i++ {
+			offset := i*pageSize - start
+			b.pages[i] = page{
+				data: append([]byte(nil), req.body[offset:offset+pageSize]...),
+				seq:  b.writeSeq,
+			}
+		}
+	case "clear":
+		for i := start / pageSize; i <= end/pageSize; i++ {
+			delete(b.pages, i)
+		}
+	default:
+		return newError(http.StatusBadRequest, "InvalidHeaderValue", "The value for x-ms-page-write is invalid.")
+	}
+
+	e.touch(b)
+	writeBlobWriteHeaders(w, b)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// pageRange returns the page aligned byte range of a Put Page request.
+func pageRange(req *request) (int64, int64, *serviceError) {
+	v := req.Header.Get("x-ms-range")
+	if v == "" {
+		v = req.Header.Get("Range")
+	}
+	var start, end int64
+	if n, _ := fmt.Sscanf(v, "bytes=%d-%d", &start, &end); n != 2 || start > end || start%pageSize != 0 || (end+1)%pageSize != 0 {
+		return 0, 0, newError(http.StatusRequestedRangeNotSatisfiable, "InvalidPageRange", "The page range %q is invalid.", v)
+	}
+	return start, end, nil
+}
+
+type pageListXML struct {
+	XMLName    xml.Name       `xml:"PageList"`
+	PageRange  []pageRangeXML `xml:"PageRange"`
+	ClearRange []pageRangeXML `xml:"ClearRange"`
+}
+
+type pageRangeXML struct {
+	Start int64 `xml:"Start"`
+	End   int64 `xml:"End"`
+}
+
+func (e *Emulator) getPageRanges(w http.ResponseWriter, req *request, c *container, name string, q url.Values) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'r', container: c.name, blob: name}); err != nil {
+		return err
+	}
+	b, v, err := e.findBlob(c, name, q)
+	if err != nil {
+		return err
+	}
+	if err := pageBlobOnly(b); err != nil {
+		return err
+	}
+	if err := checkConditions(req.Request, v.etag, v.lastModified, true); err != nil {
+		return err
+	}
+	if err := b.lease.checkRead(req.Header.Get("x-ms-lease-id")); err != nil {
+		return err
+	}
+
+	first, last := int64(0), v.size/pageSize-1
+	if r := req.Header.Get("x-ms-range"); r != "" || req.Header.Get("Range") != "" {
+		if r == "" {
+			r = req.Header.Get("Range")
+		}
+		start, end, err := parseRange(r, v.size)
+		if err != nil {
+			return err
+		}
+		first, last = start/pageSize, end/pageSize
+	}
+
+	var changed, cleared []int64
+	if prev := q.Get("prevsnapshot"); prev != "" {
+		t, perr := parseSnapshot(prev)
+		if perr != nil {
+			return newError(http.StatusBadRequest, "InvalidQueryParameterValue", "Value for one of the query parameters specified in the request URI is invalid: prevsnapshot=%s.", prev)
+		}
+		p := b.findSnapshot(t)
+		if p == nil {
+			return newError(http.StatusConflict, "PreviousSnapshotNotFound", "The previous snapshot is not found.")
+		}
+		// Pages are reported when the write that last changed them
+		// differs between the two versions.
+		for i, pg := range v.pages {
+			if old, ok := p.pages[i]; !ok || old.seq != pg.seq {
+				changed = append(changed, i)
+			}
+		}
+		for i := range p.pages {
+			if _, ok := v.pages[i]; !ok && i*pageSize < v.size {
+				cleared = append(cleared, i)
+			}
+		}
+	} else {
+		for i := range v.pages {
+			changed = append(changed, i)
+		}
+	}
+
+	out := pageListXML{
+		PageRange:  mergePages(changed, first, last),
+		ClearRange: mergePages(cleared, first, last),
+	}
+	w.Header().Set("ETag", v.etag)
+	w.Header().Set("Last-Modified", v.lastModified.Format(http.TimeFormat))
+	w.Header().Set("x-ms-blob-content-length", strconv.FormatInt(v.size, 10))
+	writeXML(w, http.StatusOK, out)
+	return nil
+}
+
+// mergePages turns page indexes within [first, last] into byte ranges of
+// consecutive pages.
+func mergePages(pages []int64, first, last int64) []pageRangeXML {
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	var out []pageRangeXML
+	for _, i := range pages {
+		if i < first || i > last {
+			continue
+		}
+		if n := len(out); n > 0 && out[n-1].End+1 == i*pageSize {
+			out[n-1].End += pageSize
+			continue
+		}
+		out = append(out, pageRangeXML{Start: i * pageSize, End: (i+1)*pageSize - 1})
+	}
+	return out
+}
@@ -0,0 +1,432 @@
+package storageemulator
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+const (
+	maxMessageSize        = 64 * 1024
+	maxMessageTTL         = 7 * 24 * time.Hour
+	maxVisibilityTimeout  = 7 * 24 * time.Hour
+	defaultVisibility     = 30 * time.Second
+	maxMessagesPerRequest = 32
+)
+
+type queue struct {
+	name     string
+	metadata map[string]string
+	policies []signedIdentifier
+	messages []*message
+}
+
+type message struct {
+	id           string
+	text         string
+	insertion    time.Time
+	expiration   time.Time
+	nextVisible  time.Time
+	popReceipt   string
+	dequeueCount int
+}
+
+// purge drops the messages that have expired.
+func (q *queue) purge(now time.Time) {
+	kept := q.messages[:0]
+	for _, m := range q.messages {
+		if m.expiration.IsZero() || now.Before(m.expiration) {
+			kept = append(kept, m)
+		}
+	}
+	q.messages = kept
+}
+
+func (e *Emulator) serveQueue(w http.ResponseWriter, req *request) *serviceError {
+	q := req.URL.Query()
+	segs := req.segments(3)
+	switch {
+	case len(segs) == 0:
+		switch {
+		case q.Get("comp") == "list" && req.Method == http.MethodGet:
+			if err := e.authorize(req, access{resourceType: 's', permission: 'l'}); err != nil {
+				return err
+			}
+			return e.listQueues(w, req, q)
+		case q.Get("restype") == "service" && q.Get("comp") == "properties":
+			return e.serveServiceProperties(w, req, &req.account.queueProps)
+		}
+	case len(segs) == 1:
+		return e.serveQueueResource(w, req, segs[0], q)
+	case segs[1] == "messages":
+		qu, ok := req.account.queues[segs[0]]
+		if !ok {
+			return newError(http.StatusNotFound, "QueueNotFound", "The specified queue does not exist.")
+		}
+		qu.purge(e.now())
+		if len(segs) == 2 {
+			return e.serveMessages(w, req, qu, q)
+		}
+		return e.serveMessage(w, req, qu, segs[2], q)
+	}
+	return unsupported(req)
+}
+
+type queueListXML struct {
+	XMLName         xml.Name   `xml:"EnumerationResults"`
+	ServiceEndpoint string     `xml:"ServiceEndpoint,attr"`
+	Prefix          string     `xml:"Prefix,omitempty"`
+	Marker          string     `xml:"Marker,omitempty"`
+	MaxResults      int        `xml:"MaxResults,omitempty"`
+	Queues          []queueXML `xml:"Queues>Queue"`
+	NextMarker      string     `xml:"NextMarker"`
+}
+
+type queueXML struct {
+	Name     string               `xml:"Name"`
+	Metadata storage.BlobMetadata `xml:"Metadata,omitempty"`
+}
+
+func (e *Emulator) listQueues(w http.ResponseWriter, req *request, q url.Values) *serviceError {
+	prefix, marker := q.Get("prefix"), q.Get("marker")
+	limit, err := parseMaxResults(q)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(req.account.queues))
+	for name := range req.account.queues {
+		if strings.HasPrefix(name, prefix) && name >= marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := queueListXML{
+		ServiceEndpoint: req.scheme() + "://" + req.Host + "/",
+		Prefix:          prefix,
+		Marker:          marker,
+		MaxResults:      limit,
+	}
+	if len(names) > limit {
+		out.NextMarker = names[limit]
+		names = names[:limit]
+	}
+	includeMetadata := q.Get("include") == "metadata"
+	for _, name := range names {
+		entry := queueXML{Name: name}
+		if includeMetadata {
+			entry.Metadata = storage.BlobMetadata(req.account.queues[name].metadata)
+		}
+		out.Queues = append(out.Queues, entry)
+	}
+	writeXML(w, http.StatusOK, out)
+	return nil
+}
+
+func (e *Emulator) serveQueueResource(w http.ResponseWriter, req *request, name string, q url.Values) *serviceError {
+	qu, exists := req.account.queues[name]
+	comp := q.Get("comp")
+
+	if req.Method == http.MethodPut && comp == "" {
+		if err := e.authorize(req, access{resourceType: 'c', permission: 'c', container: name}); err != nil {
+			return err
+		}
+		if !validContainerName(name) || strings.HasPrefix(name, "$") {
+			return newError(http.StatusBadRequest, "InvalidResourceName", "The specifed resource name contains invalid characters.")
+		}
+		metadata := metadataFromHeaders(req.Header)
+		if exists {
+			// Creating an existing queue succeeds if nothing would change.
+			if !sameMetadata(qu.metadata, metadata) {
+				return newError(http.StatusConflict, "QueueAlreadyExists", "The specified queue already exists.")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		req.account.queues[name] = &queue{name: name, metadata: metadata}
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+
+	if !exists {
+		return newError(http.StatusNotFound, "QueueNotFound", "The specified queue does not exist.")
+	}
+	qu.purge(e.now())
+
+	switch {
+	case comp == "" && req.Method == http.MethodDelete:
+		if err := e.authorize(req, access{resourceType: 'c', permission: 'd', container: name}); err != nil {
+			return err
+		}
+		delete(req.account.queues, name)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	case comp == "metadata" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		if err := e.authorize(req, access{resourceType: 'c', permission: 'r', container: name}); err != nil {
+			return err
+		}
+		w.Header().Set("x-ms-approximate-messages-count", strconv.Itoa(len(qu.messages)))
+		writeMetadataHeaders(w, qu.metadata)
+		w.WriteHeader(http.StatusOK)
+		return nil
+
+	case comp == "metadata" && req.Method == http.MethodPut:
+		if err := e.authorize(req, access{resourceType: 'c', permission: 'w', container: name}); err != nil {
+			return err
+		}
+		qu.metadata = metadataFromHeaders(req.Header)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	case comp == "acl":
+		if req.sas != nil || req.anonymous {
+			return newError(http.StatusForbidden, "AuthorizationFailure", "This request is not authorized to perform this operation.")
+		}
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			writeXML(w, http.StatusOK, signedIdentifiers{SignedIdentifiers: qu.policies})
+			return nil
+		case http.MethodPut:
+			policies, err := parseSignedIdentifiers(req.body)
+			if err != nil {
+				return err
+			}
+			qu.policies = policies
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+	return unsupported(req)
+}
+
+func sameMetadata(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+type queueMessagesXML struct {
+	XMLName  xml.Name          `xml:"QueueMessagesList"`
+	Messages []queueMessageXML `xml:"QueueMessage"`
+}
+
+type queueMessageXML struct {
+	MessageID       string `xml:"MessageId"`
+	InsertionTime   string `xml:"InsertionTime"`
+	ExpirationTime  string `xml:"ExpirationTime"`
+	PopReceipt      string `xml:"PopReceipt,omitempty"`
+	TimeNextVisible string `xml:"TimeNextVisible,omitempty"`
+	DequeueCount    *int   `xml:"DequeueCount,omitempty"`
+	MessageText     string `xml:"MessageText,omitempty"`
+}
+
+func (m *message) toXML(withReceipt, withText bool) queueMessageXML {
+	out := queueMessageXML{
+		MessageID:     m.id,
+		InsertionTime: m.insertion.Format(http.TimeFormat),
+	}
+	if m.expiration.IsZero() {
+		out.ExpirationTime = "Fri, 31 Dec 9999 23:59:59 GMT"
+	} else {
+		out.ExpirationTime = m.expiration.Format(http.TimeFormat)
+	}
+	if withReceipt {
+		out.PopReceipt = m.popReceipt
+		out.TimeNextVisible = m.nextVisible.Format(http.TimeFormat)
+	}
+	if withText {
+		count := m.dequeueCount
+		out.DequeueCount = &count
+		out.MessageText = m.text
+	}
+	return out
+}
+
+func (e *Emulator) serveMessages(w http.ResponseWriter, req *request, qu *queue, q url.Values) *serviceError {
+	now := e.timeNow()
+	switch req.Method {
+	case http.MethodPost:
+		if err := e.authorize(req, access{resourceType: 'o', permission: 'a', container: qu.name}); err != nil {
+			return err
+		}
+		text, err := parseMessageText(req.body)
+		if err != nil {
+			return err
+		}
+		visibility, err := durationParam(q, "visibilitytimeout", 0, 0, maxVisibilityTimeout)
+		if err != nil {
+			return err
+		}
+		m := &message{
+			id:          newLeaseID(),
+			text:        text,
+			insertion:   now,
+			nextVisible: now.Add(visibility),
+			popReceipt:  newPopReceipt(),
+		}
+		if q.Get("messagettl") != "-1" {
+			ttl, err := durationParam(q, "messagettl", maxMessageTTL, time.Second, maxMessageTTL)
+			if err != nil {
+				return err
+			}
+			if visibility >= ttl {
+				return newError(http.StatusBadRequest, "InvalidQueryParameterValue", "The visibility timeout must be less than the message time to live.")
+			}
+			m.expiration = now.Add(ttl)
+		}
+		qu.messages = append(qu.messages, m)
+		writeXML(w, http.StatusCreated, queueMessagesXML{Messages: []queueMessageXML{m.toXML(true, false)}})
+		return nil
+
+	case http.MethodGet:
+		peek := q.Get("peekonly") == "true"
+		permission := byte('p')
+		if peek {
+			permission = 'r'
+		}
+		if err := e.authorize(req, access{resourceType: 'o', permission: permission, container: qu.name}); err != nil {
+			return err
+		}
+		count := 1
+		if v := q.Get("numofmessages"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxMessagesPerRequest {
+				return newError(http.StatusBadRequest, "OutOfRangeQueryParameterValue", "numofmessages must be between 1 and %d.", maxMessagesPerRequest)
+			}
+			count = n
+		}
+		visibility, err := durationParam(q, "visibilitytimeout", defaultVisibility, time.Second, maxVisibilityTimeout)
+		if err != nil {
+			return err
+		}
+
+		var out queueMessagesXML
+		for _, m := range qu.messages {
+			if len(out.Messages) == count {
+				break
+			}
+			if now.Before(m.nextVisible) {
+				continue
+			}
+			if !peek {
+				m.dequeueCount++
+				m.popReceipt = newPopReceipt()
+				m.nextVisible = now.Add(visibility)
+			}
+			out.Messages = append(out.Messages, m.toXML(!peek, true))
+		}
+		writeXML(w, http.StatusOK, out)
+		return nil
+
+	case http.MethodDelete:
+		if err := e.authorize(req, access{resourceType: 'c', permission: 'd', container: qu.name}); err != nil {
+			return err
+		}
+		qu.messages = nil
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return unsupported(req)
+}
+
+func (e *Emulator) serveMessage(w http.ResponseWriter, req *request, qu *queue, id string, q url.Values) *serviceError {
+	index := -1
+	for i, m := range qu.messages {
+		if m.id == id {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return newError(http.StatusNotFound, "MessageNotFound", "The specified message does not exist.")
+	}
+	m := qu.messages[index]
+	if q.Get("popreceipt") != m.popReceipt {
+		return newError(http.StatusBadRequest, "PopReceiptMismatch", "The specified pop receipt did not match the pop receipt for a dequeued message.")
+	}
+
+	switch req.Method {
+	case http.MethodDelete:
+		if err := e.authorize(req, access{resourceType: 'o', permission: 'p', container: qu.name}); err != nil {
+			return err
+		}
+		qu.messages = append(qu.messages[:index], qu.messages[index+1:]...)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	case http.MethodPut:
+		if err := e.authorize(req, access{resourceType: 'o', permission: 'u', container: qu.name}); err != nil {
+			return err
+		}
+		if q.Get("visibilitytimeout") == "" {
+			return newError(http.StatusBadRequest, "MissingRequiredQueryParameter", "A query parameter that's mandatory for this request is not specified: visibilitytimeout.")
+		}
+		visibility, err := durationParam(q, "visibilitytimeout", 0, 0, maxVisibilityTimeout)
+		if err != nil {
+			return err
+		}
+		if len(req.body) > 0 {
+			text, err := parseMessageText(req.body)
+			if err != nil {
+				return err
+			}
+			m.text = text
+		}
+		m.popReceipt = newPopReceipt()
+		m.nextVisible = e.timeNow().Add(visibility)
+		w.Header().Set("x-ms-popreceipt", m.popReceipt)
+		w.Header().Set("x-ms-time-next-visible", m.nextVisible.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return unsupported(req)
+}
+
+func parseMessageText(body []byte) (string, *serviceError) {
+	var in struct {
+		XMLName     xml.Name `xml:"QueueMessage"`
+		MessageText string   `xml:"MessageText"`
+	}
+	if err := xml.Unmarshal(body, &in); err != nil {
+		return "", newError(http.StatusBadRequest, "InvalidXmlDocument", "XML specified is not syntactically valid: %v", err)
+	}
+	if len(in.MessageText) > maxMessageSize {
+		return "", newError(http.StatusRequestEntityTooLarge, "RequestBodyTooLarge", "The request body is too large and exceeds the maximum permissible limit.")
+	}
+	return in.MessageText, nil
+}
+
+// durationParam parses a query parameter given in seconds.
+func durationParam(q url.Values, name string, def, min, max time.Duration) (time.Duration, *serviceError) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	d := time.Duration(n) * time.Second
+	if err != nil || d < min || d > max {
+		return 0, newError(http.StatusBadRequest, "OutOfRangeQueryParameterValue", "%s must be between %d and %d seconds.", name, int(min/time.Second), int(max/time.Second))
+	}
+	return d, nil
+}
+
+func newPopReceipt() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
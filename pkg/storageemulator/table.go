@@ -0,0 +1,800 @@
+package storageemulator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// EDM types of table properties besides the ones the storage package
+// declares.
+const (
+	edmString  = "Edm.String"
+	edmBoolean = "Edm.Boolean"
+	edmInt32   = "Edm.Int32"
+	edmDouble  = "Edm.Double"
+)
+
+const (
+	maxTableResults    = 1000
+	maxEntityProps     = 252
+	maxPropertyName    = 255
+	maxKeySize         = 1024
+	maxEntitySize      = 1024 * 1024
+	entityTimestampFmt = "2006-01-02T15:04:05.0000000Z"
+)
+
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]{2,62}$`)
+
+type table struct {
+	name     string
+	policies []signedIdentifier
+	entities map[entityKey]*entity
+}
+
+type entityKey struct {
+	partitionKey string
+	rowKey       string
+}
+
+// entity is a stored entity. Entities are replaced rather than modified, so
+// a shallow copy of the entities of a table is a snapshot of it.
+type entity struct {
+	entityKey
+	props     map[string]property
+	timestamp time.Time
+	etag      string
+}
+
+// property is a typed property value. Values are strings for String, Guid
+// and Binary properties, bools, int64 for Int32 and Int64, float64 and
+// time.Time for DateTime.
+type property struct {
+	typ   string
+	value interface{}
+	// raw marks binary values holding the bytes instead of their base64
+	// encoding, as literals in filters do.
+	raw bool
+}
+
+// lookup returns the system or custom property of an entity with the given
+// name.
+func (ent *entity) lookup(name string) (property, bool) {
+	switch name {
+	case "PartitionKey":
+		return property{typ: edmString, value: ent.partitionKey}, true
+	case "RowKey":
+		return property{typ: edmString, value: ent.rowKey}, true
+	case "Timestamp":
+		return property{typ: storage.OdataDateTime, value: ent.timestamp}, true
+	}
+	p, ok := ent.props[name]
+	return p, ok
+}
+
+// findTable looks a table up by its case insensitive name.
+func (acct *account) findTable(name string) (*table, bool) {
+	t, ok := acct.tables[strings.ToLower(name)]
+	return t, ok
+}
+
+var (
+	tableResourcePattern  = regexp.MustCompile(`^Tables\('(.*)'\)$`)
+	entityResourcePattern = regexp.MustCompile(`^([^/(]+)\((.*)\)$`)
+)
+
+func (e *Emulator) serveTable(w http.ResponseWriter, req *request) *serviceError {
+	q := req.URL.Query()
+	p := strings.TrimPrefix(req.path, "/")
+	switch {
+	case p == "":
+		if q.Get("restype") == "service" && q.Get("comp") == "properties" {
+			return e.serveServiceProperties(w, req, &req.account.tableProps)
+		}
+	case p == "Tables":
+		switch req.Method {
+		case http.MethodGet:
+			return e.queryTables(w, req, q)
+		case http.MethodPost:
+			return e.createTable(w, req)
+		}
+	case p == "$batch":
+		if req.Method == http.MethodPost {
+			return e.serveBatch(w, req)
+		}
+	case tableResourcePattern.MatchString(p):
+		name := tableResourcePattern.FindStringSubmatch(p)[1]
+		switch req.Method {
+		case http.MethodGet:
+			return e.getTable(w, req, name)
+		case http.MethodDelete:
+			return e.deleteTable(w, req, name)
+		}
+	case q.Get("comp") == "acl" && !strings.Contains(p, "("):
+		return e.serveTableACL(w, req, p)
+	default:
+		name, keys := p, ""
+		if m := entityResourcePattern.FindStringSubmatch(p); m != nil {
+			name, keys = m[1], m[2]
+		}
+		t, ok := req.account.findTable(name)
+		if !ok {
+			return newError(http.StatusNotFound, "TableNotFound", "The table specified does not exist.")
+		}
+		if strings.TrimSpace(keys) == "" {
+			switch req.Method {
+			case http.MethodGet:
+				return e.queryEntities(w, req, t, q)
+			case http.MethodPost:
+				return e.insertEntity(w, req, t)
+			}
+			return unsupported(req)
+		}
+		pk, rk, ok := parseEntityKeys(keys)
+		if !ok {
+			return newError(http.StatusBadRequest, "InvalidInput", "The entity keys %s are not valid.", keys)
+		}
+		return e.serveEntity(w, req, t, entityKey{partitionKey: pk, rowKey: rk})
+	}
+	return unsupported(req)
+}
+
+// parseEntityKeys parses the PartitionKey='pk',RowKey='rk' key predicate of
+// an entity URL.
+func parseEntityKeys(s string) (string, string, bool) {
+	keys := map[string]string{}
+	for s = strings.TrimSpace(s); s != ""; {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return "", "", false
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = strings.TrimSpace(s[eq+1:])
+		if !strings.HasPrefix(s, "'") {
+			return "", "", false
+		}
+		value, n, err := parseQuoted(s)
+		if err != nil {
+			return "", "", false
+		}
+		keys[name] = value
+		s = strings.TrimSpace(s[n:])
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if s != "" {
+			return "", "", false
+		}
+	}
+	pk, hasPK := keys["PartitionKey"]
+	rk, hasRK := keys["RowKey"]
+	return pk, rk, hasPK && hasRK && len(keys) == 2
+}
+
+// metadataLevel returns the odata metadata level the client accepts:
+// nometadata, minimalmetadata or fullmetadata.
+func metadataLevel(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	for _, level := range []string{"nometadata", "fullmetadata"} {
+		if strings.Contains(accept, "odata="+level) {
+			return level
+		}
+	}
+	return "minimalmetadata"
+}
+
+// serviceRoot returns the base URL of the table service of the account the
+// request is addressed to.
+func serviceRoot(req *request) string {
+	return req.scheme() + "://" + req.Host + strings.TrimSuffix(req.URL.Path, req.path) + "/"
+}
+
+func writeJSON(w http.ResponseWriter, req *request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;odata="+metadataLevel(req.Request)+";streaming=true;charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writePreference writes the response of an operation honoring the Prefer
+// header: the body with status created, or no content.
+func writePreference(w http.ResponseWriter, req *request, created int, v interface{}) {
+	if req.Header.Get("Prefer") == "return-no-content" {
+		w.Header().Set("Preference-Applied", "return-no-content")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if req.Header.Get("Prefer") == "return-content" {
+		w.Header().Set("Preference-Applied", "return-content")
+	}
+	writeJSON(w, req, created, v)
+}
+
+func (e *Emulator) tableJSON(req *request, name string, element bool) map[string]interface{} {
+	root := serviceRoot(req)
+	out := map[string]interface{}{"TableName": name}
+	if element {
+		if level := metadataLevel(req.Request); level != "nometadata" {
+			out["odata.metadata"] = root + "$metadata#Tables/@Element"
+		}
+	}
+	if metadataLevel(req.Request) == "fullmetadata" {
+		out["odata.type"] = req.account.name + ".Tables"
+		out["odata.id"] = root + "Tables('" + name + "')"
+		out["odata.editLink"] = "Tables('" + name + "')"
+	}
+	return out
+}
+
+func (e *Emulator) createTable(w http.ResponseWriter, req *request) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'c', permission: 'c'}); err != nil {
+		if e.authorize(req, access{resourceType: 'c', permission: 'a'}) != nil {
+			return err
+		}
+	}
+	var in struct {
+		TableName string `json:"TableName"`
+	}
+	if err := json.Unmarshal(req.body, &in); err != nil {
+		return newError(http.StatusBadRequest, "InvalidInput", "The request body is not valid JSON: %v", err)
+	}
+	if !tableNamePattern.MatchString(in.TableName) || strings.EqualFold(in.TableName, "tables") {
+		return newError(http.StatusBadRequest, "InvalidResourceName", "The specifed resource name contains invalid characters.")
+	}
+	if _, exists := req.account.findTable(in.TableName); exists {
+		return newError(http.StatusConflict, "TableAlreadyExists", "The table specified already exists.")
+	}
+	req.account.tables[strings.ToLower(in.TableName)] = &table{name: in.TableName, entities: map[entityKey]*entity{}}
+	writePreference(w, req, http.StatusCreated, e.tableJSON(req, in.TableName, true))
+	return nil
+}
+
+func (e *Emulator) getTable(w http.ResponseWriter, req *request, name string) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'c', permission: 'l'}); err != nil {
+		return err
+	}
+	t, ok := req.account.findTable(name)
+	if !ok {
+		return newError(http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+	}
+	writeJSON(w, req, http.StatusOK, e.tableJSON(req, t.name, true))
+	return nil
+}
+
+func (e *Emulator) deleteTable(w http.ResponseWriter, req *request, name string) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'c', permission: 'd'}); err != nil {
+		return err
+	}
+	if _, ok := req.account.findTable(name); !ok {
+		return newError(http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+	}
+	delete(req.account.tables, strings.ToLower(name))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (e *Emulator) queryTables(w http.ResponseWriter, req *request, q url.Values) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'c', permission: 'l'}); err != nil {
+		return err
+	}
+	f, top, err := parseQueryOptions(q)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, t := range req.account.tables {
+		if t.name < q.Get("NextTableName") {
+			continue
+		}
+		name := t.name
+		lookup := func(p string) (property, bool) {
+			if p == "TableName" {
+				return property{typ: edmString, value: name}, true
+			}
+			return property{}, false
+		}
+		if matches(f, lookup) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > top {
+		w.Header().Set("x-ms-continuation-NextTableName", names[top])
+		names = names[:top]
+	}
+
+	out := map[string]interface{}{}
+	if metadataLevel(req.Request) != "nometadata" {
+		out["odata.metadata"] = serviceRoot(req) + "$metadata#Tables"
+	}
+	value := []interface{}{}
+	for _, name := range names {
+		value = append(value, e.tableJSON(req, name, false))
+	}
+	out["value"] = value
+	writeJSON(w, req, http.StatusOK, out)
+	return nil
+}
+
+// parseQueryOptions parses the $filter and $top options of a query.
+func parseQueryOptions(q url.Values) (filter, int, *serviceError) {
+	var f filter
+	if s := q.Get("$filter"); s != "" {
+		var err error
+		if f, err = parseFilter(s); err != nil {
+			return nil, 0, newError(http.StatusBadRequest, "InvalidInput", "The $filter query option is not valid: %v", err)
+		}
+	}
+	top := maxTableResults
+	if s := q.Get("$top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxTableResults {
+			return nil, 0, newError(http.StatusBadRequest, "InvalidInput", "The $top query option must be between 1 and %d.", maxTableResults)
+		}
+		top = n
+	}
+	return f, top, nil
+}
+
+func (e *Emulator) serveTableACL(w http.ResponseWriter, req *request, name string) *serviceError {
+	t, ok := req.account.findTable(name)
+	if !ok {
+		return newError(http.StatusNotFound, "TableNotFound", "The table specified does not exist.")
+	}
+	if req.sas != nil || req.anonymous {
+		return newError(http.StatusForbidden, "AuthorizationFailure", "This request is not authorized to perform this operation.")
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		writeXML(w, http.StatusOK, signedIdentifiers{SignedIdentifiers: t.policies})
+		return nil
+	case http.MethodPut:
+		policies, err := parseSignedIdentifiers(req.body)
+		if err != nil {
+			return err
+		}
+		t.policies = policies
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return unsupported(req)
+}
+
+// stampEntity gives an entity a new timestamp and ETag. Timestamps have the
+// 100ns precision of the service and increase strictly, so every change
+// gets a distinct ETag.
+func (e *Emulator) stampEntity(ent *entity) {
+	ts := e.now().UTC().Truncate(100 * time.Nanosecond)
+	if !ts.After(e.lastEntityTime) {
+		ts = e.lastEntityTime.Add(100 * time.Nanosecond)
+	}
+	e.lastEntityTime = ts
+	ent.timestamp = ts
+	ent.etag = fmt.Sprintf(`W/"datetime'%s'"`, url.QueryEscape(ts.Format(entityTimestampFmt)))
+}
+
+func (e *Emulator) insertEntity(w http.ResponseWriter, req *request, t *table) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'a', container: t.name}); err != nil {
+		return err
+	}
+	key, props, err := parseEntityBody(req.body, nil)
+	if err != nil {
+		return err
+	}
+	if _, exists := t.entities[key]; exists {
+		return newError(http.StatusConflict, "EntityAlreadyExists", "The specified entity already exists.")
+	}
+	ent := &entity{entityKey: key, props: props}
+	e.stampEntity(ent)
+	t.entities[key] = ent
+
+	w.Header().Set("ETag", ent.etag)
+	out := entityJSON(req, t, ent, nil)
+	if metadataLevel(req.Request) != "nometadata" {
+		out["odata.metadata"] = serviceRoot(req) + "$metadata#" + t.name + "/@Element"
+	}
+	writePreference(w, req, http.StatusCreated, out)
+	return nil
+}
+
+func (e *Emulator) serveEntity(w http.ResponseWriter, req *request, t *table, key entityKey) *serviceError {
+	current, exists := t.entities[key]
+	ifMatch := req.Header.Get("If-Match")
+	checkETag := func() *serviceError {
+		if !exists {
+			return newError(http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+		}
+		if ifMatch != "*" && ifMatch != current.etag {
+			return newError(http.StatusPreconditionFailed, "UpdateConditionNotSatisfied", "The update condition specified in the request was not satisfied.")
+		}
+		return nil
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		if err := e.authorize(req, access{resourceType: 'o', permission: 'r', container: t.name}); err != nil {
+			return err
+		}
+		if !exists {
+			return newError(http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+		}
+		out := entityJSON(req, t, current, parseSelect(req.URL.Query()))
+		if metadataLevel(req.Request) != "nometadata" {
+			out["odata.metadata"] = serviceRoot(req) + "$metadata#" + t.name + "/@Element"
+		}
+		w.Header().Set("ETag", current.etag)
+		writeJSON(w, req, http.StatusOK, out)
+		return nil
+
+	case http.MethodPut, "MERGE":
+		// Without If-Match these are Insert Or Replace and Insert Or Merge.
+		permission := byte('u')
+		if ifMatch == "" && !exists {
+			permission = 'a'
+		}
+		if err := e.authorize(req, access{resourceType: 'o', permission: permission, container: t.name}); err != nil {
+			return err
+		}
+		if ifMatch != "" {
+			if err := checkETag(); err != nil {
+				return err
+			}
+		}
+		_, props, err := parseEntityBody(req.body, &key)
+		if err != nil {
+			return err
+		}
+		if req.Method == "MERGE" && exists {
+			merged := make(map[string]property, len(current.props)+len(props))
+			for k, v := range current.props {
+				merged[k] = v
+			}
+			for k, v := range props {
+				merged[k] = v
+			}
+			if len(merged) > maxEntityProps {
+				return newError(http.StatusBadRequest, "TooManyProperties", "The entity contains more properties than allowed.")
+			}
+			props = merged
+		}
+		ent := &entity{entityKey: key, props: props}
+		e.stampEntity(ent)
+		t.entities[key] = ent
+		w.Header().Set("ETag", ent.etag)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	case http.MethodDelete:
+		if err := e.authorize(req, access{resourceType: 'o', permission: 'd', container: t.name}); err != nil {
+			return err
+		}
+		if ifMatch == "" {
+			return newError(http.StatusBadRequest, "MissingRequiredHeader", "An HTTP header that's mandatory for this request is not specified: If-Match.")
+		}
+		if err := checkETag(); err != nil {
+			return err
+		}
+		delete(t.entities, key)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return unsupported(req)
+}
+
+func (e *Emulator) queryEntities(w http.ResponseWriter, req *request, t *table, q url.Values) *serviceError {
+	if err := e.authorize(req, access{resourceType: 'o', permission: 'r', container: t.name}); err != nil {
+		return err
+	}
+	f, top, err := parseQueryOptions(q)
+	if err != nil {
+		return err
+	}
+	var from entityKey
+	if pk := q.Get("NextPartitionKey"); pk != "" {
+		from.partitionKey = decodeContinuation(pk)
+		from.rowKey = decodeContinuation(q.Get("NextRowKey"))
+	}
+
+	var found []*entity
+	for key, ent := range t.entities {
+		if lessKey(key, from) {
+			continue
+		}
+		if matches(f, ent.lookup) {
+			found = append(found, ent)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return lessKey(found[i].entityKey, found[j].entityKey) })
+	if len(found) > top {
+		next := found[top]
+		w.Header().Set("x-ms-continuation-NextPartitionKey", encodeContinuation(next.partitionKey))
+		w.Header().Set("x-ms-continuation-NextRowKey", encodeContinuation(next.rowKey))
+		found = found[:top]
+	}
+
+	selected := parseSelect(q)
+	out := map[string]interface{}{}
+	if metadataLevel(req.Request) != "nometadata" {
+		out["odata.metadata"] = serviceRoot(req) + "$metadata#" + t.name
+	}
+	value := []interface{}{}
+	for _, ent := range found {
+		value = append(value, entityJSON(req, t, ent, selected))
+	}
+	out["value"] = value
+	writeJSON(w, req, http.StatusOK, out)
+	return nil
+}
+
+func lessKey(a, b entityKey) bool {
+	if a.partitionKey != b.partitionKey {
+		return a.partitionKey < b.partitionKey
+	}
+	return a.rowKey < b.rowKey
+}
+
+// encodeContinuation encodes a key the way the service does in continuation
+// tokens, which keeps them valid header values.
+func encodeContinuation(key string) string {
+	encoded := base64.StdEncoding.EncodeToString([]byte(key))
+	return fmt.Sprintf("1!%d!%s", len(encoded), encoded)
+}
+
+func decodeContinuation(token string) string {
+	if i := strings.LastIndexByte(token, '!'); i >= 0 {
+		if key, err := base64.StdEncoding.DecodeString(token[i+1:]); err == nil {
+			return string(key)
+		}
+	}
+	return token
+}
+
+func parseSelect(q url.Values) map[string]bool {
+	s := q.Get("$select")
+	if s == "" {
+		return nil
+	}
+	selected := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		selected[strings.TrimSpace(name)] = true
+	}
+	return selected
+}
+
+// entityJSON returns the JSON representation of an entity at the metadata
+// level the client asked for. Properties not in selected are left out,
+// unless selected is nil.
+func entityJSON(req *request, t *table, ent *entity, selected map[string]bool) map[string]interface{} {
+	level := metadataLevel(req.Request)
+	out := map[string]interface{}{}
+	include := func(name string) bool { return selected == nil || selected[name] }
+
+	if level != "nometadata" {
+		out["odata.etag"] = ent.etag
+	}
+	if level == "fullmetadata" {
+		link := fmt.Sprintf("%s(PartitionKey='%s',RowKey='%s')", t.name, quoteKey(ent.partitionKey), quoteKey(ent.rowKey))
+		out["odata.type"] = req.account.name + "." + t.name
+		out["odata.id"] = serviceRoot(req) + link
+		out["odata.editLink"] = link
+	}
+	if include("PartitionKey") {
+		out["PartitionKey"] = ent.partitionKey
+	}
+	if include("RowKey") {
+		out["RowKey"] = ent.rowKey
+	}
+	if include("Timestamp") {
+		out["Timestamp"] = ent.timestamp.Format(time.RFC3339Nano)
+		if level == "fullmetadata" {
+			out["Timestamp"+storage.OdataTypeSuffix] = storage.OdataDateTime
+		}
+	}
+	for name, p := range ent.props {
+		if !include(name) {
+			continue
+		}
+		value, annotate := p.toJSON()
+		out[name] = value
+		if annotate && level != "nometadata" {
+			out[name+storage.OdataTypeSuffix] = p.typ
+		}
+	}
+	return out
+}
+
+func quoteKey(key string) string {
+	return strings.Replace(key, "'", "''", -1)
+}
+
+// toJSON returns the JSON value of a property and whether the type has to be
+// annotated because JSON cannot tell it.
+func (p property) toJSON() (interface{}, bool) {
+	switch p.typ {
+	case storage.OdataInt64:
+		return strconv.FormatInt(p.value.(int64), 10), true
+	case storage.OdataDateTime:
+		return p.value.(time.Time).Format(time.RFC3339Nano), true
+	case storage.OdataGUID, storage.OdataBinary:
+		return p.value, true
+	case edmDouble:
+		f := p.value.(float64)
+		switch {
+		case math.IsNaN(f):
+			return "NaN", false
+		case math.IsInf(f, 1):
+			return "Infinity", false
+		case math.IsInf(f, -1):
+			return "-Infinity", false
+		}
+	}
+	return p.value, false
+}
+
+// parseEntityBody parses the JSON body of an entity. The keys come from the
+// body unless the URL already names the entity, in which case key is given.
+func parseEntityBody(body []byte, key *entityKey) (entityKey, map[string]property, *serviceError) {
+	invalid := func(format string, args ...interface{}) (entityKey, map[string]property, *serviceError) {
+		return entityKey{}, nil, newError(http.StatusBadRequest, "InvalidInput", format, args...)
+	}
+	if len(body) > maxEntitySize {
+		return entityKey{}, nil, newError(http.StatusRequestEntityTooLarge, "EntityTooLarge", "The entity is larger than the maximum allowed size.")
+	}
+	var raw map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return invalid("The request body is not a valid JSON entity: %v", err)
+	}
+
+	var k entityKey
+	if key != nil {
+		k = *key
+	} else {
+		pk, pkOK := raw["PartitionKey"].(string)
+		rk, rkOK := raw["RowKey"].(string)
+		if !pkOK || !rkOK {
+			return entityKey{}, nil, newError(http.StatusBadRequest, "PropertiesNeedValue", "The values are not specified for all properties in the entity.")
+		}
+		k = entityKey{partitionKey: pk, rowKey: rk}
+	}
+	for _, v := range []string{k.partitionKey, k.rowKey} {
+		if !validKey(v) {
+			return entityKey{}, nil, newError(http.StatusBadRequest, "OutOfRangeInput", "One of the request inputs is out of range.")
+		}
+	}
+
+	props := map[string]property{}
+	for name, v := range raw {
+		switch {
+		case name == "PartitionKey", name == "RowKey", name == "Timestamp",
+			strings.HasPrefix(name, "odata."), strings.HasSuffix(name, storage.OdataTypeSuffix):
+			continue
+		case v == nil:
+			// Null properties are not stored.
+			continue
+		case len(name) > maxPropertyName:
+			return invalid("The property name %s is too long.", name)
+		}
+		typ, _ := raw[name+storage.OdataTypeSuffix].(string)
+		p, err := parseProperty(typ, v)
+		if err != nil {
+			return invalid("The value of property %s is not valid: %v", name, err)
+		}
+		props[name] = p
+	}
+	if len(props) > maxEntityProps {
+		return entityKey{}, nil, newError(http.StatusBadRequest, "TooManyProperties", "The entity contains more properties than allowed.")
+	}
+	return k, props, nil
+}
+
+func validKey(key string) bool {
+	if len(key) > maxKeySize {
+		return false
+	}
+	for _, r := range key {
+		if r == '/' || r == '\\' || r == '#' || r == '?' || r < 0x20 || r >= 0x7f && r <= 0x9f {
+			return false
+		}
+	}
+	return true
+}
+
+// parseProperty converts a JSON value and its optional type annotation to a
+// property.
+func parseProperty(typ string, v interface{}) (property, error) {
+	s, isString := v.(string)
+	n, isNumber := v.(json.Number)
+	switch typ {
+	case "":
+		switch v := v.(type) {
+		case string:
+			return property{typ: edmString, value: v}, nil
+		case bool:
+			return property{typ: edmBoolean, value: v}, nil
+		case json.Number:
+			if i, err := strconv.ParseInt(v.String(), 10, 32); err == nil {
+				return property{typ: edmInt32, value: i}, nil
+			}
+			f, err := v.Float64()
+			return property{typ: edmDouble, value: f}, err
+		}
+	case edmString:
+		if isString {
+			return property{typ: edmString, value: s}, nil
+		}
+	case edmBoolean:
+		if b, ok := v.(bool); ok {
+			return property{typ: edmBoolean, value: b}, nil
+		}
+	case edmInt32:
+		if isNumber {
+			i, err := strconv.ParseInt(n.String(), 10, 32)
+			return property{typ: edmInt32, value: i}, err
+		}
+	case storage.OdataInt64:
+		if isString {
+			i, err := strconv.ParseInt(s, 10, 64)
+			return property{typ: storage.OdataInt64, value: i}, err
+		}
+	case edmDouble:
+		if isNumber {
+			f, err := n.Float64()
+			return property{typ: edmDouble, value: f}, err
+		}
+		switch s {
+		case "NaN":
+			return property{typ: edmDouble, value: math.NaN()}, nil
+		case "Infinity":
+			return property{typ: edmDouble, value: math.Inf(1)}, nil
+		case "-Infinity":
+			return property{typ: edmDouble, value: math.Inf(-1)}, nil
+		}
+	case storage.OdataDateTime:
+		if isString {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			return property{typ: storage.OdataDateTime, value: t.UTC()}, err
+		}
+	case storage.OdataGUID:
+		if isString && validGUID(s) {
+			return property{typ: storage.OdataGUID, value: strings.ToLower(s)}, nil
+		}
+	case storage.OdataBinary:
+		if isString {
+			return property{typ: storage.OdataBinary, value: s}, nil
+		}
+	default:
+		return property{}, fmt.Errorf("unsupported type %s", typ)
+	}
+	return property{}, fmt.Errorf("%v is not a valid %s value", v, typ)
+}
+
+func validGUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,241 @@
+package storageemulator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+const maxBatchOperations = 100
+
+// batchOperation is one request of the change set of an entity group
+// transaction.
+type batchOperation struct {
+	req   *request
+	table *table
+	key   entityKey
+	// insert is set for Insert Entity, which names the table only.
+	insert bool
+}
+
+// serveBatch runs an entity group transaction. The operations run against a
+// copy of the table that replaces it only if all of them succeed, so a
+// failed batch leaves no trace.
+func (e *Emulator) serveBatch(w http.ResponseWriter, req *request) *serviceError {
+	ops, err := e.parseBatch(req)
+	if err != nil {
+		return err
+	}
+
+	var original, scratch *table
+	if len(ops) > 0 {
+		original = ops[0].table
+		copied := *original
+		copied.entities = make(map[entityKey]*entity, len(original.entities))
+		for k, v := range original.entities {
+			copied.entities[k] = v
+		}
+		scratch = &copied
+	}
+
+	var responses []*httptest.ResponseRecorder
+	seen := map[entityKey]bool{}
+	for i, op := range ops {
+		var serr *serviceError
+		switch {
+		case op.table != original:
+			serr = newError(http.StatusBadRequest, "InvalidInput", "All operations of a batch must target the same table.")
+		case op.key.partitionKey != ops[0].key.partitionKey:
+			serr = newError(http.StatusBadRequest, "CommandsInBatchActOnDifferentPartitions", "All commands in a batch must operate on same entity group.")
+		case seen[op.key]:
+			serr = newError(http.StatusBadRequest, "InvalidDuplicateRow", "The batch request contains multiple changes with same row key. An entity can appear only once in a batch request.")
+		}
+		seen[op.key] = true
+
+		rec := httptest.NewRecorder()
+		if serr == nil {
+			if op.insert {
+				serr = e.insertEntity(rec, op.req, scratch)
+			} else {
+				serr = e.serveEntity(rec, op.req, scratch, op.key)
+			}
+		}
+		if serr != nil {
+			writeBatchResponse(w, []*httptest.ResponseRecorder{batchErrorResponse(i, serr)})
+			return nil
+		}
+		responses = append(responses, rec)
+	}
+	if original != nil {
+		original.entities = scratch.entities
+	}
+	writeBatchResponse(w, responses)
+	return nil
+}
+
+// parseBatch reads the operations of the single change set of a batch.
+func (e *Emulator) parseBatch(req *request) ([]batchOperation, *serviceError) {
+	malformed := func(err error) *serviceError {
+		return newError(http.StatusBadRequest, "InvalidInput", "The batch request body is malformed: %v", err)
+	}
+	batchReader, err := multipartReader(req.Header.Get("Content-Type"), bytes.NewReader(req.body))
+	if err != nil {
+		return nil, malformed(err)
+	}
+	changeset, err := batchReader.NextPart()
+	if err != nil {
+		return nil, malformed(err)
+	}
+	changesetReader, err := multipartReader(changeset.Header.Get("Content-Type"), changeset)
+	if err != nil {
+		return nil, malformed(err)
+	}
+
+	var ops []batchOperation
+	for {
+		part, err := changesetReader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, malformed(err)
+		}
+		if len(ops) == maxBatchOperations {
+			return nil, newError(http.StatusBadRequest, "InvalidInput", "A batch can contain at most %d operations.", maxBatchOperations)
+		}
+		op, serr := e.parseBatchOperation(req, part)
+		if serr != nil {
+			return nil, serr
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func multipartReader(contentType string, r io.Reader) (*multipart.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, fmt.Errorf("content type %s is not multipart", contentType)
+	}
+	return multipart.NewReader(r, params["boundary"]), nil
+}
+
+// parseBatchOperation parses an application/http part into a request that
+// carries the credentials of the batch.
+func (e *Emulator) parseBatchOperation(batch *request, part *multipart.Part) (batchOperation, *serviceError) {
+	invalid := func(format string, args ...interface{}) (batchOperation, *serviceError) {
+		return batchOperation{}, newError(http.StatusBadRequest, "InvalidInput", format, args...)
+	}
+	br := bufio.NewReader(part)
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		return invalid("The batch operation is malformed: %v", err)
+	}
+	// Operations carry no Content-Length; the body runs to the end of the
+	// part.
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		return invalid("The batch operation is malformed: %v", err)
+	}
+	if r.Method == http.MethodGet {
+		return invalid("Queries are not supported in change sets.")
+	}
+
+	op, serr := e.locate(r.URL.Host, r.URL.Path)
+	if serr != nil || op.account != batch.account || op.service != tableService {
+		return invalid("The batch operation %s %s is not addressed to the batch account.", r.Method, r.URL)
+	}
+	r.RemoteAddr = batch.RemoteAddr
+	r.Header.Set(forwardedProtoHeader, batch.scheme())
+	op.Request = r
+	op.body = bytes.TrimSpace(body)
+	op.sas = batch.sas
+	op.anonymous = batch.anonymous
+
+	p := strings.TrimPrefix(op.path, "/")
+	name, keys := p, ""
+	if m := entityResourcePattern.FindStringSubmatch(p); m != nil {
+		name, keys = m[1], m[2]
+	}
+	t, ok := batch.account.findTable(name)
+	if !ok {
+		return batchOperation{}, newError(http.StatusNotFound, "TableNotFound", "The table specified does not exist.")
+	}
+
+	result := batchOperation{req: op, table: t}
+	if strings.TrimSpace(keys) == "" {
+		if r.Method != http.MethodPost {
+			return invalid("The batch operation %s %s is not supported.", r.Method, r.URL)
+		}
+		result.insert = true
+		var in struct {
+			PartitionKey string `json:"PartitionKey"`
+			RowKey       string `json:"RowKey"`
+		}
+		if err := json.Unmarshal(op.body, &in); err != nil {
+			return invalid("The request body is not a valid JSON entity: %v", err)
+		}
+		result.key = entityKey{partitionKey: in.PartitionKey, rowKey: in.RowKey}
+		return result, nil
+	}
+	pk, rk, ok := parseEntityKeys(keys)
+	if !ok {
+		return invalid("The entity keys %s are not valid.", keys)
+	}
+	result.key = entityKey{partitionKey: pk, rowKey: rk}
+	return result, nil
+}
+
+// batchErrorResponse is the response of a failed batch: the error of the
+// operation that failed, with its index prefixed to the message.
+func batchErrorResponse(index int, err *serviceError) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "application/json;odata=minimalmetadata;streaming=true;charset=utf-8")
+	rec.WriteHeader(err.status)
+	indexed := *err
+	indexed.message = fmt.Sprintf("%d:%s", index, err.message)
+	json.NewEncoder(rec).Encode(tableErrorBody(&indexed))
+	return rec
+}
+
+// writeBatchResponse writes the multipart response of a batch, with one
+// change set holding the responses of the operations.
+func writeBatchResponse(w http.ResponseWriter, responses []*httptest.ResponseRecorder) {
+	var changeset bytes.Buffer
+	cw := multipart.NewWriter(&changeset)
+	for _, rec := range responses {
+		part, _ := cw.CreatePart(map[string][]string{
+			"Content-Type":              {"application/http"},
+			"Content-Transfer-Encoding": {"binary"},
+		})
+		fmt.Fprintf(part, "HTTP/1.1 %d %s\r\n", rec.Code, http.StatusText(rec.Code))
+		rec.Header().Set("Content-Length", fmt.Sprint(rec.Body.Len()))
+		rec.Header().Write(part)
+		io.WriteString(part, "\r\n")
+		part.Write(rec.Body.Bytes())
+	}
+	cw.Close()
+
+	var batch bytes.Buffer
+	bw := multipart.NewWriter(&batch)
+	part, _ := bw.CreatePart(map[string][]string{
+		"Content-Type": {"multipart/mixed; boundary=" + cw.Boundary()},
+	})
+	part.Write(changeset.Bytes())
+	bw.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+bw.Boundary())
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(batch.Bytes())
+}
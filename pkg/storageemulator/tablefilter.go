@@ -0,0 +1,460 @@
+package storageemulator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// filter is a parsed OData $filter expression of the table service.
+type filter interface {
+	eval(lookup func(name string) (property, bool)) (property, bool)
+}
+
+// parseFilter parses the subset of OData the table service supports:
+// comparisons with eq, ne, gt, ge, lt and le combined with and, or, not
+// and parentheses, over properties and typed literals.
+func parseFilter(s string) (filter, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q at the end of the filter", p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+// matches reports whether f selects the value described by lookup. A nil
+// filter selects everything.
+func matches(f filter, lookup func(string) (property, bool)) bool {
+	if f == nil {
+		return true
+	}
+	return truthy(f.eval(lookup))
+}
+
+func truthy(p property, ok bool) bool {
+	b, isBool := p.value.(bool)
+	return ok && isBool && b
+}
+
+type tokenKind int
+
+const (
+	tokenIdent tokenKind = iota
+	tokenLiteral
+	tokenOpen
+	tokenClose
+)
+
+type filterToken struct {
+	kind    tokenKind
+	text    string
+	literal property
+}
+
+func tokenizeFilter(s string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, filterToken{kind: tokenOpen, text: "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{kind: tokenClose, text: ")"})
+			i++
+		case c == '\'':
+			text, n, err := parseQuoted(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, filterToken{kind: tokenLiteral, text: s[i : i+n], literal: property{typ: edmString, value: text}})
+			i += n
+		case c == '-' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(s) && strings.IndexByte("0123456789.eE+-", s[j]) >= 0 {
+				if (s[j] == '+' || s[j] == '-') && s[j-1] != 'e' && s[j-1] != 'E' {
+					break
+				}
+				j++
+			}
+			suffix := j < len(s) && (s[j] == 'L' || s[j] == 'l')
+			lit, err := parseNumber(s[i:j], suffix)
+			if err != nil {
+				return nil, err
+			}
+			if suffix {
+				j++
+			}
+			tokens = append(tokens, filterToken{kind: tokenLiteral, text: s[i:j], literal: lit})
+			i = j
+		case isIdentByte(c):
+			j := i
+			for j < len(s) && isIdentByte(s[j]) {
+				j++
+			}
+			word := s[i:j]
+			if j < len(s) && s[j] == '\'' {
+				text, n, err := parseQuoted(s[j:])
+				if err != nil {
+					return nil, err
+				}
+				lit, err := parseTypedLiteral(word, text)
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, filterToken{kind: tokenLiteral, text: s[i : j+n], literal: lit})
+				i = j + n
+				continue
+			}
+			switch word {
+			case "true", "false":
+				tokens = append(tokens, filterToken{kind: tokenLiteral, text: word, literal: property{typ: edmBoolean, value: word == "true"}})
+			default:
+				tokens = append(tokens, filterToken{kind: tokenIdent, text: word})
+			}
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q in the filter", c)
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// parseQuoted parses the single quoted string at the start of s, in which
+// quotes are doubled, and returns it with the number of bytes it took.
+func parseQuoted(s string) (string, int, error) {
+	var out []byte
+	for i := 1; i < len(s); i++ {
+		if s[i] != '\'' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\'' {
+			out = append(out, '\'')
+			i++
+			continue
+		}
+		return string(out), i + 1, nil
+	}
+	return "", 0, fmt.Errorf("unterminated string literal %s", s)
+}
+
+func parseNumber(s string, int64Suffix bool) (property, error) {
+	if int64Suffix {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return property{}, fmt.Errorf("invalid Int64 literal %s", s)
+		}
+		return property{typ: storage.OdataInt64, value: n}, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 32); err == nil {
+		return property{typ: edmInt32, value: n}, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return property{}, fmt.Errorf("invalid numeric literal %s", s)
+	}
+	return property{typ: edmDouble, value: f}, nil
+}
+
+func parseTypedLiteral(prefix, text string) (property, error) {
+	switch prefix {
+	case "datetime":
+		t, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return property{}, fmt.Errorf("invalid DateTime literal %s", text)
+		}
+		return property{typ: storage.OdataDateTime, value: t.UTC()}, nil
+	case "guid":
+		if !validGUID(text) {
+			return property{}, fmt.Errorf("invalid Guid literal %s", text)
+		}
+		return property{typ: storage.OdataGUID, value: strings.ToLower(text)}, nil
+	case "X", "binary":
+		raw, err := hex.DecodeString(text)
+		if err != nil {
+			return property{}, fmt.Errorf("invalid Binary literal %s", text)
+		}
+		return property{typ: storage.OdataBinary, value: string(raw), raw: true}, nil
+	}
+	return property{}, fmt.Errorf("unsupported literal type %s", prefix)
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peekWord(words ...string) string {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenIdent {
+		return ""
+	}
+	for _, w := range words {
+		if p.tokens[p.pos].text == w {
+			return w
+		}
+	}
+	return ""
+}
+
+func (p *filterParser) parseOr() (filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekWord("or") != "" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalFilter{or: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekWord("and") != "" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalFilter{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filter, error) {
+	if p.peekWord("not") != "" {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notFilter{operand}, nil
+	}
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.peekWord("eq", "ne", "gt", "ge", "lt", "le"); op != "" {
+		p.pos++
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return comparisonFilter{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *filterParser) parsePrimary() (filter, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of the filter")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case tokenOpen:
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenClose {
+			return nil, fmt.Errorf("missing closing parenthesis in the filter")
+		}
+		p.pos++
+		return f, nil
+	case tokenLiteral:
+		return literalFilter{t.literal}, nil
+	case tokenIdent:
+		switch t.text {
+		case "and", "or", "not", "eq", "ne", "gt", "ge", "lt", "le":
+			return nil, fmt.Errorf("unexpected %q in the filter", t.text)
+		}
+		return propertyFilter{t.text}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q in the filter", t.text)
+}
+
+type logicalFilter struct {
+	or          bool
+	left, right filter
+}
+
+func (f logicalFilter) eval(lookup func(string) (property, bool)) (property, bool) {
+	l := truthy(f.left.eval(lookup))
+	var v bool
+	if f.or {
+		v = l || truthy(f.right.eval(lookup))
+	} else {
+		v = l && truthy(f.right.eval(lookup))
+	}
+	return property{typ: edmBoolean, value: v}, true
+}
+
+type notFilter struct {
+	operand filter
+}
+
+func (f notFilter) eval(lookup func(string) (property, bool)) (property, bool) {
+	v, ok := f.operand.eval(lookup)
+	b, isBool := v.value.(bool)
+	if !ok || !isBool {
+		return property{}, false
+	}
+	return property{typ: edmBoolean, value: !b}, true
+}
+
+type literalFilter struct {
+	value property
+}
+
+func (f literalFilter) eval(func(string) (property, bool)) (property, bool) {
+	return f.value, true
+}
+
+type propertyFilter struct {
+	name string
+}
+
+func (f propertyFilter) eval(lookup func(string) (property, bool)) (property, bool) {
+	return lookup(f.name)
+}
+
+type comparisonFilter struct {
+	op          string
+	left, right filter
+}
+
+// eval compares the operands. Like the real service, comparisons with a
+// missing property or between values of different types are false.
+func (f comparisonFilter) eval(lookup func(string) (property, bool)) (property, bool) {
+	l, lok := f.left.eval(lookup)
+	r, rok := f.right.eval(lookup)
+	if !lok || !rok {
+		return property{typ: edmBoolean, value: false}, true
+	}
+	c, ok := compareProperties(l, r)
+	if !ok {
+		return property{typ: edmBoolean, value: false}, true
+	}
+	var v bool
+	switch f.op {
+	case "eq":
+		v = c == 0
+	case "ne":
+		v = c != 0
+	case "gt":
+		v = c > 0
+	case "ge":
+		v = c >= 0
+	case "lt":
+		v = c < 0
+	case "le":
+		v = c <= 0
+	}
+	return property{typ: edmBoolean, value: v}, true
+}
+
+// compareProperties orders two values of compatible types. Numbers of
+// different widths are compared by value.
+func compareProperties(a, b property) (int, bool) {
+	if isNumeric(a.typ) && isNumeric(b.typ) {
+		if a.typ == edmDouble || b.typ == edmDouble {
+			x, y := toFloat(a), toFloat(b)
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+		x, y := a.value.(int64), b.value.(int64)
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	if a.typ != b.typ {
+		return 0, false
+	}
+	switch a.typ {
+	case edmString, storage.OdataGUID:
+		return strings.Compare(a.value.(string), b.value.(string)), true
+	case edmBoolean:
+		x, y := a.value.(bool), b.value.(bool)
+		switch {
+		case x == y:
+			return 0, true
+		case !x:
+			return -1, true
+		}
+		return 1, true
+	case storage.OdataDateTime:
+		x, y := a.value.(time.Time), b.value.(time.Time)
+		switch {
+		case x.Before(y):
+			return -1, true
+		case x.After(y):
+			return 1, true
+		}
+		return 0, true
+	case storage.OdataBinary:
+		return bytes.Compare(a.binary(), b.binary()), true
+	}
+	return 0, false
+}
+
+func isNumeric(typ string) bool {
+	return typ == edmInt32 || typ == storage.OdataInt64 || typ == edmDouble
+}
+
+func toFloat(p property) float64 {
+	if f, ok := p.value.(float64); ok {
+		return f
+	}
+	return float64(p.value.(int64))
+}
+
+// binary returns the bytes of a binary property. Values sent by clients are
+// base64 encoded; values that are not are taken as they are.
+func (p property) binary() []byte {
+	s := p.value.(string)
+	if p.raw {
+		return []byte(s)
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b
+	}
+	return []byte(s)
+}
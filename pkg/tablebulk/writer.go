@@ -0,0 +1,246 @@
+// Package tablebulk writes any number of table operations through entity
+// group transactions. A single transaction holds at most 100 operations on
+// one partition of one table, each entity appearing once, which
+// storage.TableBatch leaves to its callers. A Writer groups the operations
+// by PartitionKey, splits every group into valid changesets and runs them
+// concurrently, reporting the outcome of each operation on its own.
+package tablebulk
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/golang/glog"
+)
+
+const (
+	maxChangesetOperations = 100
+	// A batch request is limited to 4 MiB.
+	maxChangesetSize = 4 << 20
+	// operationOverhead makes room for the request line and headers that
+	// come with the body of each operation.
+	operationOverhead = 1024
+
+	defaultParallelism = 4
+)
+
+// failedElementPattern matches the message storage.TableBatch gives the
+// error of a failed changeset, which names the index of the operation at
+// fault.
+var failedElementPattern = regexp.MustCompile(`^Element (\d+) in the batch`)
+
+// Result is the outcome of one operation passed to Write.
+type Result struct {
+	Op storage.BatchEntity
+	// Err is the error of the operation, as returned by the service, or nil
+	// if it was applied.
+	Err error
+}
+
+// Writer applies operations to a table in batches.
+type Writer struct {
+	table *storage.Table
+
+	// Parallelism bounds the number of changesets in flight. It defaults to
+	// 4.
+	Parallelism int
+}
+
+// NewWriter returns a writer for table.
+func NewWriter(table *storage.Table) *Writer {
+	return &Writer{
+		table:       table,
+		Parallelism: defaultParallelism,
+	}
+}
+
+// changeset holds indexes into the operations passed to Write.
+type changeset []int
+
+// unit is a sequence of changesets that run one after the other, because
+// they operate on the same entities.
+type unit []changeset
+
+// Write applies ops and returns their results in the same order. Operations
+// on the same entity are applied in the order given; others may be applied
+// in any order. When an operation fails, the others of its changeset are
+// retried without it, so every operation succeeds or fails on its own. The
+// error summarizes the failed operations, if any.
+func (w *Writer) Write(ops []storage.BatchEntity) ([]Result, error) {
+	results := make([]Result, len(ops))
+	for i, op := range ops {
+		results[i].Op = op
+	}
+	units := w.plan(ops, results)
+
+	parallelism := w.Parallelism
+	if parallelism <= 0 {
+		parallelism = defaultParallelism
+	}
+	work := make(chan unit)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism && i < len(units); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range work {
+				for _, cs := range u {
+					w.execute(ops, cs, results)
+				}
+			}
+		}()
+	}
+	for _, u := range units {
+		work <- u
+	}
+	close(work)
+	wg.Wait()
+
+	failed := 0
+	var first error
+	for _, r := range results {
+		if r.Err != nil {
+			if first == nil {
+				first = r.Err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("tablebulk: %d of %d operations on %s failed, the first with: %v", failed, len(ops), w.table.Name, first)
+	}
+	return results, nil
+}
+
+// plan splits ops into changesets. Invalid operations get their error in
+// results and are left out.
+func (w *Writer) plan(ops []storage.BatchEntity, results []Result) []unit {
+	type partition struct {
+		changesets []changeset
+		// ordered is set once an entity shows up in two changesets.
+		ordered bool
+		seen    map[string]bool
+		// rows and size are those of the last changeset.
+		rows map[string]bool
+		size int
+	}
+	partitions := map[string]*partition{}
+	var order []string
+
+	for i, op := range ops {
+		size, err := w.validate(op)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		p, ok := partitions[op.PartitionKey]
+		if !ok {
+			p = &partition{seen: map[string]bool{}}
+			partitions[op.PartitionKey] = p
+			order = append(order, op.PartitionKey)
+		}
+
+		last := len(p.changesets) - 1
+		if last < 0 || len(p.changesets[last]) == maxChangesetOperations || p.size+size > maxChangesetSize || p.rows[op.RowKey] {
+			p.changesets = append(p.changesets, nil)
+			p.rows = map[string]bool{}
+			p.size = 0
+			last++
+		}
+		if p.seen[op.RowKey] {
+			// The entity is in an earlier changeset too.
+			p.ordered = true
+		}
+		p.changesets[last] = append(p.changesets[last], i)
+		p.rows[op.RowKey] = true
+		p.seen[op.RowKey] = true
+		p.size += size
+	}
+
+	var units []unit
+	for _, key := range order {
+		p := partitions[key]
+		if p.ordered {
+			units = append(units, unit(p.changesets))
+			continue
+		}
+		for _, cs := range p.changesets {
+			units = append(units, unit{cs})
+		}
+	}
+	glog.V(2).Infof("tablebulk: writing %d operations on %s in %d partitions", len(ops), w.table.Name, len(order))
+	return units
+}
+
+// validate checks op can be put in a changeset of the writer and returns
+// its approximate size there.
+func (w *Writer) validate(op storage.BatchEntity) (int, error) {
+	if op.Entity == nil {
+		return 0, fmt.Errorf("tablebulk: operation has no entity")
+	}
+	if op.Table == nil || op.Table.Name != w.table.Name {
+		return 0, fmt.Errorf("tablebulk: entity %s/%s does not belong to table %s", op.PartitionKey, op.RowKey, w.table.Name)
+	}
+	if op.Op < storage.InsertOp || op.Op > storage.InsertOrMergeOp {
+		return 0, fmt.Errorf("tablebulk: unknown operation %d on %s/%s", op.Op, op.PartitionKey, op.RowKey)
+	}
+	body, err := json.Marshal(op.Entity)
+	if err != nil {
+		return 0, fmt.Errorf("tablebulk: encoding %s/%s: %v", op.PartitionKey, op.RowKey, err)
+	}
+	if len(body)+operationOverhead > maxChangesetSize {
+		return 0, fmt.Errorf("tablebulk: entity %s/%s is too large for a batch", op.PartitionKey, op.RowKey)
+	}
+	return len(body) + operationOverhead, nil
+}
+
+// execute runs a changeset. A failed changeset is rolled back as a whole,
+// so when the operation at fault is known it is dropped and the rest run
+// again.
+func (w *Writer) execute(ops []storage.BatchEntity, cs changeset, results []Result) {
+	for len(cs) > 0 {
+		batch := w.table.NewBatch()
+		for _, i := range cs {
+			batch.BatchEntitySlice = append(batch.BatchEntitySlice, ops[i])
+		}
+		err := batch.ExecuteBatch()
+		if err == nil {
+			return
+		}
+
+		failed, ok := failedOperation(err, len(cs))
+		if !ok {
+			for _, i := range cs {
+				results[i].Err = err
+			}
+			return
+		}
+		op := ops[cs[failed]]
+		glog.V(2).Infof("tablebulk: operation on %s/%s failed, retrying %d others: %v", op.PartitionKey, op.RowKey, len(cs)-1, err)
+		results[cs[failed]].Err = err
+		// Copy rather than shift the remaining operations in place.
+		cs = append(cs[:failed:failed], cs[failed+1:]...)
+	}
+}
+
+// failedOperation returns the index within its changeset of the operation
+// that failed it.
+func failedOperation(err error, n int) (int, bool) {
+	serr, ok := err.(storage.AzureStorageServiceError)
+	if !ok {
+		return 0, false
+	}
+	m := failedElementPattern.FindStringSubmatch(serr.Message)
+	if m == nil {
+		return 0, false
+	}
+	i, err := strconv.Atoi(m[1])
+	if err != nil || i >= n {
+		return 0, false
+	}
+	return i, true
+}
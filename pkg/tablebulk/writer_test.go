@@ -0,0 +1,254 @@
+package tablebulk
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/honcao/cloudprovider/pkg/storageemulator"
+)
+
+// batchCounter counts the batch requests sent through it.
+type batchCounter struct {
+	next http.RoundTripper
+
+	mu      sync.Mutex
+	batches int
+}
+
+func (c *batchCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/$batch") {
+		c.mu.Lock()
+		c.batches++
+		c.mu.Unlock()
+	}
+	return c.next.RoundTrip(req)
+}
+
+func newTestTable(t *testing.T) (*storage.Table, *batchCounter) {
+	e := storageemulator.New()
+	t.Cleanup(e.Close)
+	client, err := e.NewClient(storage.StorageEmulatorAccountName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &batchCounter{next: e.Transport()}
+	client.HTTPClient = &http.Client{Transport: counter}
+	tables := client.GetTableService()
+	table := tables.GetTableReference("nodes")
+	if err := table.Create(30, storage.NoMetadata, nil); err != nil {
+		t.Fatal(err)
+	}
+	return table, counter
+}
+
+func op(table *storage.Table, op storage.Operation, partitionKey, rowKey string, properties map[string]interface{}) storage.BatchEntity {
+	entity := table.GetEntityReference(partitionKey, rowKey)
+	entity.Properties = properties
+	return storage.BatchEntity{Entity: entity, Op: op}
+}
+
+// rows returns the row keys of a partition, with the value of their
+// "state" property.
+func rows(t *testing.T, table *storage.Table, partitionKey string) map[string]interface{} {
+	result, err := table.QueryEntities(30, storage.NoMetadata, &storage.QueryOptions{Filter: fmt.Sprintf("PartitionKey eq '%s'", partitionKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := map[string]interface{}{}
+	for {
+		for _, entity := range result.Entities {
+			out[entity.RowKey] = entity.Properties["state"]
+		}
+		if result.NextLink == nil {
+			return out
+		}
+		if result, err = result.NextResults(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWriteSplitsIntoChangesets(t *testing.T) {
+	table, counter := newTestTable(t)
+	var ops []storage.BatchEntity
+	for i := 0; i < 250; i++ {
+		ops = append(ops, op(table, storage.InsertOp, "a", fmt.Sprintf("%03d", i), map[string]interface{}{"state": "ready"}))
+	}
+	for i := 0; i < 3; i++ {
+		ops = append(ops, op(table, storage.InsertOp, "b", fmt.Sprint(i), map[string]interface{}{"state": "ready"}))
+	}
+	results, err := NewWriter(table).Write(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if r.Err != nil || r.Op.RowKey != ops[i].RowKey {
+			t.Errorf("result %d = %+v", i, r)
+		}
+	}
+	// 100, 100 and 50 operations on partition a and 3 on b.
+	if counter.batches != 4 {
+		t.Errorf("sent %d batches, want 4", counter.batches)
+	}
+	if n, m := len(rows(t, table, "a")), len(rows(t, table, "b")); n != 250 || m != 3 {
+		t.Errorf("partitions have %d and %d entities, want 250 and 3", n, m)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	table, _ := newTestTable(t)
+	w := NewWriter(table)
+	// Each of these takes over a MiB of a changeset.
+	large := map[string]interface{}{"state": strings.Repeat("x", 1<<20+512)}
+	other := &storage.Table{Name: "other"}
+	for _, tt := range []struct {
+		name    string
+		ops     []storage.BatchEntity
+		want    [][][]int
+		invalid []int
+	}{
+		{
+			name: "4 MiB",
+			ops: []storage.BatchEntity{
+				op(table, storage.InsertOp, "a", "1", large),
+				op(table, storage.InsertOp, "a", "2", large),
+				op(table, storage.InsertOp, "a", "3", large),
+				op(table, storage.InsertOp, "a", "4", large),
+				op(table, storage.InsertOp, "a", "5", nil),
+			},
+			want: [][][]int{{{0, 1, 2}}, {{3, 4}}},
+		},
+		{
+			name: "an entity twice",
+			ops: []storage.BatchEntity{
+				op(table, storage.InsertOp, "a", "1", nil),
+				op(table, storage.InsertOp, "a", "2", nil),
+				op(table, storage.InsertOp, "b", "1", nil),
+				op(table, storage.MergeOp, "a", "1", nil),
+				op(table, storage.MergeOp, "a", "3", nil),
+			},
+			// The changesets of a run one after the other.
+			want: [][][]int{{{0, 1}, {3, 4}}, {{2}}},
+		},
+		{
+			name: "invalid operations",
+			ops: []storage.BatchEntity{
+				op(table, storage.InsertOp, "a", "1", nil),
+				{Op: storage.InsertOp},
+				op(other, storage.InsertOp, "a", "2", nil),
+				op(table, storage.Operation(9), "a", "3", nil),
+				op(table, storage.InsertOp, "a", "4", map[string]interface{}{"state": strings.Repeat("x", 4<<20)}),
+			},
+			want:    [][][]int{{{0}}},
+			invalid: []int{1, 2, 3, 4},
+		},
+	} {
+		results := make([]Result, len(tt.ops))
+		var got [][][]int
+		for _, u := range w.plan(tt.ops, results) {
+			var changesets [][]int
+			for _, cs := range u {
+				changesets = append(changesets, []int(cs))
+			}
+			got = append(got, changesets)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: plan() = %v, want %v", tt.name, got, tt.want)
+		}
+		var invalid []int
+		for i, r := range results {
+			if r.Err != nil {
+				invalid = append(invalid, i)
+			}
+		}
+		if !reflect.DeepEqual(invalid, tt.invalid) {
+			t.Errorf("%s: operations %v are invalid, want %v", tt.name, invalid, tt.invalid)
+		}
+	}
+}
+
+func TestWriteAppliesOperationsOnAnEntityInOrder(t *testing.T) {
+	table, counter := newTestTable(t)
+	ops := []storage.BatchEntity{
+		op(table, storage.InsertOp, "a", "1", map[string]interface{}{"state": "new"}),
+		op(table, storage.InsertOp, "a", "2", map[string]interface{}{"state": "new"}),
+		op(table, storage.InsertOrReplaceOp, "a", "1", map[string]interface{}{"state": "ready"}),
+		op(table, storage.DeleteOp, "a", "2", nil),
+	}
+	ops[3].Force = true
+	if _, err := NewWriter(table).Write(ops); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rows(t, table, "a"), map[string]interface{}{"1": "ready"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entities %v, want %v", got, want)
+	}
+	if counter.batches != 2 {
+		t.Errorf("sent %d batches, want 2", counter.batches)
+	}
+}
+
+func TestWriteRetriesWithoutTheFailedOperation(t *testing.T) {
+	table, counter := newTestTable(t)
+	existing := table.GetEntityReference("a", "2")
+	existing.Properties = map[string]interface{}{"state": "old"}
+	if err := existing.Insert(storage.NoMetadata, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var ops []storage.BatchEntity
+	for i := 1; i <= 4; i++ {
+		ops = append(ops, op(table, storage.InsertOp, "a", fmt.Sprint(i), map[string]interface{}{"state": "new"}))
+	}
+	// Replacing a missing entity fails too.
+	ops = append(ops, op(table, storage.ReplaceOp, "a", "9", map[string]interface{}{"state": "new"}))
+	ops[4].Force = true
+	results, err := NewWriter(table).Write(ops)
+	if err == nil || !strings.Contains(err.Error(), "2 of 5 operations") {
+		t.Errorf("Write() = %v, want 2 of 5 operations failed", err)
+	}
+	var failed []string
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r.Op.RowKey)
+			if serr, ok := r.Err.(storage.AzureStorageServiceError); !ok || !strings.HasPrefix(serr.Message, "Element ") {
+				t.Errorf("the error of %s is %v, want that of the service", r.Op.RowKey, r.Err)
+			}
+		}
+	}
+	if want := []string{"2", "9"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("operations on %v failed, want %v", failed, want)
+	}
+	want := map[string]interface{}{"1": "new", "2": "old", "3": "new", "4": "new"}
+	if got := rows(t, table, "a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("entities %v, want %v", got, want)
+	}
+	// Each failure costs one more batch.
+	if counter.batches != 3 {
+		t.Errorf("sent %d batches, want 3", counter.batches)
+	}
+}
+
+func TestFailedOperation(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want int
+		ok   bool
+	}{
+		{storage.AzureStorageServiceError{Message: "Element 3 in the batch returned an unexpected response code.\n3:The specified entity already exists."}, 3, true},
+		{storage.AzureStorageServiceError{Message: "Element 0 in the batch returned an unexpected response code."}, 0, true},
+		// Out of the changeset.
+		{storage.AzureStorageServiceError{Message: "Element 5 in the batch returned an unexpected response code."}, 0, false},
+		{storage.AzureStorageServiceError{Message: "The batch request body is malformed."}, 0, false},
+		{fmt.Errorf("Element 1 in the batch returned an unexpected response code."), 0, false},
+	} {
+		got, ok := failedOperation(tt.err, 5)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("failedOperation(%v) = %d, %v, want %d, %v", tt.err, got, ok, tt.want, tt.ok)
+		}
+	}
+}
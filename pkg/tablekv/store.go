@@ -0,0 +1,459 @@
+// Package tablekv implements a small key-value store on a storage table, for
+// controllers that keep durable state on the stamp they manage. Each key is
+// one entity in a single partition of the table. Conditional writes and
+// deletes are guarded by the entity ETag, values too large for a single
+// property are split across several, and entries may carry an expiry after
+// which they read as absent.
+//
+// Everything goes through storage.Table and storage.Entity, so a Store can be
+// exercised against the storageemulator package.
+package tablekv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+)
+
+const (
+	// A string property holds at most 64 KiB of UTF-16, which is 32768
+	// base64 characters encoding 24 KiB of value.
+	chunkSize = 24 * 1024
+	// An entity holds at most 1 MiB; the chunks leave room for the keys and
+	// the other properties.
+	maxChunks = 15
+
+	// MaxValueSize is the largest value a Store accepts.
+	MaxValueSize = maxChunks * chunkSize
+
+	// Keys of an entity are limited to 1 KiB by the service.
+	maxKeyLength = 1024
+
+	propertyChunkPrefix = "Chunk"
+	propertySize        = "Size"
+	propertyExpires     = "ExpiresUnixNano"
+
+	requestTimeout = 30 // seconds
+)
+
+var (
+	// ErrNotFound is returned for keys that do not exist or have expired.
+	ErrNotFound = errors.New("tablekv: key not found")
+	// ErrConflict is returned by conditional writes and deletes when the
+	// entry has changed since its ETag was read, or already exists when
+	// it was to be created.
+	ErrConflict = errors.New("tablekv: entry exists or has changed")
+)
+
+// Entry is a key with its value.
+type Entry struct {
+	Key   string
+	Value []byte
+	// ETag identifies this version of the entry for CompareAndSwap and
+	// Delete.
+	ETag string
+	// ExpiresAt is when the entry stops being readable. It is zero for
+	// entries that do not expire.
+	ExpiresAt time.Time
+	// Modified is when the entry was last written, as recorded by the
+	// service.
+	Modified time.Time
+}
+
+// Store is a key-value store kept in one partition of a table. A Store is
+// safe for concurrent use; concurrent writers to a key are arbitrated by the
+// service through ETags.
+type Store struct {
+	table     *storage.Table
+	partition string
+
+	// Now returns the current time, against which expiry is checked. It
+	// defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewStore returns a store keeping its entries in the partition called
+// partition of table. Several stores can share a table by using different
+// partitions.
+func NewStore(table *storage.Table, partition string) (*Store, error) {
+	if err := validatePartition(partition); err != nil {
+		return nil, err
+	}
+	return &Store{
+		table:     table,
+		partition: partition,
+		Now:       time.Now,
+	}, nil
+}
+
+// EnsureTable creates the table of the store if it does not exist yet.
+func (s *Store) EnsureTable() error {
+	err := s.table.Create(requestTimeout, storage.EmptyPayload, nil)
+	if err != nil && !apierror.IsStorageStatus(err, http.StatusConflict) {
+		return fmt.Errorf("tablekv: creating table %s: %v", s.table.Name, err)
+	}
+	return nil
+}
+
+// Get returns the entry of key, or ErrNotFound.
+func (s *Store) Get(key string) (*Entry, error) {
+	ent, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := s.decode(ent)
+	if err != nil {
+		return nil, err
+	}
+	if s.expired(entry.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return entry, nil
+}
+
+// Put sets the value of key whatever its current value, and returns the
+// ETag of the new entry. A ttl of zero keeps the entry until it is deleted.
+func (s *Store) Put(key string, value []byte, ttl time.Duration) (string, error) {
+	ent, err := s.encode(key, value, ttl)
+	if err != nil {
+		return "", err
+	}
+	if err := ent.InsertOrReplace(nil); err != nil {
+		return "", fmt.Errorf("tablekv: writing %s: %v", key, err)
+	}
+	return ent.OdataEtag, nil
+}
+
+// CompareAndSwap sets the value of key if its entry still has the given
+// ETag, and returns the ETag of the new entry. An empty etag creates the
+// entry only if key is absent or expired. It returns ErrConflict when the
+// condition does not hold.
+func (s *Store) CompareAndSwap(key, etag string, value []byte, ttl time.Duration) (string, error) {
+	ent, err := s.encode(key, value, ttl)
+	if err != nil {
+		return "", err
+	}
+	if etag == "" {
+		return s.create(ent, key)
+	}
+	return s.replace(ent, key, etag)
+}
+
+// create inserts ent, replacing an expired entry in its place.
+func (s *Store) create(ent *storage.Entity, key string) (string, error) {
+	err := ent.Insert(storage.MinimalMetadata, nil)
+	if err == nil {
+		return ent.OdataEtag, nil
+	}
+	if !apierror.IsStorageStatus(err, http.StatusConflict) {
+		return "", fmt.Errorf("tablekv: creating %s: %v", key, err)
+	}
+
+	existing, err := s.get(key)
+	if err == ErrNotFound {
+		// Deleted since; let the caller read again and retry.
+		return "", ErrConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	if !s.expired(expiresAt(existing)) {
+		return "", ErrConflict
+	}
+	glog.V(2).Infof("tablekv: replacing expired entry %s", key)
+	return s.replace(ent, key, existing.OdataEtag)
+}
+
+func (s *Store) replace(ent *storage.Entity, key, etag string) (string, error) {
+	ent.OdataEtag = etag
+	if err := ent.Update(false, nil); err != nil {
+		if apierror.IsStorageStatus(err, http.StatusNotFound) || isPreconditionFailed(err) {
+			return "", ErrConflict
+		}
+		return "", fmt.Errorf("tablekv: updating %s: %v", key, err)
+	}
+	return ent.OdataEtag, nil
+}
+
+// Delete removes key. With an empty etag the entry is removed whatever its
+// version and a missing key is not an error; otherwise it is removed only if
+// it still has the given ETag, and ErrConflict is returned if it does not.
+func (s *Store) Delete(key, etag string) error {
+	rowKey, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	ent := s.table.GetEntityReference(s.partition, rowKey)
+	ent.OdataEtag = etag
+	if err := ent.Delete(etag == "", nil); err != nil {
+		switch {
+		case apierror.IsStorageStatus(err, http.StatusNotFound) && etag == "":
+			return nil
+		case apierror.IsStorageStatus(err, http.StatusNotFound) || isPreconditionFailed(err):
+			return ErrConflict
+		}
+		return fmt.Errorf("tablekv: deleting %s: %v", key, err)
+	}
+	return nil
+}
+
+// List returns the unexpired entries whose keys start with prefix, sorted by
+// key. An empty prefix lists the whole store.
+func (s *Store) List(prefix string) ([]*Entry, error) {
+	filter := fmt.Sprintf("PartitionKey eq '%s'", s.partition)
+	if prefix != "" {
+		lower := escapeKey(prefix)
+		// Escaped keys are ASCII below '{', so bumping the last character of
+		// the escaped prefix gives the first key past all that start with it.
+		upper := lower[:len(lower)-1] + string(lower[len(lower)-1]+1)
+		filter += fmt.Sprintf(" and RowKey ge '%s' and RowKey lt '%s'", lower, upper)
+	}
+
+	var entries []*Entry
+	err := s.query(filter, nil, func(ent *storage.Entity) error {
+		entry, err := s.decode(ent)
+		if err != nil {
+			return err
+		}
+		if !s.expired(entry.ExpiresAt) {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+// DeleteExpired removes the entries that have expired and returns how many
+// it removed. Expired entries already read as absent, so this only reclaims
+// their space; an entry rewritten meanwhile is left alone.
+func (s *Store) DeleteExpired() (int, error) {
+	filter := fmt.Sprintf("PartitionKey eq '%s' and %s gt 0L and %s le %dL",
+		s.partition, propertyExpires, propertyExpires, s.Now().UnixNano())
+
+	var expired []*storage.Entity
+	err := s.query(filter, []string{"RowKey"}, func(ent *storage.Entity) error {
+		expired = append(expired, ent)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, found := range expired {
+		ent := s.table.GetEntityReference(s.partition, found.RowKey)
+		ent.OdataEtag = found.OdataEtag
+		if err := ent.Delete(false, nil); err != nil {
+			if apierror.IsStorageStatus(err, http.StatusNotFound) || isPreconditionFailed(err) {
+				continue
+			}
+			return deleted, fmt.Errorf("tablekv: deleting expired entity %s: %v", found.RowKey, err)
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		glog.V(2).Infof("tablekv: deleted %d expired entries from %s/%s", deleted, s.table.Name, s.partition)
+	}
+	return deleted, nil
+}
+
+// query calls fn for every entity matching filter, following continuations.
+func (s *Store) query(filter string, selected []string, fn func(*storage.Entity) error) error {
+	result, err := s.table.QueryEntities(requestTimeout, storage.MinimalMetadata, &storage.QueryOptions{
+		Filter: filter,
+		Select: selected,
+	})
+	for {
+		if err != nil {
+			return fmt.Errorf("tablekv: querying %s: %v", s.table.Name, err)
+		}
+		for _, ent := range result.Entities {
+			if err := fn(ent); err != nil {
+				return err
+			}
+		}
+		if result.NextLink == nil {
+			return nil
+		}
+		result, err = result.NextResults(nil)
+	}
+}
+
+func (s *Store) get(key string) (*storage.Entity, error) {
+	rowKey, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	ent := s.table.GetEntityReference(s.partition, rowKey)
+	if err := ent.Get(requestTimeout, storage.MinimalMetadata, nil); err != nil {
+		if apierror.IsStorageStatus(err, http.StatusNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("tablekv: reading %s: %v", key, err)
+	}
+	return ent, nil
+}
+
+// encode returns the entity holding value under key. The value is base64
+// encoded into as many string properties as it needs; binary properties
+// would do, but the storage package does not encode them.
+func (s *Store) encode(key string, value []byte, ttl time.Duration) (*storage.Entity, error) {
+	rowKey, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) > MaxValueSize {
+		return nil, fmt.Errorf("tablekv: value of %s is %d bytes, more than the limit of %d", key, len(value), MaxValueSize)
+	}
+	if ttl < 0 {
+		return nil, fmt.Errorf("tablekv: negative ttl %v for %s", ttl, key)
+	}
+
+	ent := s.table.GetEntityReference(s.partition, rowKey)
+	ent.Properties = map[string]interface{}{
+		propertySize: int64(len(value)),
+	}
+	for i := 0; i*chunkSize < len(value); i++ {
+		end := (i + 1) * chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		ent.Properties[chunkName(i)] = base64.StdEncoding.EncodeToString(value[i*chunkSize : end])
+	}
+	if ttl > 0 {
+		ent.Properties[propertyExpires] = s.Now().Add(ttl).UnixNano()
+	}
+	return ent, nil
+}
+
+func (s *Store) decode(ent *storage.Entity) (*Entry, error) {
+	key, err := unescapeKey(ent.RowKey)
+	if err != nil {
+		return nil, fmt.Errorf("tablekv: entity %s does not belong to the store: %v", ent.RowKey, err)
+	}
+	var value bytes.Buffer
+	for i := 0; ; i++ {
+		prop, ok := ent.Properties[chunkName(i)]
+		if !ok {
+			break
+		}
+		chunk, ok := prop.(string)
+		if !ok {
+			return nil, fmt.Errorf("tablekv: chunk %d of %s is a %T, not a string", i, key, prop)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(chunk)
+		if err != nil {
+			return nil, fmt.Errorf("tablekv: chunk %d of %s: %v", i, key, err)
+		}
+		value.Write(decoded)
+	}
+	if size, ok := ent.Properties[propertySize].(int64); !ok || size != int64(value.Len()) {
+		return nil, fmt.Errorf("tablekv: value of %s is %d bytes, expected %v", key, value.Len(), ent.Properties[propertySize])
+	}
+	return &Entry{
+		Key:       key,
+		Value:     value.Bytes(),
+		ETag:      ent.OdataEtag,
+		ExpiresAt: expiresAt(ent),
+		Modified:  ent.TimeStamp,
+	}, nil
+}
+
+func (s *Store) expired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !s.Now().Before(expiresAt)
+}
+
+func expiresAt(ent *storage.Entity) time.Time {
+	if nanos, ok := ent.Properties[propertyExpires].(int64); ok && nanos > 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+func chunkName(i int) string {
+	return fmt.Sprintf("%s%03d", propertyChunkPrefix, i)
+}
+
+// encodeKey returns the row key of key.
+func encodeKey(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("tablekv: empty key")
+	}
+	rowKey := escapeKey(key)
+	if len(rowKey) > maxKeyLength {
+		return "", fmt.Errorf("tablekv: key %.32q... is longer than %d bytes once escaped", key, maxKeyLength)
+	}
+	return rowKey, nil
+}
+
+// escapeKey percent-encodes every byte of key except letters, digits and
+// "-._". Row keys may not contain "/", "\", "#", "?" or control characters,
+// and the storage package puts them into URLs and filters unquoted. As each
+// byte is escaped on its own, the escaped form of a prefix of a key is a
+// prefix of the escaped key.
+func escapeKey(key string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func unescapeKey(rowKey string) (string, error) {
+	var buf bytes.Buffer
+	for i := 0; i < len(rowKey); i++ {
+		if rowKey[i] != '%' {
+			buf.WriteByte(rowKey[i])
+			continue
+		}
+		if i+2 >= len(rowKey) {
+			return "", fmt.Errorf("truncated escape at %d", i)
+		}
+		c, err := strconv.ParseUint(rowKey[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape at %d: %v", i, err)
+		}
+		buf.WriteByte(byte(c))
+		i += 2
+	}
+	return buf.String(), nil
+}
+
+func validatePartition(partition string) error {
+	if partition == "" || len(partition) > maxKeyLength {
+		return fmt.Errorf("tablekv: partition name must be 1 to %d bytes long", maxKeyLength)
+	}
+	for _, r := range partition {
+		// Single quotes would end the key in the entity URLs the storage
+		// package builds and in filters.
+		if strings.ContainsRune(`/\#?'`, r) || r < 0x20 || 0x7f <= r && r < 0xa0 {
+			return fmt.Errorf("tablekv: partition name %q contains %q", partition, r)
+		}
+	}
+	return nil
+}
+
+// isPreconditionFailed reports whether err is an ETag mismatch. Entity.Update
+// and Entity.Delete wrap those into plain errors, so only the message tells.
+func isPreconditionFailed(err error) bool {
+	return apierror.IsStorageStatus(err, http.StatusPreconditionFailed) || strings.HasPrefix(err.Error(), "Etag didn't match")
+}
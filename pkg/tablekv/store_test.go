@@ -0,0 +1,236 @@
+package tablekv
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/honcao/cloudprovider/pkg/storageemulator"
+)
+
+func newTestStore(t *testing.T) *Store {
+	e := storageemulator.New()
+	t.Cleanup(e.Close)
+	client, err := e.NewClient(storage.StorageEmulatorAccountName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := client.GetTableService()
+	s, err := NewStore(tables.GetTableReference("state"), "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnsureTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnsureTable(); err != nil {
+		t.Fatalf("EnsureTable() of an existing table = %v", err)
+	}
+	return s
+}
+
+func randomValue(n int) []byte {
+	value := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(value)
+	return value
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	s := newTestStore(t)
+
+	etag, err := s.CompareAndSwap("leader", "", []byte("a"), 0)
+	if err != nil {
+		t.Fatalf("creating leader: %v", err)
+	}
+	if _, err := s.CompareAndSwap("leader", "", []byte("b"), 0); err != ErrConflict {
+		t.Fatalf("creating an existing key = %v, want ErrConflict", err)
+	}
+
+	newETag, err := s.CompareAndSwap("leader", etag, []byte("b"), 0)
+	if err != nil {
+		t.Fatalf("swapping with the current ETag: %v", err)
+	}
+	if newETag == etag {
+		t.Fatalf("ETag %s did not change on write", etag)
+	}
+	// A writer holding the old ETag lost the race.
+	if _, err := s.CompareAndSwap("leader", etag, []byte("c"), 0); err != ErrConflict {
+		t.Fatalf("swapping with a stale ETag = %v, want ErrConflict", err)
+	}
+	if err := s.Delete("leader", etag); err != ErrConflict {
+		t.Fatalf("deleting with a stale ETag = %v, want ErrConflict", err)
+	}
+
+	entry, err := s.Get("leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Value) != "b" || entry.ETag != newETag {
+		t.Fatalf("Get() = %q, %s, want b, %s", entry.Value, entry.ETag, newETag)
+	}
+	if err := s.Delete("leader", newETag); err != nil {
+		t.Fatalf("deleting with the current ETag: %v", err)
+	}
+	if _, err := s.CompareAndSwap("leader", newETag, []byte("d"), 0); err != ErrConflict {
+		t.Fatalf("swapping a deleted key = %v, want ErrConflict", err)
+	}
+	if err := s.Delete("leader", ""); err != nil {
+		t.Fatalf("unconditional delete of a missing key = %v", err)
+	}
+}
+
+func TestChunkedValues(t *testing.T) {
+	s := newTestStore(t)
+
+	for _, size := range []int{0, 1, chunkSize, chunkSize + 1, 100 * 1024, MaxValueSize} {
+		value := randomValue(size)
+		if _, err := s.Put("blob", value, 0); err != nil {
+			t.Fatalf("Put() of %d bytes = %v", size, err)
+		}
+		entry, err := s.Get("blob")
+		if err != nil {
+			t.Fatalf("Get() of %d bytes = %v", size, err)
+		}
+		if !bytes.Equal(entry.Value, value) {
+			t.Fatalf("value of %d bytes came back as %d different bytes", size, len(entry.Value))
+		}
+
+		// Check the chunks the service holds, not only the round trip.
+		ent, err := s.get("blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks := 0
+		for name := range ent.Properties {
+			if len(name) > len(propertyChunkPrefix) && name[:len(propertyChunkPrefix)] == propertyChunkPrefix {
+				chunks++
+			}
+		}
+		if want := (size + chunkSize - 1) / chunkSize; chunks != want {
+			t.Fatalf("value of %d bytes is in %d chunks, want %d", size, chunks, want)
+		}
+	}
+
+	if _, err := s.Put("blob", randomValue(MaxValueSize+1), 0); err == nil {
+		t.Fatalf("Put() of a value past %d chunks succeeded", maxChunks)
+	}
+	if _, err := s.CompareAndSwap("other", "", randomValue(MaxValueSize+1), 0); err == nil {
+		t.Fatalf("CompareAndSwap() of a value past %d chunks succeeded", maxChunks)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now()
+	s.Now = func() time.Time { return now }
+
+	if _, err := s.Put("short", []byte("1"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put("long", []byte("2"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put("forever", []byte("3"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put("bad", []byte("4"), -time.Second); err == nil {
+		t.Fatalf("Put() with a negative ttl succeeded")
+	}
+	entry, err := s.Get("short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !entry.ExpiresAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("ExpiresAt = %v, want %v", entry.ExpiresAt, now.Add(time.Minute))
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := s.Get("short"); err != ErrNotFound {
+		t.Fatalf("Get() of an expired key = %v, want ErrNotFound", err)
+	}
+	entries, err := s.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(entries); !reflect.DeepEqual(got, []string{"forever", "long"}) {
+		t.Fatalf("List() = %v after short expired", got)
+	}
+
+	// An expired key can be created again.
+	if _, err := s.CompareAndSwap("short", "", []byte("5"), 0); err != nil {
+		t.Fatalf("creating over an expired key = %v", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	n, err := s.DeleteExpired()
+	if err != nil || n != 1 {
+		t.Fatalf("DeleteExpired() = %d, %v, want 1", n, err)
+	}
+	entries, err = s.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(entries); !reflect.DeepEqual(got, []string{"forever", "short"}) {
+		t.Fatalf("List() = %v after DeleteExpired", got)
+	}
+}
+
+func TestListPrefix(t *testing.T) {
+	s := newTestStore(t)
+	for _, key := range []string{"nodes/a", "nodes/b", "nodes/b/c", "nodesx", "pods/a", "node", "nodes 1"} {
+		if _, err := s.Put(key, []byte(key), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"nodes/", []string{"nodes/a", "nodes/b", "nodes/b/c"}},
+		{"nodes/b", []string{"nodes/b", "nodes/b/c"}},
+		{"node", []string{"node", "nodes 1", "nodes/a", "nodes/b", "nodes/b/c", "nodesx"}},
+		{"pods/", []string{"pods/a"}},
+		{"services/", nil},
+		{"", []string{"node", "nodes 1", "nodes/a", "nodes/b", "nodes/b/c", "nodesx", "pods/a"}},
+	} {
+		entries, err := s.List(tt.prefix)
+		if err != nil {
+			t.Fatalf("List(%q) = %v", tt.prefix, err)
+		}
+		if got := keys(entries); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("List(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+		for _, entry := range entries {
+			if string(entry.Value) != entry.Key {
+				t.Errorf("List(%q): %s has value %q", tt.prefix, entry.Key, entry.Value)
+			}
+		}
+	}
+}
+
+func TestKeyEscaping(t *testing.T) {
+	for _, key := range []string{"a", "a/b", `a\b#c?d'e`, "über", "%41", " "} {
+		escaped := escapeKey(key)
+		got, err := unescapeKey(escaped)
+		if err != nil || got != key {
+			t.Errorf("unescapeKey(escapeKey(%q)) = %q, %v", key, got, err)
+		}
+	}
+	if _, err := encodeKey(""); err == nil {
+		t.Errorf("encodeKey() of an empty key succeeded")
+	}
+	if _, err := NewStore(nil, "a/b"); err == nil {
+		t.Errorf("NewStore() with a partition containing / succeeded")
+	}
+}
+
+func keys(entries []*Entry) []string {
+	var keys []string
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
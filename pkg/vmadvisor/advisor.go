@@ -0,0 +1,114 @@
+// Package vmadvisor tells which VM sizes and images a stamp has, so that
+// picking a vmSize and an image is not trial and error on Azure Stack. It
+// answers queries such as "the smallest size with at least 4 cores and
+// 8 GiB that supports premium storage and has quota for 10 more VMs" and
+// "the latest version of Canonical UbuntuServer 16.04-LTS".
+//
+// Sizes come from the VM sizes of the location, with the premium storage
+// support and family of the resource SKUs API where the stamp has it. On
+// stamps without it, premium storage support is told from the size names,
+// and only the regional core quota is checked.
+package vmadvisor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+)
+
+const (
+	defaultCacheTTL = 10 * time.Minute
+)
+
+// ErrNotFound is returned when no size or image matches a query.
+var ErrNotFound = errors.New("vmadvisor: no match")
+
+// SizesClient is the subset of compute.VirtualMachineSizesClient the
+// Advisor uses.
+type SizesClient interface {
+	List(location string) (compute.VirtualMachineSizeListResult, error)
+}
+
+var _ SizesClient = compute.VirtualMachineSizesClient{}
+
+// ResourceSkusClient is the subset of compute.ResourceSkusClient the
+// Advisor uses.
+type ResourceSkusClient interface {
+	List() (compute.ResourceSkusResult, error)
+	ListNextResults(lastResults compute.ResourceSkusResult) (compute.ResourceSkusResult, error)
+}
+
+var _ ResourceSkusClient = compute.ResourceSkusClient{}
+
+// ImagesClient is the subset of compute.VirtualMachineImagesClient the
+// Advisor uses.
+type ImagesClient interface {
+	ListPublishers(location string) (compute.ListVirtualMachineImageResource, error)
+	ListOffers(location string, publisherName string) (compute.ListVirtualMachineImageResource, error)
+	ListSkus(location string, publisherName string, offer string) (compute.ListVirtualMachineImageResource, error)
+	List(location string, publisherName string, offer string, skus string, filter string, top *int32, orderby string) (compute.ListVirtualMachineImageResource, error)
+}
+
+var _ ImagesClient = compute.VirtualMachineImagesClient{}
+
+// UsageClient is the subset of compute.UsageClient the Advisor uses.
+type UsageClient interface {
+	List(location string) (compute.ListUsagesResult, error)
+	ListNextResults(lastResults compute.ListUsagesResult) (compute.ListUsagesResult, error)
+}
+
+var _ UsageClient = compute.UsageClient{}
+
+// Config configures an Advisor.
+type Config struct {
+	Location string
+	Sizes    SizesClient
+	// ResourceSkus is optional. Without it, or on stamps that lack the
+	// resource SKUs API, sizes have no family and their premium storage
+	// support is told from their names.
+	ResourceSkus ResourceSkusClient
+	Images       ImagesClient
+	// Usage is needed for quota checks.
+	Usage UsageClient
+	// CacheTTL is how long sizes are kept. It defaults to 10m. Usage is
+	// never cached.
+	CacheTTL time.Duration
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// Advisor answers queries about the sizes and images of a location.
+type Advisor struct {
+	config Config
+
+	mu           sync.Mutex
+	sizes        []Size
+	sizesExpires time.Time
+}
+
+// NewAdvisor validates config and returns an Advisor.
+func NewAdvisor(config Config) (*Advisor, error) {
+	if config.Location == "" {
+		return nil, fmt.Errorf("vmadvisor: a location is required")
+	}
+	if config.Sizes == nil || config.Images == nil {
+		return nil, fmt.Errorf("vmadvisor: size and image clients are required")
+	}
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = defaultCacheTTL
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	return &Advisor{config: config}, nil
+}
+
+// sameLocation reports whether two location names are the same, as ARM
+// compares them: without regard to case and spaces.
+func sameLocation(a, b string) bool {
+	return strings.EqualFold(strings.Replace(a, " ", "", -1), strings.Replace(b, " ", "", -1))
+}
@@ -0,0 +1,153 @@
+package vmadvisor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+)
+
+// Image is a marketplace image of the location.
+type Image struct {
+	Publisher string
+	Offer     string
+	Sku       string
+	Version   string
+}
+
+// URN returns the image as publisher:offer:sku:version, as the Azure CLI
+// takes it.
+func (i Image) URN() string {
+	return strings.Join([]string{i.Publisher, i.Offer, i.Sku, i.Version}, ":")
+}
+
+// Publishers returns the image publishers of the location, in the order of
+// their names.
+func (a *Advisor) Publishers() ([]string, error) {
+	result, err := a.config.Images.ListPublishers(a.config.Location)
+	if err != nil {
+		return nil, fmt.Errorf("vmadvisor: listing the image publishers of location %s: %v", a.config.Location, err)
+	}
+	return names(result), nil
+}
+
+// Offers returns the image offers of a publisher, in the order of their
+// names. It returns ErrNotFound if the location has no such publisher.
+func (a *Advisor) Offers(publisher string) ([]string, error) {
+	result, err := a.config.Images.ListOffers(a.config.Location, publisher)
+	if apierror.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("vmadvisor: listing the image offers of %s in location %s: %v", publisher, a.config.Location, err)
+	}
+	return names(result), nil
+}
+
+// Skus returns the image SKUs of an offer, in the order of their names. It
+// returns ErrNotFound if the location has no such offer.
+func (a *Advisor) Skus(publisher, offer string) ([]string, error) {
+	result, err := a.config.Images.ListSkus(a.config.Location, publisher, offer)
+	if apierror.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("vmadvisor: listing the image SKUs of %s %s in location %s: %v", publisher, offer, a.config.Location, err)
+	}
+	return names(result), nil
+}
+
+// Versions returns the versions of an image SKU, oldest first. It returns
+// ErrNotFound if the location has no such SKU.
+func (a *Advisor) Versions(publisher, offer, sku string) ([]string, error) {
+	result, err := a.config.Images.List(a.config.Location, publisher, offer, sku, "", nil, "")
+	if apierror.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("vmadvisor: listing the versions of image %s %s %s in location %s: %v", publisher, offer, sku, a.config.Location, err)
+	}
+	versions := names(result)
+	sort.Sort(byVersion(versions))
+	return versions, nil
+}
+
+// LatestImage returns the latest version of an image SKU, e.g. of Canonical
+// UbuntuServer 16.04-LTS. It returns ErrNotFound if the location has no
+// version of it.
+func (a *Advisor) LatestImage(publisher, offer, sku string) (Image, error) {
+	versions, err := a.Versions(publisher, offer, sku)
+	if err != nil {
+		return Image{}, err
+	}
+	if len(versions) == 0 {
+		return Image{}, ErrNotFound
+	}
+	return Image{
+		Publisher: publisher,
+		Offer:     offer,
+		Sku:       sku,
+		Version:   versions[len(versions)-1],
+	}, nil
+}
+
+// HasImage reports whether the location has image. A version of "latest"
+// matches any version.
+func (a *Advisor) HasImage(image Image) (bool, error) {
+	versions, err := a.Versions(image.Publisher, image.Offer, image.Sku)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if strings.EqualFold(image.Version, "latest") {
+		return len(versions) > 0, nil
+	}
+	for _, v := range versions {
+		if strings.EqualFold(v, image.Version) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// names returns the names of the resources of result, in order.
+func names(result compute.ListVirtualMachineImageResource) []string {
+	list := []string{}
+	if result.Value == nil {
+		return list
+	}
+	for _, r := range *result.Value {
+		if r.Name != nil {
+			list = append(list, *r.Name)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// byVersion sorts image versions, such as 16.04.201711211, by their
+// numeric parts.
+type byVersion []string
+
+func (s byVersion) Len() int { return len(s) }
+func (s byVersion) Less(i, j int) bool {
+	a, b := strings.Split(s[i], "."), strings.Split(s[j], ".")
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] == b[k] {
+			continue
+		}
+		x, xerr := strconv.ParseUint(a[k], 10, 64)
+		y, yerr := strconv.ParseUint(b[k], 10, 64)
+		if xerr != nil || yerr != nil {
+			return a[k] < b[k]
+		}
+		return x < y
+	}
+	return len(a) < len(b)
+}
+func (s byVersion) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
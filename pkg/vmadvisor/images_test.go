@@ -0,0 +1,108 @@
+package vmadvisor
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// fakeImages lists the versions of the image SKUs it holds by
+// publisher/offer/sku.
+type fakeImages struct {
+	versions map[string][]string
+}
+
+func resources(names ...string) compute.ListVirtualMachineImageResource {
+	list := []compute.VirtualMachineImageResource{}
+	for i := range names {
+		list = append(list, compute.VirtualMachineImageResource{Name: &names[i]})
+	}
+	return compute.ListVirtualMachineImageResource{Value: &list}
+}
+
+func (f *fakeImages) ListPublishers(location string) (compute.ListVirtualMachineImageResource, error) {
+	return resources(), nil
+}
+
+func (f *fakeImages) ListOffers(location string, publisherName string) (compute.ListVirtualMachineImageResource, error) {
+	return resources(), nil
+}
+
+func (f *fakeImages) ListSkus(location string, publisherName string, offer string) (compute.ListVirtualMachineImageResource, error) {
+	return resources(), nil
+}
+
+func (f *fakeImages) List(location string, publisherName string, offer string, skus string, filter string, top *int32, orderby string) (compute.ListVirtualMachineImageResource, error) {
+	versions, ok := f.versions[publisherName+"/"+offer+"/"+skus]
+	if !ok {
+		return compute.ListVirtualMachineImageResource{}, autorest.DetailedError{StatusCode: http.StatusNotFound}
+	}
+	return resources(versions...), nil
+}
+
+func TestByVersion(t *testing.T) {
+	versions := []string{
+		"16.04.201711211",
+		"16.04.201709190",
+		"2016.127.20170406",
+		"16.04.20180109",
+		"4.0.20160617",
+		"16.04.201711211.1",
+		"16.04.a",
+		"16.04.201711211",
+	}
+	sort.Sort(byVersion(versions))
+	want := []string{
+		"4.0.20160617",
+		"16.04.20180109",
+		"16.04.201709190",
+		"16.04.201711211",
+		"16.04.201711211",
+		"16.04.201711211.1",
+		"16.04.a",
+		"2016.127.20170406",
+	}
+	if !reflect.DeepEqual(versions, want) {
+		t.Errorf("sorted versions %v, want %v", versions, want)
+	}
+}
+
+func TestLatestImage(t *testing.T) {
+	a := newTestAdvisor(t, nil, "")
+	a.config.Images = &fakeImages{versions: map[string][]string{
+		"Canonical/UbuntuServer/16.04-LTS": {"16.04.201711211", "16.04.201802220", "16.04.201709190"},
+		"Canonical/UbuntuServer/14.04-LTS": {},
+	}}
+	image, err := a.LatestImage("Canonical", "UbuntuServer", "16.04-LTS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urn := image.URN(); urn != "Canonical:UbuntuServer:16.04-LTS:16.04.201802220" {
+		t.Errorf("LatestImage() = %s", urn)
+	}
+	for _, sku := range []string{"14.04-LTS", "18.04-LTS"} {
+		if _, err := a.LatestImage("Canonical", "UbuntuServer", sku); err != ErrNotFound {
+			t.Errorf("LatestImage() of %s = %v, want %v", sku, err, ErrNotFound)
+		}
+	}
+
+	for _, tt := range []struct {
+		image Image
+		want  bool
+	}{
+		{Image{"Canonical", "UbuntuServer", "16.04-LTS", "latest"}, true},
+		{Image{"Canonical", "UbuntuServer", "16.04-LTS", "16.04.201711211"}, true},
+		{Image{"Canonical", "UbuntuServer", "16.04-LTS", "16.04.201601010"}, false},
+		{Image{"Canonical", "UbuntuServer", "14.04-LTS", "latest"}, false},
+		{Image{"Canonical", "UbuntuServer", "18.04-LTS", "latest"}, false},
+	} {
+		got, err := a.HasImage(tt.image)
+		if err != nil || got != tt.want {
+			t.Errorf("HasImage(%s) = %v, %v, want %v", tt.image.URN(), got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package vmadvisor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+)
+
+const (
+	virtualMachinesResourceType = "virtualMachines"
+	premiumIOCapability         = "PremiumIO"
+
+	// The names of the usages of regional cores and VMs. The usages of
+	// the cores of size families are named after the families.
+	coresUsage           = "cores"
+	virtualMachinesUsage = "virtualMachines"
+)
+
+// Size is a VM size of the location.
+type Size struct {
+	Name               string
+	Cores              int
+	MemoryMB           int
+	MaxDataDisks       int
+	OSDiskSizeMB       int
+	ResourceDiskSizeMB int
+	// Family is the family of the size, e.g. "standardDSv2Family", which
+	// names its core quota. It is empty on stamps without resource SKUs.
+	Family string
+	// PremiumIO reports whether the size supports premium storage.
+	PremiumIO bool
+}
+
+// SizeQuery selects sizes. Zero fields match any size.
+type SizeQuery struct {
+	MinCores     int
+	MinMemoryMB  int
+	MinDataDisks int
+	PremiumIO    bool
+	// Count, if set, restricts the sizes to those with the quota for Count
+	// more VMs.
+	Count int
+}
+
+// Quota is the usage and limit of a quota of the location.
+type Quota struct {
+	// Name is e.g. "cores", "virtualMachines" or "standardDSv2Family".
+	Name    string
+	Current int64
+	Limit   int64
+}
+
+// Remaining returns what is left of the quota.
+func (q Quota) Remaining() int64 {
+	return q.Limit - q.Current
+}
+
+// Sizes returns the sizes of the location, smallest first: by cores, then
+// memory, then name. Sizes the subscription may not use there are left
+// out.
+func (a *Advisor) Sizes() ([]Size, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.config.Now()
+	if a.sizes != nil && now.Before(a.sizesExpires) {
+		return a.sizes, nil
+	}
+	sizes, err := a.listSizes()
+	if err != nil {
+		return nil, err
+	}
+	a.sizes = sizes
+	a.sizesExpires = now.Add(a.config.CacheTTL)
+	return sizes, nil
+}
+
+// FindSizes returns the sizes q selects, smallest first.
+func (a *Advisor) FindSizes(q SizeQuery) ([]Size, error) {
+	sizes, err := a.Sizes()
+	if err != nil {
+		return nil, err
+	}
+	var quotas map[string]Quota
+	if q.Count > 0 {
+		if quotas, err = a.quotas(); err != nil {
+			return nil, err
+		}
+	}
+	var found []Size
+	for _, size := range sizes {
+		if size.Cores < q.MinCores || size.MemoryMB < q.MinMemoryMB || size.MaxDataDisks < q.MinDataDisks {
+			continue
+		}
+		if q.PremiumIO && !size.PremiumIO {
+			continue
+		}
+		if q.Count > 0 && !fits(quotas, size, q.Count) {
+			continue
+		}
+		found = append(found, size)
+	}
+	return found, nil
+}
+
+// SmallestSize returns the smallest size q selects, or ErrNotFound.
+func (a *Advisor) SmallestSize(q SizeQuery) (Size, error) {
+	sizes, err := a.FindSizes(q)
+	if err != nil {
+		return Size{}, err
+	}
+	if len(sizes) == 0 {
+		return Size{}, ErrNotFound
+	}
+	return sizes[0], nil
+}
+
+// Quotas returns the compute quotas of the location, in the order of their
+// names.
+func (a *Advisor) Quotas() ([]Quota, error) {
+	quotas, err := a.quotas()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Quota, 0, len(quotas))
+	for _, quota := range quotas {
+		list = append(list, quota)
+	}
+	sort.Sort(quotasByName(list))
+	return list, nil
+}
+
+// fits reports whether quotas leave room for count more VMs of size. The
+// quotas the stamp does not report are taken to have room.
+func fits(quotas map[string]Quota, size Size, count int) bool {
+	cores := int64(count) * int64(size.Cores)
+	if quota, ok := quotas[strings.ToLower(coresUsage)]; ok && quota.Remaining() < cores {
+		return false
+	}
+	if quota, ok := quotas[strings.ToLower(virtualMachinesUsage)]; ok && quota.Remaining() < int64(count) {
+		return false
+	}
+	if size.Family != "" {
+		if quota, ok := quotas[strings.ToLower(size.Family)]; ok && quota.Remaining() < cores {
+			return false
+		}
+	}
+	return true
+}
+
+// quotas returns the compute quotas of the location by lower case name.
+func (a *Advisor) quotas() (map[string]Quota, error) {
+	if a.config.Usage == nil {
+		return nil, fmt.Errorf("vmadvisor: a usage client is required for quota checks")
+	}
+	quotas := map[string]Quota{}
+	result, err := a.config.Usage.List(a.config.Location)
+	for {
+		if err != nil {
+			return nil, fmt.Errorf("vmadvisor: listing the usage of location %s: %v", a.config.Location, err)
+		}
+		if result.Value != nil {
+			for _, usage := range *result.Value {
+				if usage.Name == nil || usage.Name.Value == nil {
+					continue
+				}
+				quota := Quota{Name: *usage.Name.Value}
+				if usage.CurrentValue != nil {
+					quota.Current = int64(*usage.CurrentValue)
+				}
+				if usage.Limit != nil {
+					quota.Limit = *usage.Limit
+				}
+				quotas[strings.ToLower(quota.Name)] = quota
+			}
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			break
+		}
+		result, err = a.config.Usage.ListNextResults(result)
+	}
+	return quotas, nil
+}
+
+// listSizes lists the sizes of the location and fills them in from the
+// resource SKUs.
+func (a *Advisor) listSizes() ([]Size, error) {
+	result, err := a.config.Sizes.List(a.config.Location)
+	if err != nil {
+		return nil, fmt.Errorf("vmadvisor: listing the VM sizes of location %s: %v", a.config.Location, err)
+	}
+	skus, err := a.listSkus()
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := []Size{}
+	if result.Value == nil {
+		return sizes, nil
+	}
+	for _, vmSize := range *result.Value {
+		if vmSize.Name == nil {
+			continue
+		}
+		size := Size{
+			Name:               *vmSize.Name,
+			Cores:              int32Value(vmSize.NumberOfCores),
+			MemoryMB:           int32Value(vmSize.MemoryInMB),
+			MaxDataDisks:       int32Value(vmSize.MaxDataDiskCount),
+			OSDiskSizeMB:       int32Value(vmSize.OsDiskSizeInMB),
+			ResourceDiskSizeMB: int32Value(vmSize.ResourceDiskSizeInMB),
+		}
+		sku, ok := skus[strings.ToLower(size.Name)]
+		switch {
+		case !ok:
+			size.PremiumIO = premiumIOFromName(size.Name)
+		case restricted(sku, a.config.Location):
+			glog.V(2).Infof("vmadvisor: VM size %s is restricted in location %s", size.Name, a.config.Location)
+			continue
+		default:
+			if sku.Family != nil {
+				size.Family = *sku.Family
+			}
+			size.PremiumIO = capability(sku, premiumIOCapability) == "True"
+		}
+		sizes = append(sizes, size)
+	}
+	sort.Sort(sizesBySize(sizes))
+	return sizes, nil
+}
+
+// listSkus returns the VM resource SKUs of the location by lower case name.
+// It returns none if there is no resource SKUs client or the stamp lacks
+// the API.
+func (a *Advisor) listSkus() (map[string]compute.ResourceSku, error) {
+	skus := map[string]compute.ResourceSku{}
+	if a.config.ResourceSkus == nil {
+		return skus, nil
+	}
+	result, err := a.config.ResourceSkus.List()
+	for {
+		if err != nil {
+			if apierror.IsUnsupported(err) {
+				glog.V(2).Infof("vmadvisor: the stamp lacks resource SKUs, telling premium storage support from VM size names: %v", err)
+				return map[string]compute.ResourceSku{}, nil
+			}
+			return nil, fmt.Errorf("vmadvisor: listing resource SKUs: %v", err)
+		}
+		if result.Value != nil {
+			for _, sku := range *result.Value {
+				if sku.Name == nil || sku.ResourceType == nil || !strings.EqualFold(*sku.ResourceType, virtualMachinesResourceType) {
+					continue
+				}
+				if !hasLocation(sku, a.config.Location) {
+					continue
+				}
+				skus[strings.ToLower(*sku.Name)] = sku
+			}
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			break
+		}
+		result, err = a.config.ResourceSkus.ListNextResults(result)
+	}
+	return skus, nil
+}
+
+func hasLocation(sku compute.ResourceSku, location string) bool {
+	if sku.Locations == nil {
+		return false
+	}
+	for _, l := range *sku.Locations {
+		if sameLocation(l, location) {
+			return true
+		}
+	}
+	return false
+}
+
+// restricted reports whether the subscription may not use sku in location.
+func restricted(sku compute.ResourceSku, location string) bool {
+	if sku.Restrictions == nil {
+		return false
+	}
+	for _, r := range *sku.Restrictions {
+		if r.Type != compute.Location || r.Values == nil {
+			continue
+		}
+		for _, l := range *r.Values {
+			if sameLocation(l, location) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func capability(sku compute.ResourceSku, name string) string {
+	if sku.Capabilities == nil {
+		return ""
+	}
+	for _, c := range *sku.Capabilities {
+		if c.Name != nil && c.Value != nil && strings.EqualFold(*c.Name, name) {
+			return *c.Value
+		}
+	}
+	return ""
+}
+
+// premiumIOFromName tells from the name of a size whether it supports
+// premium storage: the DS and GS series do, as do the sizes with an "s"
+// among the letters after their number, such as Standard_D2s_v3 and
+// Standard_B1ms.
+func premiumIOFromName(name string) bool {
+	series := strings.TrimPrefix(name, "Standard_")
+	if i := strings.Index(series, "_"); i >= 0 {
+		series = series[:i]
+	}
+	if strings.HasPrefix(series, "DS") || strings.HasPrefix(series, "GS") {
+		return true
+	}
+	i := strings.IndexAny(series, "0123456789")
+	if i < 0 {
+		return false
+	}
+	return strings.Contains(strings.TrimLeft(series[i:], "0123456789-"), "s")
+}
+
+func int32Value(p *int32) int {
+	if p == nil {
+		return 0
+	}
+	return int(*p)
+}
+
+// sizesBySize sorts sizes by cores, then memory, then name.
+type sizesBySize []Size
+
+func (s sizesBySize) Len() int { return len(s) }
+func (s sizesBySize) Less(i, j int) bool {
+	if s[i].Cores != s[j].Cores {
+		return s[i].Cores < s[j].Cores
+	}
+	if s[i].MemoryMB != s[j].MemoryMB {
+		return s[i].MemoryMB < s[j].MemoryMB
+	}
+	return s[i].Name < s[j].Name
+}
+func (s sizesBySize) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// quotasByName sorts quotas by name.
+type quotasByName []Quota
+
+func (s quotasByName) Len() int           { return len(s) }
+func (s quotasByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s quotasByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
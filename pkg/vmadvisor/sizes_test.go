@@ -0,0 +1,270 @@
+package vmadvisor
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// testSizes are the VM sizes of the location, as the stamp lists them.
+const testSizes = `{"value":[
+	{"name":"Standard_D2_v2","numberOfCores":2,"memoryInMB":7168,"maxDataDiskCount":8},
+	{"name":"Standard_DS2_v2","numberOfCores":2,"memoryInMB":7168,"maxDataDiskCount":8},
+	{"name":"Standard_A1","numberOfCores":1,"memoryInMB":1792,"maxDataDiskCount":2},
+	{"name":"Standard_F4s","numberOfCores":4,"memoryInMB":8192,"maxDataDiskCount":16},
+	{"name":"Standard_D4_v2","numberOfCores":8,"memoryInMB":28672,"maxDataDiskCount":32}]}`
+
+// testSkus are the resource SKUs of the stamp, in two pages. Standard_F4s
+// is restricted in the location, and Standard_D4_v2 is only listed for
+// another one.
+var testSkus = []string{
+	`{"value":[
+		{"resourceType":"virtualMachines","name":"Standard_D2_v2","family":"standardDv2Family","locations":["local"],
+		 "capabilities":[{"name":"PremiumIO","value":"False"}]},
+		{"resourceType":"virtualMachines","name":"Standard_DS2_v2","family":"standardDSv2Family","locations":["Local"],
+		 "capabilities":[{"name":"PremiumIO","value":"True"}]},
+		{"resourceType":"disks","name":"Premium_LRS","locations":["local"]}],
+	 "nextLink":"page2"}`,
+	`{"value":[
+		{"resourceType":"virtualMachines","name":"Standard_A1","family":"standardAFamily","locations":["local"]},
+		{"resourceType":"virtualMachines","name":"Standard_F4s","family":"standardFSFamily","locations":["local"],
+		 "capabilities":[{"name":"PremiumIO","value":"True"}],
+		 "restrictions":[{"type":"Location","values":["local"],"reasonCode":"NotAvailableForSubscription"}]},
+		{"resourceType":"virtualMachines","name":"Standard_D4_v2","family":"standardDv2Family","locations":["other"]}]}`,
+}
+
+func unmarshal(t *testing.T, data string, v interface{}) {
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type fakeSizes struct {
+	result compute.VirtualMachineSizeListResult
+}
+
+func (f *fakeSizes) List(location string) (compute.VirtualMachineSizeListResult, error) {
+	return f.result, nil
+}
+
+// fakeResourceSkus returns its pages, or err if set.
+type fakeResourceSkus struct {
+	pages []compute.ResourceSkusResult
+	err   error
+}
+
+func (f *fakeResourceSkus) List() (compute.ResourceSkusResult, error) {
+	if f.err != nil {
+		return compute.ResourceSkusResult{}, f.err
+	}
+	return f.pages[0], nil
+}
+
+func (f *fakeResourceSkus) ListNextResults(lastResults compute.ResourceSkusResult) (compute.ResourceSkusResult, error) {
+	for i, page := range f.pages[:len(f.pages)-1] {
+		if *page.NextLink == *lastResults.NextLink {
+			return f.pages[i+1], nil
+		}
+	}
+	return compute.ResourceSkusResult{}, nil
+}
+
+type fakeUsage struct {
+	result compute.ListUsagesResult
+}
+
+func (f *fakeUsage) List(location string) (compute.ListUsagesResult, error) {
+	return f.result, nil
+}
+
+func (f *fakeUsage) ListNextResults(lastResults compute.ListUsagesResult) (compute.ListUsagesResult, error) {
+	return compute.ListUsagesResult{}, nil
+}
+
+func newTestAdvisor(t *testing.T, skus ResourceSkusClient, usage string) *Advisor {
+	sizes := &fakeSizes{}
+	unmarshal(t, testSizes, &sizes.result)
+	config := Config{Location: "local", Sizes: sizes, ResourceSkus: skus, Images: &fakeImages{}}
+	if usage != "" {
+		u := &fakeUsage{}
+		unmarshal(t, usage, &u.result)
+		config.Usage = u
+	}
+	a, err := NewAdvisor(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func newTestResourceSkus(t *testing.T) *fakeResourceSkus {
+	f := &fakeResourceSkus{}
+	for _, page := range testSkus {
+		var result compute.ResourceSkusResult
+		unmarshal(t, page, &result)
+		f.pages = append(f.pages, result)
+	}
+	return f
+}
+
+func TestSizesFromResourceSkus(t *testing.T) {
+	a := newTestAdvisor(t, newTestResourceSkus(t), "")
+	sizes, err := a.Sizes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Size{
+		{Name: "Standard_A1", Cores: 1, MemoryMB: 1792, MaxDataDisks: 2, Family: "standardAFamily"},
+		{Name: "Standard_D2_v2", Cores: 2, MemoryMB: 7168, MaxDataDisks: 8, Family: "standardDv2Family"},
+		{Name: "Standard_DS2_v2", Cores: 2, MemoryMB: 7168, MaxDataDisks: 8, Family: "standardDSv2Family", PremiumIO: true},
+		// Not listed for the location, it is told from its name.
+		{Name: "Standard_D4_v2", Cores: 8, MemoryMB: 28672, MaxDataDisks: 32},
+	}
+	if !reflect.DeepEqual(sizes, want) {
+		t.Errorf("Sizes() = %+v, want %+v", sizes, want)
+	}
+}
+
+func TestSizesWithoutResourceSkus(t *testing.T) {
+	withoutCode := func(status int) error {
+		return autorest.DetailedError{
+			StatusCode: status,
+			Original:   &azure.RequestError{ServiceError: &azure.ServiceError{Message: "No HTTP resource was found"}},
+		}
+	}
+	withCode := func(status int, code string) error {
+		return autorest.DetailedError{
+			StatusCode: status,
+			Original:   &azure.RequestError{ServiceError: &azure.ServiceError{Code: code}},
+		}
+	}
+	for _, tt := range []struct {
+		name string
+		skus ResourceSkusClient
+		ok   bool
+	}{
+		{"no client", nil, true},
+		{"404 with no error code", &fakeResourceSkus{err: autorest.DetailedError{StatusCode: http.StatusNotFound}}, true},
+		{"404 with a message only", &fakeResourceSkus{err: withoutCode(http.StatusNotFound)}, true},
+		{"unknown resource type", &fakeResourceSkus{err: withCode(http.StatusBadRequest, "InvalidResourceType")}, true},
+		{"server error", &fakeResourceSkus{err: withoutCode(http.StatusInternalServerError)}, false},
+	} {
+		a := newTestAdvisor(t, tt.skus, "")
+		sizes, err := a.Sizes()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Sizes() = %v, want success %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		premium := map[string]bool{}
+		for _, size := range sizes {
+			if size.Family != "" {
+				t.Errorf("%s: size %s has family %s without resource SKUs", tt.name, size.Name, size.Family)
+			}
+			premium[size.Name] = size.PremiumIO
+		}
+		want := map[string]bool{"Standard_A1": false, "Standard_D2_v2": false, "Standard_DS2_v2": true, "Standard_F4s": true, "Standard_D4_v2": false}
+		if !reflect.DeepEqual(premium, want) {
+			t.Errorf("%s: premium storage support %v, want %v", tt.name, premium, want)
+		}
+	}
+}
+
+func TestPremiumIOFromName(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"Standard_A1", false},
+		{"Standard_A2_v2", false},
+		{"Standard_A2m_v2", false},
+		{"Standard_D2_v2", false},
+		{"Standard_D2_v3", false},
+		{"Standard_DS2_v2", true},
+		{"Standard_DS11-1_v2", true},
+		{"Standard_GS5", true},
+		{"Standard_D2s_v3", true},
+		{"Standard_E32-16s_v3", true},
+		{"Standard_F4s", true},
+		{"Standard_B1ms", true},
+		{"Standard_M64-32ms", true},
+		{"Standard_F4", false},
+		{"Basic_A0", false},
+	} {
+		if got := premiumIOFromName(tt.name); got != tt.want {
+			t.Errorf("premiumIOFromName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFits(t *testing.T) {
+	quotas := map[string]Quota{
+		"cores":              {Name: "cores", Current: 10, Limit: 20},
+		"virtualmachines":    {Name: "virtualMachines", Current: 5, Limit: 8},
+		"standarddsv2family": {Name: "standardDSv2Family", Current: 2, Limit: 6},
+	}
+	ds2 := Size{Name: "Standard_DS2_v2", Cores: 2, Family: "standardDSv2Family"}
+	a1 := Size{Name: "Standard_A1", Cores: 1}
+	d4 := Size{Name: "Standard_D4_v2", Cores: 8, Family: "standardDv2Family"}
+	for _, tt := range []struct {
+		name   string
+		quotas map[string]Quota
+		size   Size
+		count  int
+		want   bool
+	}{
+		{"within all quotas", quotas, ds2, 2, true},
+		{"family cores", quotas, ds2, 3, false},
+		{"VMs", quotas, a1, 4, false},
+		{"regional cores", quotas, d4, 2, false},
+		{"unreported family quota", quotas, d4, 1, true},
+		{"no quotas reported", nil, d4, 100, true},
+	} {
+		if got := fits(tt.quotas, tt.size, tt.count); got != tt.want {
+			t.Errorf("%s: fits(%s, %d) = %v, want %v", tt.name, tt.size.Name, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestFindSizes(t *testing.T) {
+	usage := `{"value":[
+		{"name":{"value":"cores"},"currentValue":10,"limit":20},
+		{"name":{"value":"virtualMachines"},"currentValue":2,"limit":50},
+		{"name":{"value":"standardDSv2Family"},"currentValue":4,"limit":8}]}`
+	a := newTestAdvisor(t, newTestResourceSkus(t), usage)
+	for _, tt := range []struct {
+		name string
+		q    SizeQuery
+		want []string
+	}{
+		{"any", SizeQuery{}, []string{"Standard_A1", "Standard_D2_v2", "Standard_DS2_v2", "Standard_D4_v2"}},
+		{"cores and memory", SizeQuery{MinCores: 2, MinMemoryMB: 8192}, []string{"Standard_D4_v2"}},
+		{"premium storage", SizeQuery{PremiumIO: true}, []string{"Standard_DS2_v2"}},
+		{"data disks", SizeQuery{MinDataDisks: 10}, []string{"Standard_D4_v2"}},
+		{"quota for 2", SizeQuery{Count: 2}, []string{"Standard_A1", "Standard_D2_v2", "Standard_DS2_v2"}},
+		{"quota for 3", SizeQuery{Count: 3}, []string{"Standard_A1", "Standard_D2_v2"}},
+		{"premium storage and quota for 3", SizeQuery{PremiumIO: true, Count: 3}, nil},
+	} {
+		sizes, err := a.FindSizes(tt.q)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for _, size := range sizes {
+			got = append(got, size.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: FindSizes() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if _, err := a.SmallestSize(SizeQuery{PremiumIO: true, Count: 3}); err != ErrNotFound {
+		t.Errorf("SmallestSize() = %v, want %v", err, ErrNotFound)
+	}
+}
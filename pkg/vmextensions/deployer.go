@@ -0,0 +1,394 @@
+// Package vmextensions applies a VM extension, such as a custom script, to
+// the VMs of a resource group that have given tags. The VMs are handled a
+// few at a time, transient failures are retried, and the status each
+// extension reports in its instance view is collected into a Report.
+//
+// Extensions only run again when their settings or forceUpdateTag change,
+// so applying an extension a VM already has bumps its forceUpdateTag.
+package vmextensions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+	"github.com/honcao/cloudprovider/pkg/internal/tags"
+)
+
+const (
+	defaultConcurrency = 5
+	defaultRetries     = 3
+	defaultRetryDelay  = 30 * time.Second
+
+	// The custom script extension of Linux VMs, which Extension defaults
+	// to.
+	customScriptPublisher = "Microsoft.Azure.Extensions"
+	customScriptType      = "CustomScript"
+	customScriptVersion   = "2.0"
+
+	instanceViewExpand = "instanceView"
+
+	provisioningSucceeded = "Succeeded"
+)
+
+// VirtualMachinesClient is the subset of compute.VirtualMachinesClient the
+// Deployer uses.
+type VirtualMachinesClient interface {
+	List(resourceGroupName string) (compute.VirtualMachineListResult, error)
+	ListNextResults(lastResults compute.VirtualMachineListResult) (compute.VirtualMachineListResult, error)
+}
+
+var _ VirtualMachinesClient = compute.VirtualMachinesClient{}
+
+// ExtensionsClient is the subset of compute.VirtualMachineExtensionsClient
+// the Deployer uses.
+type ExtensionsClient interface {
+	Get(resourceGroupName string, VMName string, VMExtensionName string, expand string) (compute.VirtualMachineExtension, error)
+	CreateOrUpdate(resourceGroupName string, VMName string, VMExtensionName string, extensionParameters compute.VirtualMachineExtension, cancel <-chan struct{}) (<-chan compute.VirtualMachineExtension, <-chan error)
+}
+
+var _ ExtensionsClient = compute.VirtualMachineExtensionsClient{}
+
+// Extension is the extension to apply.
+type Extension struct {
+	// Name is the name of the extension on the VMs.
+	Name string
+	// Publisher, Type and TypeHandlerVersion default to the custom script
+	// extension of Linux, Microsoft.Azure.Extensions CustomScript 2.0.
+	Publisher               string
+	Type                    string
+	TypeHandlerVersion      string
+	AutoUpgradeMinorVersion bool
+	// Settings are the public settings, e.g. the fileUris and
+	// commandToExecute of a custom script.
+	Settings map[string]interface{}
+	// ProtectedSettings are the settings that are encrypted on the way to
+	// the VM and never returned by the API.
+	ProtectedSettings map[string]interface{}
+	// ProtectedSettingsFile, if set, is a JSON file the protected settings
+	// are read from, so that secrets stay out of command lines and
+	// configuration.
+	ProtectedSettingsFile string
+}
+
+// Selector selects VMs.
+type Selector struct {
+	ResourceGroup string
+	// Tags restricts the selection to the VMs with all of these tags. A
+	// value of "*" matches any value.
+	Tags map[string]string
+}
+
+// Config configures a Deployer.
+type Config struct {
+	VirtualMachines VirtualMachinesClient
+	Extensions      ExtensionsClient
+	// Concurrency is the number of VMs handled at once. It defaults to 5.
+	Concurrency int
+	// Retries is the number of times transient failures are retried. It
+	// defaults to 3.
+	Retries int
+	// RetryDelay is the delay before the first retry, which doubles for
+	// the next ones. It defaults to 30s.
+	RetryDelay time.Duration
+}
+
+// Deployer applies extensions to VMs.
+type Deployer struct {
+	config Config
+}
+
+// NewDeployer validates config and returns a Deployer.
+func NewDeployer(config Config) (*Deployer, error) {
+	if config.VirtualMachines == nil || config.Extensions == nil {
+		return nil, fmt.Errorf("vmextensions: virtual machine and extension clients are required")
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = defaultConcurrency
+	}
+	if config.Retries < 0 {
+		return nil, fmt.Errorf("vmextensions: retries %d is negative", config.Retries)
+	}
+	if config.Retries == 0 {
+		config.Retries = defaultRetries
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = defaultRetryDelay
+	}
+	return &Deployer{config: config}, nil
+}
+
+// Deploy applies ext to the VMs sel selects and reports how it went on
+// each. It returns an error only if the VMs cannot be listed or ext is
+// invalid; failures on VMs are in the report.
+func (d *Deployer) Deploy(ctx context.Context, ext Extension, sel Selector) (*Report, error) {
+	if sel.ResourceGroup == "" {
+		return nil, fmt.Errorf("vmextensions: a resource group is required")
+	}
+	ext, err := ext.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	vms, err := d.listVMs(sel)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("vmextensions: applying extension %s to %d VMs of resource group %s", ext.Name, len(vms), sel.ResourceGroup)
+
+	report := &Report{Extension: ext.Name, Results: make([]Result, len(vms))}
+	sem := make(chan struct{}, d.config.Concurrency)
+	var wg sync.WaitGroup
+	for i, vm := range vms {
+		report.Results[i].VM = *vm.Name
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			report.Results[i].Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(result *Result, vm compute.VirtualMachine) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			d.apply(ctx, ext, sel.ResourceGroup, vm, result)
+		}(&report.Results[i], vm)
+	}
+	wg.Wait()
+	return report, nil
+}
+
+// apply applies ext to vm, retrying transient failures, and records the
+// outcome in result.
+func (d *Deployer) apply(ctx context.Context, ext Extension, resourceGroup string, vm compute.VirtualMachine, result *Result) {
+	delay := d.config.RetryDelay
+	for {
+		result.Attempts++
+		err := d.applyOnce(ctx, ext, resourceGroup, vm, result)
+		if err == nil || result.Attempts > d.config.Retries || !isTransient(err) {
+			result.Err = err
+			break
+		}
+		glog.V(2).Infof("vmextensions: retrying extension %s on VM %s in %v: %v", ext.Name, result.VM, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			result.Err = ctx.Err()
+			return
+		}
+		delay *= 2
+	}
+	if result.Err != nil {
+		glog.Warningf("vmextensions: extension %s on VM %s: %v", ext.Name, result.VM, result.Err)
+	} else {
+		glog.V(2).Infof("vmextensions: extension %s on VM %s is %s", ext.Name, result.VM, result.ProvisioningState)
+	}
+}
+
+// applyOnce creates or updates the extension on vm and reads back its
+// instance view.
+func (d *Deployer) applyOnce(ctx context.Context, ext Extension, resourceGroup string, vm compute.VirtualMachine, result *Result) error {
+	name := *vm.Name
+	existing, err := d.config.Extensions.Get(resourceGroup, name, ext.Name, "")
+	if err != nil && !apierror.IsNotFound(err) {
+		return &apiError{fmt.Sprintf("getting extension %s", ext.Name), err}
+	}
+	var tag string
+	if err == nil {
+		// The Type of the resource is Microsoft.Compute/virtualMachines/extensions;
+		// that of the extension is in its properties.
+		if p := existing.VirtualMachineExtensionProperties; p != nil && p.Publisher != nil && p.Type != nil &&
+			(!strings.EqualFold(*p.Publisher, ext.Publisher) || !strings.EqualFold(*p.Type, ext.Type)) {
+			return fmt.Errorf("the VM has an extension %s of type %s.%s", ext.Name, *p.Publisher, *p.Type)
+		}
+		tag = nextForceUpdateTag(existing)
+	}
+
+	props := &compute.VirtualMachineExtensionProperties{
+		Publisher:               stringPtr(ext.Publisher),
+		Type:                    stringPtr(ext.Type),
+		TypeHandlerVersion:      stringPtr(ext.TypeHandlerVersion),
+		AutoUpgradeMinorVersion: &ext.AutoUpgradeMinorVersion,
+	}
+	if tag != "" {
+		props.ForceUpdateTag = &tag
+	}
+	if ext.Settings != nil {
+		settings := ext.Settings
+		props.Settings = &settings
+	}
+	if ext.ProtectedSettings != nil {
+		protected := ext.ProtectedSettings
+		props.ProtectedSettings = &protected
+	}
+	_, errc := d.config.Extensions.CreateOrUpdate(resourceGroup, name, ext.Name, compute.VirtualMachineExtension{
+		Location:                          vm.Location,
+		VirtualMachineExtensionProperties: props,
+	}, ctx.Done())
+	applyErr := <-errc
+
+	// The instance view tells why an extension failed, so it is read in
+	// either case.
+	view, err := d.config.Extensions.Get(resourceGroup, name, ext.Name, instanceViewExpand)
+	if err == nil {
+		result.record(view)
+	} else if applyErr == nil {
+		return &apiError{fmt.Sprintf("getting the instance view of extension %s", ext.Name), err}
+	}
+	if applyErr != nil {
+		op := fmt.Sprintf("applying extension %s", ext.Name)
+		if result.Message != "" {
+			op = fmt.Sprintf("applying extension %s (%s)", ext.Name, result.Message)
+		}
+		return &apiError{op, applyErr}
+	}
+	if result.ProvisioningState != provisioningSucceeded {
+		return fmt.Errorf("extension %s is %s: %s", ext.Name, result.ProvisioningState, result.Message)
+	}
+	return nil
+}
+
+// listVMs returns the VMs sel selects, in the order of their names.
+func (d *Deployer) listVMs(sel Selector) ([]compute.VirtualMachine, error) {
+	var vms []compute.VirtualMachine
+	result, err := d.config.VirtualMachines.List(sel.ResourceGroup)
+	for {
+		if err != nil {
+			return nil, fmt.Errorf("vmextensions: listing the VMs of resource group %s: %v", sel.ResourceGroup, err)
+		}
+		if result.Value != nil {
+			for _, vm := range *result.Value {
+				if vm.Name != nil && sel.selects(vm) {
+					vms = append(vms, vm)
+				}
+			}
+		}
+		if result.NextLink == nil || *result.NextLink == "" {
+			break
+		}
+		result, err = d.config.VirtualMachines.ListNextResults(result)
+	}
+	sort.Sort(vmsByName(vms))
+	return vms, nil
+}
+
+// withDefaults validates ext, fills in the custom script extension and
+// reads the protected settings file.
+func (ext Extension) withDefaults() (Extension, error) {
+	if ext.Name == "" {
+		return ext, fmt.Errorf("vmextensions: an extension name is required")
+	}
+	if ext.Publisher == "" && ext.Type == "" {
+		ext.Publisher = customScriptPublisher
+		ext.Type = customScriptType
+		if ext.TypeHandlerVersion == "" {
+			ext.TypeHandlerVersion = customScriptVersion
+		}
+	}
+	if ext.Publisher == "" || ext.Type == "" || ext.TypeHandlerVersion == "" {
+		return ext, fmt.Errorf("vmextensions: extension %s needs a publisher, type and version", ext.Name)
+	}
+	if ext.ProtectedSettingsFile != "" {
+		if ext.ProtectedSettings != nil {
+			return ext, fmt.Errorf("vmextensions: extension %s has both protected settings and a protected settings file", ext.Name)
+		}
+		settings, err := readSettings(ext.ProtectedSettingsFile)
+		if err != nil {
+			return ext, err
+		}
+		ext.ProtectedSettings = settings
+	}
+	return ext, nil
+}
+
+// readSettings reads extension settings from a JSON file.
+func readSettings(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("vmextensions: %v", err)
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("vmextensions: reading settings from %s: %v", path, err)
+	}
+	return settings, nil
+}
+
+// selects reports whether sel selects vm.
+func (sel Selector) selects(vm compute.VirtualMachine) bool {
+	return tags.Match(vm.Tags, sel.Tags)
+}
+
+// nextForceUpdateTag returns a forceUpdateTag that differs from the one of
+// ext: the next number, or 1 if it is not a number.
+func nextForceUpdateTag(ext compute.VirtualMachineExtension) string {
+	if ext.VirtualMachineExtensionProperties == nil || ext.ForceUpdateTag == nil {
+		return "1"
+	}
+	n, err := strconv.ParseUint(*ext.ForceUpdateTag, 10, 64)
+	if err != nil {
+		return "1"
+	}
+	return strconv.FormatUint(n+1, 10)
+}
+
+// isTransient reports whether err may go away when tried again: throttling,
+// conflicts with other operations on the VM, server errors and network
+// errors.
+func isTransient(err error) bool {
+	if aerr, ok := err.(*apiError); ok {
+		err = aerr.err
+	}
+	switch e := err.(type) {
+	case autorest.DetailedError:
+		if e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusConflict {
+			return true
+		}
+		if code, ok := e.StatusCode.(int); ok && code >= 500 {
+			return true
+		}
+		if e.StatusCode == nil || e.StatusCode == 0 {
+			_, ok := e.Original.(net.Error)
+			return ok
+		}
+		return false
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+// apiError is an error of an API call, which keeps the cause so that
+// isTransient can tell whether to retry.
+type apiError struct {
+	op  string
+	err error
+}
+
+func (e *apiError) Error() string {
+	return e.op + ": " + e.err.Error()
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// vmsByName sorts VMs by name.
+type vmsByName []compute.VirtualMachine
+
+func (s vmsByName) Len() int           { return len(s) }
+func (s vmsByName) Less(i, j int) bool { return *s[i].Name < *s[j].Name }
+func (s vmsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
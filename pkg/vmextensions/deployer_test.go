@@ -0,0 +1,140 @@
+package vmextensions
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// extensionResourceType is the Type ARM gives every VM extension resource.
+const extensionResourceType = "Microsoft.Compute/virtualMachines/extensions"
+
+type fakeVMs struct {
+	vms []compute.VirtualMachine
+}
+
+func (f *fakeVMs) List(resourceGroupName string) (compute.VirtualMachineListResult, error) {
+	return compute.VirtualMachineListResult{Value: &f.vms}, nil
+}
+
+func (f *fakeVMs) ListNextResults(lastResults compute.VirtualMachineListResult) (compute.VirtualMachineListResult, error) {
+	return compute.VirtualMachineListResult{}, nil
+}
+
+// fakeExtensions holds the extensions of VMs by VM and records what writes
+// send. Writes succeed.
+type fakeExtensions struct {
+	extensions map[string]compute.VirtualMachineExtension
+	sent       []compute.VirtualMachineExtension
+}
+
+func (f *fakeExtensions) Get(resourceGroupName string, VMName string, VMExtensionName string, expand string) (compute.VirtualMachineExtension, error) {
+	ext, ok := f.extensions[VMName+"/"+VMExtensionName]
+	if !ok {
+		return compute.VirtualMachineExtension{}, autorest.DetailedError{StatusCode: http.StatusNotFound}
+	}
+	return ext, nil
+}
+
+func (f *fakeExtensions) CreateOrUpdate(resourceGroupName string, VMName string, VMExtensionName string, extensionParameters compute.VirtualMachineExtension, cancel <-chan struct{}) (<-chan compute.VirtualMachineExtension, <-chan error) {
+	f.sent = append(f.sent, extensionParameters)
+	ext := extensionParameters
+	props := *ext.VirtualMachineExtensionProperties
+	props.ProvisioningState = stringPtr(provisioningSucceeded)
+	ext.VirtualMachineExtensionProperties = &props
+	ext.Name = stringPtr(VMExtensionName)
+	ext.Type = stringPtr(extensionResourceType)
+	f.extensions[VMName+"/"+VMExtensionName] = ext
+
+	resultc, errc := make(chan compute.VirtualMachineExtension, 1), make(chan error, 1)
+	resultc <- ext
+	close(errc)
+	return resultc, errc
+}
+
+func newTestDeployer(t *testing.T, existing map[string]compute.VirtualMachineExtension) (*Deployer, *fakeExtensions) {
+	vms := &fakeVMs{vms: []compute.VirtualMachine{{Name: stringPtr("node-0"), Location: stringPtr("local")}}}
+	extensions := &fakeExtensions{extensions: existing}
+	d, err := NewDeployer(Config{VirtualMachines: vms, Extensions: extensions, Retries: 1, RetryDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, extensions
+}
+
+func TestDeployUpdatesExistingExtension(t *testing.T) {
+	d, extensions := newTestDeployer(t, map[string]compute.VirtualMachineExtension{
+		"node-0/setup": {
+			Name: stringPtr("setup"),
+			Type: stringPtr(extensionResourceType),
+			VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
+				Publisher:         stringPtr(customScriptPublisher),
+				Type:              stringPtr(customScriptType),
+				ForceUpdateTag:    stringPtr("3"),
+				ProvisioningState: stringPtr(provisioningSucceeded),
+			},
+		},
+	})
+	report, err := d.Deploy(context.Background(), Extension{Name: "setup"}, Selector{ResourceGroup: "group"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != 1 || !report.Results[0].Succeeded() {
+		t.Fatalf("Deploy() reported %+v, want success on node-0", report.Results)
+	}
+	if len(extensions.sent) != 1 {
+		t.Fatalf("sent %d writes, want 1", len(extensions.sent))
+	}
+	if tag := extensions.sent[0].ForceUpdateTag; tag == nil || *tag != "4" {
+		t.Errorf("sent forceUpdateTag %v, want 4", tag)
+	}
+
+	// Applying it again bumps the tag again.
+	if _, err := d.Deploy(context.Background(), Extension{Name: "setup"}, Selector{ResourceGroup: "group"}); err != nil {
+		t.Fatal(err)
+	}
+	if tag := extensions.sent[1].ForceUpdateTag; tag == nil || *tag != "5" {
+		t.Errorf("sent forceUpdateTag %v, want 5", tag)
+	}
+}
+
+func TestDeployRejectsOtherExtensionType(t *testing.T) {
+	d, extensions := newTestDeployer(t, map[string]compute.VirtualMachineExtension{
+		"node-0/setup": {
+			Name: stringPtr("setup"),
+			Type: stringPtr(extensionResourceType),
+			VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
+				Publisher: stringPtr("Microsoft.Compute"),
+				Type:      stringPtr("CustomScriptExtension"),
+			},
+		},
+	})
+	report, err := d.Deploy(context.Background(), Extension{Name: "setup"}, Selector{ResourceGroup: "group"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != 1 || report.Results[0].Succeeded() || report.Results[0].Attempts != 1 {
+		t.Errorf("Deploy() reported %+v, want one failed attempt", report.Results)
+	}
+	if len(extensions.sent) != 0 {
+		t.Errorf("sent %d writes over an extension of another type", len(extensions.sent))
+	}
+}
+
+func TestDeployCreatesExtension(t *testing.T) {
+	d, extensions := newTestDeployer(t, map[string]compute.VirtualMachineExtension{})
+	report, err := d.Deploy(context.Background(), Extension{Name: "setup"}, Selector{ResourceGroup: "group"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != 1 || !report.Results[0].Succeeded() {
+		t.Fatalf("Deploy() reported %+v, want success on node-0", report.Results)
+	}
+	if len(extensions.sent) != 1 || extensions.sent[0].ForceUpdateTag != nil {
+		t.Errorf("sent %+v, want one write without a forceUpdateTag", extensions.sent)
+	}
+}
@@ -0,0 +1,137 @@
+package vmextensions
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+)
+
+// Status is a status an extension reports in its instance view. The
+// substatuses of the custom script extension hold the output of the
+// script, with codes ending in StdOut and StdErr.
+type Status struct {
+	Code    string
+	Level   string
+	Message string
+}
+
+// Result is how applying an extension went on a VM.
+type Result struct {
+	VM string
+	// Attempts is the number of times the extension was applied.
+	Attempts int
+	// ProvisioningState is the provisioning state of the extension after
+	// the last attempt, if it could be read.
+	ProvisioningState string
+	// Message is the message of the first status of the extension that is
+	// not Info, or else of its first status.
+	Message     string
+	Statuses    []Status
+	Substatuses []Status
+	// Err is why the extension failed on the VM, if it did.
+	Err error
+}
+
+// Succeeded reports whether the extension succeeded on the VM.
+func (r Result) Succeeded() bool {
+	return r.Err == nil
+}
+
+// record records the state of ext from its instance view.
+func (r *Result) record(ext compute.VirtualMachineExtension) {
+	r.ProvisioningState = ""
+	r.Message = ""
+	r.Statuses = nil
+	r.Substatuses = nil
+	props := ext.VirtualMachineExtensionProperties
+	if props == nil {
+		return
+	}
+	if props.ProvisioningState != nil {
+		r.ProvisioningState = *props.ProvisioningState
+	}
+	if props.InstanceView == nil {
+		return
+	}
+	r.Statuses = statuses(props.InstanceView.Statuses)
+	r.Substatuses = statuses(props.InstanceView.Substatuses)
+	for _, s := range r.Statuses {
+		if s.Level != string(compute.Info) {
+			r.Message = s.Message
+			return
+		}
+	}
+	if len(r.Statuses) > 0 {
+		r.Message = r.Statuses[0].Message
+	}
+}
+
+func statuses(in *[]compute.InstanceViewStatus) []Status {
+	if in == nil {
+		return nil
+	}
+	out := make([]Status, 0, len(*in))
+	for _, s := range *in {
+		var status Status
+		if s.Code != nil {
+			status.Code = *s.Code
+		}
+		status.Level = string(s.Level)
+		if s.Message != nil {
+			status.Message = *s.Message
+		}
+		out = append(out, status)
+	}
+	return out
+}
+
+// Report is how applying an extension went on each VM.
+type Report struct {
+	Extension string
+	// Results has a Result for each selected VM, in the order of their
+	// names.
+	Results []Result
+}
+
+// Succeeded returns the number of VMs the extension succeeded on.
+func (r *Report) Succeeded() int {
+	n := 0
+	for _, result := range r.Results {
+		if result.Succeeded() {
+			n++
+		}
+	}
+	return n
+}
+
+// Failed returns the results of the VMs the extension failed on.
+func (r *Report) Failed() []Result {
+	var failed []Result
+	for _, result := range r.Results {
+		if !result.Succeeded() {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// String summarizes the report, with a line for each VM.
+func (r *Report) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "extension %s: %d of %d VMs succeeded\n", r.Extension, r.Succeeded(), len(r.Results))
+	for _, result := range r.Results {
+		if result.Succeeded() {
+			fmt.Fprintf(&b, "  %s: %s\n", result.VM, result.ProvisioningState)
+		} else {
+			fmt.Fprintf(&b, "  %s: failed after %d attempts: %s\n", result.VM, result.Attempts, oneLine(result.Err.Error()))
+		}
+	}
+	return b.String()
+}
+
+// oneLine joins the lines of s, which may be the output of a script.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
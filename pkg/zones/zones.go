@@ -0,0 +1,247 @@
+// Package zones gives nodes failure domain labels on clouds without
+// availability zones, such as Azure Stack. The region of a node is the
+// location of the cluster, from azure.json, and its zone is the platform
+// fault domain of its VM in the availability set or scale set. A node finds
+// its own zone in the instance metadata service (IMDS); other nodes are
+// looked up through the instance views of their VMs.
+package zones
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/golang/glog"
+	"github.com/honcao/cloudprovider/pkg/apierror"
+	"github.com/honcao/cloudprovider/pkg/instances"
+	"github.com/honcao/cloudprovider/pkg/resourceid"
+)
+
+const (
+	defaultMetadataEndpoint = "http://169.254.169.254/metadata"
+	// metadataAPIVersion is the first version of the IMDS compute document
+	// with fault and update domains, and one Azure Stack serves.
+	metadataAPIVersion = "2017-04-02"
+	metadataTimeout    = 5 * time.Second
+
+	scaleSetsType = "virtualMachineScaleSets"
+)
+
+// Zone is the topology of a node, as in the Kubernetes cloud provider
+// interface.
+type Zone struct {
+	// FailureDomain is the platform fault domain of the VM, e.g. "0".
+	FailureDomain string
+	// Region is the location of the cluster, e.g. "local".
+	Region string
+	// UpdateDomain is the platform update domain of the VM, for spreading
+	// workloads across planned maintenance as well. It is empty when
+	// unknown.
+	UpdateDomain string
+}
+
+// VirtualMachinesClient is the subset of compute.VirtualMachinesClient
+// Zones uses.
+type VirtualMachinesClient interface {
+	InstanceView(resourceGroupName string, VMName string) (compute.VirtualMachineInstanceView, error)
+}
+
+var _ VirtualMachinesClient = compute.VirtualMachinesClient{}
+
+// VirtualMachineScaleSetVMsClient is the subset of
+// compute.VirtualMachineScaleSetVMsClient Zones uses.
+type VirtualMachineScaleSetVMsClient interface {
+	GetInstanceView(resourceGroupName string, VMScaleSetName string, instanceID string) (compute.VirtualMachineScaleSetVMInstanceView, error)
+}
+
+var _ VirtualMachineScaleSetVMsClient = compute.VirtualMachineScaleSetVMsClient{}
+
+// Config configures Zones. Location, ResourceGroup and UseInstanceMetadata
+// are read from azure.json by ReadConfig.
+type Config struct {
+	// Location is the region of every node.
+	Location string
+	// ResourceGroup holds the VMs of nodes looked up by name. Lookups by
+	// provider ID take the resource group from the ID.
+	ResourceGroup string
+	// UseInstanceMetadata makes GetZone ask the instance metadata service
+	// first.
+	UseInstanceMetadata bool
+	// MetadataEndpoint is the base URL of the instance metadata service. It
+	// defaults to http://169.254.169.254/metadata.
+	MetadataEndpoint string
+	// HTTPClient sends the requests to the instance metadata service. It
+	// defaults to a client with a 5s timeout.
+	HTTPClient *http.Client
+	// VirtualMachines looks up the nodes backed by VMs.
+	VirtualMachines VirtualMachinesClient
+	// ScaleSetVMs, if set, looks up the nodes backed by scale set VMs. Nodes
+	// are looked up by name among scale set VMs when no VM has their name,
+	// assuming the scale set computer name prefix is the scale set name.
+	ScaleSetVMs VirtualMachineScaleSetVMsClient
+}
+
+// ReadConfig reads the settings of Zones from azure.json.
+func ReadConfig(r io.Reader) (Config, error) {
+	var file struct {
+		Location            string `json:"location"`
+		ResourceGroup       string `json:"resourceGroup"`
+		UseInstanceMetadata bool   `json:"useInstanceMetadata"`
+	}
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return Config{}, fmt.Errorf("zones: reading cloud config: %v", err)
+	}
+	return Config{
+		Location:            file.Location,
+		ResourceGroup:       file.ResourceGroup,
+		UseInstanceMetadata: file.UseInstanceMetadata,
+	}, nil
+}
+
+// Zones tells the zones of nodes.
+type Zones struct {
+	config Config
+}
+
+// NewZones validates config and returns Zones.
+func NewZones(config Config) (*Zones, error) {
+	if config.Location == "" {
+		return nil, fmt.Errorf("zones: a location is required")
+	}
+	if config.VirtualMachines == nil {
+		return nil, fmt.Errorf("zones: a virtual machine client is required")
+	}
+	if config.MetadataEndpoint == "" {
+		config.MetadataEndpoint = defaultMetadataEndpoint
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: metadataTimeout}
+	}
+	return &Zones{config: config}, nil
+}
+
+// GetZone returns the zone of the node it runs on. It asks the instance
+// metadata service if enabled, and otherwise or if that fails looks up the
+// node named after the host name.
+func (z *Zones) GetZone() (Zone, error) {
+	if z.config.UseInstanceMetadata {
+		zone, err := z.metadataZone()
+		if err == nil {
+			return zone, nil
+		}
+		glog.Warningf("zones: falling back to the instance view: %v", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return Zone{}, fmt.Errorf("zones: getting host name: %v", err)
+	}
+	return z.GetZoneByNodeName(strings.ToLower(hostname))
+}
+
+// GetZoneByNodeName returns the zone of the node nodeName, backed by a VM of
+// that name or else by a scale set VM with that computer name.
+func (z *Zones) GetZoneByNodeName(nodeName string) (Zone, error) {
+	view, err := z.config.VirtualMachines.InstanceView(z.config.ResourceGroup, nodeName)
+	if err == nil {
+		return z.zone(view.PlatformFaultDomain, view.PlatformUpdateDomain, nodeName)
+	}
+	if apierror.IsNotFound(err) && z.config.ScaleSetVMs != nil {
+		if scaleSet, instanceID, ok := instances.SplitScaleSetComputerName(nodeName); ok {
+			return z.scaleSetVMZone(z.config.ResourceGroup, scaleSet, instanceID)
+		}
+	}
+	return Zone{}, fmt.Errorf("zones: getting instance view of node %s: %v", nodeName, err)
+}
+
+// GetZoneByProviderID returns the zone of the node with the provider ID
+// providerID.
+func (z *Zones) GetZoneByProviderID(providerID string) (Zone, error) {
+	id, err := resourceid.ParseProviderID(providerID)
+	if err != nil {
+		return Zone{}, err
+	}
+	if scaleSet, ok := id.NameOf(scaleSetsType); ok {
+		if z.config.ScaleSetVMs == nil {
+			return Zone{}, fmt.Errorf("zones: %s is a scale set VM but no scale set VM client is configured", providerID)
+		}
+		return z.scaleSetVMZone(id.ResourceGroup, scaleSet, id.Name())
+	}
+	view, err := z.config.VirtualMachines.InstanceView(id.ResourceGroup, id.Name())
+	if err != nil {
+		return Zone{}, fmt.Errorf("zones: getting instance view of VM %s: %v", id, err)
+	}
+	return z.zone(view.PlatformFaultDomain, view.PlatformUpdateDomain, id.String())
+}
+
+func (z *Zones) scaleSetVMZone(resourceGroup, scaleSet, instanceID string) (Zone, error) {
+	view, err := z.config.ScaleSetVMs.GetInstanceView(resourceGroup, scaleSet, instanceID)
+	if err != nil {
+		return Zone{}, fmt.Errorf("zones: getting instance view of VM %s of scale set %s: %v", instanceID, scaleSet, err)
+	}
+	return z.zone(view.PlatformFaultDomain, view.PlatformUpdateDomain, scaleSet+"/"+instanceID)
+}
+
+// zone returns the zone of a VM from its instance view.
+func (z *Zones) zone(faultDomain, updateDomain *int32, vm string) (Zone, error) {
+	if faultDomain == nil {
+		return Zone{}, fmt.Errorf("zones: instance view of %s has no fault domain", vm)
+	}
+	zone := Zone{
+		FailureDomain: strconv.Itoa(int(*faultDomain)),
+		Region:        z.config.Location,
+	}
+	if updateDomain != nil {
+		zone.UpdateDomain = strconv.Itoa(int(*updateDomain))
+	}
+	return zone, nil
+}
+
+// metadataZone reads the zone from the compute document of the instance
+// metadata service.
+func (z *Zones) metadataZone() (Zone, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(z.config.MetadataEndpoint, "/")+"/instance/compute?format=json&api-version="+metadataAPIVersion, nil)
+	if err != nil {
+		return Zone{}, err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := z.config.HTTPClient.Do(req)
+	if err != nil {
+		return Zone{}, fmt.Errorf("zones: querying instance metadata: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Zone{}, fmt.Errorf("zones: reading instance metadata: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Zone{}, fmt.Errorf("zones: instance metadata service returned %s: %s", resp.Status, body)
+	}
+
+	var doc struct {
+		Location             string `json:"location"`
+		PlatformFaultDomain  string `json:"platformFaultDomain"`
+		PlatformUpdateDomain string `json:"platformUpdateDomain"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return Zone{}, fmt.Errorf("zones: decoding instance metadata: %v", err)
+	}
+	if doc.PlatformFaultDomain == "" {
+		return Zone{}, fmt.Errorf("zones: instance metadata has no fault domain")
+	}
+	region := z.config.Location
+	if doc.Location != "" && !strings.EqualFold(doc.Location, region) {
+		glog.Warningf("zones: instance metadata location %s differs from configured location %s", doc.Location, region)
+	}
+	return Zone{
+		FailureDomain: doc.PlatformFaultDomain,
+		Region:        region,
+		UpdateDomain:  doc.PlatformUpdateDomain,
+	}, nil
+}
@@ -0,0 +1,169 @@
+package zones
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+const testScaleSetID = "/subscriptions/sub/resourceGroups/cluster/providers/Microsoft.Compute/virtualMachineScaleSets/pool"
+
+func int32Ptr(i int32) *int32 { return &i }
+
+// fakeVMs holds the fault and update domains of VMs by resource group and
+// name.
+type fakeVMs map[string][2]int32
+
+func (f fakeVMs) InstanceView(resourceGroupName string, VMName string) (compute.VirtualMachineInstanceView, error) {
+	d, ok := f[resourceGroupName+"/"+VMName]
+	if !ok {
+		return compute.VirtualMachineInstanceView{}, autorest.DetailedError{StatusCode: http.StatusNotFound}
+	}
+	return compute.VirtualMachineInstanceView{PlatformFaultDomain: int32Ptr(d[0]), PlatformUpdateDomain: int32Ptr(d[1])}, nil
+}
+
+// fakeScaleSetVMs holds the fault domains of scale set VMs by resource
+// group, scale set and instance ID. Their update domains are unknown.
+type fakeScaleSetVMs map[string]int32
+
+func (f fakeScaleSetVMs) GetInstanceView(resourceGroupName string, VMScaleSetName string, instanceID string) (compute.VirtualMachineScaleSetVMInstanceView, error) {
+	d, ok := f[resourceGroupName+"/"+VMScaleSetName+"/"+instanceID]
+	if !ok {
+		return compute.VirtualMachineScaleSetVMInstanceView{}, autorest.DetailedError{StatusCode: http.StatusNotFound}
+	}
+	return compute.VirtualMachineScaleSetVMInstanceView{PlatformFaultDomain: int32Ptr(d)}, nil
+}
+
+func newTestZones(t *testing.T, config Config) *Zones {
+	config.Location = "local"
+	config.ResourceGroup = "cluster"
+	z, err := NewZones(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+// newMetadataServer serves body with status as the compute document of the
+// instance metadata service.
+func newMetadataServer(t *testing.T, status int, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metadata/instance/compute" || r.Header.Get("Metadata") != "true" || r.URL.Query().Get("api-version") != metadataAPIVersion {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGetZone(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vms := fakeVMs{"cluster/" + strings.ToLower(hostname): {2, 4}}
+	fromInstanceView := Zone{FailureDomain: "2", Region: "local", UpdateDomain: "4"}
+	for _, tt := range []struct {
+		name        string
+		useMetadata bool
+		status      int
+		body        string
+		want        Zone
+	}{
+		{"metadata", true, http.StatusOK, `{"location":"local","name":"node0","platformFaultDomain":"1","platformUpdateDomain":"3","vmSize":"Standard_D2_v2"}`, Zone{FailureDomain: "1", Region: "local", UpdateDomain: "3"}},
+		{"metadata of another location", true, http.StatusOK, `{"location":"other","platformFaultDomain":"0"}`, Zone{FailureDomain: "0", Region: "local"}},
+		{"metadata disabled", false, http.StatusOK, `{"platformFaultDomain":"1"}`, fromInstanceView},
+		{"metadata error", true, http.StatusInternalServerError, `{"error":"internal"}`, fromInstanceView},
+		{"metadata without a fault domain", true, http.StatusOK, `{"location":"local"}`, fromInstanceView},
+		{"malformed metadata", true, http.StatusOK, `<html>`, fromInstanceView},
+	} {
+		server := newMetadataServer(t, tt.status, tt.body)
+		z := newTestZones(t, Config{
+			UseInstanceMetadata: tt.useMetadata,
+			MetadataEndpoint:    server.URL + "/metadata/",
+			VirtualMachines:     vms,
+		})
+		got, err := z.GetZone()
+		if err != nil {
+			t.Errorf("%s: GetZone() = %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: GetZone() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetZoneByNodeName(t *testing.T) {
+	z := newTestZones(t, Config{
+		VirtualMachines: fakeVMs{"cluster/node0": {1, 3}},
+		ScaleSetVMs:     fakeScaleSetVMs{"cluster/pool/10": 2},
+	})
+	for _, tt := range []struct {
+		node string
+		want Zone
+		ok   bool
+	}{
+		{"node0", Zone{FailureDomain: "1", Region: "local", UpdateDomain: "3"}, true},
+		// No VM is named so; the VM 10 of scale set pool has that
+		// computer name.
+		{"pool00000a", Zone{FailureDomain: "2", Region: "local"}, true},
+		{"pool00000b", Zone{}, false},
+		{"node1", Zone{}, false},
+	} {
+		got, err := z.GetZoneByNodeName(tt.node)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("GetZoneByNodeName(%s) = %+v, %v, want %+v", tt.node, got, err, tt.want)
+		}
+	}
+
+	// Without a scale set VM client, only VMs are looked up.
+	z.config.ScaleSetVMs = nil
+	if _, err := z.GetZoneByNodeName("pool00000a"); err == nil {
+		t.Errorf("GetZoneByNodeName() of a scale set VM succeeded without a scale set VM client")
+	}
+}
+
+func TestGetZoneByProviderID(t *testing.T) {
+	z := newTestZones(t, Config{
+		VirtualMachines: fakeVMs{"other/node0": {1, 3}},
+		ScaleSetVMs:     fakeScaleSetVMs{"cluster/pool/10": 2},
+	})
+	for _, tt := range []struct {
+		providerID string
+		want       Zone
+		ok         bool
+	}{
+		// The resource group comes from the ID.
+		{"azure:///subscriptions/sub/resourceGroups/other/providers/Microsoft.Compute/virtualMachines/node0", Zone{FailureDomain: "1", Region: "local", UpdateDomain: "3"}, true},
+		{"azure://" + testScaleSetID + "/virtualMachines/10", Zone{FailureDomain: "2", Region: "local"}, true},
+		{"azure://" + testScaleSetID + "/virtualMachines/11", Zone{}, false},
+		{"aws:///us-east-1a/i-0123", Zone{}, false},
+	} {
+		got, err := z.GetZoneByProviderID(tt.providerID)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("GetZoneByProviderID(%s) = %+v, %v, want %+v", tt.providerID, got, err, tt.want)
+		}
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	config, err := ReadConfig(strings.NewReader(`{"cloud":"AzureStackCloud","location":"local","resourceGroup":"cluster","useInstanceMetadata":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Location != "local" || config.ResourceGroup != "cluster" || !config.UseInstanceMetadata {
+		t.Errorf("ReadConfig() = %+v", config)
+	}
+	if _, err := ReadConfig(strings.NewReader(`location: local`)); err == nil {
+		t.Errorf("ReadConfig() of YAML succeeded")
+	}
+}